@@ -0,0 +1,278 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fixtureStart is the start time of every athlete's first activity
+var fixtureStart = time.Date(2024, 1, 6, 7, 30, 0, 0, time.UTC)
+
+// Athlete is a fixture Strava athlete
+type Athlete struct {
+	ID        int64  `json:"id"`
+	Username  string `json:"username"`
+	FirstName string `json:"firstname"`
+	LastName  string `json:"lastname"`
+	City      string `json:"city"`
+	Country   string `json:"country"`
+	Sex       string `json:"sex"`
+	Premium   bool   `json:"premium"`
+	Summit    bool   `json:"summit"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// Activity is a fixture activity together with its streams
+type Activity struct {
+	ID      int64 `json:"id"`
+	Athlete struct {
+		ID int64 `json:"id"`
+	} `json:"athlete"`
+	Name               string    `json:"name"`
+	Distance           float64   `json:"distance"`
+	MovingTime         int       `json:"moving_time"`
+	ElapsedTime        int       `json:"elapsed_time"`
+	TotalElevationGain float64   `json:"total_elevation_gain"`
+	Type               string    `json:"type"`
+	SportType          string    `json:"sport_type"`
+	StartDate          string    `json:"start_date"`
+	StartDateLocal     string    `json:"start_date_local"`
+	Timezone           string    `json:"timezone"`
+	StartLatlng        []float64 `json:"start_latlng"`
+	EndLatlng          []float64 `json:"end_latlng"`
+	Manual             bool      `json:"manual"`
+	Trainer            bool      `json:"trainer"`
+	Commute            bool      `json:"commute"`
+	Private            bool      `json:"private"`
+	Visibility         string    `json:"visibility"`
+	Description        string    `json:"description"`
+	Map                struct {
+		ID              string `json:"id"`
+		Polyline        string `json:"polyline,omitempty"`
+		SummaryPolyline string `json:"summary_polyline"`
+		ResourceState   int    `json:"resource_state"`
+	} `json:"map"`
+	ResourceState int `json:"resource_state"`
+
+	streams activityStreams
+}
+
+// activityStreams holds the per-point streams served by /activities/{id}/streams
+type activityStreams struct {
+	LatLng   [][]float64
+	Time     []int
+	Altitude []float64
+	Distance []float64
+}
+
+// athleteFixture describes how an athlete's activities are generated
+type athleteFixture struct {
+	athlete    Athlete
+	timezone   string
+	utcOffset  time.Duration
+	centre     [2]float64 // lat, lng
+	baseAlt    float64
+	activities int
+	sports     []string
+	indoor     bool
+}
+
+var athleteFixtures = []athleteFixture{
+	{
+		athlete:    Athlete{ID: 1001, Username: "sheffield_runner", FirstName: "Sam", LastName: "Runner", City: "Sheffield", Country: "United Kingdom", Sex: "F", Summit: true},
+		timezone:   "(GMT+00:00) Europe/London",
+		centre:     [2]float64{53.3811, -1.4701},
+		baseAlt:    90,
+		activities: 45,
+		sports:     []string{"Run", "Run", "Walk", "TrailRun"},
+	},
+	{
+		athlete:    Athlete{ID: 1002, Username: "london_cyclist", FirstName: "Alex", LastName: "Cyclist", City: "London", Country: "United Kingdom", Sex: "M"},
+		timezone:   "(GMT+00:00) Europe/London",
+		centre:     [2]float64{51.5074, -0.1278},
+		baseAlt:    20,
+		activities: 25,
+		sports:     []string{"Ride", "Ride", "Run"},
+	},
+	{
+		athlete:    Athlete{ID: 1003, Username: "paris_walker", FirstName: "Camille", LastName: "Walker", City: "Paris", Country: "France", Sex: "F"},
+		timezone:   "(GMT+01:00) Europe/Paris",
+		utcOffset:  time.Hour,
+		centre:     [2]float64{48.8566, 2.3522},
+		baseAlt:    35,
+		activities: 12,
+		sports:     []string{"Walk", "Run"},
+	},
+	{
+		athlete:    Athlete{ID: 1004, Username: "indoor_only", FirstName: "Jordan", LastName: "Trainer", City: "Leeds", Country: "United Kingdom"},
+		timezone:   "(GMT+00:00) Europe/London",
+		centre:     [2]float64{53.8008, -1.5491},
+		activities: 6,
+		sports:     []string{"VirtualRide"},
+		indoor:     true,
+	},
+}
+
+// buildFixtures generates every fixture athlete and activity. The output depends only
+// on the fixture table above, so repeated runs serve identical data.
+func buildFixtures() (map[int64]*Athlete, map[int64]*Activity) {
+	athletes := make(map[int64]*Athlete)
+	activities := make(map[int64]*Activity)
+
+	for _, fx := range athleteFixtures {
+		athlete := fx.athlete
+		athlete.CreatedAt = fixtureStart.AddDate(-1, 0, 0).Format(time.RFC3339)
+		athlete.UpdatedAt = fixtureStart.Format(time.RFC3339)
+		athletes[athlete.ID] = &athlete
+
+		rng := rand.New(rand.NewSource(athlete.ID))
+		for n := 0; n < fx.activities; n++ {
+			start := fixtureStart.AddDate(0, 0, 2*n).Add(time.Duration(rng.Intn(120)) * time.Minute)
+			activity := generateActivity(rng, fx, athlete.ID*100000+int64(n+1), start)
+			activities[activity.ID] = activity
+		}
+	}
+	return athletes, activities
+}
+
+// generateActivity builds one activity as a random walk around the athlete's centre
+func generateActivity(rng *rand.Rand, fx athleteFixture, id int64, start time.Time) *Activity {
+	sport := fx.sports[int(id)%len(fx.sports)]
+	speed := map[string]float64{"Run": 3.0, "TrailRun": 2.6, "Walk": 1.4, "Ride": 6.5, "VirtualRide": 8.0}[sport]
+
+	a := &Activity{
+		ID:             id,
+		Name:           activityName(sport, start.Add(fx.utcOffset)),
+		Type:           strings.TrimPrefix(sport, "Trail"),
+		SportType:      sport,
+		StartDate:      start.Format(time.RFC3339),
+		StartDateLocal: start.Add(fx.utcOffset).Format("2006-01-02T15:04:05Z"),
+		Timezone:       fx.timezone,
+		Trainer:        fx.indoor,
+		Commute:        !fx.indoor && id%5 == 0,
+		Visibility:     "everyone",
+		ResourceState:  2,
+	}
+	a.Athlete.ID = fx.athlete.ID
+	a.Map.ID = "a" + strconv.FormatInt(id, 10)
+	a.Map.ResourceState = 2
+
+	points := 150 + rng.Intn(450)
+	const interval = 5 // seconds between samples
+
+	if fx.indoor {
+		a.ElapsedTime = points * interval
+		a.MovingTime = a.ElapsedTime
+		a.Distance = round1(speed * float64(a.MovingTime))
+		return a
+	}
+
+	lat, lng := fx.centre[0]+(rng.Float64()-0.5)*0.02, fx.centre[1]+(rng.Float64()-0.5)*0.03
+	heading := rng.Float64() * 2 * math.Pi
+	alt := fx.baseAlt + rng.Float64()*20
+
+	for i := 0; i < points; i++ {
+		if i > 0 {
+			heading += (rng.Float64() - 0.5) * 0.6
+			step := speed * interval * (0.8 + rng.Float64()*0.4)
+			prev := a.streams.LatLng[i-1]
+			lat += step * math.Cos(heading) / 111320
+			lng += step * math.Sin(heading) / (111320 * math.Cos(lat*math.Pi/180))
+			alt += (rng.Float64() - 0.5) * 3
+			a.streams.Distance = append(a.streams.Distance, round1(a.streams.Distance[i-1]+haversine(prev[0], prev[1], lat, lng)))
+		} else {
+			a.streams.Distance = append(a.streams.Distance, 0)
+		}
+		a.streams.LatLng = append(a.streams.LatLng, []float64{round6(lat), round6(lng)})
+		a.streams.Time = append(a.streams.Time, i*interval)
+		a.streams.Altitude = append(a.streams.Altitude, round1(alt))
+	}
+
+	last := len(a.streams.LatLng) - 1
+	a.StartLatlng = a.streams.LatLng[0]
+	a.EndLatlng = a.streams.LatLng[last]
+	a.Distance = a.streams.Distance[last]
+	a.MovingTime = a.streams.Time[last]
+	a.ElapsedTime = a.MovingTime + rng.Intn(120)
+	for i := 1; i <= last; i++ {
+		if gain := a.streams.Altitude[i] - a.streams.Altitude[i-1]; gain > 0 {
+			a.TotalElevationGain += gain
+		}
+	}
+	a.TotalElevationGain = round1(a.TotalElevationGain)
+	a.Map.Polyline = encodePolyline(a.streams.LatLng)
+	a.Map.SummaryPolyline = encodePolyline(every(a.streams.LatLng, 10))
+	return a
+}
+
+// activityName names an activity the way the Strava apps do by default
+func activityName(sport string, local time.Time) string {
+	part := "Morning"
+	switch h := local.Hour(); {
+	case h >= 12 && h < 17:
+		part = "Afternoon"
+	case h >= 17:
+		part = "Evening"
+	}
+	switch sport {
+	case "TrailRun":
+		return part + " Trail Run"
+	case "VirtualRide":
+		return "Zwift - " + part + " Ride"
+	}
+	return part + " " + sport
+}
+
+// encodePolyline encodes [lat, lng] points with the Google polyline algorithm used by Strava
+func encodePolyline(points [][]float64) string {
+	var sb strings.Builder
+	var prevLat, prevLng int
+	for _, p := range points {
+		lat := int(math.Round(p[0] * 1e5))
+		lng := int(math.Round(p[1] * 1e5))
+		encodeValue(&sb, lat-prevLat)
+		encodeValue(&sb, lng-prevLng)
+		prevLat, prevLng = lat, lng
+	}
+	return sb.String()
+}
+
+func encodeValue(sb *strings.Builder, v int) {
+	v <<= 1
+	if v < 0 {
+		v = ^v
+	}
+	for v >= 0x20 {
+		sb.WriteByte(byte((0x20 | (v & 0x1f)) + 63))
+		v >>= 5
+	}
+	sb.WriteByte(byte(v + 63))
+}
+
+// every returns every nth point plus the last one
+func every(points [][]float64, n int) [][]float64 {
+	var out [][]float64
+	for i := 0; i < len(points); i += n {
+		out = append(out, points[i])
+	}
+	if len(points) > 0 && (len(points)-1)%n != 0 {
+		out = append(out, points[len(points)-1])
+	}
+	return out
+}
+
+func haversine(lat1, lng1, lat2, lng2 float64) float64 {
+	const r = 6371000.0
+	p1, p2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dp := p2 - p1
+	dl := (lng2 - lng1) * math.Pi / 180
+	h := math.Sin(dp/2)*math.Sin(dp/2) + math.Cos(p1)*math.Cos(p2)*math.Sin(dl/2)*math.Sin(dl/2)
+	return 2 * r * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func round1(v float64) float64 { return math.Round(v*10) / 10 }
+func round6(v float64) float64 { return math.Round(v*1e6) / 1e6 }
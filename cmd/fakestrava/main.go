@@ -0,0 +1,51 @@
+// Command fakestrava serves a local emulation of the Strava API endpoints used by the
+// server: OAuth, athlete and activity reads, activity updates, streams, comments and push subscriptions.
+// Fixture athletes and activities are generated deterministically, so every run serves
+// the same data.
+//
+// Point the server at it with:
+//
+//	STRAVA_API_URL=http://localhost:8090/api/v3
+//	STRAVA_OAUTH_URL=http://localhost:8090/oauth
+//	STRAVA_CLIENT_ID=fake-client STRAVA_CLIENT_SECRET=fake-secret
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+func main() {
+	addr := flag.String("addr", envOr("FAKE_STRAVA_ADDR", ":8090"), "listen address")
+	clientID := flag.String("client-id", envOr("STRAVA_CLIENT_ID", "fake-client"), "accepted OAuth client ID")
+	clientSecret := flag.String("client-secret", envOr("STRAVA_CLIENT_SECRET", "fake-secret"), "accepted OAuth client secret")
+	limit15 := flag.Int("rate-limit-15min", 200, "requests allowed per 15 minutes")
+	limitDaily := flag.Int("rate-limit-daily", 2000, "requests allowed per day")
+	flag.Parse()
+
+	if os.Getenv("GIN_MODE") == "" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	fake := NewFakeStrava(*clientID, *clientSecret, RateLimits{FifteenMinute: *limit15, Daily: *limitDaily})
+
+	log.Printf("Fake Strava listening on %s (client_id=%s)", *addr, *clientID)
+	for _, fx := range athleteFixtures {
+		log.Printf("  athlete %d %s %s: %d activities", fx.athlete.ID, fx.athlete.FirstName, fx.athlete.LastName, fx.activities)
+	}
+	if err := http.ListenAndServe(*addr, fake.Router()); err != nil {
+		log.Fatalf("Fake Strava failed: %v", err)
+	}
+}
+
+// envOr returns the environment variable or a fallback when it is unset
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,763 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenLifetime matches the six hours Strava access tokens are valid for
+const tokenLifetime = 6 * time.Hour
+
+// RateLimits configures the emulated Strava rate limits
+type RateLimits struct {
+	FifteenMinute int
+	Daily         int
+}
+
+// tokenGrant is an access token issued by the fake
+type tokenGrant struct {
+	athleteID int64
+	scope     string
+	expiresAt time.Time
+}
+
+// Comment is a comment posted on an activity
+type Comment struct {
+	ID         int64    `json:"id"`
+	ActivityID int64    `json:"activity_id"`
+	Text       string   `json:"text"`
+	Athlete    *Athlete `json:"athlete"`
+	CreatedAt  string   `json:"created_at"`
+}
+
+// Subscription is a webhook push subscription
+type Subscription struct {
+	ID            int64  `json:"id"`
+	ApplicationID int64  `json:"application_id"`
+	CallbackURL   string `json:"callback_url"`
+	CreatedAt     string `json:"created_at"`
+	UpdatedAt     string `json:"updated_at"`
+}
+
+// FakeStrava emulates the parts of the Strava API this project uses
+type FakeStrava struct {
+	clientID     string
+	clientSecret string
+	limits       RateLimits
+	now          func() time.Time
+	httpClient   *http.Client
+
+	mu            sync.Mutex
+	athletes      map[int64]*Athlete
+	activities    map[int64]*Activity
+	codes         map[string]tokenGrant
+	accessTokens  map[string]tokenGrant
+	refreshTokens map[string]tokenGrant
+	comments      map[int64][]Comment
+	subscriptions map[int64]*Subscription
+	nextID        int64
+	usage         struct {
+		windowStart time.Time
+		dayStart    time.Time
+		window      int
+		day         int
+	}
+}
+
+// NewFakeStrava creates a fake Strava API serving the fixture athletes
+func NewFakeStrava(clientID, clientSecret string, limits RateLimits) *FakeStrava {
+	athletes, activities := buildFixtures()
+	return &FakeStrava{
+		clientID:      clientID,
+		clientSecret:  clientSecret,
+		limits:        limits,
+		now:           time.Now,
+		httpClient:    &http.Client{Timeout: 10 * time.Second},
+		athletes:      athletes,
+		activities:    activities,
+		codes:         make(map[string]tokenGrant),
+		accessTokens:  make(map[string]tokenGrant),
+		refreshTokens: make(map[string]tokenGrant),
+		comments:      make(map[int64][]Comment),
+		subscriptions: make(map[int64]*Subscription),
+		nextID:        1,
+	}
+}
+
+// Router builds the HTTP routes of the fake
+func (f *FakeStrava) Router() *gin.Engine {
+	r := gin.New()
+	r.Use(gin.Recovery())
+
+	oauth := r.Group("/oauth")
+	{
+		oauth.GET("/authorize", f.authorizeHandler)
+		oauth.POST("/token", f.tokenHandler)
+		oauth.POST("/deauthorize", f.deauthorizeHandler)
+	}
+
+	api := r.Group("/api/v3")
+	api.Use(f.rateLimitMiddleware())
+	{
+		// Push subscriptions authenticate with the client credentials, not a token
+		api.POST("/push_subscriptions", f.createSubscriptionHandler)
+		api.GET("/push_subscriptions", f.listSubscriptionsHandler)
+		api.DELETE("/push_subscriptions/:id", f.deleteSubscriptionHandler)
+
+		authed := api.Group("")
+		authed.Use(f.authMiddleware())
+		{
+			authed.GET("/athlete", f.athleteHandler)
+			authed.GET("/athlete/activities", f.listActivitiesHandler)
+			authed.GET("/activities/:id", f.activityHandler)
+			authed.PUT("/activities/:id", f.updateActivityHandler)
+			authed.GET("/activities/:id/streams", f.streamsHandler)
+			authed.GET("/activities/:id/comments", f.listCommentsHandler)
+			authed.POST("/activities/:id/comments", f.createCommentHandler)
+		}
+	}
+
+	// Test controls that do not exist on the real Strava API
+	fake := r.Group("/fake")
+	{
+		fake.GET("/athletes", f.listAthletesHandler)
+		fake.POST("/athletes/:id/activities", f.addActivityHandler)
+		fake.POST("/webhooks/fire", f.fireWebhookHandler)
+	}
+
+	return r
+}
+
+// stravaError writes an error in the shape Strava uses
+func stravaError(c *gin.Context, status int, message, resource, field, code string) {
+	c.AbortWithStatusJSON(status, gin.H{
+		"message": message,
+		"errors":  []gin.H{{"resource": resource, "field": field, "code": code}},
+	})
+}
+
+// authorizeHandler approves the request immediately and redirects back with a code.
+// The athlete defaults to the first fixture and can be chosen with ?athlete_id=.
+func (f *FakeStrava) authorizeHandler(c *gin.Context) {
+	if c.Query("client_id") != f.clientID {
+		stravaError(c, http.StatusBadRequest, "Bad Request", "Application", "client_id", "invalid")
+		return
+	}
+	redirectURI, err := url.Parse(c.Query("redirect_uri"))
+	if err != nil || redirectURI.Host == "" {
+		stravaError(c, http.StatusBadRequest, "Bad Request", "Application", "redirect_uri", "invalid")
+		return
+	}
+
+	query := redirectURI.Query()
+	if c.Query("approval") == "deny" {
+		query.Set("error", "access_denied")
+	} else {
+		athleteID := athleteFixtures[0].athlete.ID
+		if id, err := strconv.ParseInt(c.Query("athlete_id"), 10, 64); err == nil {
+			athleteID = id
+		}
+
+		f.mu.Lock()
+		if _, ok := f.athletes[athleteID]; !ok {
+			f.mu.Unlock()
+			stravaError(c, http.StatusNotFound, "Record Not Found", "Athlete", "athlete_id", "not found")
+			return
+		}
+		code := f.newToken("code")
+		f.codes[code] = tokenGrant{athleteID: athleteID, scope: c.Query("scope"), expiresAt: f.now().Add(10 * time.Minute)}
+		f.mu.Unlock()
+
+		query.Set("code", code)
+		query.Set("scope", c.Query("scope"))
+	}
+	if state := c.Query("state"); state != "" {
+		query.Set("state", state)
+	}
+	redirectURI.RawQuery = query.Encode()
+	c.Redirect(http.StatusFound, redirectURI.String())
+}
+
+// tokenHandler exchanges an authorization code or a refresh token for an access token
+func (f *FakeStrava) tokenHandler(c *gin.Context) {
+	if c.PostForm("client_id") != f.clientID || c.PostForm("client_secret") != f.clientSecret {
+		stravaError(c, http.StatusBadRequest, "Bad Request", "Application", "client_id", "invalid")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var grant tokenGrant
+	var ok bool
+	switch c.PostForm("grant_type") {
+	case "authorization_code":
+		code := c.PostForm("code")
+		grant, ok = f.codes[code]
+		delete(f.codes, code) // codes are single use
+		if !ok || f.now().After(grant.expiresAt) {
+			stravaError(c, http.StatusBadRequest, "Bad Request", "AuthorizationCode", "code", "invalid")
+			return
+		}
+	case "refresh_token":
+		refresh := c.PostForm("refresh_token")
+		grant, ok = f.refreshTokens[refresh]
+		if !ok {
+			stravaError(c, http.StatusBadRequest, "Bad Request", "RefreshToken", "refresh_token", "invalid")
+			return
+		}
+		delete(f.refreshTokens, refresh)
+	default:
+		stravaError(c, http.StatusBadRequest, "Bad Request", "Application", "grant_type", "invalid")
+		return
+	}
+
+	access, refresh := f.newToken("access"), f.newToken("refresh")
+	grant.expiresAt = f.now().Add(tokenLifetime)
+	f.accessTokens[access] = grant
+	f.refreshTokens[refresh] = grant
+
+	resp := gin.H{
+		"token_type":    "Bearer",
+		"access_token":  access,
+		"refresh_token": refresh,
+		"expires_at":    grant.expiresAt.Unix(),
+		"expires_in":    int(tokenLifetime.Seconds()),
+	}
+	if c.PostForm("grant_type") == "authorization_code" {
+		resp["athlete"] = f.athletes[grant.athleteID]
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// deauthorizeHandler revokes every token of the athlete owning the given access token
+func (f *FakeStrava) deauthorizeHandler(c *gin.Context) {
+	token := c.PostForm("access_token")
+	if token == "" {
+		token = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	grant, ok := f.accessTokens[token]
+	if !ok {
+		stravaError(c, http.StatusUnauthorized, "Authorization Error", "Athlete", "access_token", "invalid")
+		return
+	}
+	for t, g := range f.accessTokens {
+		if g.athleteID == grant.athleteID {
+			delete(f.accessTokens, t)
+		}
+	}
+	for t, g := range f.refreshTokens {
+		if g.athleteID == grant.athleteID {
+			delete(f.refreshTokens, t)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"access_token": token})
+}
+
+// newToken returns a unique token; callers must hold f.mu
+func (f *FakeStrava) newToken(kind string) string {
+	f.nextID++
+	return fmt.Sprintf("fake-%s-%06d", kind, f.nextID)
+}
+
+// authMiddleware resolves the bearer token to an athlete
+func (f *FakeStrava) authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+		f.mu.Lock()
+		grant, ok := f.accessTokens[token]
+		f.mu.Unlock()
+
+		if !ok || f.now().After(grant.expiresAt) {
+			stravaError(c, http.StatusUnauthorized, "Authorization Error", "Athlete", "access_token", "invalid")
+			return
+		}
+		c.Set("athleteID", grant.athleteID)
+		c.Set("scope", grant.scope)
+		c.Next()
+	}
+}
+
+// rateLimitMiddleware counts requests and reports usage in the X-RateLimit headers.
+// Requests over either limit are rejected with 429 like the real API.
+func (f *FakeStrava) rateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		now := f.now()
+
+		f.mu.Lock()
+		window := now.Truncate(15 * time.Minute)
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		if !f.usage.windowStart.Equal(window) {
+			f.usage.windowStart, f.usage.window = window, 0
+		}
+		if !f.usage.dayStart.Equal(day) {
+			f.usage.dayStart, f.usage.day = day, 0
+		}
+		f.usage.window++
+		f.usage.day++
+		windowUsage, dayUsage := f.usage.window, f.usage.day
+		f.mu.Unlock()
+
+		c.Header("X-RateLimit-Limit", fmt.Sprintf("%d,%d", f.limits.FifteenMinute, f.limits.Daily))
+		c.Header("X-RateLimit-Usage", fmt.Sprintf("%d,%d", windowUsage, dayUsage))
+
+		if windowUsage > f.limits.FifteenMinute || dayUsage > f.limits.Daily {
+			stravaError(c, http.StatusTooManyRequests, "Rate Limit Exceeded", "Application", "rate limit", "exceeded")
+			return
+		}
+		c.Next()
+	}
+}
+
+// ownedActivity looks up an activity belonging to the authenticated athlete
+func (f *FakeStrava) ownedActivity(c *gin.Context) (*Activity, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		stravaError(c, http.StatusNotFound, "Record Not Found", "Activity", "id", "not found")
+		return nil, false
+	}
+
+	f.mu.Lock()
+	activity, ok := f.activities[id]
+	f.mu.Unlock()
+
+	if !ok || activity.Athlete.ID != c.GetInt64("athleteID") {
+		stravaError(c, http.StatusNotFound, "Record Not Found", "Activity", "id", "not found")
+		return nil, false
+	}
+	return activity, true
+}
+
+func (f *FakeStrava) athleteHandler(c *gin.Context) {
+	f.mu.Lock()
+	athlete := f.athletes[c.GetInt64("athleteID")]
+	f.mu.Unlock()
+	c.JSON(http.StatusOK, athlete)
+}
+
+// listActivitiesHandler pages through the athlete's activities, newest first
+func (f *FakeStrava) listActivitiesHandler(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "30"))
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = 30
+	}
+	if perPage > 200 {
+		perPage = 200
+	}
+	before, _ := strconv.ParseInt(c.Query("before"), 10, 64)
+	after, _ := strconv.ParseInt(c.Query("after"), 10, 64)
+
+	athleteID := c.GetInt64("athleteID")
+	var activities []*Activity
+	f.mu.Lock()
+	for _, a := range f.activities {
+		if a.Athlete.ID != athleteID {
+			continue
+		}
+		start, _ := time.Parse(time.RFC3339, a.StartDate)
+		if (before > 0 && start.Unix() >= before) || (after > 0 && start.Unix() <= after) {
+			continue
+		}
+		activities = append(activities, a)
+	}
+	f.mu.Unlock()
+
+	sort.Slice(activities, func(i, j int) bool {
+		if activities[i].StartDate != activities[j].StartDate {
+			return activities[i].StartDate > activities[j].StartDate
+		}
+		return activities[i].ID > activities[j].ID
+	})
+
+	summaries := []gin.H{}
+	for i := (page - 1) * perPage; i < len(activities) && i < page*perPage; i++ {
+		summaries = append(summaries, activitySummary(activities[i]))
+	}
+	c.JSON(http.StatusOK, summaries)
+}
+
+// activitySummary is the list representation of an activity, without the full polyline
+func activitySummary(a *Activity) gin.H {
+	var out gin.H
+	raw, _ := json.Marshal(a)
+	_ = json.Unmarshal(raw, &out)
+	if m, ok := out["map"].(map[string]interface{}); ok {
+		delete(m, "polyline")
+	}
+	delete(out, "description")
+	return out
+}
+
+func (f *FakeStrava) activityHandler(c *gin.Context) {
+	activity, ok := f.ownedActivity(c)
+	if !ok {
+		return
+	}
+	detail := *activity
+	detail.ResourceState = 3
+	c.JSON(http.StatusOK, detail)
+}
+
+// updateActivityHandler applies the UpdatableActivity fields present in the JSON body
+func (f *FakeStrava) updateActivityHandler(c *gin.Context) {
+	activity, ok := f.ownedActivity(c)
+	if !ok {
+		return
+	}
+	if !strings.Contains(c.GetString("scope"), "activity:write") {
+		log.Printf("Activity %d updated without activity:write scope", activity.ID)
+	}
+
+	var body struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+		SportType   *string `json:"sport_type"`
+		Commute     *bool   `json:"commute"`
+		Trainer     *bool   `json:"trainer"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		stravaError(c, http.StatusBadRequest, "Bad Request", "Activity", "body", "invalid")
+		return
+	}
+
+	f.mu.Lock()
+	if body.Name != nil {
+		activity.Name = *body.Name
+	}
+	if body.Description != nil {
+		activity.Description = *body.Description
+	}
+	if body.SportType != nil {
+		activity.SportType = *body.SportType
+	}
+	if body.Commute != nil {
+		activity.Commute = *body.Commute
+	}
+	if body.Trainer != nil {
+		activity.Trainer = *body.Trainer
+	}
+	detail := *activity
+	f.mu.Unlock()
+
+	log.Printf("Activity %d updated", activity.ID)
+	detail.ResourceState = 3
+	c.JSON(http.StatusOK, detail)
+}
+
+// streamsHandler serves the requested streams in list form, or keyed by type
+// when key_by_type=true
+func (f *FakeStrava) streamsHandler(c *gin.Context) {
+	activity, ok := f.ownedActivity(c)
+	if !ok {
+		return
+	}
+
+	available := map[string]interface{}{}
+	if len(activity.streams.LatLng) > 0 {
+		available["latlng"] = activity.streams.LatLng
+		available["time"] = activity.streams.Time
+		available["altitude"] = activity.streams.Altitude
+		available["distance"] = activity.streams.Distance
+	}
+
+	keyByType := c.Query("key_by_type") == "true"
+	byType := gin.H{}
+	list := []gin.H{}
+	for _, key := range strings.Split(c.DefaultQuery("keys", "latlng"), ",") {
+		data, ok := available[key]
+		if !ok {
+			continue
+		}
+		stream := gin.H{
+			"type":          key,
+			"data":          data,
+			"series_type":   "distance",
+			"original_size": len(activity.streams.LatLng),
+			"resolution":    "high",
+		}
+		list = append(list, stream)
+		byType[key] = stream
+	}
+
+	if keyByType {
+		c.JSON(http.StatusOK, byType)
+	} else {
+		c.JSON(http.StatusOK, list)
+	}
+}
+
+func (f *FakeStrava) listCommentsHandler(c *gin.Context) {
+	activity, ok := f.ownedActivity(c)
+	if !ok {
+		return
+	}
+	f.mu.Lock()
+	comments := append([]Comment{}, f.comments[activity.ID]...)
+	f.mu.Unlock()
+	c.JSON(http.StatusOK, comments)
+}
+
+// createCommentHandler accepts the comment text as form data or JSON, as the clients here send both
+func (f *FakeStrava) createCommentHandler(c *gin.Context) {
+	activity, ok := f.ownedActivity(c)
+	if !ok {
+		return
+	}
+	if !strings.Contains(c.GetString("scope"), "activity:write") {
+		log.Printf("Comment on activity %d posted without activity:write scope", activity.ID)
+	}
+
+	text := c.PostForm("text")
+	if text == "" {
+		var body struct {
+			Text string `json:"text"`
+		}
+		_ = c.ShouldBindJSON(&body)
+		text = body.Text
+	}
+	if text == "" {
+		stravaError(c, http.StatusBadRequest, "Bad Request", "Comment", "text", "invalid")
+		return
+	}
+
+	f.mu.Lock()
+	f.nextID++
+	comment := Comment{
+		ID:         f.nextID,
+		ActivityID: activity.ID,
+		Text:       text,
+		Athlete:    f.athletes[c.GetInt64("athleteID")],
+		CreatedAt:  f.now().UTC().Format(time.RFC3339),
+	}
+	f.comments[activity.ID] = append(f.comments[activity.ID], comment)
+	f.mu.Unlock()
+
+	log.Printf("Comment posted on activity %d: %q", activity.ID, text)
+	c.JSON(http.StatusCreated, comment)
+}
+
+// createSubscriptionHandler validates the callback like Strava does, by sending
+// a hub.challenge GET that must be echoed back, then stores the subscription
+func (f *FakeStrava) createSubscriptionHandler(c *gin.Context) {
+	if c.PostForm("client_id") != f.clientID || c.PostForm("client_secret") != f.clientSecret {
+		stravaError(c, http.StatusUnauthorized, "Authorization Error", "Application", "client_id", "invalid")
+		return
+	}
+	callbackURL := c.PostForm("callback_url")
+
+	f.mu.Lock()
+	exists := len(f.subscriptions) > 0
+	f.mu.Unlock()
+	if exists {
+		stravaError(c, http.StatusBadRequest, "Bad Request", "PushSubscription", "callback_url", "already exists")
+		return
+	}
+
+	challenge := fmt.Sprintf("challenge-%d", f.now().UnixNano())
+	validateURL, err := url.Parse(callbackURL)
+	if err != nil || validateURL.Host == "" {
+		stravaError(c, http.StatusBadRequest, "Bad Request", "PushSubscription", "callback_url", "invalid")
+		return
+	}
+	query := validateURL.Query()
+	query.Set("hub.mode", "subscribe")
+	query.Set("hub.challenge", challenge)
+	query.Set("hub.verify_token", c.PostForm("verify_token"))
+	validateURL.RawQuery = query.Encode()
+
+	resp, err := f.httpClient.Get(validateURL.String())
+	if err != nil {
+		stravaError(c, http.StatusBadRequest, "Bad Request", "PushSubscription", "callback_url", "not verifiable")
+		return
+	}
+	defer resp.Body.Close()
+
+	var echo map[string]string
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&echo) != nil || echo["hub.challenge"] != challenge {
+		stravaError(c, http.StatusBadRequest, "Bad Request", "PushSubscription", "callback_url", "not verifiable")
+		return
+	}
+
+	now := f.now().UTC().Format(time.RFC3339)
+	f.mu.Lock()
+	f.nextID++
+	sub := &Subscription{ID: f.nextID, ApplicationID: 1, CallbackURL: callbackURL, CreatedAt: now, UpdatedAt: now}
+	f.subscriptions[sub.ID] = sub
+	f.mu.Unlock()
+
+	c.JSON(http.StatusCreated, gin.H{"id": sub.ID})
+}
+
+func (f *FakeStrava) listSubscriptionsHandler(c *gin.Context) {
+	if c.Query("client_id") != f.clientID || c.Query("client_secret") != f.clientSecret {
+		stravaError(c, http.StatusUnauthorized, "Authorization Error", "Application", "client_id", "invalid")
+		return
+	}
+	f.mu.Lock()
+	subs := []*Subscription{}
+	for _, sub := range f.subscriptions {
+		subs = append(subs, sub)
+	}
+	f.mu.Unlock()
+	c.JSON(http.StatusOK, subs)
+}
+
+func (f *FakeStrava) deleteSubscriptionHandler(c *gin.Context) {
+	if c.Query("client_id") != f.clientID || c.Query("client_secret") != f.clientSecret {
+		stravaError(c, http.StatusUnauthorized, "Authorization Error", "Application", "client_id", "invalid")
+		return
+	}
+	id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+
+	f.mu.Lock()
+	_, ok := f.subscriptions[id]
+	delete(f.subscriptions, id)
+	f.mu.Unlock()
+
+	if !ok {
+		stravaError(c, http.StatusNotFound, "Record Not Found", "PushSubscription", "id", "not found")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// listAthletesHandler lists the fixture athletes and their activity counts
+func (f *FakeStrava) listAthletesHandler(c *gin.Context) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	counts := make(map[int64]int)
+	for _, a := range f.activities {
+		counts[a.Athlete.ID]++
+	}
+	athletes := []gin.H{}
+	for _, fx := range athleteFixtures {
+		athletes = append(athletes, gin.H{"athlete": f.athletes[fx.athlete.ID], "activities": counts[fx.athlete.ID]})
+	}
+	c.JSON(http.StatusOK, athletes)
+}
+
+// addActivityHandler generates a new activity for an athlete, starting now, and sends
+// the activity create event to the subscription unless ?webhook=false
+func (f *FakeStrava) addActivityHandler(c *gin.Context) {
+	athleteID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+
+	var fx *athleteFixture
+	for i := range athleteFixtures {
+		if athleteFixtures[i].athlete.ID == athleteID {
+			fx = &athleteFixtures[i]
+		}
+	}
+	if fx == nil {
+		stravaError(c, http.StatusNotFound, "Record Not Found", "Athlete", "id", "not found")
+		return
+	}
+
+	f.mu.Lock()
+	var count int64
+	for _, a := range f.activities {
+		if a.Athlete.ID == athleteID {
+			count++
+		}
+	}
+	id := athleteID*100000 + count + 1
+	rng := rand.New(rand.NewSource(id))
+	activity := generateActivity(rng, *fx, id, f.now().UTC().Truncate(time.Second))
+	f.activities[id] = activity
+	f.mu.Unlock()
+
+	result := gin.H{"activity": activitySummary(activity)}
+	if c.Query("webhook") != "false" {
+		result["deliveries"] = f.fireEvent(webhookEvent{
+			ObjectType: "activity",
+			ObjectID:   id,
+			AspectType: "create",
+			OwnerID:    athleteID,
+			Updates:    map[string]string{},
+		})
+	}
+	c.JSON(http.StatusCreated, result)
+}
+
+// webhookEvent is the payload Strava posts to subscription callbacks
+type webhookEvent struct {
+	ObjectType     string            `json:"object_type"`
+	ObjectID       int64             `json:"object_id"`
+	AspectType     string            `json:"aspect_type"`
+	OwnerID        int64             `json:"owner_id"`
+	SubscriptionID int64             `json:"subscription_id"`
+	EventTime      int64             `json:"event_time"`
+	Updates        map[string]string `json:"updates"`
+}
+
+// fireWebhookHandler sends an arbitrary event to every subscription
+func (f *FakeStrava) fireWebhookHandler(c *gin.Context) {
+	var event webhookEvent
+	if err := c.ShouldBindJSON(&event); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event payload"})
+		return
+	}
+	if event.ObjectType == "" || event.AspectType == "" || event.ObjectID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "object_type, object_id and aspect_type are required"})
+		return
+	}
+	if event.Updates == nil {
+		event.Updates = map[string]string{}
+	}
+
+	deliveries := f.fireEvent(event)
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+// fireEvent posts the event to every subscription callback and reports each outcome
+func (f *FakeStrava) fireEvent(event webhookEvent) []gin.H {
+	f.mu.Lock()
+	subs := make([]Subscription, 0, len(f.subscriptions))
+	for _, sub := range f.subscriptions {
+		subs = append(subs, *sub)
+	}
+	f.mu.Unlock()
+
+	if event.EventTime == 0 {
+		event.EventTime = f.now().Unix()
+	}
+
+	deliveries := []gin.H{}
+	for _, sub := range subs {
+		event.SubscriptionID = sub.ID
+		payload, _ := json.Marshal(event)
+
+		delivery := gin.H{"subscription_id": sub.ID, "callback_url": sub.CallbackURL}
+		resp, err := f.httpClient.Post(sub.CallbackURL, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			delivery["error"] = err.Error()
+		} else {
+			delivery["status"] = resp.StatusCode
+			resp.Body.Close()
+		}
+		log.Printf("Webhook %s/%s %d sent to %s: %v", event.ObjectType, event.AspectType, event.ObjectID, sub.CallbackURL, delivery)
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries
+}
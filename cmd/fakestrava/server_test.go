@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func newTestFake() (*FakeStrava, *gin.Engine) {
+	fake := NewFakeStrava("client", "secret", RateLimits{FifteenMinute: 100, Daily: 1000})
+	return fake, fake.Router()
+}
+
+// login runs the OAuth flow for an athlete and returns the token response
+func login(t *testing.T, router *gin.Engine, athleteID string) map[string]interface{} {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth/authorize?client_id=client&response_type=code&redirect_uri=http://localhost:8080/oauth/callback&scope=read,activity:read_all&state=xyz&athlete_id="+athleteID, nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusFound, w.Code)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "/oauth/callback", location.Path)
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	require.NotEmpty(t, code)
+
+	form := url.Values{"client_id": {"client"}, "client_secret": {"secret"}, "code": {code}, "grant_type": {"authorization_code"}}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var token map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &token))
+	return token
+}
+
+func get(router *gin.Engine, path, accessToken string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestFixturesAreDeterministic(t *testing.T) {
+	_, first := buildFixtures()
+	_, second := buildFixtures()
+
+	require.Equal(t, len(first), len(second))
+	for id, a := range first {
+		assert.Equal(t, a, second[id])
+	}
+}
+
+func TestOAuthFlow(t *testing.T) {
+	_, router := newTestFake()
+
+	token := login(t, router, "1002")
+	athlete := token["athlete"].(map[string]interface{})
+	assert.Equal(t, float64(1002), athlete["id"])
+
+	w := get(router, "/api/v3/athlete", token["access_token"].(string))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"firstname":"Alex"`)
+
+	t.Run("Refresh", func(t *testing.T) {
+		form := url.Values{"client_id": {"client"}, "client_secret": {"secret"}, "refresh_token": {token["refresh_token"].(string)}, "grant_type": {"refresh_token"}}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var refreshed map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &refreshed))
+		assert.NotEqual(t, token["access_token"], refreshed["access_token"])
+	})
+
+	t.Run("Invalid token", func(t *testing.T) {
+		w := get(router, "/api/v3/athlete", "nope")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+func TestActivitiesPagingAndStreams(t *testing.T) {
+	_, router := newTestFake()
+	token := login(t, router, "1001")["access_token"].(string)
+
+	var pages [][]map[string]interface{}
+	for _, page := range []string{"1", "2", "3"} {
+		w := get(router, "/api/v3/athlete/activities?per_page=20&page="+page, token)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "100,1000", w.Header().Get("X-RateLimit-Limit"))
+
+		var activities []map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &activities))
+		pages = append(pages, activities)
+	}
+	assert.Len(t, pages[0], 20)
+	assert.Len(t, pages[1], 20)
+	assert.Len(t, pages[2], 5)
+	assert.GreaterOrEqual(t, pages[0][0]["start_date"], pages[0][1]["start_date"])
+
+	id := int64(pages[0][0]["id"].(float64))
+	w := get(router, "/api/v3/activities/"+jsonNumber(id)+"/streams?keys=latlng,time,altitude,distance", token)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var streams []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &streams))
+	assert.Len(t, streams, 4)
+
+	// Other athletes' activities are not visible
+	other := login(t, router, "1002")["access_token"].(string)
+	w = get(router, "/api/v3/activities/"+jsonNumber(id), other)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRateLimit(t *testing.T) {
+	fake := NewFakeStrava("client", "secret", RateLimits{FifteenMinute: 2, Daily: 10})
+	router := fake.Router()
+	token := login(t, router, "1001")["access_token"].(string)
+
+	assert.Equal(t, http.StatusOK, get(router, "/api/v3/athlete", token).Code)
+	assert.Equal(t, http.StatusOK, get(router, "/api/v3/athlete", token).Code)
+
+	w := get(router, "/api/v3/athlete", token)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "3,3", w.Header().Get("X-RateLimit-Usage"))
+}
+
+func TestCommentsAndWebhooks(t *testing.T) {
+	var received []webhookEvent
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			json.NewEncoder(w).Encode(map[string]string{"hub.challenge": r.URL.Query().Get("hub.challenge")})
+			return
+		}
+		var event webhookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		received = append(received, event)
+	}))
+	defer callback.Close()
+
+	_, router := newTestFake()
+	token := login(t, router, "1003")["access_token"].(string)
+
+	form := url.Values{"client_id": {"client"}, "client_secret": {"secret"}, "callback_url": {callback.URL}, "verify_token": {"verify"}}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v3/push_subscriptions", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/fake/athletes/1003/activities", nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	require.Len(t, received, 1)
+	assert.Equal(t, "create", received[0].AspectType)
+	assert.Equal(t, int64(1003), received[0].OwnerID)
+
+	path := "/api/v3/activities/" + jsonNumber(received[0].ObjectID) + "/comments"
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", path, strings.NewReader(`{"text":"Nice one"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	w = get(router, path, token)
+	assert.Contains(t, w.Body.String(), "Nice one")
+}
+
+func jsonNumber(id int64) string {
+	b, _ := json.Marshal(id)
+	return string(b)
+}
+
+func TestUpdateActivity(t *testing.T) {
+	_, router := newTestFake()
+	token := login(t, router, "1004")["access_token"].(string)
+
+	w := get(router, "/api/v3/athlete/activities?per_page=1", token)
+	require.Equal(t, http.StatusOK, w.Code)
+	var activities []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &activities))
+	require.Len(t, activities, 1)
+	path := "/api/v3/activities/" + jsonNumber(int64(activities[0]["id"].(float64)))
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", path, strings.NewReader(`{"description":"Legs felt good"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var detail map[string]interface{}
+	w = get(router, path, token)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &detail))
+	assert.Equal(t, "Legs felt good", detail["description"])
+	assert.Equal(t, activities[0]["name"], detail["name"])
+}
@@ -0,0 +1,83 @@
+// Command rotate_tokens re-encrypts stored Strava tokens with the newest key in
+// TOKEN_ENCRYPTION_KEYS (or TOKEN_ENCRYPTION_KEY_FILE), encrypting any still stored in
+// plaintext. To rotate keys:
+//
+//  1. Generate a key with `openssl rand -base64 32` and add it with the next version,
+//     keeping the old one: TOKEN_ENCRYPTION_KEYS=2:<new key>,1:<old key>
+//  2. Deploy the server with the new keys, then run `go run ./cmd/rotate_tokens`
+//  3. Once it reports no tokens under version 1, remove that key
+//
+// With -dry-run it only reports how many tokens each key version holds.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "only report how many tokens each key version holds")
+	flag.Parse()
+
+	cfg := config.Load()
+	if cfg.DBUrl == "" {
+		log.Fatal("DB_URL environment variable is required")
+	}
+
+	keys, err := storage.LoadKeyRing(cfg.TokenEncryptionKeys, cfg.TokenEncryptionKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load token encryption keys: %v", err)
+	}
+	if keys == nil {
+		log.Fatal("TOKEN_ENCRYPTION_KEYS or TOKEN_ENCRYPTION_KEY_FILE must hold at least one key")
+	}
+
+	db, err := storage.NewDB(cfg.DBUrl)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+	db.SetTokenKeys(keys)
+
+	printCounts(db, keys.Current())
+	if *dryRun {
+		return
+	}
+
+	rewritten, err := db.ReencryptTokens()
+	fmt.Printf("Re-encrypted %d tokens with key version %d\n", rewritten, keys.Current())
+	if err != nil {
+		log.Fatalf("Some tokens could not be re-encrypted: %v", err)
+	}
+	printCounts(db, keys.Current())
+}
+
+// printCounts reports how many tokens each key version holds
+func printCounts(db *storage.DB, current int) {
+	counts, err := db.CountTokensByKeyVersion()
+	if err != nil {
+		log.Fatalf("Failed to count tokens: %v", err)
+	}
+
+	versions := make([]int, 0, len(counts))
+	for version := range counts {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	for _, version := range versions {
+		switch {
+		case version == 0:
+			fmt.Printf("  plaintext: %d\n", counts[version])
+		case version == current:
+			fmt.Printf("  key version %d (current): %d\n", version, counts[version])
+		default:
+			fmt.Printf("  key version %d: %d\n", version, counts[version])
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/nikhilvedi/strava-coverage/internal/session"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
+)
+
+// publicRoutes can be called without signing in
+var publicRoutes = []string{
+	"GET /api/health",
+	"GET /api/openapi.json",
+	"GET /metrics",
+
+	// Signing in and out
+	"GET /oauth/authorize",
+	"GET /oauth/callback",
+	"POST /api/auth/logout",
+
+	// Strava's push subscription validation and events
+	"GET /api/automation/webhook",
+	"POST /api/automation/webhook",
+
+	// Unsubscribe links in digest emails carry their own token
+	"GET /api/digest/unsubscribe",
+	"POST /api/digest/unsubscribe",
+
+	// Cities, their maps and leaderboards
+	"GET /api/cities/",
+	"GET /api/cities/search",
+	"GET /api/cities/:id",
+	"GET /api/maps/cities",
+	"GET /api/maps/cities/:cityId",
+	"GET /api/maps/config",
+	"GET /api/maps/styles",
+	"GET /api/maps/bounds/city/:cityId",
+	"GET /api/multi-coverage/global/leaderboard",
+	"GET /api/multi-coverage/city/:cityId/stats",
+	"GET /api/detection/nearby-cities",
+}
+
+// moderatorRoutes are the admin routes moderators may call: reading, and editing cities
+var moderatorRoutes = []string{
+	"GET /api/admin/",
+	"PUT /api/admin/cities/",
+	"POST /api/admin/cities/",
+	"DELETE /api/admin/cities/",
+}
+
+// adminRoutes are every other admin route, and routes working across every user
+var adminRoutes = []string{
+	"/api/admin/",
+	"POST /api/coverage/recalculate-all",
+}
+
+// newGuard decides who may call each route: anyone for the public routes, moderators and
+// admins for the admin routes, and otherwise only the user that the IDs in the path belong
+// to
+func newGuard(db *storage.DB, jobOwner session.Lookup) *session.Guard {
+	guard := session.NewGuard()
+	guard.Public(publicRoutes...)
+
+	guard.Roles(db.GetUserRole, storage.Roles...)
+	guard.Require(storage.RoleModerator, moderatorRoutes...)
+	guard.Require(storage.RoleAdmin, adminRoutes...)
+	// Admin webhook endpoints and their deliveries
+	guard.Unowned(storage.RoleAdmin)
+
+	guard.User("", "userId")
+	guard.User("/api/users/:id", "id")
+	guard.UserQuery("/api/import_activity/:id", "user_id", func(value string) (int, error) {
+		stravaID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, session.ErrInvalidID
+		}
+		return db.GetUserIDByStravaID(stravaID)
+	})
+
+	guard.Owned("", "activityId", "Activity", utils.CodeActivityNotFound, func(value string) (int, error) {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, session.ErrInvalidID
+		}
+		return db.GetActivityOwner(id)
+	})
+	guard.Owned("/api/custom-areas/:id", "id", "Custom area", utils.CodeCustomAreaNotFound, func(value string) (int, error) {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, session.ErrInvalidID
+		}
+		return db.GetCustomAreaOwner(id)
+	})
+	guard.Owned("/api/webhooks/endpoints/:id", "id", "Webhook endpoint", utils.CodeWebhookEndpointNotFound, func(value string) (int, error) {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, session.ErrInvalidID
+		}
+		return db.GetWebhookEndpointOwner(id)
+	})
+	guard.Owned("", "deliveryId", "Webhook delivery", utils.CodeWebhookDeliveryNotFound, func(value string) (int, error) {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, session.ErrInvalidID
+		}
+		return db.GetWebhookDeliveryOwner(id)
+	})
+
+	// Recalculations of every user's activities are unowned, so only admins can follow them
+	guard.Owned("", "jobId", "Job", utils.CodeJobNotFound, jobOwner)
+
+	// Cities and Strava webhook events belong to no user
+	guard.Shared("", "cityId", "eventId")
+	// The Strava activity to import, which is not stored yet
+	guard.Shared("/api/import_activity/:id", "id")
+
+	return guard
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,11 +13,21 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/account"
+	"github.com/nikhilvedi/strava-coverage/internal/admin"
+	"github.com/nikhilvedi/strava-coverage/internal/apiv2"
 	"github.com/nikhilvedi/strava-coverage/internal/auth"
 	"github.com/nikhilvedi/strava-coverage/internal/comments"
 	"github.com/nikhilvedi/strava-coverage/internal/coverage"
+	"github.com/nikhilvedi/strava-coverage/internal/digest"
+	"github.com/nikhilvedi/strava-coverage/internal/logging"
+	"github.com/nikhilvedi/strava-coverage/internal/metrics"
 	"github.com/nikhilvedi/strava-coverage/internal/middleware"
+	"github.com/nikhilvedi/strava-coverage/internal/notify"
+	"github.com/nikhilvedi/strava-coverage/internal/progress"
+	"github.com/nikhilvedi/strava-coverage/internal/session"
 	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/nikhilvedi/strava-coverage/internal/webhooks"
 )
 
 func main() {
@@ -28,6 +39,7 @@ func main() {
 func run() error {
 	// Load configuration
 	cfg := config.Load()
+	logging.Setup(cfg)
 	if cfg.DBUrl == "" {
 		return fmt.Errorf("DB_URL environment variable is required")
 	}
@@ -39,9 +51,16 @@ func run() error {
 	}
 	defer func() {
 		if err := db.Close(); err != nil {
-			log.Printf("Failed to close database connection: %v", err)
+			slog.Error("Failed to close database connection", "error", err)
 		}
 	}()
+	metrics.RegisterDB(db)
+	if err := setupTokenEncryption(cfg, db); err != nil {
+		return err
+	}
+	if cfg.StravaWebhookSubscriptionID == 0 {
+		slog.Warn("STRAVA_WEBHOOK_SUBSCRIPTION_ID is not set; Strava webhook events of any subscription are accepted")
+	}
 
 	// Configure Gin mode
 	if os.Getenv("GIN_MODE") != "" {
@@ -50,8 +69,16 @@ func run() error {
 		gin.SetMode(gin.DebugMode)
 	}
 
+	// The routes and the background workers share one instance of each service
+	svc := newServices(cfg, db, progress.NewBroker())
+
 	// Initialize router
-	r := setupRouter(cfg, db)
+	r := setupRouter(cfg, db, svc)
+
+	// Background workers stop when the server shuts down
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	startBackgroundWorkers(workerCtx, cfg, db, svc)
 
 	// Setup HTTP server
 	port := os.Getenv("PORT")
@@ -61,7 +88,7 @@ func run() error {
 
 	srv := &http.Server{
 		Addr:    ":" + port,
-		Handler: r,
+		Handler: apiv2.Handler(r),
 	}
 
 	// Setup graceful shutdown
@@ -70,7 +97,7 @@ func run() error {
 
 	// Start server in goroutine
 	go func() {
-		log.Printf("Server starting on port %s", port)
+		slog.Info("Server starting", "port", port)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed to start: %v", err)
 		}
@@ -78,79 +105,197 @@ func run() error {
 
 	// Wait for interrupt signal
 	<-quit
-	log.Println("Server shutting down...")
+	slog.Info("Server shutting down")
 
 	// Graceful shutdown with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Printf("Server forced to shutdown: %v", err)
+		slog.Error("Server forced to shutdown", "error", err)
 		return err
 	}
 
-	log.Println("Server exited")
+	slog.Info("Server exited")
+	return nil
+}
+
+// setupTokenEncryption loads the keys Strava tokens are encrypted with and, in the
+// background, encrypts tokens still in plaintext or under an older key
+func setupTokenEncryption(cfg *config.Config, db *storage.DB) error {
+	keys, err := storage.LoadKeyRing(cfg.TokenEncryptionKeys, cfg.TokenEncryptionKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load token encryption keys: %v", err)
+	}
+	if keys == nil {
+		slog.Warn("TOKEN_ENCRYPTION_KEYS is not set; Strava tokens are stored in plaintext")
+		return nil
+	}
+	db.SetTokenKeys(keys)
+	slog.Info("Encrypting Strava tokens", "key_version", keys.Current())
+
+	go func() {
+		rewritten, err := db.ReencryptTokens()
+		if err != nil {
+			slog.Error("Failed to re-encrypt some Strava tokens", "error", err)
+		}
+		if rewritten > 0 {
+			slog.Info("Re-encrypted Strava tokens", "tokens", rewritten, "key_version", keys.Current())
+		}
+	}()
 	return nil
 }
 
-func setupRouter(cfg *config.Config, db *storage.DB) *gin.Engine {
+// services holds the services with queues or state of their own. Each is built once so
+// that the routes and the background workers feed the same notification pipeline, webhook
+// dispatcher and digest, with one retry worker per queue.
+type services struct {
+	broker        *progress.Broker
+	sessions      *session.Manager
+	events        *webhooks.Dispatcher
+	notifier      *notify.Notifier
+	coverage      *coverage.CoverageService
+	detection     *coverage.CityDetectionService
+	multiCoverage *coverage.MultiCityCoverageService
+	digest        *digest.Service
+	initialImport *coverage.InitialImportService
+	automation    *coverage.AutomationService
+}
+
+// newServices builds the shared services. broker receives the progress of imports and
+// recalculations, for the streaming endpoints.
+func newServices(cfg *config.Config, db *storage.DB, broker *progress.Broker) *services {
+	svc := &services{
+		broker:        broker,
+		sessions:      session.NewManager(cfg),
+		events:        webhooks.NewDispatcher(db, cfg.WebhookAllowLocal),
+		notifier:      notify.NewNotifier(db, cfg),
+		coverage:      coverage.NewCoverageService(db, broker),
+		detection:     coverage.NewCityDetectionService(db),
+		multiCoverage: coverage.NewMultiCityCoverageService(db),
+	}
+	svc.sessions.Generations(db.GetSessionGeneration)
+	svc.digest = digest.NewService(db, cfg, svc.multiCoverage)
+	svc.initialImport = coverage.NewInitialImportService(db, cfg, svc.coverage, svc.notifier, svc.detection, svc.events, broker)
+	svc.automation = coverage.NewAutomationService(db, cfg, svc.coverage, svc.notifier, svc.events)
+	return svc
+}
+
+// startBackgroundWorkers starts the notification and webhook retry workers, the weekly
+// digest, the recovery of lost Strava events, the activity metadata backfill and the
+// optional polling workers enabled by configuration
+func startBackgroundWorkers(ctx context.Context, cfg *config.Config, db *storage.DB, svc *services) {
+	go svc.notifier.RunRetryWorker(ctx, time.Minute)
+	go svc.events.RunRetryWorker(ctx, time.Minute)
+	go svc.digest.RunWorker(ctx, time.Hour)
+	go svc.automation.RunRecoveryWorker(ctx, time.Minute)
+	go svc.initialImport.RunMetadataBackfillWorker(ctx, 24*time.Hour)
+
+	if cfg.RateLimitPerMinute > 0 && cfg.RateLimitStore == "postgres" {
+		go pruneRateLimitBuckets(ctx, db, time.Hour)
+	}
+
+	if cfg.ActivityWatchDir != "" {
+		watcher := coverage.NewDirectoryWatcher(cfg.ActivityWatchDir, cfg.ActivityWatchInterval, svc.initialImport)
+		go watcher.Run(ctx)
+	}
+}
+
+func setupRouter(cfg *config.Config, db *storage.DB, svc *services) *gin.Engine {
 	r := gin.New()
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		slog.Warn("Ignoring invalid TRUSTED_PROXIES", "error", err)
+	}
 
 	// Add middleware
 	r.Use(gin.Recovery())
 	r.Use(middleware.RequestIDMiddleware())
 	r.Use(middleware.LoggingMiddleware())
+	r.Use(metrics.Middleware())
 	r.Use(middleware.ErrorHandlingMiddleware())
-	r.Use(middleware.CORSMiddleware())
+	r.Use(middleware.CORSMiddleware(cfg.FrontendURL))
 
-	// Initialize services
-	authService := auth.NewService(cfg, db)
-	coverageService := coverage.NewCoverageService(db)
-	commentService := coverage.NewCommentService(db, cfg)
+	// Resolve the signed-in user and enforce who may call which route
+	guard := newGuard(db, svc.coverage.JobOwner)
+	r.Use(svc.sessions.Middleware())
+	if limiter := newRateLimiter(cfg, db); limiter != nil {
+		r.Use(limiter.Middleware())
+	}
+	r.Use(guard.Middleware())
+
+	// Reject requests that don't match the API description
+	spec := newSpec()
+	r.Use(spec.Middleware())
 
 	// Register routes
-	setupRoutes(r, cfg, db, authService, coverageService, commentService)
+	setupRoutes(r, cfg, db, svc)
+	r.GET("/api/openapi.json", spec.Handler)
+	r.GET("/metrics", metrics.Handler())
+
+	for _, route := range guard.Uncovered(r.Routes()) {
+		slog.Warn("Route has no access rule and refuses every request", "route", route)
+	}
+	if cfg.RateLimitPerMinute > 0 {
+		for _, route := range unknownRateLimitRoutes(cfg, r.Routes()) {
+			slog.Warn("Rate limited route is not registered", "route", route)
+		}
+	}
 
 	return r
 }
 
-func setupRoutes(r *gin.Engine, cfg *config.Config, db *storage.DB, authService *auth.Service, coverageService *coverage.CoverageService, commentService *coverage.CommentService) {
+func setupRoutes(r *gin.Engine, cfg *config.Config, db *storage.DB, svc *services) {
 	// Auth routes
+	authService := auth.NewService(cfg, db, svc.sessions, svc.events, svc.broker)
 	authService.SetupRoutes(r)
 
 	// Core service routes
 	importService := coverage.NewImportService(db, cfg)
 	importService.RegisterImportRoutes(r)
 
-	cityService := coverage.NewCityService(db)
+	cityService := coverage.NewCityService(db, svc.events)
 	cityService.RegisterCityRoutes(r)
 
-	coverageService.RegisterCoverageRoutes(r)
+	svc.coverage.RegisterCoverageRoutes(r)
 
 	// Comment system routes
-	autoCommentHandler := comments.NewHandler(db, cfg)
+	autoCommentHandler := comments.NewHandler(db, cfg, svc.notifier)
 	autoCommentHandler.RegisterRoutes(r)
+	commentService := coverage.NewCommentService(db, cfg, svc.notifier)
 	commentService.RegisterCommentRoutes(r)
 
 	// Advanced features
 	customAreasService := coverage.NewCustomAreasService(db)
 	customAreasService.RegisterCustomAreaRoutes(r)
 
-	automationService := coverage.NewAutomationService(db, cfg, coverageService, commentService)
-	automationService.RegisterAutomationRoutes(r)
+	svc.automation.RegisterAutomationRoutes(r)
 
-	detectionService := coverage.NewCityDetectionService(db)
-	detectionService.RegisterCityDetectionRoutes(r)
+	svc.detection.RegisterCityDetectionRoutes(r)
+	svc.multiCoverage.RegisterMultiCityCoverageRoutes(r)
+	svc.digest.RegisterDigestRoutes(r)
+	svc.initialImport.RegisterInitialImportRoutes(r)
 
-	multiCoverageService := coverage.NewMultiCityCoverageService(db)
-	multiCoverageService.RegisterMultiCityCoverageRoutes(r)
+	progressHandler := progress.NewHandler(svc.broker)
+	progressHandler.RegisterRoutes(r)
 
-	initialImportService := coverage.NewInitialImportService(db, cfg, coverageService, commentService, detectionService)
-	initialImportService.RegisterInitialImportRoutes(r)
+	activityService := coverage.NewActivityService(db)
+	activityService.RegisterActivityRoutes(r)
 
 	mapService := coverage.NewMapService(db)
 	mapService.RegisterMapRoutes(r)
 
+	// Data export and account deletion
+	accountService := account.NewService(db, cfg, svc.multiCoverage, svc.sessions)
+	accountService.RegisterAccountRoutes(r)
+
+	// Operator endpoints
+	adminService := admin.NewService(db, svc.coverage, svc.initialImport, accountService)
+	adminService.RegisterAdminRoutes(r)
+
+	// Outbound webhooks
+	webhookHandler := webhooks.NewHandler(db, svc.events)
+	webhookHandler.RegisterRoutes(r)
+
 	// Health check
 	api := r.Group("/api")
 	{
@@ -0,0 +1,684 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nikhilvedi/strava-coverage/internal/account"
+	"github.com/nikhilvedi/strava-coverage/internal/admin"
+	"github.com/nikhilvedi/strava-coverage/internal/auth"
+	"github.com/nikhilvedi/strava-coverage/internal/comments"
+	"github.com/nikhilvedi/strava-coverage/internal/coverage"
+	"github.com/nikhilvedi/strava-coverage/internal/digest"
+	"github.com/nikhilvedi/strava-coverage/internal/notify"
+	"github.com/nikhilvedi/strava-coverage/internal/openapi"
+	"github.com/nikhilvedi/strava-coverage/internal/pagination"
+	"github.com/nikhilvedi/strava-coverage/internal/session"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
+	"github.com/nikhilvedi/strava-coverage/internal/webhooks"
+)
+
+// openAPIRoute serves the document itself
+const openAPIRoute = "GET /api/openapi.json"
+
+// newSpec describes every route setupRoutes registers. Request bodies and responses are
+// given as the Go types handlers bind and write, so the document follows them; the
+// validator rejects requests that don't match before they reach a handler.
+func newSpec() *openapi.Spec {
+	spec := openapi.New(openapi.Info{
+		Title:       "Strava Coverage API",
+		Description: "Street coverage of Strava activities across cities, with leaderboards, comments, digests and webhooks.",
+		Version:     "1.0.0",
+	})
+
+	spec.Security("session", &openapi.SecurityScheme{
+		Type:        "apiKey",
+		In:          "cookie",
+		Name:        session.CookieName,
+		Description: "Session cookie set at the OAuth callback",
+	})
+	spec.Security("bearer", &openapi.SecurityScheme{
+		Type:        "http",
+		Scheme:      "bearer",
+		Description: "The session token, for clients that can't keep cookies",
+	})
+
+	for _, name := range []string{"userId", "cityId", "activityId", "id", "eventId", "deliveryId"} {
+		spec.PathParam(name, openapi.ID())
+	}
+
+	schemas := spec.Schemas()
+	validationError := schemas.Of(utils.ValidationError{})
+	spec.Document().Components.Schemas["Error"] = openapi.Object(map[string]*openapi.Schema{
+		"error":             openapi.Any().Describe("A message, or an object with code, message and details"),
+		"validation_errors": openapi.ArrayOf(validationError),
+	}).Optional("validation_errors")
+
+	message := openapi.Object(map[string]*openapi.Schema{"message": openapi.String()})
+	limit := openapi.Integer().Min(1)
+	geoJSON := coverage.GeoJSONFeatureCollection{}
+	eventStream := openapi.String().Describe("Server-sent events")
+	var roles []interface{}
+	for _, role := range storage.Roles {
+		roles = append(roles, role)
+	}
+
+	spec.Tag("auth", "Signing in with Strava and the signed-in user")
+	spec.Tag("users", "User profiles, preferences and their data")
+	spec.Tag("cities", "Cities and their street coverage")
+	spec.Tag("coverage", "Coverage calculation")
+	spec.Tag("activities", "Activity history")
+	spec.Tag("maps", "GeoJSON for maps")
+	spec.Tag("import", "Importing activities from Strava")
+	spec.Tag("automation", "Strava push events and background processing")
+	spec.Tag("comments", "Coverage comments posted to Strava activities")
+	spec.Tag("digest", "Digest emails")
+	spec.Tag("webhooks", "Outgoing webhooks")
+	spec.Tag("admin", "Operator endpoints")
+	spec.Tag("system", "Health, metrics and the API description")
+
+	// System
+	spec.Route("GET /api/health", "getHealth", "Health check").Tags("system").
+		Returns(http.StatusOK, "The server is up", openapi.Object(map[string]*openapi.Schema{
+			"status":    openapi.String(),
+			"timestamp": openapi.String().WithFormat("date-time"),
+			"version":   openapi.String(),
+		}))
+	spec.Route(openAPIRoute, "getOpenAPI", "This document").Tags("system").
+		Returns(http.StatusOK, "The OpenAPI document", openapi.Any())
+	spec.Route("GET /metrics", "getMetrics", "Prometheus metrics").Tags("system").
+		ReturnsContent(http.StatusOK, "Metrics in the Prometheus text format", "text/plain", openapi.String())
+
+	// Auth
+	spec.Route("GET /oauth/authorize", "authorize", "Start signing in with Strava").Tags("auth").
+		Query("prompt", openapi.String(), false, "Strava approval prompt, such as force").
+		Query("return_to", openapi.String(), false, "Frontend path to return to after signing in").
+		ReturnsContent(http.StatusFound, "Redirect to Strava", "text/html", openapi.String())
+	spec.Route("GET /oauth/callback", "oauthCallback", "Finish signing in with Strava").Tags("auth").
+		Query("state", openapi.String(), false, "").
+		Query("code", openapi.String(), false, "").
+		Query("scope", openapi.String(), false, "").
+		Query("error", openapi.String(), false, "").
+		ReturnsContent(http.StatusFound, "Redirect to the frontend", "text/html", openapi.String()).
+		Errors(http.StatusBadRequest, http.StatusBadGateway)
+	spec.Route("POST /api/auth/logout", "logout", "Sign out").Tags("auth").
+		Returns(http.StatusNoContent, "Signed out", nil)
+
+	user := openapi.Object(map[string]*openapi.Schema{
+		"id":        openapi.Integer(),
+		"strava_id": openapi.Integer().WithFormat("int64"),
+		"name":      openapi.String(),
+		"email":     openapi.String(),
+		"scopes":    openapi.ArrayOf(openapi.String()),
+		"features":  schemas.Of([]auth.Feature{}),
+	})
+	spec.Route("GET /api/me", "getCurrentUser", "The signed-in user").Tags("auth").
+		Returns(http.StatusOK, "The user", user).
+		Errors(http.StatusUnauthorized, http.StatusNotFound)
+
+	// Users
+	spec.Route("GET /api/users/:id", "getUser", "Get a user").Tags("users").
+		Returns(http.StatusOK, "The user", user).
+		Errors(http.StatusNotFound)
+	spec.Route("GET /api/users/:id/preferences", "getUserPreferences", "Get language and units").Tags("users").
+		Returns(http.StatusOK, "Preferences and the choices", openapi.Object(map[string]*openapi.Schema{
+			"preferences": schemas.Of(storage.UserPreferences{}),
+			"languages":   openapi.ArrayOf(openapi.String()),
+			"units":       openapi.ArrayOf(openapi.String()),
+		})).
+		Errors(http.StatusNotFound)
+	spec.Route("PUT /api/users/:id/preferences", "updateUserPreferences", "Set language or units").Tags("users").
+		Body(auth.UpdateUserPreferencesRequest{}, true).
+		Returns(http.StatusOK, "Updated", openapi.Object(map[string]*openapi.Schema{
+			"message":     openapi.String(),
+			"preferences": schemas.Of(storage.UserPreferences{}),
+		})).
+		Errors(http.StatusBadRequest, http.StatusNotFound)
+	spec.Route("GET /api/users/:id/processing-status", "getProcessingStatus", "Import and coverage progress").Tags("users").
+		Returns(http.StatusOK, "Counts so far", openapi.Object(map[string]*openapi.Schema{
+			"user_id":        openapi.Integer(),
+			"status":         openapi.String(),
+			"activity_count": openapi.Integer(),
+			"cities_count":   openapi.Integer(),
+			"coverage_count": openapi.Integer(),
+		}))
+	spec.Route("POST /api/users/:id/discover-cities", "discoverCities", "Find the cities a user has run in").Tags("users").
+		Returns(http.StatusOK, "Started", openapi.Object(map[string]*openapi.Schema{
+			"message": openapi.String(),
+			"user_id": openapi.Integer(),
+		}))
+	spec.Route("GET /api/users/:id/features", "getUserFeatures", "Features the granted Strava scopes allow").Tags("users").
+		Query("return_to", openapi.String(), false, "Frontend path for the reauthorize link to return to").
+		Returns(http.StatusOK, "Features", openapi.Object(map[string]*openapi.Schema{
+			"user_id":         openapi.Integer(),
+			"scopes":          openapi.ArrayOf(openapi.String()),
+			"features":        schemas.Of([]auth.Feature{}),
+			"reauthorize_url": openapi.String(),
+		})).
+		Errors(http.StatusNotFound)
+	spec.Route("GET /api/users/:id/export", "exportUserData", "Download everything stored about a user").Tags("users").
+		ReturnsContent(http.StatusOK, "A zip archive", "application/zip", openapi.String().WithFormat("binary"))
+	spec.Route("DELETE /api/users/:id", "deleteUser", "Delete a user and their data").Tags("users").
+		Returns(http.StatusOK, "Deleted", account.DeletionResult{}).
+		Errors(http.StatusNotFound)
+
+	// Cities
+	spec.Route("GET /api/cities/", "listCities", "List cities").Tags("cities").
+		Query("country_code", openapi.String(), false, "Only cities in this country").
+		With(paged(coverage.CityPages)).
+		Returns(http.StatusOK, "Cities", []coverage.City{})
+	spec.Route("POST /api/cities/", "createCity", "Add a city").Tags("cities").
+		Body(coverage.CreateCityRequest{}, true).
+		Returns(http.StatusCreated, "Created", openapi.Object(map[string]*openapi.Schema{
+			"id":      openapi.Integer(),
+			"message": openapi.String(),
+		})).
+		Errors(http.StatusBadRequest)
+	spec.Route("GET /api/cities/search", "searchCities", "Search cities by name").Tags("cities").
+		Query("q", openapi.String().MinLen(2), true, "Part of the name").
+		Returns(http.StatusOK, "Matching cities", []coverage.City{})
+	spec.Route("GET /api/cities/:id", "getCity", "Get a city").Tags("cities").
+		Returns(http.StatusOK, "The city", coverage.City{}).
+		Errors(http.StatusNotFound)
+	spec.Route("GET /api/cities/user/:userId", "listUserCities", "Cities a user has activities in").Tags("cities").
+		With(paged(coverage.CityPages)).
+		Returns(http.StatusOK, "Cities", []coverage.City{})
+	spec.Route("GET /api/cities/user/:userId/coverage", "listUserCitiesWithCoverage", "A user's cities with their coverage").Tags("cities").
+		With(paged(coverage.CityCoveragePages)).
+		Returns(http.StatusOK, "Cities", openapi.Object(map[string]*openapi.Schema{
+			"user_id":     openapi.Integer(),
+			"cities":      schemas.Of([]coverage.CityWithCoverage{}),
+			"count":       openapi.Integer(),
+			"total":       openapi.Integer(),
+			"next_cursor": openapi.String(),
+		}))
+
+	// Custom areas
+	spec.Route("GET /api/custom-areas/user/:userId", "listCustomAreas", "A user's custom areas").Tags("cities").
+		With(paged(coverage.CustomAreaPages)).
+		Returns(http.StatusOK, "Custom areas", []coverage.CustomAreaResponse{})
+	spec.Route("POST /api/custom-areas/user/:userId", "createCustomArea", "Draw a custom area").Tags("cities").
+		Body(coverage.CreateCustomAreaRequest{}, true).
+		Returns(http.StatusCreated, "Created", coverage.CustomAreaResponse{}).
+		Errors(http.StatusBadRequest)
+	spec.Route("GET /api/custom-areas/:id", "getCustomArea", "Get a custom area").Tags("cities").
+		Returns(http.StatusOK, "The custom area", coverage.CustomAreaResponse{}).
+		Errors(http.StatusNotFound)
+	spec.Route("PUT /api/custom-areas/:id", "updateCustomArea", "Redraw a custom area").Tags("cities").
+		Body(coverage.CreateCustomAreaRequest{}, true).
+		Returns(http.StatusOK, "Updated", coverage.CustomAreaResponse{}).
+		Errors(http.StatusBadRequest, http.StatusNotFound)
+	spec.Route("DELETE /api/custom-areas/:id", "deleteCustomArea", "Delete a custom area").Tags("cities").
+		Returns(http.StatusOK, "Deleted", message).
+		Errors(http.StatusNotFound)
+	spec.Route("POST /api/custom-areas/:id/calculate-coverage", "calculateCustomAreaCoverage", "Calculate a custom area's coverage").Tags("coverage").
+		Returns(http.StatusAccepted, "Started", openapi.MapOf(openapi.Any()))
+
+	// Coverage
+	spec.Route("POST /api/coverage/calculate/:activityId", "calculateActivityCoverage", "Calculate an activity's coverage").Tags("coverage").
+		Returns(http.StatusOK, "Coverage of the activity's city", coverage.CoverageResult{}).
+		Errors(http.StatusNotFound)
+	spec.Route("POST /api/coverage/recalculate-all", "recalculateAllCoverage", "Recalculate coverage of every activity").Tags("coverage").
+		Describe("Admins only").
+		Returns(http.StatusOK, "Job started", openapi.Object(map[string]*openapi.Schema{
+			"job_id":  openapi.String(),
+			"status":  openapi.String(),
+			"message": openapi.String(),
+		}))
+	spec.Route("GET /api/coverage/recalculate-status/:jobId", "getRecalculationStatus", "Progress of a recalculation").Tags("coverage").
+		Returns(http.StatusOK, "Progress", coverage.RecalculationStatus{}).
+		Errors(http.StatusNotFound)
+	spec.Route("GET /api/coverage/recalculate-status/:jobId/stream", "streamRecalculationStatus", "Follow a recalculation").Tags("coverage").
+		ReturnsContent(http.StatusOK, "Progress events", "text/event-stream", eventStream).
+		Errors(http.StatusNotFound)
+	spec.Route("GET /api/coverage/user/:userId/city/:cityId", "getUserCityCoverage", "A user's coverage of a city").Tags("coverage").
+		Returns(http.StatusOK, "Coverage", openapi.Object(map[string]*openapi.Schema{
+			"user_id":            openapi.Integer(),
+			"city_id":            openapi.Integer(),
+			"city_name":          openapi.String(),
+			"coverage_percent":   openapi.Number(),
+			"total_streets_km":   openapi.Number(),
+			"covered_streets_km": openapi.Number(),
+		})).
+		Errors(http.StatusNotFound)
+	spec.Route("GET /api/coverage/activity/:activityId", "getActivityCoverage", "An activity's coverage").Tags("coverage").
+		Returns(http.StatusOK, "Coverage, when it has been calculated", openapi.Object(map[string]*openapi.Schema{
+			"activity_id":      openapi.Integer().WithFormat("int64"),
+			"city_id":          openapi.Integer(),
+			"city_name":        openapi.String(),
+			"coverage_percent": openapi.Number(),
+		}).Optional("city_id", "city_name", "coverage_percent"))
+	spec.Route("GET /api/coverage/activity/:activityId/streams", "getActivityStreams", "Statistics of an activity's streams").Tags("coverage").
+		Query("min_speed_kmh", openapi.Number().Min(0), false, "Ignore points slower than this").
+		Query("max_speed_kmh", openapi.Number().Min(0), false, "Ignore points faster than this").
+		Returns(http.StatusOK, "Stream statistics", openapi.Object(map[string]*openapi.Schema{
+			"activity_id":          openapi.Integer().WithFormat("int64"),
+			"has_time":             openapi.Boolean(),
+			"has_altitude":         openapi.Boolean(),
+			"has_distance":         openapi.Boolean(),
+			"stats":                schemas.Of(coverage.StreamStats{}),
+			"speed_filtered_stats": schemas.Of(coverage.StreamStats{}),
+			"city_first_reached": openapi.Object(map[string]*openapi.Schema{
+				"city_id":    openapi.Integer(),
+				"city_name":  openapi.String(),
+				"reached_at": openapi.String().WithFormat("date-time"),
+			}),
+			"streets_first_reached": schemas.Of([]storage.StreetReached{}),
+			"tiles_first_reached":   schemas.Of([]storage.TileReached{}),
+		}).Optional("speed_filtered_stats", "city_first_reached")).
+		Errors(http.StatusNotFound)
+
+	// Activities
+	spec.Route("GET /api/activities/user/:userId", "listUserActivities", "A user's activity history").Tags("activities").
+		With(activityFilters(true), paged(coverage.ActivityPages)).
+		Returns(http.StatusOK, "Activities", openapi.Object(map[string]*openapi.Schema{
+			"user_id":     openapi.Integer(),
+			"activities":  schemas.Of([]coverage.ActivitySummary{}),
+			"count":       openapi.Integer(),
+			"total":       openapi.Integer(),
+			"next_cursor": openapi.String(),
+		}))
+
+	// Maps
+	spec.Route("GET /api/maps/cities", "getCitiesGeoJSON", "City boundaries").Tags("maps").
+		Returns(http.StatusOK, "Feature collection", geoJSON)
+	spec.Route("GET /api/maps/cities/:cityId", "getCityGeoJSON", "A city's boundary").Tags("maps").
+		Returns(http.StatusOK, "Feature collection", geoJSON).
+		Errors(http.StatusNotFound)
+	spec.Route("GET /api/maps/activities/user/:userId", "getUserActivitiesGeoJSON", "A user's activity routes").Tags("maps").
+		With(activityFilters(true), paged(coverage.ActivityMapPages)).
+		Returns(http.StatusOK, "Feature collection", geoJSON)
+	spec.Route("GET /api/maps/activities/user/:userId/city/:cityId", "getUserCityActivitiesGeoJSON", "A user's activity routes in a city").Tags("maps").
+		With(activityFilters(false), paged(coverage.ActivityMapPages)).
+		Returns(http.StatusOK, "Feature collection", geoJSON)
+	spec.Route("GET /api/maps/coverage/user/:userId/city/:cityId", "getCoverageGeoJSON", "Covered and uncovered streets").Tags("maps").
+		Returns(http.StatusOK, "Feature collection", geoJSON)
+	spec.Route("GET /api/maps/config", "getMapConfig", "Tile servers and layers").Tags("maps").
+		Returns(http.StatusOK, "Map configuration", coverage.MapConfig{})
+	spec.Route("GET /api/maps/styles", "getMapStyles", "Styles for map layers").Tags("maps").
+		Returns(http.StatusOK, "Styles", openapi.MapOf(openapi.Any()))
+	spec.Route("GET /api/maps/bounds/city/:cityId", "getCityBounds", "A city's bounding box").Tags("maps").
+		Returns(http.StatusOK, "Bounds", coverage.Bounds{}).
+		Errors(http.StatusNotFound)
+	spec.Route("GET /api/maps/bounds/user/:userId", "getUserActivityBounds", "The bounding box of a user's activities").Tags("maps").
+		Returns(http.StatusOK, "Bounds", coverage.Bounds{})
+
+	// Import
+	spec.Route("POST /api/import_activity/:id", "importActivity", "Import one Strava activity").Tags("import").
+		Query("user_id", openapi.ID().Describe("Strava athlete ID"), true, "").
+		Returns(http.StatusOK, "Imported", openapi.Object(map[string]*openapi.Schema{
+			"message":    openapi.String(),
+			"has_path":   openapi.Boolean(),
+			"linestring": openapi.String(),
+		}).Optional("linestring")).
+		Errors(http.StatusBadGateway)
+	spec.Route("POST /api/import/initial/:userId", "startInitialImport", "Import a user's Strava history").Tags("import").
+		Returns(http.StatusAccepted, "Started", openapi.MapOf(openapi.Any()))
+	spec.Route("POST /api/import/backfill-metadata/:userId", "backfillMetadata", "Fetch missing activity details").Tags("import").
+		Returns(http.StatusAccepted, "Started", openapi.MapOf(openapi.Any()))
+	spec.Route("POST /api/import/process-imported/:userId", "processImported", "Calculate coverage of imported activities").Tags("import").
+		Returns(http.StatusAccepted, "Started", openapi.MapOf(openapi.Any()))
+	spec.Route("GET /api/import/status/:userId", "getImportStatus", "Progress of an import").Tags("import").
+		Returns(http.StatusOK, "Progress", coverage.ImportStatus{})
+
+	// Automation
+	spec.Route("GET /api/automation/webhook", "validateStravaWebhook", "Strava's subscription check").Tags("automation").
+		Query("hub.mode", openapi.String(), false, "").
+		Query("hub.verify_token", openapi.String(), false, "").
+		Query("hub.challenge", openapi.String(), false, "").
+		Returns(http.StatusOK, "The challenge echoed", openapi.Object(map[string]*openapi.Schema{"hub.challenge": openapi.String()})).
+		Errors(http.StatusForbidden)
+	spec.Route("POST /api/automation/webhook", "receiveStravaWebhook", "An event pushed by Strava").Tags("automation").
+		Body(coverage.StravaWebhookEvent{}, true).
+		Returns(http.StatusOK, "Recorded", openapi.Object(map[string]*openapi.Schema{
+			"message":  openapi.String(),
+			"event_id": openapi.Integer().WithFormat("int64"),
+		}).Optional("event_id")).
+		Errors(http.StatusForbidden)
+	spec.Route("POST /api/automation/process-user/:userId", "processUserActivities", "Calculate coverage of all a user's activities").Tags("automation").
+		Returns(http.StatusAccepted, "Started", message)
+	spec.Route("POST /api/automation/sync-recent/:userId", "syncRecentActivities", "Import a user's latest activities").Tags("automation").
+		Returns(http.StatusOK, "Synced", openapi.Object(map[string]*openapi.Schema{
+			"message":  openapi.String(),
+			"imported": openapi.Integer(),
+			"skipped":  openapi.Integer(),
+			"failed":   openapi.Integer(),
+			"total":    openapi.Integer(),
+		}))
+	spec.Route("GET /api/admin/webhook-events", "listWebhookEvents", "Strava events received").Tags("admin").
+		Query("status", openapi.String().OneOf("received", "processing", "processed", "skipped", "failed"), false, "").
+		With(paged(storage.WebhookEventPages)).
+		Returns(http.StatusOK, "Events, newest first", openapi.Object(map[string]*openapi.Schema{
+			"events":      schemas.Of([]storage.WebhookEvent{}),
+			"count":       openapi.Integer(),
+			"total":       openapi.Integer(),
+			"next_cursor": openapi.String(),
+		}))
+	spec.Route("GET /api/admin/webhook-events/:eventId", "getWebhookEvent", "A Strava event").Tags("admin").
+		Returns(http.StatusOK, "The event", storage.WebhookEvent{}).
+		Errors(http.StatusNotFound)
+	spec.Route("POST /api/admin/webhook-events/:eventId/replay", "replayWebhookEvent", "Process a Strava event again").Tags("admin").
+		Returns(http.StatusAccepted, "Queued", openapi.Object(map[string]*openapi.Schema{
+			"message":  openapi.String(),
+			"event_id": openapi.Integer().WithFormat("int64"),
+			"attempts": openapi.Integer(),
+		})).
+		Errors(http.StatusNotFound, http.StatusConflict)
+
+	// City detection and multi-city coverage
+	spec.Route("POST /api/detection/find-cities/:activityId", "findActivityCities", "Cities an activity passes through").Tags("cities").
+		Returns(http.StatusOK, "Cities", coverage.ActivityCityResult{}).
+		Errors(http.StatusNotFound)
+	spec.Route("GET /api/detection/nearby-cities", "findNearbyCities", "Cities near a point").Tags("cities").
+		Query("lat", openapi.Number().Min(-90).Max(90), true, "").
+		Query("lng", openapi.Number().Min(-180).Max(180), true, "").
+		Query("radius", openapi.Number().Min(0), false, "Kilometres, 50 by default").
+		Returns(http.StatusOK, "Cities, nearest first", openapi.Object(map[string]*openapi.Schema{
+			"coordinate": openapi.MapOf(openapi.Number()),
+			"radius_km":  openapi.Number(),
+			"cities": openapi.ArrayOf(openapi.Object(map[string]*openapi.Schema{
+				"id":           openapi.Integer(),
+				"name":         openapi.String(),
+				"country_code": openapi.String(),
+				"distance_km":  openapi.Number(),
+			})),
+		}))
+	spec.Route("POST /api/detection/auto-detect/:userId", "autoDetectUserCities", "Assign cities to a user's activities").Tags("cities").
+		Returns(http.StatusOK, "Detected", openapi.Object(map[string]*openapi.Schema{
+			"user_id":            openapi.Integer(),
+			"cities":             openapi.Any(),
+			"updated_activities": openapi.Integer(),
+			"message":            openapi.String(),
+		}))
+	spec.Route("GET /api/multi-coverage/user/:userId/summary", "getUserCoverageSummary", "A user's coverage across cities").Tags("coverage").
+		Returns(http.StatusOK, "Summary", coverage.UserCoverageSummary{})
+	spec.Route("GET /api/multi-coverage/user/:userId/leaderboard", "getUserCityLeaderboard", "A city's leaderboard around a user").Tags("coverage").
+		Query("city_id", openapi.ID(), true, "").
+		Query("limit", limit, false, "").
+		Returns(http.StatusOK, "Leaderboard", openapi.Object(map[string]*openapi.Schema{
+			"city_id":       openapi.Integer(),
+			"user_rank":     openapi.Integer(),
+			"leaderboard":   schemas.Of([]coverage.CityLeaderboardEntry{}),
+			"total_entries": openapi.Integer(),
+		}))
+	spec.Route("POST /api/multi-coverage/calculate-all/:userId", "calculateAllUserCoverage", "Calculate a user's coverage of every city").Tags("coverage").
+		Returns(http.StatusOK, "Calculated", openapi.Object(map[string]*openapi.Schema{
+			"user_id": openapi.Integer(),
+			"message": openapi.String(),
+			"cities":  openapi.Any(),
+		}))
+	spec.Route("GET /api/multi-coverage/global/leaderboard", "getGlobalLeaderboard", "Users with the most coverage").Tags("coverage").
+		Query("limit", limit, false, "").
+		Returns(http.StatusOK, "Leaderboard", openapi.Object(map[string]*openapi.Schema{
+			"global_leaderboard": openapi.ArrayOf(openapi.MapOf(openapi.Any())),
+			"total_entries":      openapi.Integer(),
+		}))
+	spec.Route("GET /api/multi-coverage/city/:cityId/stats", "getCityStats", "Coverage statistics of a city").Tags("coverage").
+		Returns(http.StatusOK, "Statistics", coverage.CityStats{}).
+		Errors(http.StatusNotFound)
+
+	// Comments
+	spec.Route("POST /api/comments/post/:activityId", "postCoverageComment", "Comment an activity's coverage on Strava").Tags("comments").
+		Returns(http.StatusOK, "Posted", openapi.MapOf(openapi.Any())).
+		Returns(http.StatusAccepted, "Queued", openapi.MapOf(openapi.Any()))
+	spec.Route("POST /api/comments/post-all/:userId", "postAllUncommented", "Comment every activity not yet commented").Tags("comments").
+		Returns(http.StatusOK, "Results", openapi.Object(map[string]*openapi.Schema{
+			"message":       openapi.String(),
+			"success_count": openapi.Integer(),
+			"queued_count":  openapi.Integer(),
+			"fail_count":    openapi.Integer(),
+			"results":       schemas.Of([]*notify.Result{}),
+		}))
+	spec.Route("GET /api/comments/settings/user/:userId", "getCommentSettings", "A user's comment settings").Tags("comments").
+		Returns(http.StatusOK, "Settings", openapi.Object(map[string]*openapi.Schema{
+			"settings": schemas.Of(comments.CommentSettings{}),
+		}))
+	spec.Route("PUT /api/comments/settings/user/:userId", "updateCommentSettings", "Change a user's comment settings").Tags("comments").
+		Body(comments.CommentSettings{}, true).
+		Returns(http.StatusOK, "Updated", openapi.Object(map[string]*openapi.Schema{
+			"message":  openapi.String(),
+			"settings": schemas.Of(comments.CommentSettings{}),
+		}))
+	spec.Route("GET /api/comments/triggers/user/:userId", "getCommentTriggers", "When comments are posted").Tags("comments").
+		Returns(http.StatusOK, "Triggers", openapi.Object(map[string]*openapi.Schema{
+			"triggers": schemas.Of([]comments.CommentTrigger{}),
+		}))
+	spec.Route("PUT /api/comments/triggers/user/:userId", "updateCommentTriggers", "Change when comments are posted").Tags("comments").
+		Body(comments.UpdateCommentTriggersRequest{}, true).
+		Returns(http.StatusOK, "Updated", openapi.Object(map[string]*openapi.Schema{
+			"message":  openapi.String(),
+			"triggers": schemas.Of([]comments.CommentTrigger{}),
+		}))
+	spec.Route("POST /api/comments/settings/:userId/preview", "previewComment", "Render a comment template").Tags("comments").
+		Body(comments.PreviewCommentRequest{}, false).
+		Returns(http.StatusOK, "The rendered comment", openapi.Object(map[string]*openapi.Schema{
+			"comment":     openapi.String(),
+			"template":    openapi.String(),
+			"activity_id": openapi.Integer().WithFormat("int64"),
+			"variables":   openapi.MapOf(openapi.Any()),
+		})).
+		Errors(http.StatusNotFound)
+	spec.Route("POST /api/comments/process/user/:userId", "processComments", "Post comments a user's triggers call for").Tags("comments").
+		Returns(http.StatusOK, "Started", openapi.Object(map[string]*openapi.Schema{
+			"message": openapi.String(),
+			"user_id": openapi.Integer(),
+		}))
+	spec.Route("GET /api/comments/history/user/:userId", "getCommentHistory", "Comments sent and queued").Tags("comments").
+		Query("status", openapi.String().OneOf("pending", "sending", "sent", "failed", "dry_run"), false, "").
+		With(paged(storage.OutboxPages)).
+		Returns(http.StatusOK, "History, newest first", openapi.Object(map[string]*openapi.Schema{
+			"history":     schemas.Of([]storage.OutboxEntry{}),
+			"count":       openapi.Integer(),
+			"total":       openapi.Integer(),
+			"next_cursor": openapi.String(),
+		}))
+	spec.Route("GET /api/comments/increases/user/:userId", "getCoverageIncreases", "Recent coverage increases").Tags("comments").
+		Returns(http.StatusOK, "Increases", openapi.Object(map[string]*openapi.Schema{
+			"increases": schemas.Of([]comments.CoverageIncrease{}),
+			"count":     openapi.Integer(),
+			"user_id":   openapi.Integer(),
+		}))
+
+	// Digest
+	spec.Route("GET /api/digest/user/:userId/settings", "getDigestSettings", "A user's digest subscription").Tags("digest").
+		Returns(http.StatusOK, "Settings", openapi.Object(map[string]*openapi.Schema{
+			"settings":       schemas.Of(storage.DigestSubscription{}),
+			"smtp_available": openapi.Boolean(),
+		}))
+	spec.Route("PUT /api/digest/user/:userId/settings", "updateDigestSettings", "Change a user's digest subscription").Tags("digest").
+		Body(digest.UpdateSettingsRequest{}, true).
+		Returns(http.StatusOK, "Updated", openapi.Object(map[string]*openapi.Schema{
+			"settings": schemas.Of(storage.DigestSubscription{}),
+		})).
+		Errors(http.StatusNotFound)
+	spec.Route("GET /api/digest/user/:userId/preview", "previewDigest", "Render the next digest").Tags("digest").
+		Query("format", openapi.String().OneOf("html", "text", "json"), false, "html by default").
+		ReturnsContent(http.StatusOK, "The digest", "text/html", openapi.String())
+	spec.Route("POST /api/digest/user/:userId/send", "sendDigest", "Send the digest now").Tags("digest").
+		Returns(http.StatusOK, "Sent", openapi.Object(map[string]*openapi.Schema{
+			"sent":    openapi.Boolean(),
+			"message": openapi.String(),
+		})).
+		Errors(http.StatusBadGateway, http.StatusServiceUnavailable)
+	spec.Route("GET /api/digest/unsubscribe", "unsubscribePage", "Unsubscribe link from a digest email").Tags("digest").
+		Query("token", openapi.String(), true, "").
+		ReturnsContent(http.StatusOK, "Confirmation page", "text/html", openapi.String())
+	spec.Route("POST /api/digest/unsubscribe", "unsubscribe", "One-click unsubscribe").Tags("digest").
+		Query("token", openapi.String(), true, "").
+		Returns(http.StatusOK, "Unsubscribed", message).
+		Errors(http.StatusBadRequest)
+
+	// Progress
+	spec.Route("GET /api/progress/user/:userId/stream", "streamUserProgress", "Follow a user's imports and calculations").Tags("users").
+		Query("last_event_id", openapi.String(), false, "Resume after this event").
+		ReturnsContent(http.StatusOK, "Progress events", "text/event-stream", eventStream)
+
+	// Outgoing webhooks
+	endpoint := openapi.Object(map[string]*openapi.Schema{"endpoint": schemas.Of(storage.WebhookEndpoint{})})
+	endpoints := openapi.Object(map[string]*openapi.Schema{
+		"endpoints": schemas.Of([]storage.WebhookEndpoint{}),
+		"count":     openapi.Integer(),
+	})
+	created := openapi.Object(map[string]*openapi.Schema{
+		"endpoint": schemas.Of(storage.WebhookEndpoint{}),
+		"secret":   openapi.String().Describe("Only shown here and on rotation"),
+	})
+	spec.Route("GET /api/webhooks/endpoints/user/:userId", "listWebhookEndpoints", "A user's webhook endpoints").Tags("webhooks").
+		Returns(http.StatusOK, "Endpoints", endpoints)
+	spec.Route("POST /api/webhooks/endpoints/user/:userId", "createWebhookEndpoint", "Register a webhook endpoint").Tags("webhooks").
+		Body(webhooks.CreateEndpointRequest{}, true).
+		Returns(http.StatusCreated, "Registered", created).
+		Errors(http.StatusNotFound)
+	spec.Route("GET /api/webhooks/endpoints/:id", "getWebhookEndpoint", "Get a webhook endpoint").Tags("webhooks").
+		Returns(http.StatusOK, "The endpoint", endpoint).
+		Errors(http.StatusNotFound)
+	spec.Route("PUT /api/webhooks/endpoints/:id", "updateWebhookEndpoint", "Change a webhook endpoint").Tags("webhooks").
+		Body(webhooks.UpdateEndpointRequest{}, true).
+		Returns(http.StatusOK, "Updated", endpoint).
+		Errors(http.StatusNotFound)
+	spec.Route("DELETE /api/webhooks/endpoints/:id", "deleteWebhookEndpoint", "Delete a webhook endpoint").Tags("webhooks").
+		Returns(http.StatusOK, "Deleted", message).
+		Errors(http.StatusNotFound)
+	spec.Route("POST /api/webhooks/endpoints/:id/rotate-secret", "rotateWebhookSecret", "Replace an endpoint's signing secret").Tags("webhooks").
+		Body(webhooks.RotateSecretRequest{}, false).
+		Returns(http.StatusOK, "The new secret", openapi.Object(map[string]*openapi.Schema{
+			"secret":                     openapi.String(),
+			"previous_secret_expires_at": openapi.String().WithFormat("date-time"),
+		})).
+		Errors(http.StatusNotFound)
+	spec.Route("GET /api/webhooks/endpoints/:id/deliveries", "listWebhookDeliveries", "An endpoint's delivery log").Tags("webhooks").
+		Query("status", openapi.String().OneOf("pending", "sending", "delivered", "failed"), false, "").
+		With(paged(storage.WebhookDeliveryPages)).
+		Returns(http.StatusOK, "Deliveries, newest first", openapi.Object(map[string]*openapi.Schema{
+			"deliveries":  schemas.Of([]storage.WebhookDelivery{}),
+			"count":       openapi.Integer(),
+			"total":       openapi.Integer(),
+			"next_cursor": openapi.String(),
+		})).
+		Errors(http.StatusNotFound)
+	spec.Route("POST /api/webhooks/endpoints/:id/ping", "pingWebhookEndpoint", "Send a ping event now").Tags("webhooks").
+		Returns(http.StatusOK, "The delivery", openapi.Object(map[string]*openapi.Schema{
+			"delivered": openapi.Boolean(),
+			"delivery":  schemas.Of(storage.WebhookDelivery{}),
+		})).
+		Errors(http.StatusNotFound)
+	spec.Route("POST /api/webhooks/deliveries/:deliveryId/redeliver", "redeliverWebhook", "Send a delivery again").Tags("webhooks").
+		Returns(http.StatusAccepted, "Queued", message).
+		Errors(http.StatusNotFound, http.StatusConflict)
+	spec.Route("GET /api/admin/webhooks/endpoints", "listAdminWebhookEndpoints", "Operator webhook endpoints").Tags("admin").
+		Returns(http.StatusOK, "Endpoints", endpoints)
+	spec.Route("POST /api/admin/webhooks/endpoints", "createAdminWebhookEndpoint", "Register an operator webhook endpoint").Tags("admin").
+		Body(webhooks.CreateEndpointRequest{}, true).
+		Returns(http.StatusCreated, "Registered", created)
+
+	// Admin
+	features := openapi.MapOf(openapi.Boolean()).Describe("Whether each feature is on: " + strings.Join(storage.UserFeatures, ", "))
+	spec.Route("GET /api/admin/users", "adminListUsers", "Find users").Tags("admin").
+		Query("q", openapi.String(), false, "Part of the name or email, or the Strava athlete ID").
+		Query("role", openapi.String().OneOf(roles...), false, "").
+		With(paged(storage.UserPages)).
+		Returns(http.StatusOK, "Users", openapi.Object(map[string]*openapi.Schema{
+			"users":       schemas.Of([]storage.AdminUser{}),
+			"count":       openapi.Integer(),
+			"total":       openapi.Integer(),
+			"next_cursor": openapi.String(),
+		}))
+	spec.Route("GET /api/admin/users/:userId", "adminGetUser", "A user with their features").Tags("admin").
+		Returns(http.StatusOK, "The user", openapi.Object(map[string]*openapi.Schema{
+			"user":     schemas.Of(storage.AdminUser{}),
+			"features": features,
+		})).
+		Errors(http.StatusNotFound)
+	spec.Route("PUT /api/admin/users/:userId/role", "adminSetRole", "Change a user's role").Tags("admin").
+		Body(admin.SetRoleRequest{}, true).
+		Returns(http.StatusOK, "Changed", openapi.Object(map[string]*openapi.Schema{
+			"user_id": openapi.Integer(),
+			"role":    openapi.String(),
+		})).
+		Errors(http.StatusNotFound)
+	spec.Route("PUT /api/admin/users/:userId/features", "adminSetFeatures", "Switch features on or off for a user").Tags("admin").
+		Body(features, true).
+		Returns(http.StatusOK, "Every feature after the change", openapi.Object(map[string]*openapi.Schema{
+			"user_id":  openapi.Integer(),
+			"features": features,
+		})).
+		Errors(http.StatusNotFound)
+	spec.Route("POST /api/admin/users/:userId/import", "adminStartImport", "Import a user's Strava history").Tags("admin").
+		Query("force", openapi.Boolean(), false, "Restart an import still marked in progress").
+		Returns(http.StatusAccepted, "Started", openapi.Object(map[string]*openapi.Schema{
+			"message": openapi.String(),
+			"user_id": openapi.Integer(),
+		})).
+		Errors(http.StatusNotFound, http.StatusConflict)
+	spec.Route("POST /api/admin/users/:userId/recalculate", "adminRecalculateUser", "Recalculate coverage of a user's activities").Tags("admin").
+		Returns(http.StatusAccepted, "Job started", openapi.Object(map[string]*openapi.Schema{
+			"job_id":  openapi.String(),
+			"user_id": openapi.Integer(),
+			"message": openapi.String(),
+		})).
+		Errors(http.StatusNotFound)
+	spec.Route("DELETE /api/admin/users/:userId", "adminDeleteUser", "Delete a user and their data").Tags("admin").
+		Returns(http.StatusOK, "Deleted", account.DeletionResult{}).
+		Errors(http.StatusNotFound)
+	spec.Route("PUT /api/admin/cities/:cityId", "adminUpdateCity", "Change a city").Tags("admin").
+		Body(admin.UpdateCityRequest{}, true).
+		Returns(http.StatusOK, "Updated", openapi.Object(map[string]*openapi.Schema{
+			"id":      openapi.Integer(),
+			"message": openapi.String(),
+		})).
+		Errors(http.StatusNotFound)
+	spec.Route("POST /api/admin/cities/:cityId/merge", "adminMergeCity", "Fold a city into another").Tags("admin").
+		Body(admin.MergeCityRequest{}, true).
+		Returns(http.StatusOK, "Merged", openapi.Object(map[string]*openapi.Schema{
+			"city_id":          openapi.Integer(),
+			"merged_city_id":   openapi.Integer(),
+			"activities_moved": openapi.Integer(),
+			"message":          openapi.String(),
+		})).
+		Errors(http.StatusNotFound)
+	spec.Route("DELETE /api/admin/cities/:cityId", "adminDeleteCity", "Delete a city, keeping its activities").Tags("admin").
+		Returns(http.StatusOK, "Deleted", openapi.Object(map[string]*openapi.Schema{
+			"city_id":               openapi.Integer(),
+			"activities_unassigned": openapi.Integer(),
+			"message":               openapi.String(),
+		})).
+		Errors(http.StatusNotFound)
+	spec.Route("GET /api/admin/jobs", "adminListJobs", "Background work").Tags("admin").
+		Returns(http.StatusOK, "Recalculations, running imports and queues by status", openapi.Object(map[string]*openapi.Schema{
+			"recalculations": schemas.Of([]coverage.RecalculationStatus{}),
+			"imports":        schemas.Of([]storage.RunningImport{}),
+			"queues":         openapi.MapOf(openapi.MapOf(openapi.Integer())),
+		}))
+
+	spec.Public(publicRoutes...)
+	return spec
+}
+
+// paged adds the ?limit=, ?sort= and ?cursor= of a paginated list
+func paged(opts pagination.Options) func(*openapi.OperationBuilder) {
+	var sorts []interface{}
+	for _, name := range pagination.SortNames(opts) {
+		sorts = append(sorts, name, "-"+name)
+	}
+	return func(b *openapi.OperationBuilder) {
+		b.Query("limit", openapi.Integer().Min(1), false, fmt.Sprintf("%d by default, at most %d", opts.DefaultLimit, opts.MaxLimit)).
+			Query("sort", openapi.String().OneOf(sorts...), false, fmt.Sprintf("- for descending, %s by default", opts.Default)).
+			Query("cursor", openapi.String(), false, "The next_cursor of the previous page")
+	}
+}
+
+// activityFilters adds the filters of activity lists. city_id is left out where the
+// path names the city.
+func activityFilters(cityID bool) func(*openapi.OperationBuilder) {
+	return func(b *openapi.OperationBuilder) {
+		b.Query("from", openapi.String(), false, "Started on or after this date (YYYY-MM-DD) or time (RFC 3339)").
+			Query("to", openapi.String(), false, "Started on or before this date or time").
+			Query("sport_type", openapi.String(), false, "Comma-separated sport types, such as Run,Ride").
+			Query("min_distance_km", openapi.Number().Min(0), false, "")
+		if cityID {
+			b.Query("city_id", openapi.ID(), false, "Only activities in this city")
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/middleware"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+// newRateLimiter builds the limiter configured by RATE_LIMIT_*. It returns nil when rate
+// limiting is off.
+func newRateLimiter(cfg *config.Config, db *storage.DB) *middleware.RateLimiter {
+	if cfg.RateLimitPerMinute <= 0 {
+		return nil
+	}
+
+	var store middleware.BucketStore
+	switch cfg.RateLimitStore {
+	case "postgres":
+		store = db
+	case "", "memory":
+		store = middleware.NewMemoryBuckets()
+	default:
+		slog.Warn("Unknown RATE_LIMIT_STORE, keeping rate limits in memory", "store", cfg.RateLimitStore)
+		store = middleware.NewMemoryBuckets()
+	}
+
+	limiter := middleware.NewRateLimiter(store, cfg.RateLimitPerMinute, cfg.RateLimitBurst)
+	limiter.Cost(cfg.RateLimitExternalCost, cfg.RateLimitExternalRoutes...)
+	limiter.Cost(cfg.RateLimitHeavyCost, cfg.RateLimitHeavyRoutes...)
+	limiter.Exempt(cfg.RateLimitExemptRoutes...)
+	return limiter
+}
+
+// unknownRateLimitRoutes lists the configured rate limit routes that are not registered,
+// which a typo in RATE_LIMIT_*_ROUTES would otherwise leave at the standard cost unnoticed
+func unknownRateLimitRoutes(cfg *config.Config, routes gin.RoutesInfo) []string {
+	registered := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		registered[route.Method+" "+route.Path] = true
+	}
+
+	var unknown []string
+	for _, list := range [][]string{cfg.RateLimitExternalRoutes, cfg.RateLimitHeavyRoutes, cfg.RateLimitExemptRoutes} {
+		for _, route := range list {
+			if !registered[route] {
+				unknown = append(unknown, route)
+			}
+		}
+	}
+	return unknown
+}
+
+// pruneRateLimitBuckets deletes shared buckets nobody has drawn from for a day
+func pruneRateLimitBuckets(ctx context.Context, db *storage.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pruned, err := db.PruneRateLimitBuckets(time.Now().Add(-24 * time.Hour))
+			if err != nil {
+				slog.Error("Failed to prune rate limit buckets", "error", err)
+			} else if pruned > 0 {
+				slog.Debug("Pruned idle rate limit buckets", "buckets", pruned)
+			}
+		}
+	}
+}
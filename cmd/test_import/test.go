@@ -93,10 +93,11 @@ func testImportStatus(db *storage.DB, userIDStr string) {
 		fmt.Printf("   - Failed: %d\n", failed)
 	}
 
-	fmt.Printf("\n🚀 To start initial import, make a POST request to:\n")
-	fmt.Printf("   curl -X POST http://localhost:8080/api/import/initial/%s\n", userIDStr)
+	fmt.Printf("\n🚀 To start initial import, sign in as the user and make a POST request with the\n")
+	fmt.Printf("   strava_coverage_session cookie value as SESSION:\n")
+	fmt.Printf("   curl -X POST -H \"Authorization: Bearer $SESSION\" http://localhost:8080/api/import/initial/%s\n", userIDStr)
 	fmt.Printf("\n📊 To check progress:\n")
-	fmt.Printf("   curl http://localhost:8080/api/import/status/%s\n", userIDStr)
+	fmt.Printf("   curl -H \"Authorization: Bearer $SESSION\" http://localhost:8080/api/import/status/%s\n", userIDStr)
 }
 
 func listUsers(db *storage.DB) {
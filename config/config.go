@@ -1,17 +1,135 @@
 package config
 
 import (
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
+// Default Strava endpoints, overridable to point the server at a local fake (cmd/fakestrava)
+const (
+	DefaultStravaAPIURL   = "https://www.strava.com/api/v3"
+	DefaultStravaOAuthURL = "https://www.strava.com/oauth"
+)
+
+// Default rate limit cost classes. Routes are given as "METHOD /path" the way they are
+// registered; every other route costs 1 token.
+const (
+	// DefaultRateLimitExternalCost is the cost of routes calling Strava or Nominatim,
+	// whose own limits are shared by every user
+	DefaultRateLimitExternalCost = 5
+	// DefaultRateLimitHeavyCost is the cost of coverage calculations over whole cities
+	DefaultRateLimitHeavyCost = 20
+)
+
+var (
+	// DefaultRateLimitExternalRoutes call Strava or Nominatim on the caller's behalf
+	DefaultRateLimitExternalRoutes = []string{
+		"GET /api/cities/search",
+		"POST /api/import_activity/:id",
+		"POST /api/import/initial/:userId",
+		"POST /api/import/backfill-metadata/:userId",
+		"POST /api/automation/sync-recent/:userId",
+		"POST /api/comments/post/:activityId",
+		"POST /api/comments/post-all/:userId",
+		"POST /api/admin/users/:userId/import",
+	}
+
+	// DefaultRateLimitHeavyRoutes calculate coverage over whole cities or every activity
+	// of a user
+	DefaultRateLimitHeavyRoutes = []string{
+		"GET /api/maps/coverage/user/:userId/city/:cityId",
+		"POST /api/custom-areas/:id/calculate-coverage",
+		"POST /api/coverage/recalculate-all",
+		"POST /api/multi-coverage/calculate-all/:userId",
+		"POST /api/automation/process-user/:userId",
+		"POST /api/import/process-imported/:userId",
+		"POST /api/detection/auto-detect/:userId",
+		"POST /api/admin/users/:userId/recalculate",
+	}
+
+	// DefaultRateLimitExemptRoutes take no tokens: Strava delivers webhook events from a
+	// few addresses in bursts, health checks come from the load balancer and metrics from
+	// the scraper
+	DefaultRateLimitExemptRoutes = []string{
+		"GET /api/health",
+		"GET /metrics",
+		"GET /api/automation/webhook",
+		"POST /api/automation/webhook",
+	}
+)
+
 type Config struct {
 	StravaClientID     string
 	StravaClientSecret string
 	StravaRedirectURI  string
+	StravaAPIURL       string
+	StravaOAuthURL     string
 	DBUrl              string
 	FrontendURL        string
+
+	// StravaWebhookSubscriptionID is the push subscription whose events are accepted;
+	// events naming another subscription are rejected. While unset every event is accepted.
+	StravaWebhookSubscriptionID int64
+
+	// ActivityWatchDir, when set, is polled for GPX/FIT files in per-user folders (<dir>/<userID>/)
+	ActivityWatchDir      string
+	ActivityWatchInterval time.Duration
+
+	// CommentDryRun renders and records every notification without delivering any
+	CommentDryRun bool
+
+	// WebhookAllowLocal lets outbound webhook endpoints use plain HTTP to loopback addresses,
+	// for development only; otherwise endpoints must be HTTPS to public addresses
+	WebhookAllowLocal bool
+
+	// PublicURL is the externally reachable base URL of this API, used for links in emails
+	PublicURL string
+
+	// SMTP server the weekly digest is sent through; digests are off while SMTPHost is empty
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+
+	// SessionSecret signs session tokens; without it sessions end when the server restarts
+	SessionSecret string
+	SessionTTL    time.Duration
+
+	// TokenEncryptionKeys and the file named by TokenEncryptionKeyFile hold the versioned
+	// keys Strava tokens are encrypted with; without any, tokens are stored in plaintext
+	TokenEncryptionKeys    string
+	TokenEncryptionKeyFile string
+
+	// RateLimitPerMinute is how many standard requests a user or IP may make a minute, in
+	// bursts of up to RateLimitBurst; zero, the default, turns rate limiting off.
+	// RateLimitStore is "memory", or "postgres" to share limits between instances.
+	RateLimitPerMinute int
+	RateLimitBurst     int
+	RateLimitStore     string
+
+	// RateLimitExternalRoutes cost RateLimitExternalCost tokens and RateLimitHeavyRoutes
+	// RateLimitHeavyCost; RateLimitExemptRoutes cost nothing and every other route 1
+	RateLimitExternalCost   float64
+	RateLimitExternalRoutes []string
+	RateLimitHeavyCost      float64
+	RateLimitHeavyRoutes    []string
+	RateLimitExemptRoutes   []string
+
+	// TrustedProxies are the proxies whose X-Forwarded-For is believed when working out
+	// client IPs; without any, the connecting address is the client
+	TrustedProxies []string
+
+	// LogLevel is the least severe level logged, and LogFormat "json" or "text". Lines
+	// about the users in LogDebugUsers are logged from the debug level whatever LogLevel is.
+	LogLevel      slog.Level
+	LogFormat     string
+	LogDebugUsers []int
 }
 
 func Load() *Config {
@@ -20,11 +138,150 @@ func Load() *Config {
 	if frontendURL == "" {
 		frontendURL = "http://localhost:3000" // Default for local development
 	}
+	watchInterval, err := time.ParseDuration(os.Getenv("ACTIVITY_WATCH_INTERVAL"))
+	if err != nil || watchInterval <= 0 {
+		watchInterval = 30 * time.Second
+	}
+	subscriptionID, _ := strconv.ParseInt(os.Getenv("STRAVA_WEBHOOK_SUBSCRIPTION_ID"), 10, 64)
+	dryRun, _ := strconv.ParseBool(os.Getenv("COMMENT_DRY_RUN"))
+	webhookAllowLocal, _ := strconv.ParseBool(os.Getenv("WEBHOOK_ALLOW_LOCAL"))
+	publicURL := os.Getenv("PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = "http://localhost:8080"
+	}
+	smtpPort, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+	if err != nil || smtpPort <= 0 {
+		smtpPort = 587
+	}
+	smtpFrom := os.Getenv("SMTP_FROM")
+	if smtpFrom == "" {
+		smtpFrom = "Strava Coverage <digest@localhost>"
+	}
+	sessionTTL, err := time.ParseDuration(os.Getenv("SESSION_TTL"))
+	if err != nil || sessionTTL <= 0 {
+		sessionTTL = 7 * 24 * time.Hour
+	}
+	rateLimit, err := strconv.Atoi(os.Getenv("RATE_LIMIT_PER_MINUTE"))
+	if err != nil || rateLimit < 0 {
+		rateLimit = 0
+	}
+	rateLimitBurst, err := strconv.Atoi(os.Getenv("RATE_LIMIT_BURST"))
+	if err != nil || rateLimitBurst <= 0 {
+		rateLimitBurst = 2 * rateLimit
+	}
+	rateLimitStore := os.Getenv("RATE_LIMIT_STORE")
+	if rateLimitStore == "" {
+		rateLimitStore = "memory"
+	}
+	externalCost, err := strconv.ParseFloat(os.Getenv("RATE_LIMIT_EXTERNAL_COST"), 64)
+	if err != nil || externalCost < 0 {
+		externalCost = DefaultRateLimitExternalCost
+	}
+	heavyCost, err := strconv.ParseFloat(os.Getenv("RATE_LIMIT_HEAVY_COST"), 64)
+	if err != nil || heavyCost < 0 {
+		heavyCost = DefaultRateLimitHeavyCost
+	}
+	var trustedProxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		logLevel = slog.LevelInfo
+	}
+	logFormat := os.Getenv("LOG_FORMAT")
+	if logFormat != "text" {
+		logFormat = "json"
+	}
+	var logDebugUsers []int
+	for _, id := range strings.Split(os.Getenv("LOG_DEBUG_USERS"), ",") {
+		if userID, err := strconv.Atoi(strings.TrimSpace(id)); err == nil {
+			logDebugUsers = append(logDebugUsers, userID)
+		}
+	}
 	return &Config{
 		StravaClientID:     os.Getenv("STRAVA_CLIENT_ID"),
 		StravaClientSecret: os.Getenv("STRAVA_CLIENT_SECRET"),
 		StravaRedirectURI:  os.Getenv("STRAVA_REDIRECT_URI"),
+		StravaAPIURL:       os.Getenv("STRAVA_API_URL"),
+		StravaOAuthURL:     os.Getenv("STRAVA_OAUTH_URL"),
 		DBUrl:              os.Getenv("DB_URL"),
 		FrontendURL:        frontendURL,
+
+		StravaWebhookSubscriptionID: subscriptionID,
+
+		ActivityWatchDir:      os.Getenv("ACTIVITY_WATCH_DIR"),
+		ActivityWatchInterval: watchInterval,
+
+		CommentDryRun: dryRun,
+
+		WebhookAllowLocal: webhookAllowLocal,
+
+		PublicURL: strings.TrimRight(publicURL, "/"),
+
+		SMTPHost:     os.Getenv("SMTP_HOST"),
+		SMTPPort:     smtpPort,
+		SMTPUsername: os.Getenv("SMTP_USERNAME"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+		SMTPFrom:     smtpFrom,
+
+		SessionSecret: os.Getenv("SESSION_SECRET"),
+		SessionTTL:    sessionTTL,
+
+		TokenEncryptionKeys:    os.Getenv("TOKEN_ENCRYPTION_KEYS"),
+		TokenEncryptionKeyFile: os.Getenv("TOKEN_ENCRYPTION_KEY_FILE"),
+
+		RateLimitPerMinute: rateLimit,
+		RateLimitBurst:     rateLimitBurst,
+		RateLimitStore:     rateLimitStore,
+
+		RateLimitExternalCost:   externalCost,
+		RateLimitExternalRoutes: routeList("RATE_LIMIT_EXTERNAL_ROUTES", DefaultRateLimitExternalRoutes),
+		RateLimitHeavyCost:      heavyCost,
+		RateLimitHeavyRoutes:    routeList("RATE_LIMIT_HEAVY_ROUTES", DefaultRateLimitHeavyRoutes),
+		RateLimitExemptRoutes:   routeList("RATE_LIMIT_EXEMPT_ROUTES", DefaultRateLimitExemptRoutes),
+
+		TrustedProxies: trustedProxies,
+
+		LogLevel:      logLevel,
+		LogFormat:     logFormat,
+		LogDebugUsers: logDebugUsers,
+	}
+}
+
+// StravaAPI returns the Strava API base URL without a trailing slash
+func (c *Config) StravaAPI() string {
+	if c == nil || c.StravaAPIURL == "" {
+		return DefaultStravaAPIURL
+	}
+	return strings.TrimRight(c.StravaAPIURL, "/")
+}
+
+// StravaOAuth returns the Strava OAuth base URL without a trailing slash
+func (c *Config) StravaOAuth() string {
+	if c == nil || c.StravaOAuthURL == "" {
+		return DefaultStravaOAuthURL
+	}
+	return strings.TrimRight(c.StravaOAuthURL, "/")
+}
+
+// routeList reads a comma-separated list of "METHOD /path" routes from an environment
+// variable, or returns defaults when it is unset. Set to "none", the list is empty.
+func routeList(env string, defaults []string) []string {
+	value, ok := os.LookupEnv(env)
+	if !ok || strings.TrimSpace(value) == "" {
+		return defaults
+	}
+	routes := []string{}
+	if strings.TrimSpace(value) == "none" {
+		return routes
+	}
+	for _, route := range strings.Split(value, ",") {
+		if route = strings.Join(strings.Fields(route), " "); route != "" {
+			routes = append(routes, route)
+		}
 	}
+	return routes
 }
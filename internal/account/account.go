@@ -0,0 +1,167 @@
+// Package account exports everything stored about a user and deletes it again, for data
+// access and erasure requests.
+package account
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	resty "github.com/go-resty/resty/v2"
+	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/comments"
+	"github.com/nikhilvedi/strava-coverage/internal/coverage"
+	"github.com/nikhilvedi/strava-coverage/internal/metrics"
+	"github.com/nikhilvedi/strava-coverage/internal/session"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
+)
+
+// Service handles personal data exports and account deletion
+type Service struct {
+	DB       *storage.DB
+	Config   *config.Config
+	Coverage *coverage.MultiCityCoverageService
+	Comments *comments.AutoCommentService
+	Sessions *session.Manager
+	client   *resty.Client
+}
+
+// NewService creates an account service. sessions clears the session cookie of users who
+// delete their own account.
+func NewService(db *storage.DB, cfg *config.Config, coverageService *coverage.MultiCityCoverageService, sessions *session.Manager) *Service {
+	return &Service{
+		DB:       db,
+		Config:   cfg,
+		Coverage: coverageService,
+		Comments: comments.NewAutoCommentService(db, cfg),
+		Sessions: sessions,
+		client:   metrics.NewStravaClient(cfg).SetTimeout(15 * time.Second),
+	}
+}
+
+// RegisterAccountRoutes adds the export and deletion endpoints
+func (s *Service) RegisterAccountRoutes(r *gin.Engine) {
+	r.GET("/api/users/:id/export", s.ExportHandler)
+	r.DELETE("/api/users/:id", s.DeleteHandler)
+}
+
+// ExportHandler responds with a ZIP of everything stored about a user
+func (s *Service) ExportHandler(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	export, err := s.gather(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to gather export", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export user data"})
+		return
+	}
+
+	filename := fmt.Sprintf("strava-coverage-user-%d-%s.zip", userID, export.GeneratedAt.Format("20060102"))
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(http.StatusOK)
+
+	// Headers are sent, so failures from here on can only cut the archive short
+	if err := s.writeZip(c.Writer, export); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to write export", "error", err)
+	}
+}
+
+// DeletionResult reports what deleting an account removed
+type DeletionResult struct {
+	UserID int `json:"user_id"`
+	// StravaRevoked is whether Strava accepted the revocation of the app's access. Rows are
+	// deleted either way; the athlete can still revoke access in their Strava settings.
+	StravaRevoked bool             `json:"strava_revoked"`
+	RevokeError   string           `json:"revoke_error,omitempty"`
+	Removed       map[string]int64 `json:"removed"`
+	DeletedAt     time.Time        `json:"deleted_at"`
+}
+
+// DeleteHandler revokes the app's Strava access for a user and deletes every row stored
+// about them
+func (s *Service) DeleteHandler(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	result, err := s.Delete(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to delete user", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user data"})
+		return
+	}
+
+	if current, ok := session.UserID(c); ok && current == userID && s.Sessions != nil {
+		s.Sessions.ClearCookie(c)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// Delete revokes the app's Strava access for a user and deletes every row stored about them
+func (s *Service) Delete(userID int) (*DeletionResult, error) {
+	if _, err := s.DB.GetUserProfile(userID); err != nil {
+		return nil, err
+	}
+
+	result := &DeletionResult{UserID: userID}
+	if err := s.revokeStravaAccess(userID); err != nil {
+		slog.Warn("Failed to revoke Strava access", "user_id", userID, "error", err)
+		result.RevokeError = err.Error()
+	} else {
+		result.StravaRevoked = true
+	}
+
+	removed, err := s.DB.DeleteUserData(userID)
+	if err != nil {
+		return nil, err
+	}
+	result.Removed = removed
+	result.DeletedAt = time.Now().UTC()
+
+	slog.Info("Deleted user", "user_id", userID, "removed", removed)
+	return result, nil
+}
+
+// revokeStravaAccess deauthorizes the app on the athlete's Strava account, which revokes
+// every token it holds for them
+func (s *Service) revokeStravaAccess(userID int) error {
+	token, err := s.DB.GetStravaToken(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("no Strava token stored")
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.R().
+		SetFormData(map[string]string{"access_token": token.AccessToken}).
+		Post(s.Config.StravaOAuth() + "/deauthorize")
+	if err != nil {
+		return fmt.Errorf("deauthorize request failed: %v", err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("strava deauthorize returned %d", resp.StatusCode())
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package account
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nikhilvedi/strava-coverage/internal/coverage"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sampleActivity() storage.ExportedActivity {
+	start := time.Date(2025, 3, 10, 8, 0, 0, 0, time.UTC)
+	path := `{"type":"LineString","coordinates":[[-1.47,53.38],[-1.46,53.39]]}`
+	activity := storage.ExportedActivity{PathGeoJSON: &path}
+	activity.StravaActivityID = 42
+	activity.Name = "Morning Run"
+	activity.SportType = "Run"
+	activity.StartDate = &start
+	return activity
+}
+
+func TestWriteGPX(t *testing.T) {
+	activity := sampleActivity()
+	path := activityPath(&activity)
+	require.Len(t, path, 2)
+
+	t.Run("from the stored path", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, writeGPX(&buf, &activity, path, nil))
+
+		gpx := buf.String()
+		assert.True(t, strings.HasPrefix(gpx, "<?xml"))
+		assert.Contains(t, gpx, `<name>Morning Run</name>`)
+		assert.Contains(t, gpx, `<trkpt lat="53.38" lon="-1.47">`)
+		assert.NotContains(t, gpx, "<time>")
+	})
+
+	t.Run("from streams", func(t *testing.T) {
+		streams := &coverage.ActivityStreams{
+			LatLng:   [][]float64{{53.38, -1.47}, {53.385, -1.465}, {53.39, -1.46}},
+			Time:     []int{0, 30, 65},
+			Altitude: []float64{100, 102.5, 101},
+		}
+		var buf bytes.Buffer
+		require.NoError(t, writeGPX(&buf, &activity, path, streams))
+
+		gpx := buf.String()
+		assert.Equal(t, 3, strings.Count(gpx, "<trkpt "))
+		assert.Contains(t, gpx, `<ele>102.5</ele>`)
+		assert.Contains(t, gpx, `<time>2025-03-10T08:01:05Z</time>`)
+	})
+}
+
+func TestActivitiesGeoJSON(t *testing.T) {
+	withPath := sampleActivity()
+	withoutPath := sampleActivity()
+	withoutPath.StravaActivityID = 43
+	withoutPath.PathGeoJSON = nil
+
+	data, err := json.Marshal(activitiesGeoJSON([]storage.ExportedActivity{withPath, withoutPath}))
+	require.NoError(t, err)
+
+	var collection struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry   json.RawMessage        `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	require.NoError(t, json.Unmarshal(data, &collection))
+	assert.Equal(t, "FeatureCollection", collection.Type)
+	require.Len(t, collection.Features, 2)
+	assert.JSONEq(t, *withPath.PathGeoJSON, string(collection.Features[0].Geometry))
+	assert.Equal(t, "null", string(collection.Features[1].Geometry))
+	assert.Equal(t, float64(43), collection.Features[1].Properties["activity_id"])
+}
@@ -0,0 +1,266 @@
+package account
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/nikhilvedi/strava-coverage/internal/comments"
+	"github.com/nikhilvedi/strava-coverage/internal/coverage"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+// Export is everything stored about a user, gathered before the archive is written
+type Export struct {
+	GeneratedAt     time.Time
+	Profile         *storage.UserProfile
+	Activities      []storage.ExportedActivity
+	CityCoverage    []coverage.CityCoverageInfo
+	Streets         []storage.ExportedStreet
+	CustomAreas     []storage.ExportedCustomArea
+	CommentSettings *comments.CommentSettings
+	CommentTriggers []comments.CommentTrigger
+	CommentHistory  []storage.OutboxEntry
+}
+
+// gather loads a user's data. It returns sql.ErrNoRows if there is no such user.
+func (s *Service) gather(userID int) (*Export, error) {
+	export := &Export{GeneratedAt: time.Now().UTC()}
+
+	var err error
+	if export.Profile, err = s.DB.GetUserProfile(userID); err != nil {
+		return nil, err
+	}
+	if export.Activities, err = s.DB.ListActivitiesForExport(userID); err != nil {
+		return nil, fmt.Errorf("activities: %w", err)
+	}
+	if export.CityCoverage, err = s.Coverage.UserCityCoverage(strconv.Itoa(userID), nil); err != nil {
+		return nil, fmt.Errorf("city coverage: %w", err)
+	}
+	if export.Streets, err = s.DB.ListStreetsReachedForExport(userID); err != nil {
+		return nil, fmt.Errorf("streets: %w", err)
+	}
+	if export.CustomAreas, err = s.DB.ListCustomAreasForExport(userID); err != nil {
+		return nil, fmt.Errorf("custom areas: %w", err)
+	}
+	if export.CommentSettings, err = s.Comments.GetUserCommentSettings(userID); err != nil {
+		return nil, fmt.Errorf("comment settings: %w", err)
+	}
+	if export.CommentTriggers, err = s.Comments.GetCommentTriggers(userID); err != nil {
+		return nil, fmt.Errorf("comment triggers: %w", err)
+	}
+	if export.CommentHistory, err = s.DB.ListOutboxEntries(userID, "", math.MaxInt32); err != nil {
+		return nil, fmt.Errorf("comment history: %w", err)
+	}
+	return export, nil
+}
+
+// writeZip writes the export archive:
+//
+//	profile.json          the user and their preferences
+//	activities.geojson    every activity, with its path where it has one
+//	gpx/<id>.gpx          one track per activity with a path
+//	coverage.json         coverage per city as of the export, per activity, and the
+//	                      streets reached
+//	custom_areas.geojson  the user's custom areas
+//	comments.json         comment settings and triggers
+//	comment_history.json  every notification rendered for the user
+func (s *Service) writeZip(w io.Writer, export *Export) error {
+	zw := zip.NewWriter(w)
+
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", export.Profile},
+		{"activities.geojson", activitiesGeoJSON(export.Activities)},
+		{"coverage.json", coverageSnapshot(export)},
+		{"custom_areas.geojson", customAreasGeoJSON(export.CustomAreas)},
+		{"comments.json", map[string]interface{}{
+			"settings": export.CommentSettings,
+			"triggers": export.CommentTriggers,
+		}},
+		{"comment_history.json", export.CommentHistory},
+	}
+	for _, f := range files {
+		if err := writeJSON(zw, f.name, export.GeneratedAt, f.data); err != nil {
+			return err
+		}
+	}
+
+	for i := range export.Activities {
+		activity := &export.Activities[i]
+		path := activityPath(activity)
+		if len(path) < 2 {
+			continue
+		}
+
+		streams, err := coverage.StoredActivityStreams(s.DB, activity.StravaActivityID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			slog.Warn("Exporting activity without streams", "activity_id", activity.StravaActivityID, "error", err)
+		}
+		f, err := create(zw, fmt.Sprintf("gpx/%d.gpx", activity.StravaActivityID), export.GeneratedAt)
+		if err != nil {
+			return err
+		}
+		if err := writeGPX(f, activity, path, streams); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func create(zw *zip.Writer, name string, modified time.Time) (io.Writer, error) {
+	return zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+}
+
+func writeJSON(zw *zip.Writer, name string, modified time.Time, data interface{}) error {
+	f, err := create(zw, name, modified)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(data)
+}
+
+// feature is a GeoJSON feature whose geometry comes straight from PostGIS
+type feature struct {
+	Type       string                 `json:"type"`
+	Geometry   json.RawMessage        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type featureCollection struct {
+	Type     string    `json:"type"`
+	Features []feature `json:"features"`
+}
+
+// activitiesGeoJSON lists every activity as a feature; activities without GPS have a null
+// geometry
+func activitiesGeoJSON(activities []storage.ExportedActivity) featureCollection {
+	collection := featureCollection{Type: "FeatureCollection", Features: []feature{}}
+	for i := range activities {
+		a := &activities[i]
+		geometry := json.RawMessage("null")
+		if a.PathGeoJSON != nil {
+			geometry = json.RawMessage(*a.PathGeoJSON)
+		}
+		collection.Features = append(collection.Features, feature{
+			Type:     "Feature",
+			Geometry: geometry,
+			Properties: map[string]interface{}{
+				"activity_id":            a.StravaActivityID,
+				"source":                 a.Source,
+				"source_ref":             a.SourceRef,
+				"name":                   a.Name,
+				"activity_type":          a.ActivityType,
+				"sport_type":             a.SportType,
+				"start_date":             a.StartDate,
+				"start_date_local":       a.StartDateLocal,
+				"timezone":               a.Timezone,
+				"distance_km":            a.DistanceKm,
+				"moving_time_seconds":    a.MovingTimeSeconds,
+				"elapsed_time_seconds":   a.ElapsedTimeSeconds,
+				"total_elevation_gain_m": a.TotalElevationGainM,
+				"manual":                 a.Manual,
+				"trainer":                a.Trainer,
+				"commute":                a.Commute,
+				"private":                a.Private,
+				"visibility":             a.Visibility,
+				"city_id":                a.CityID,
+				"city_name":              a.CityName,
+				"coverage_percentage":    a.CoveragePercentage,
+				"new_km":                 a.NewKm,
+				"commented_at":           a.CommentedAt,
+				"imported_at":            a.CreatedAt,
+			},
+		})
+	}
+	return collection
+}
+
+// customAreasGeoJSON lists the custom areas as polygon features
+func customAreasGeoJSON(areas []storage.ExportedCustomArea) featureCollection {
+	collection := featureCollection{Type: "FeatureCollection", Features: []feature{}}
+	for _, area := range areas {
+		collection.Features = append(collection.Features, feature{
+			Type:     "Feature",
+			Geometry: json.RawMessage(area.GeometryGeoJSON),
+			Properties: map[string]interface{}{
+				"id":                  area.ID,
+				"name":                area.Name,
+				"coverage_percentage": area.CoveragePercentage,
+				"activities_count":    area.ActivitiesCount,
+				"created_at":          area.CreatedAt,
+				"updated_at":          area.UpdatedAt,
+			},
+		})
+	}
+	return collection
+}
+
+// activityCoverage is the coverage an activity added to its city
+type activityCoverage struct {
+	ActivityID         int64    `json:"activity_id"`
+	CityID             *int     `json:"city_id"`
+	CityName           *string  `json:"city_name"`
+	CoveragePercentage *float64 `json:"coverage_percentage"`
+	NewKm              *float64 `json:"new_km"`
+}
+
+// coverageSnapshot is the user's coverage of every city as of the export, and what each
+// activity contributed
+func coverageSnapshot(export *Export) map[string]interface{} {
+	activities := []activityCoverage{}
+	for _, a := range export.Activities {
+		if a.CityID == nil && a.CoveragePercentage == nil {
+			continue
+		}
+		activities = append(activities, activityCoverage{
+			ActivityID:         a.StravaActivityID,
+			CityID:             a.CityID,
+			CityName:           a.CityName,
+			CoveragePercentage: a.CoveragePercentage,
+			NewKm:              a.NewKm,
+		})
+	}
+
+	cities := export.CityCoverage
+	if cities == nil {
+		cities = []coverage.CityCoverageInfo{}
+	}
+	streets := export.Streets
+	if streets == nil {
+		streets = []storage.ExportedStreet{}
+	}
+	return map[string]interface{}{
+		"as_of":      export.GeneratedAt,
+		"cities":     cities,
+		"activities": activities,
+		"streets":    streets,
+	}
+}
+
+// activityPath reads the [lng, lat] points of an activity's GeoJSON path
+func activityPath(activity *storage.ExportedActivity) [][]float64 {
+	if activity.PathGeoJSON == nil {
+		return nil
+	}
+	var line struct {
+		Coordinates [][]float64 `json:"coordinates"`
+	}
+	if err := json.Unmarshal([]byte(*activity.PathGeoJSON), &line); err != nil {
+		slog.Warn("Failed to parse activity path", "activity_id", activity.StravaActivityID, "error", err)
+		return nil
+	}
+	return line.Coordinates
+}
@@ -0,0 +1,92 @@
+package account
+
+import (
+	"encoding/xml"
+	"io"
+	"time"
+
+	"github.com/nikhilvedi/strava-coverage/internal/coverage"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+type gpxFile struct {
+	XMLName xml.Name `xml:"gpx"`
+	Version string   `xml:"version,attr"`
+	Creator string   `xml:"creator,attr"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Track   gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name    string     `xml:"name,omitempty"`
+	Type    string     `xml:"type,omitempty"`
+	Segment gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxPoint struct {
+	Lat       float64  `xml:"lat,attr"`
+	Lon       float64  `xml:"lon,attr"`
+	Elevation *float64 `xml:"ele,omitempty"`
+	Time      string   `xml:"time,omitempty"`
+}
+
+// writeGPX writes an activity as a GPX track. path holds the stored [lng, lat] points;
+// when the activity's streams were kept, their points are used instead, with elevation
+// and, given a start date, timestamps.
+func writeGPX(w io.Writer, activity *storage.ExportedActivity, path [][]float64, streams *coverage.ActivityStreams) error {
+	track := gpxTrack{Name: activity.Name, Type: activity.SportType}
+	if track.Type == "" {
+		track.Type = activity.ActivityType
+	}
+	track.Segment.Points = gpxPoints(activity.StartDate, path, streams)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(gpxFile{
+		Version: "1.1",
+		Creator: "strava-coverage",
+		Xmlns:   "http://www.topografix.com/GPX/1/1",
+		Track:   track,
+	}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func gpxPoints(start *time.Time, path [][]float64, streams *coverage.ActivityStreams) []gpxPoint {
+	if streams == nil || len(streams.LatLng) < 2 {
+		points := make([]gpxPoint, 0, len(path))
+		for _, p := range path {
+			if len(p) < 2 {
+				continue
+			}
+			points = append(points, gpxPoint{Lat: p[1], Lon: p[0]})
+		}
+		return points
+	}
+
+	points := make([]gpxPoint, 0, len(streams.LatLng))
+	for i, p := range streams.LatLng {
+		if len(p) < 2 {
+			continue
+		}
+		point := gpxPoint{Lat: p[0], Lon: p[1]}
+		if i < len(streams.Altitude) {
+			elevation := streams.Altitude[i]
+			point.Elevation = &elevation
+		}
+		if start != nil && i < len(streams.Time) {
+			point.Time = start.UTC().Add(time.Duration(streams.Time[i]) * time.Second).Format(time.RFC3339)
+		}
+		points = append(points, point)
+	}
+	return points
+}
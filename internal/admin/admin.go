@@ -0,0 +1,436 @@
+// Package admin serves the operator API under /api/admin: finding users and changing
+// their role and features, forcing imports and recalculations, editing cities and
+// inspecting the background job queues. The guard restricts it to moderators, who can
+// read it and edit cities, and admins, who can do everything.
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/internal/account"
+	"github.com/nikhilvedi/strava-coverage/internal/coverage"
+	"github.com/nikhilvedi/strava-coverage/internal/pagination"
+	"github.com/nikhilvedi/strava-coverage/internal/session"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
+)
+
+// Service handles the admin API
+type Service struct {
+	DB       *storage.DB
+	Coverage *coverage.CoverageService
+	Imports  *coverage.InitialImportService
+	Accounts *account.Service
+}
+
+// NewService creates an admin service
+func NewService(db *storage.DB, coverageService *coverage.CoverageService, importService *coverage.InitialImportService, accountService *account.Service) *Service {
+	return &Service{
+		DB:       db,
+		Coverage: coverageService,
+		Imports:  importService,
+		Accounts: accountService,
+	}
+}
+
+// RegisterAdminRoutes adds the admin endpoints
+func (s *Service) RegisterAdminRoutes(r *gin.Engine) {
+	admin := r.Group("/api/admin")
+	{
+		admin.GET("/users", s.ListUsersHandler)
+		admin.GET("/users/:userId", s.GetUserHandler)
+		admin.PUT("/users/:userId/role", s.SetRoleHandler)
+		admin.PUT("/users/:userId/features", s.SetFeaturesHandler)
+		admin.POST("/users/:userId/import", s.ImportHandler)
+		admin.POST("/users/:userId/recalculate", s.RecalculateHandler)
+		admin.DELETE("/users/:userId", s.DeleteUserHandler)
+
+		admin.PUT("/cities/:cityId", s.UpdateCityHandler)
+		admin.POST("/cities/:cityId/merge", s.MergeCityHandler)
+		admin.DELETE("/cities/:cityId", s.DeleteCityHandler)
+
+		admin.GET("/jobs", s.JobsHandler)
+	}
+}
+
+// ListUsersHandler pages through users, searched by ?q= (name, email or Strava athlete
+// ID) and filtered by ?role=
+func (s *Service) ListUsersHandler(c *gin.Context) {
+	role := c.Query("role")
+	if role != "" && !storage.ValidRole(role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be one of " + strings.Join(storage.Roles, ", ")})
+		return
+	}
+	params, err := pagination.Parse(c, storage.UserPages)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	users, page, err := s.DB.ListUsers(strings.TrimSpace(c.Query("q")), role, params)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to list users", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list users"})
+		return
+	}
+
+	pagination.SetHeaders(c, page)
+	c.JSON(http.StatusOK, gin.H{
+		"users":       users,
+		"count":       len(users),
+		"total":       page.Total,
+		"next_cursor": page.Next,
+	})
+}
+
+// GetUserHandler returns a user with their features
+func (s *Service) GetUserHandler(c *gin.Context) {
+	userID, ok := userParam(c)
+	if !ok {
+		return
+	}
+
+	user, err := s.DB.GetAdminUser(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to get user", "target_user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		return
+	}
+	features, err := s.DB.GetUserFeatures(userID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to get user features", "target_user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user":     user,
+		"features": features,
+	})
+}
+
+// SetRoleRequest changes a user's role
+type SetRoleRequest struct {
+	Role string `json:"role" binding:"required,oneof=user moderator admin"`
+}
+
+// SetRoleHandler changes a user's role. Admins cannot change their own, so there is always
+// one left.
+func (s *Service) SetRoleHandler(c *gin.Context) {
+	userID, ok := userParam(c)
+	if !ok {
+		return
+	}
+	var req SetRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be one of " + strings.Join(storage.Roles, ", ")})
+		return
+	}
+	caller, _ := session.UserID(c)
+	if caller == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot change your own role"})
+		return
+	}
+
+	err := s.DB.SetUserRole(userID, req.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to set user role", "target_user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set role"})
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "Set user role", "target_user_id", userID, "role", req.Role)
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "role": req.Role})
+}
+
+// SetFeaturesHandler switches features on or off for a user. The body maps feature names
+// to whether they are on; features left out keep their setting.
+func (s *Service) SetFeaturesHandler(c *gin.Context) {
+	userID, ok := userParam(c)
+	if !ok {
+		return
+	}
+	var features map[string]bool
+	if err := c.ShouldBindJSON(&features); err != nil || len(features) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Body must map features to true or false"})
+		return
+	}
+	for feature := range features {
+		if !storage.ValidUserFeature(feature) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown feature %q; features are %s", feature, strings.Join(storage.UserFeatures, ", "))})
+			return
+		}
+	}
+	if !s.userExists(c, userID) {
+		return
+	}
+
+	caller, _ := session.UserID(c)
+	if err := s.DB.SetUserFeatures(userID, features, caller); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to set user features", "target_user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set features"})
+		return
+	}
+	current, err := s.DB.GetUserFeatures(userID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to get user features", "target_user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get features"})
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "Set user features", "target_user_id", userID, "features", features)
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "features": current})
+}
+
+// ImportHandler starts a user's initial import from Strava. ?force=true restarts an import
+// still marked in progress, such as one cut off by a restart.
+func (s *Service) ImportHandler(c *gin.Context) {
+	userID, ok := userParam(c)
+	if !ok {
+		return
+	}
+	force, _ := strconv.ParseBool(c.Query("force"))
+	if !s.userExists(c, userID) {
+		return
+	}
+
+	if err := s.Imports.StartImport(c.Request.Context(), userID, force); errors.Is(err, coverage.ErrImportInProgress) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Import already in progress for this user; force=true restarts it"})
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "Started import", "target_user_id", userID, "force", force)
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "Import started",
+		"user_id": userID,
+	})
+}
+
+// RecalculateHandler recalculates the coverage of a user's activities in the background
+func (s *Service) RecalculateHandler(c *gin.Context) {
+	userID, ok := userParam(c)
+	if !ok {
+		return
+	}
+	if !s.userExists(c, userID) {
+		return
+	}
+
+	jobID := s.Coverage.StartRecalculation(c.Request.Context(), userID)
+	c.JSON(http.StatusAccepted, gin.H{
+		"job_id":  jobID,
+		"user_id": userID,
+		"message": "Recalculation started; follow it at /api/coverage/recalculate-status/" + jobID,
+	})
+}
+
+// DeleteUserHandler deletes a user and everything stored about them, as the user can
+// themselves
+func (s *Service) DeleteUserHandler(c *gin.Context) {
+	userID, ok := userParam(c)
+	if !ok {
+		return
+	}
+
+	result, err := s.Accounts.Delete(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to delete user", "target_user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user data"})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// UpdateCityRequest changes a city; fields left out keep their value
+type UpdateCityRequest struct {
+	Name        *string `json:"name" binding:"omitempty,min=1"`
+	CountryCode *string `json:"country_code" binding:"omitempty,len=2"`
+	// Boundary is a GeoJSON Polygon or MultiPolygon
+	Boundary interface{} `json:"boundary"`
+}
+
+// UpdateCityHandler changes a city's name, country or boundary
+func (s *Service) UpdateCityHandler(c *gin.Context) {
+	cityID, ok := cityParam(c)
+	if !ok {
+		return
+	}
+	var req UpdateCityRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name == nil && req.CountryCode == nil && req.Boundary == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to update"})
+		return
+	}
+
+	update := storage.CityUpdate{Name: req.Name, CountryCode: req.CountryCode}
+	if req.Boundary != nil {
+		boundary, err := json.Marshal(req.Boundary)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid boundary format"})
+			return
+		}
+		geoJSON := string(boundary)
+		update.BoundaryGeoJSON = &geoJSON
+	}
+
+	err := s.DB.UpdateCity(cityID, update)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeCityNotFound, "City not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to update city", "city_id", cityID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update city"})
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "Updated city", "city_id", cityID)
+	c.JSON(http.StatusOK, gin.H{"id": cityID, "message": "City updated"})
+}
+
+// MergeCityRequest names the city to merge into
+type MergeCityRequest struct {
+	IntoCityID int `json:"into_city_id" binding:"required,min=1"`
+}
+
+// MergeCityHandler folds a city into another, such as a duplicate added from search
+func (s *Service) MergeCityHandler(c *gin.Context) {
+	cityID, ok := cityParam(c)
+	if !ok {
+		return
+	}
+	var req MergeCityRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "into_city_id is required"})
+		return
+	}
+	if req.IntoCityID == cityID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A city cannot be merged into itself"})
+		return
+	}
+
+	moved, err := s.DB.MergeCities(cityID, req.IntoCityID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeCityNotFound, "City not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to merge city", "city_id", cityID, "into_city_id", req.IntoCityID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge cities"})
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "Merged city", "city_id", cityID, "into_city_id", req.IntoCityID, "activities_moved", moved)
+	c.JSON(http.StatusOK, gin.H{
+		"city_id":          req.IntoCityID,
+		"merged_city_id":   cityID,
+		"activities_moved": moved,
+		"message":          "Cities merged; recalculate coverage for the moved activities",
+	})
+}
+
+// DeleteCityHandler deletes a city. Its activities are kept without a city.
+func (s *Service) DeleteCityHandler(c *gin.Context) {
+	cityID, ok := cityParam(c)
+	if !ok {
+		return
+	}
+
+	unassigned, err := s.DB.DeleteCity(cityID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeCityNotFound, "City not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to delete city", "city_id", cityID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete city"})
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "Deleted city", "city_id", cityID, "activities_unassigned", unassigned)
+	c.JSON(http.StatusOK, gin.H{
+		"city_id":               cityID,
+		"activities_unassigned": unassigned,
+		"message":               "City deleted",
+	})
+}
+
+// JobsHandler describes the background work: recalculation jobs since the server started,
+// imports in progress, and the comment outbox, webhook delivery and Strava event queues by
+// status
+func (s *Service) JobsHandler(c *gin.Context) {
+	imports, err := s.DB.ListRunningImports()
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to list running imports", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get jobs"})
+		return
+	}
+	queues, err := s.DB.QueueCounts()
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to count queues", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get jobs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"recalculations": s.Coverage.Jobs(),
+		"imports":        imports,
+		"queues":         queues,
+	})
+}
+
+// userExists responds 404 and returns false if there is no such user
+func (s *Service) userExists(c *gin.Context, userID int) bool {
+	_, err := s.DB.GetUserRole(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeUserNotFound, "User not found")
+		return false
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to look up user", "target_user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up user"})
+		return false
+	}
+	return true
+}
+
+func userParam(c *gin.Context) (int, bool) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return 0, false
+	}
+	return userID, true
+}
+
+func cityParam(c *gin.Context) (int, bool) {
+	cityID, err := strconv.Atoi(c.Param("cityId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid city ID"})
+		return 0, false
+	}
+	return cityID, true
+}
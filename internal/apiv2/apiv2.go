@@ -0,0 +1,252 @@
+// Package apiv2 serves the API a second time under /api/v2, with every JSON response
+// wrapped in the utils.Envelope. Requests are routed to the v1 handlers, so both
+// versions share access rules, rate limits and validation, and v1 responses are left as
+// they are for existing clients.
+package apiv2
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nikhilvedi/strava-coverage/internal/pagination"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
+)
+
+const (
+	// Prefix is where the v2 API is served
+	Prefix = "/api/v2"
+
+	v1Prefix = "/api"
+)
+
+// Handler serves /api/v2/... from the v1 route of the same path and passes every other
+// request straight to next
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, Prefix)
+		if !ok || rest != "" && !strings.HasPrefix(rest, "/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, code := utils.TrackErrorCode(r.Context())
+		v1 := r.WithContext(ctx)
+		url := *r.URL
+		url.Path = v1Prefix + rest
+		url.RawPath = ""
+		v1.URL = &url
+
+		ew := &envelopeWriter{ResponseWriter: w, code: code}
+		next.ServeHTTP(ew, v1)
+		ew.finish()
+	})
+}
+
+// envelopeWriter holds back JSON responses to wrap them. Anything else, such as export
+// archives, redirects and event streams, is written through as it comes.
+type envelopeWriter struct {
+	http.ResponseWriter
+	code        *utils.ErrorCode // set by the handler of a failed request
+	status      int
+	wroteHeader bool
+	buffered    bool
+	body        bytes.Buffer
+}
+
+func (w *envelopeWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+
+	// gin answers unknown routes with plain text
+	contentType := w.Header().Get("Content-Type")
+	isJSON := strings.HasPrefix(contentType, "application/json") && status != http.StatusNoContent && status != http.StatusNotModified
+	plainError := strings.HasPrefix(contentType, "text/plain") && status >= http.StatusBadRequest
+	if isJSON || plainError {
+		w.buffered = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *envelopeWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffered {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends streamed responses on; buffered ones are sent whole at the end
+func (w *envelopeWriter) Flush() {
+	if w.buffered {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish writes the envelope of a buffered response
+func (w *envelopeWriter) finish() {
+	if !w.buffered {
+		return
+	}
+
+	body, err := wrap(w.status, w.body.Bytes(), w.Header(), *w.code)
+	if err != nil {
+		// Not JSON after all: send it as the handler wrote it
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.body.Bytes())
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if link := w.Header().Get("Link"); link != "" {
+		w.Header().Set("Link", strings.Replace(link, "<"+v1Prefix+"/", "<"+Prefix+"/", 1))
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
+
+// wrap turns a v1 JSON body into the envelope of its status, taking the request ID and
+// the page of paginated lists from the headers. code is the error code the handler set,
+// if any.
+func wrap(status int, body []byte, header http.Header, code utils.ErrorCode) ([]byte, error) {
+	var value interface{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil && status < http.StatusBadRequest {
+			return nil, err
+		}
+	}
+
+	envelope := utils.Envelope{
+		Success:   status < http.StatusBadRequest,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		RequestID: header.Get("X-Request-ID"),
+	}
+	if envelope.Success {
+		envelope.Data = normalize("", value)
+		if total, err := strconv.Atoi(header.Get(pagination.HeaderTotalCount)); err == nil {
+			envelope.Pagination = &utils.EnvelopePagination{
+				Total:      total,
+				NextCursor: header.Get(pagination.HeaderNextCursor),
+			}
+		}
+	} else {
+		envelope.Error = envelopeError(status, value, code)
+	}
+	return json.Marshal(envelope)
+}
+
+// envelopeError reads the message out of the error bodies v1 writes: {"error": "..."},
+// a bare utils.APIError, or {"error": APIError, "validation_errors": [...]} from the
+// validators. Errors without a code from their handler get the code of their status.
+func envelopeError(status int, value interface{}, code utils.ErrorCode) *utils.EnvelopeError {
+	apiErr := &utils.EnvelopeError{
+		Code:    utils.CodeForStatus(status),
+		Status:  status,
+		Message: http.StatusText(status),
+	}
+
+	body, _ := value.(map[string]interface{})
+	switch e := body["error"].(type) {
+	case string:
+		apiErr.Message = e
+	case map[string]interface{}:
+		body = mergeDetails(body, e)
+	}
+	if _, ok := body["error"]; !ok {
+		if message, ok := body["message"].(string); ok {
+			apiErr.Message = message
+		}
+	}
+	if details, ok := body["details"].(string); ok {
+		apiErr.Details = details
+	}
+
+	if raw, ok := body["validation_errors"]; ok {
+		data, _ := json.Marshal(raw)
+		json.Unmarshal(data, &apiErr.ValidationErrors)
+		apiErr.Code = utils.CodeValidationFailed
+	}
+	if code != "" {
+		apiErr.Code = code
+	}
+	return apiErr
+}
+
+// mergeDetails lifts a nested APIError's message and details into the body
+func mergeDetails(body, nested map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(body)+2)
+	for key, value := range body {
+		if key != "error" {
+			merged[key] = value
+		}
+	}
+	for _, key := range []string{"message", "details"} {
+		if value, ok := nested[key]; ok {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// timeLayouts are the ways v1 writes times, newest style first
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05",
+}
+
+// normalize makes IDs numbers and timestamps RFC 3339 in UTC. v1 writes some IDs as
+// strings and some times as Postgres formats them.
+func normalize(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = normalize(k, item)
+		}
+		return v
+	case []interface{}:
+		itemKey := strings.TrimSuffix(key, "s")
+		for i, item := range v {
+			v[i] = normalize(itemKey, item)
+		}
+		return v
+	case string:
+		switch {
+		case isIDKey(key):
+			if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return json.Number(v)
+			}
+		case isTimeKey(key):
+			for _, layout := range timeLayouts {
+				if t, err := time.Parse(layout, v); err == nil {
+					return t.UTC().Format(time.RFC3339)
+				}
+			}
+		}
+	}
+	return value
+}
+
+func isIDKey(key string) bool {
+	return key == "id" || strings.HasSuffix(key, "_id")
+}
+
+func isTimeKey(key string) bool {
+	return key == "timestamp" || strings.HasSuffix(key, "_at") || key == "date" || strings.HasSuffix(key, "_date")
+}
@@ -0,0 +1,136 @@
+package apiv2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/internal/pagination"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRouter() http.Handler {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/summary/:userId", func(c *gin.Context) {
+		c.Header("X-Request-ID", "req-1")
+		c.JSON(http.StatusOK, gin.H{
+			"user_id":      c.Param("userId"),
+			"name":         "Leeds",
+			"created_at":   "2025-03-01 12:30:00",
+			"activity_ids": []string{"12", "13"},
+			"event_time":   1740832200,
+		})
+	})
+	r.GET("/api/cities/", func(c *gin.Context) {
+		pagination.SetHeaders(c, pagination.Page{Total: 3, Next: "abc"})
+		c.JSON(http.StatusOK, []gin.H{{"id": 1}, {"id": 2}})
+	})
+	r.GET("/api/users/:id", func(c *gin.Context) {
+		utils.NotFound(c, utils.CodeUserNotFound, "User not found")
+	})
+	r.GET("/api/cities/:id", func(c *gin.Context) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "City not found"})
+	})
+	r.GET("/api/broken", func(c *gin.Context) {
+		utils.ErrorResponse(c, utils.NewAPIError(http.StatusInternalServerError, "Database error", "Failed to fetch cities data"))
+	})
+	r.GET("/api/invalid", func(c *gin.Context) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             utils.NewAPIError(http.StatusBadRequest, "Validation failed", "Request parameters are invalid"),
+			"validation_errors": []utils.ValidationError{{Field: "lat", Message: "must be a number", Value: "north"}},
+		})
+	})
+	r.GET("/api/export", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/zip", []byte("PK"))
+	})
+	return Handler(r)
+}
+
+func get(t *testing.T, path string) (*httptest.ResponseRecorder, utils.Envelope) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	testRouter().ServeHTTP(w, req)
+
+	var envelope utils.Envelope
+	if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+	}
+	return w, envelope
+}
+
+func TestSuccessEnvelope(t *testing.T) {
+	w, envelope := get(t, "/api/v2/summary/7")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, envelope.Success)
+	assert.Equal(t, "req-1", envelope.RequestID)
+	assert.Nil(t, envelope.Error)
+
+	data := envelope.Data.(map[string]interface{})
+	assert.Equal(t, float64(7), data["user_id"])
+	assert.Equal(t, "Leeds", data["name"])
+	assert.Equal(t, "2025-03-01T12:30:00Z", data["created_at"])
+	assert.Equal(t, []interface{}{float64(12), float64(13)}, data["activity_ids"])
+	assert.Equal(t, float64(1740832200), data["event_time"])
+	assert.Nil(t, envelope.Pagination)
+}
+
+func TestPaginationEnvelope(t *testing.T) {
+	w, envelope := get(t, "/api/v2/cities/?limit=2")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, envelope.Data, 2)
+	assert.Equal(t, &utils.EnvelopePagination{Total: 3, NextCursor: "abc"}, envelope.Pagination)
+	assert.Equal(t, `</api/v2/cities/?cursor=abc&limit=2>; rel="next"`, w.Header().Get("Link"))
+}
+
+func TestErrorEnvelopes(t *testing.T) {
+	tests := []struct {
+		path        string
+		wantStatus  int
+		wantCode    utils.ErrorCode
+		wantMessage string
+		wantDetails string
+	}{
+		{"/api/v2/users/3", http.StatusNotFound, utils.CodeUserNotFound, "User not found", ""},
+		// The code comes from the handler, never from the message
+		{"/api/v2/cities/3", http.StatusNotFound, utils.CodeNotFound, "City not found", ""},
+		{"/api/v2/broken", http.StatusInternalServerError, utils.CodeInternal, "Database error", "Failed to fetch cities data"},
+		{"/api/v2/invalid", http.StatusBadRequest, utils.CodeValidationFailed, "Validation failed", "Request parameters are invalid"},
+		{"/api/v2/missing", http.StatusNotFound, utils.CodeNotFound, "Not Found", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w, envelope := get(t, tt.path)
+			require.Equal(t, tt.wantStatus, w.Code)
+			require.NotNil(t, envelope.Error, w.Body.String())
+			assert.False(t, envelope.Success)
+			assert.Equal(t, tt.wantCode, envelope.Error.Code)
+			assert.Equal(t, tt.wantStatus, envelope.Error.Status)
+			assert.Equal(t, tt.wantMessage, envelope.Error.Message)
+			assert.Equal(t, tt.wantDetails, envelope.Error.Details)
+		})
+	}
+
+	_, envelope := get(t, "/api/v2/invalid")
+	assert.Equal(t, []utils.ValidationError{{Field: "lat", Message: "must be a number", Value: "north"}}, envelope.Error.ValidationErrors)
+}
+
+func TestPassThrough(t *testing.T) {
+	// v1 is untouched
+	w, _ := get(t, "/api/summary/7")
+	assert.JSONEq(t, `{"user_id":"7","name":"Leeds","created_at":"2025-03-01 12:30:00","activity_ids":["12","13"],"event_time":1740832200}`, w.Body.String())
+
+	// Non-JSON responses are not wrapped
+	w, _ = get(t, "/api/v2/export")
+	assert.Equal(t, "PK", w.Body.String())
+
+	// Neither are paths that only start like the prefix
+	w, _ = get(t, "/api/v2x/summary/7")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
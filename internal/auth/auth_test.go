@@ -3,10 +3,12 @@ package auth
 import (
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/gin-gonic/gin"
 	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/session"
 	"github.com/nikhilvedi/strava-coverage/internal/storage"
 	"github.com/stretchr/testify/assert"
 )
@@ -17,9 +19,10 @@ func setupAuthTestService() *Service {
 		StravaClientSecret: "test_client_secret",
 		StravaRedirectURI:  "http://localhost:8080/oauth/callback",
 		DBUrl:              "test_db_url",
+		SessionSecret:      "test_session_secret",
 	}
 	db := &storage.DB{} // Mock database for testing
-	return NewService(cfg, db)
+	return NewService(cfg, db, session.NewManager(cfg), nil, nil)
 }
 
 func setupAuthTestRouter() *gin.Engine {
@@ -64,22 +67,114 @@ func TestOAuthAuthorizeRedirect(t *testing.T) {
 
 	assert.Equal(t, http.StatusFound, w.Code)
 
-	location := w.Header().Get("Location")
-	assert.Contains(t, location, "https://www.strava.com/oauth/authorize")
-	assert.Contains(t, location, "client_id=test_client_id")
-	assert.Contains(t, location, "response_type=code")
-	assert.Contains(t, location, "scope=read,activity:read")
+	location, err := url.Parse(w.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://www.strava.com/oauth/authorize", location.Scheme+"://"+location.Host+location.Path)
+	query := location.Query()
+	assert.Equal(t, "test_client_id", query.Get("client_id"))
+	assert.Equal(t, "code", query.Get("response_type"))
+	assert.Equal(t, "read,activity:read,activity:read_all,activity:write", query.Get("scope"))
+	assert.NotEmpty(t, query.Get("state"))
+
+	// The state is bound to the browser through a cookie
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, session.StateCookieName, cookies[0].Name)
 }
 
-func TestOAuthCallbackMissingCode(t *testing.T) {
+func TestOAuthCallbackWithoutState(t *testing.T) {
 	router := setupAuthTestRouter()
 
 	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/oauth/callback", nil)
+	req, _ := http.NewRequest("GET", "/oauth/callback?code=abc", nil)
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusBadRequest, w.Code)
-	assert.Contains(t, w.Body.String(), "Authorization code not provided")
+	assert.Contains(t, w.Body.String(), "sign in again")
+}
+
+func TestOAuthCallbackDenied(t *testing.T) {
+	service := setupAuthTestService()
+	service.config.FrontendURL = "http://localhost:3000"
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	service.SetupRoutes(router)
+
+	// Start signing in to get a state and its cookie
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/oauth/authorize?return_to=/cities/3", nil))
+	location, _ := url.Parse(w.Header().Get("Location"))
+	cookie := w.Result().Cookies()[0]
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/oauth/callback?error=access_denied&state="+url.QueryEscape(location.Query().Get("state")), nil)
+	req.AddCookie(cookie)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "http://localhost:3000/oauth/callback?error=access_denied&return_to=%2Fcities%2F3&success=false", w.Header().Get("Location"))
+}
+
+func TestOAuthCallbackRejectsBadTokenResponse(t *testing.T) {
+	responses := map[string]struct {
+		status int
+		body   string
+	}{
+		"refused code":    {http.StatusBadRequest, `{"message":"Bad Request","errors":[{"field":"code","code":"invalid"}]}`},
+		"no access token": {http.StatusOK, `{"refresh_token":"r","expires_at":1700000000,"athlete":{"id":42}}`},
+		"no athlete":      {http.StatusOK, `{"access_token":"a","refresh_token":"r","expires_at":1700000000}`},
+		"not JSON":        {http.StatusOK, `<html>maintenance</html>`},
+	}
+
+	for name, response := range responses {
+		t.Run(name, func(t *testing.T) {
+			strava := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(response.status)
+				_, _ = w.Write([]byte(response.body))
+			}))
+			defer strava.Close()
+
+			service := setupAuthTestService()
+			service.config.StravaOAuthURL = strava.URL
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			service.SetupRoutes(router)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/oauth/authorize", nil))
+			location, _ := url.Parse(w.Header().Get("Location"))
+			cookie := w.Result().Cookies()[0]
+
+			// Nothing reaches the (mock) database, and nobody is signed in
+			w = httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/oauth/callback?code=abc&scope=read,activity:read&state="+url.QueryEscape(location.Query().Get("state")), nil)
+			req.AddCookie(cookie)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusBadGateway, w.Code)
+			for _, c := range w.Result().Cookies() {
+				assert.NotEqual(t, session.CookieName, c.Name)
+			}
+		})
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	features := Features(storage.Scopes{storage.ScopeRead, storage.ScopeActivityRead})
+	assert.Len(t, features, 3)
+
+	enabled := map[string]bool{}
+	for _, f := range features {
+		enabled[f.Name] = f.Enabled
+		if !f.Enabled {
+			assert.NotEmpty(t, f.Reason)
+		}
+	}
+	assert.Equal(t, map[string]bool{
+		FeatureActivityImport:    true,
+		FeaturePrivateActivities: false,
+		FeatureActivityUpdates:   false,
+	}, enabled)
 }
 
 func TestInvalidUserIDInUserRoute(t *testing.T) {
@@ -1,36 +1,55 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"time"
 
 	resty "github.com/go-resty/resty/v2"
 	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/logging"
+	"github.com/nikhilvedi/strava-coverage/internal/metrics"
+	"github.com/nikhilvedi/strava-coverage/internal/progress"
 	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/nikhilvedi/strava-coverage/internal/webhooks"
 )
 
 // AutoProcessor handles automatic processing of user data on login
 type AutoProcessor struct {
-	DB     *storage.DB
-	Config *config.Config
-	client *resty.Client
+	DB       *storage.DB
+	Config   *config.Config
+	Webhooks *webhooks.Dispatcher
+	Progress *progress.Broker
+	client   *resty.Client
 }
 
 // NewAutoProcessor creates a new auto processor
-func NewAutoProcessor(db *storage.DB, cfg *config.Config) *AutoProcessor {
+func NewAutoProcessor(db *storage.DB, cfg *config.Config, events *webhooks.Dispatcher, broker *progress.Broker) *AutoProcessor {
 	return &AutoProcessor{
-		DB:     db,
-		Config: cfg,
-		client: resty.New(),
+		DB:       db,
+		Config:   cfg,
+		Webhooks: events,
+		Progress: broker,
+		client:   metrics.NewStravaClient(cfg),
 	}
 }
 
 // ProcessUserOnLogin automatically processes user's activities and maps them to cities
-func (ap *AutoProcessor) ProcessUserOnLogin(userID int, accessToken string) error {
-	log.Printf("Starting automatic processing for user %d", userID)
+func (ap *AutoProcessor) ProcessUserOnLogin(ctx context.Context, userID int, accessToken string) (err error) {
+	ctx = logging.With(ctx, logging.KeyUserID, userID, logging.KeyJobID, logging.NewJobID("login"))
+	slog.InfoContext(ctx, "Starting automatic processing")
+
+	ap.publish(userID, progress.TypeStarted, nil)
+	defer func() {
+		if err != nil {
+			ap.publish(userID, progress.TypeFailed, progress.Failure{Error: err.Error()})
+		} else {
+			ap.publish(userID, progress.TypeCompleted, nil)
+		}
+	}()
 
 	// Step 1: Check if user already has activities imported
 	hasActivities, err := ap.hasExistingActivities(userID)
@@ -39,39 +58,56 @@ func (ap *AutoProcessor) ProcessUserOnLogin(userID int, accessToken string) erro
 	}
 
 	if hasActivities {
-		log.Printf("User %d already has activities, skipping import and proceeding to mapping/coverage", userID)
+		slog.InfoContext(ctx, "User already has activities, skipping import and proceeding to mapping/coverage")
 		// Skip import, but still try to map activities to cities and calculate coverage
-		if err := ap.mapActivitiesToCities(userID); err != nil {
-			log.Printf("Warning: Failed to map activities to cities for user %d: %v", userID, err)
+		ap.publish(userID, progress.TypeStep, progress.Step{Step: progress.StepMappingCities})
+		if err := ap.mapActivitiesToCities(ctx, userID); err != nil {
+			slog.WarnContext(ctx, "Failed to map activities to cities", "error", err)
 		}
-		if err := ap.calculateCoverageForUserCities(userID); err != nil {
-			log.Printf("Warning: Failed to calculate coverage for user %d: %v", userID, err)
+		ap.publish(userID, progress.TypeStep, progress.Step{Step: progress.StepCalculatingCoverage})
+		if err := ap.calculateCoverageForUserCities(ctx, userID); err != nil {
+			slog.WarnContext(ctx, "Failed to calculate coverage", "error", err)
 		}
 		return nil
 	}
 
 	// Step 2: Import all activities from Strava
-	log.Printf("Importing activities for user %d", userID)
-	if err := ap.importAllActivities(userID, accessToken); err != nil {
+	slog.InfoContext(ctx, "Importing activities")
+	ap.publish(userID, progress.TypeStep, progress.Step{Step: progress.StepImporting})
+	if err := ap.importAllActivities(ctx, userID, accessToken); err != nil {
+		metrics.Imports.WithLabelValues(storage.ActivitySourceStrava, "failed").Inc()
 		return fmt.Errorf("failed to import activities: %w", err)
 	}
+	metrics.Imports.WithLabelValues(storage.ActivitySourceStrava, "completed").Inc()
 
 	// Step 3: Map activities to cities
-	log.Printf("Mapping activities to cities for user %d", userID)
-	if err := ap.mapActivitiesToCities(userID); err != nil {
+	slog.InfoContext(ctx, "Mapping activities to cities")
+	ap.publish(userID, progress.TypeStep, progress.Step{Step: progress.StepMappingCities})
+	if err := ap.mapActivitiesToCities(ctx, userID); err != nil {
 		return fmt.Errorf("failed to map activities to cities: %w", err)
 	}
 
 	// Step 4: Calculate coverage for detected cities
-	log.Printf("Calculating coverage for user %d", userID)
-	if err := ap.calculateCoverageForUserCities(userID); err != nil {
+	slog.InfoContext(ctx, "Calculating coverage")
+	ap.publish(userID, progress.TypeStep, progress.Step{Step: progress.StepCalculatingCoverage})
+	if err := ap.calculateCoverageForUserCities(ctx, userID); err != nil {
 		return fmt.Errorf("failed to calculate coverage: %w", err)
 	}
 
-	log.Printf("Completed automatic processing for user %d", userID)
+	slog.InfoContext(ctx, "Completed automatic processing")
 	return nil
 }
 
+// publish publishes the progress of a user's login processing
+func (ap *AutoProcessor) publish(userID int, eventType string, data interface{}) {
+	ap.Progress.Publish(progress.Event{
+		Kind:   progress.KindLogin,
+		Type:   eventType,
+		UserID: userID,
+		Data:   data,
+	})
+}
+
 // hasExistingActivities checks if user already has activities in the database
 func (ap *AutoProcessor) hasExistingActivities(userID int) (bool, error) {
 	var count int
@@ -82,17 +118,25 @@ func (ap *AutoProcessor) hasExistingActivities(userID int) (bool, error) {
 	return count > 0, nil
 }
 
-// importAllActivities imports all activities from Strava API with rate limit handling
-func (ap *AutoProcessor) importAllActivities(userID int, accessToken string) error {
+// importAllActivities imports all activities from Strava API with rate limit handling.
+// Private activities are skipped unless the user granted activity:read_all.
+func (ap *AutoProcessor) importAllActivities(ctx context.Context, userID int, accessToken string) error {
+	scopes, err := ap.DB.GetUserScopes(userID)
+	if err != nil {
+		return fmt.Errorf("failed to get Strava scopes: %w", err)
+	}
+
 	page := 1
 	perPage := 25 // Conservative to avoid rate limits (Strava allows ~100 requests per 15 min)
 	totalImported := 0
+	totalSkipped := 0
+	totalFailed := 0
 	maxRetries := 3
 
 	for {
-		log.Printf("Importing page %d for user %d (imported %d so far)", page, userID, totalImported)
+		slog.DebugContext(ctx, "Importing page", "page", page, "imported", totalImported)
 
-		var activities []StravaActivity
+		var activities []storage.StravaActivity
 		var err error
 
 		// Retry with exponential backoff for rate limits
@@ -104,7 +148,7 @@ func (ap *AutoProcessor) importAllActivities(userID int, accessToken string) err
 					"page":     fmt.Sprintf("%d", page),
 					"per_page": fmt.Sprintf("%d", perPage),
 				}).
-				Get("https://www.strava.com/api/v3/athlete/activities")
+				Get("/athlete/activities")
 
 			if httpErr != nil {
 				err = fmt.Errorf("HTTP request failed: %w", httpErr)
@@ -114,7 +158,7 @@ func (ap *AutoProcessor) importAllActivities(userID int, accessToken string) err
 			// Check for rate limit (429) or other API errors
 			if resp.StatusCode() == 429 {
 				backoffDuration := time.Duration(1<<uint(attempt)) * time.Minute // 1min, 2min, 4min
-				log.Printf("Rate limited on page %d, attempt %d/%d. Backing off for %v", page, attempt+1, maxRetries, backoffDuration)
+				slog.WarnContext(ctx, "Rate limited by Strava, backing off", "page", page, "attempt", attempt+1, "max_attempts", maxRetries, "backoff", backoffDuration.String())
 
 				if attempt == maxRetries-1 {
 					return fmt.Errorf("rate limit exceeded after %d attempts on page %d", maxRetries, page)
@@ -150,12 +194,43 @@ func (ap *AutoProcessor) importAllActivities(userID int, accessToken string) err
 
 		// Process each activity (using summary data only, no detailed fetches)
 		for _, activity := range activities {
+			if !scopes.AllowsActivity(activity.Private) {
+				totalSkipped++
+				metrics.ImportedActivities.WithLabelValues(storage.ActivitySourceStrava, "skipped").Inc()
+				ap.publish(userID, progress.TypeActivity, progress.ActivityResult{
+					ActivityID: activity.ID,
+					Name:       activity.Name,
+					Status:     progress.StatusSkipped,
+				})
+				continue
+			}
 			if err := ap.importActivitySummary(userID, activity); err != nil {
-				log.Printf("Failed to import activity %d: %v", activity.ID, err)
+				slog.WarnContext(ctx, "Failed to import activity", "activity_id", activity.ID, "error", err)
+				totalFailed++
+				metrics.ImportedActivities.WithLabelValues(storage.ActivitySourceStrava, "failed").Inc()
+				ap.publish(userID, progress.TypeActivity, progress.ActivityResult{
+					ActivityID: activity.ID,
+					Name:       activity.Name,
+					Status:     progress.StatusFailed,
+					Error:      err.Error(),
+				})
 				continue
 			}
 			totalImported++
+			metrics.ImportedActivities.WithLabelValues(storage.ActivitySourceStrava, "imported").Inc()
+			ap.publish(userID, progress.TypeActivity, progress.ActivityResult{
+				ActivityID: activity.ID,
+				Name:       activity.Name,
+				Status:     progress.StatusImported,
+			})
 		}
+		ap.publish(userID, progress.TypeProgress, progress.Counts{
+			Source:   storage.ActivitySourceStrava,
+			Page:     page,
+			Imported: totalImported,
+			Skipped:  totalSkipped,
+			Failed:   totalFailed,
+		})
 
 		// If we got fewer activities than requested, we've reached the end
 		if len(activities) < perPage {
@@ -168,37 +243,15 @@ func (ap *AutoProcessor) importAllActivities(userID int, accessToken string) err
 		time.Sleep(5 * time.Second)
 	}
 
-	log.Printf("Imported %d activities for user %d", totalImported, userID)
+	slog.InfoContext(ctx, "Imported activities", "imported", totalImported, "skipped", totalSkipped, "failed", totalFailed)
 	return nil
 }
 
-// StravaActivity represents a Strava activity from the API
-type StravaActivity struct {
-	ID             int64     `json:"id"`
-	Name           string    `json:"name"`
-	Type           string    `json:"type"`
-	SportType      string    `json:"sport_type"`
-	Distance       float64   `json:"distance"`
-	MovingTime     int       `json:"moving_time"`
-	ElapsedTime    int       `json:"elapsed_time"`
-	TotalElevation float64   `json:"total_elevation_gain"`
-	StartDate      string    `json:"start_date"`
-	StartDateLocal string    `json:"start_date_local"`
-	TimeZone       string    `json:"timezone"`
-	StartLatLng    []float64 `json:"start_latlng"`
-	EndLatLng      []float64 `json:"end_latlng"`
-	Map            struct {
-		ID              string `json:"id"`
-		Polyline        string `json:"polyline"`
-		SummaryPolyline string `json:"summary_polyline"`
-	} `json:"map"`
-}
-
 // importSingleActivity imports a single activity with detailed data
 // TODO: This function will be used for selective activity import in future versions
 //
 //nolint:unused // This method is reserved for future functionality
-func (ap *AutoProcessor) importSingleActivity(userID int, accessToken string, activity StravaActivity) error {
+func (ap *AutoProcessor) importSingleActivity(userID int, accessToken string, activity storage.StravaActivity) error {
 	// Check if activity already exists
 	var existingID int64
 	err := ap.DB.QueryRow("SELECT strava_activity_id FROM activities WHERE strava_activity_id = $1", activity.ID).Scan(&existingID)
@@ -210,70 +263,18 @@ func (ap *AutoProcessor) importSingleActivity(userID int, accessToken string, ac
 	// Get detailed activity data including polyline
 	detailedResp, err := ap.client.R().
 		SetHeader("Authorization", "Bearer "+accessToken).
-		Get(fmt.Sprintf("https://www.strava.com/api/v3/activities/%d", activity.ID))
+		Get(fmt.Sprintf("/activities/%d", activity.ID))
 
 	if err != nil {
 		return fmt.Errorf("failed to fetch detailed activity: %w", err)
 	}
 
-	var detailedActivity StravaActivity
+	var detailedActivity storage.StravaActivity
 	if err := json.Unmarshal(detailedResp.Body(), &detailedActivity); err != nil {
 		return fmt.Errorf("failed to parse detailed activity: %w", err)
 	}
 
-	// Parse start date
-	startTime, err := time.Parse(time.RFC3339, detailedActivity.StartDate)
-	if err != nil {
-		return fmt.Errorf("failed to parse start date: %w", err)
-	}
-
-	// Insert activity into database
-	query := `
-		INSERT INTO activities (
-			user_id, strava_activity_id, name, activity_type, sport_type,
-			distance_km, moving_time_seconds, elapsed_time_seconds,
-			total_elevation_gain_m, start_time, timezone, polyline,
-			start_latitude, start_longitude, end_latitude, end_longitude
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
-		ON CONFLICT (strava_activity_id) DO NOTHING`
-
-	var startLat, startLng, endLat, endLng *float64
-	if len(detailedActivity.StartLatLng) == 2 {
-		startLat = &detailedActivity.StartLatLng[0]
-		startLng = &detailedActivity.StartLatLng[1]
-	}
-	if len(detailedActivity.EndLatLng) == 2 {
-		endLat = &detailedActivity.EndLatLng[0]
-		endLng = &detailedActivity.EndLatLng[1]
-	}
-
-	// Convert sport_type to activity_type if sport_type is empty
-	activityType := detailedActivity.Type
-	sportType := detailedActivity.SportType
-	if sportType == "" {
-		sportType = activityType
-	}
-
-	_, err = ap.DB.Exec(query,
-		userID,
-		detailedActivity.ID,
-		detailedActivity.Name,
-		activityType,
-		sportType,
-		detailedActivity.Distance/1000.0, // Convert to km
-		detailedActivity.MovingTime,
-		detailedActivity.ElapsedTime,
-		detailedActivity.TotalElevation,
-		startTime,
-		detailedActivity.TimeZone,
-		detailedActivity.Map.Polyline,
-		startLat,
-		startLng,
-		endLat,
-		endLng,
-	)
-
-	if err != nil {
+	if _, err := ap.DB.UpsertActivity(userID, detailedActivity.Metadata(), ""); err != nil {
 		return fmt.Errorf("failed to insert activity: %w", err)
 	}
 
@@ -281,7 +282,7 @@ func (ap *AutoProcessor) importSingleActivity(userID int, accessToken string, ac
 }
 
 // importActivitySummary imports activity using only summary data (no additional API calls)
-func (ap *AutoProcessor) importActivitySummary(userID int, activity StravaActivity) error {
+func (ap *AutoProcessor) importActivitySummary(userID int, activity storage.StravaActivity) error {
 	// Check if activity already exists
 	var existingID int64
 	err := ap.DB.QueryRow("SELECT strava_activity_id FROM activities WHERE strava_activity_id = $1", activity.ID).Scan(&existingID)
@@ -290,58 +291,8 @@ func (ap *AutoProcessor) importActivitySummary(userID int, activity StravaActivi
 		return nil
 	}
 
-	// Parse start date
-	startTime, err := time.Parse(time.RFC3339, activity.StartDate)
-	if err != nil {
-		return fmt.Errorf("failed to parse start date: %w", err)
-	}
-
-	// Insert activity using summary data only
-	query := `
-		INSERT INTO activities (
-			user_id, strava_activity_id, name, activity_type, sport_type,
-			distance_km, moving_time_seconds, elapsed_time_seconds,
-			total_elevation_gain_m, start_time, timezone,
-			start_latitude, start_longitude, end_latitude, end_longitude
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
-		ON CONFLICT (strava_activity_id) DO NOTHING`
-
-	var startLat, startLng, endLat, endLng *float64
-	if len(activity.StartLatLng) == 2 {
-		startLat = &activity.StartLatLng[0]
-		startLng = &activity.StartLatLng[1]
-	}
-	if len(activity.EndLatLng) == 2 {
-		endLat = &activity.EndLatLng[0]
-		endLng = &activity.EndLatLng[1]
-	}
-
-	// Convert sport_type to activity_type if sport_type is empty
-	activityType := activity.Type
-	sportType := activity.SportType
-	if sportType == "" {
-		sportType = activityType
-	}
-
-	_, err = ap.DB.Exec(query,
-		userID,
-		activity.ID,
-		activity.Name,
-		activityType,
-		sportType,
-		activity.Distance/1000.0, // Convert to km
-		activity.MovingTime,
-		activity.ElapsedTime,
-		activity.TotalElevation,
-		startTime,
-		activity.TimeZone,
-		startLat,
-		startLng,
-		endLat,
-		endLng,
-	)
-
-	if err != nil {
+	// The path is built later from the summary polyline or start/end coordinates
+	if _, err := ap.DB.UpsertActivity(userID, activity.Metadata(), ""); err != nil {
 		return fmt.Errorf("failed to insert activity: %w", err)
 	}
 
@@ -349,15 +300,15 @@ func (ap *AutoProcessor) importActivitySummary(userID int, activity StravaActivi
 }
 
 // mapActivitiesToCities maps user activities to cities based on spatial intersection and discovers new cities
-func (ap *AutoProcessor) mapActivitiesToCities(userID int) error {
+func (ap *AutoProcessor) mapActivitiesToCities(ctx context.Context, userID int) error {
 	// First, create geometries for activities that don't have them
-	if err := ap.createActivityGeometries(userID); err != nil {
+	if err := ap.createActivityGeometries(ctx, userID); err != nil {
 		return fmt.Errorf("failed to create activity geometries: %w", err)
 	}
 
 	// Step 1: Discover and create new cities BEFORE mapping to avoid over-assignment to large existing cities
-	if err := ap.discoverAndCreateCitiesFromAllActivities(userID); err != nil {
-		log.Printf("Warning: Failed to discover new cities for user %d: %v", userID, err)
+	if err := ap.discoverAndCreateCitiesFromAllActivities(ctx, userID); err != nil {
+		slog.WarnContext(ctx, "Failed to discover new cities", "error", err)
 		// Continue with mapping to existing cities
 	}
 
@@ -379,13 +330,13 @@ func (ap *AutoProcessor) mapActivitiesToCities(userID int) error {
 	}
 
 	mapped, _ := result.RowsAffected()
-	log.Printf("Mapped %d activities to cities for user %d", mapped, userID)
+	slog.InfoContext(ctx, "Mapped activities to cities", "mapped", mapped)
 
 	return nil
 }
 
 // createActivityGeometries creates PostGIS geometries from polylines or start/end coordinates
-func (ap *AutoProcessor) createActivityGeometries(userID int) error {
+func (ap *AutoProcessor) createActivityGeometries(ctx context.Context, userID int) error {
 	// First try to create geometries from polylines if available
 	polylineQuery := `
 		UPDATE activities 
@@ -397,11 +348,11 @@ func (ap *AutoProcessor) createActivityGeometries(userID int) error {
 
 	result, err := ap.DB.Exec(polylineQuery, userID)
 	if err != nil {
-		log.Printf("Polyline geometry creation failed (expected if PostGIS < 3.1): %v", err)
+		slog.WarnContext(ctx, "Polyline geometry creation failed (expected if PostGIS < 3.1)", "error", err)
 		// Fall back to coordinate-based approach
 	} else {
 		rowsAffected, _ := result.RowsAffected()
-		log.Printf("Created geometries from polylines for %d activities for user %d", rowsAffected, userID)
+		slog.DebugContext(ctx, "Created geometries from polylines", "activities", rowsAffected)
 	}
 
 	// Fall back to creating simple linestrings from start/end coordinates for activities without paths
@@ -426,13 +377,13 @@ func (ap *AutoProcessor) createActivityGeometries(userID int) error {
 	}
 
 	rowsAffected2, _ := result2.RowsAffected()
-	log.Printf("Created geometries from coordinates for %d activities for user %d", rowsAffected2, userID)
+	slog.DebugContext(ctx, "Created geometries from coordinates", "activities", rowsAffected2)
 
 	return nil
 }
 
 // calculateCoverageForUserCities calculates coverage for all cities that the user has activities in
-func (ap *AutoProcessor) calculateCoverageForUserCities(userID int) error {
+func (ap *AutoProcessor) calculateCoverageForUserCities(ctx context.Context, userID int) error {
 	// Get all cities where user has activities
 	citiesQuery := `
 		SELECT DISTINCT c.id, c.name
@@ -459,15 +410,15 @@ func (ap *AutoProcessor) calculateCoverageForUserCities(userID int) error {
 		cityNames[cityID] = cityName
 	}
 
-	log.Printf("Calculating coverage for %d cities for user %d", len(cityIDs), userID)
+	slog.InfoContext(ctx, "Calculating coverage of cities", "cities", len(cityIDs))
 
 	// Calculate coverage for each city
 	for _, cityID := range cityIDs {
 		if err := ap.calculateCityCoverage(userID, cityID); err != nil {
-			log.Printf("Failed to calculate coverage for city %d (%s): %v", cityID, cityNames[cityID], err)
+			slog.WarnContext(ctx, "Failed to calculate coverage", "city_id", cityID, "city", cityNames[cityID], "error", err)
 			continue
 		}
-		log.Printf("Calculated coverage for city %d (%s)", cityID, cityNames[cityID])
+		slog.DebugContext(ctx, "Calculated coverage", "city_id", cityID, "city", cityNames[cityID])
 	}
 
 	return nil
@@ -509,7 +460,7 @@ func (ap *AutoProcessor) calculateCityCoverage(userID, cityID int) error {
 // TODO: This function will be used for automatic city discovery in future versions
 //
 //nolint:unused // This method is reserved for future functionality
-func (ap *AutoProcessor) discoverAndCreateCitiesForUnmappedActivities(userID int) error {
+func (ap *AutoProcessor) discoverAndCreateCitiesForUnmappedActivities(ctx context.Context, userID int) error {
 	// Find unique coordinate clusters for unmapped activities
 	query := `
 		SELECT 
@@ -543,10 +494,10 @@ func (ap *AutoProcessor) discoverAndCreateCitiesForUnmappedActivities(userID int
 			continue
 		}
 
-		log.Printf("Found cluster of %d activities around lat=%f, lng=%f", activityCount, avgLat, avgLng)
+		slog.DebugContext(ctx, "Found activity cluster", "activities", activityCount, "lat", avgLat, "lng", avgLng)
 
 		// Try to get city name from reverse geocoding or use coordinates as name
-		cityName, countryCode := ap.reverseGeocodeCity(avgLat, avgLng)
+		cityName, countryCode := ap.reverseGeocodeCity(ctx, avgLat, avgLng)
 		if cityName == "" {
 			cityName = fmt.Sprintf("Area_%d_%d", int(avgLat*100), int(avgLng*100))
 			countryCode = "XX" // Unknown country
@@ -560,27 +511,26 @@ func (ap *AutoProcessor) discoverAndCreateCitiesForUnmappedActivities(userID int
 		}
 
 		if existingCount > 0 {
-			log.Printf("City %s already exists, skipping creation", cityName)
+			slog.DebugContext(ctx, "City already exists, skipping creation", "city", cityName)
 			continue
 		}
 
 		// Create new city with circular boundary (10km radius)
-		if err := ap.createCityFromCoordinates(cityName, countryCode, avgLat, avgLng); err != nil {
-			log.Printf("Failed to create city %s: %v", cityName, err)
+		if err := ap.createCityFromCoordinates(ctx, cityName, countryCode, avgLat, avgLng); err != nil {
+			slog.WarnContext(ctx, "Failed to create city", "city", cityName, "error", err)
 			continue
 		}
 
 		citiesCreated++
-		log.Printf("Created new city: %s, %s", cityName, countryCode)
 	}
 
-	log.Printf("Created %d new cities for user %d", citiesCreated, userID)
+	slog.InfoContext(ctx, "Created new cities", "created", citiesCreated)
 	return nil
 }
 
 // discoverAndCreateCitiesFromAllActivities finds activity clusters from ALL user activities (regardless of current mapping) and creates cities for them
-func (ap *AutoProcessor) discoverAndCreateCitiesFromAllActivities(userID int) error {
-	log.Printf("Starting city discovery from all activities for user %d", userID)
+func (ap *AutoProcessor) discoverAndCreateCitiesFromAllActivities(ctx context.Context, userID int) error {
+	slog.InfoContext(ctx, "Starting city discovery from all activities")
 
 	// Find unique coordinate clusters from GPS path data (since start coordinates are sparse)
 	query := `
@@ -615,10 +565,10 @@ func (ap *AutoProcessor) discoverAndCreateCitiesFromAllActivities(userID int) er
 		}
 
 		clustersFound++
-		log.Printf("Found cluster #%d of %d activities around lat=%f, lng=%f", clustersFound, activityCount, avgLat, avgLng)
+		slog.DebugContext(ctx, "Found activity cluster", "cluster", clustersFound, "activities", activityCount, "lat", avgLat, "lng", avgLng)
 
 		// Try to get city name from reverse geocoding or use coordinates as name
-		cityName, countryCode := ap.reverseGeocodeCity(avgLat, avgLng)
+		cityName, countryCode := ap.reverseGeocodeCity(ctx, avgLat, avgLng)
 		if cityName == "" {
 			cityName = fmt.Sprintf("Area_%d_%d", int(avgLat*100), int(avgLng*100))
 			countryCode = "XX" // Unknown country
@@ -635,24 +585,21 @@ func (ap *AutoProcessor) discoverAndCreateCitiesFromAllActivities(userID int) er
 		}
 
 		if existingCount > 0 {
-			log.Printf("City %s or nearby city already exists, skipping creation", cityName)
+			slog.DebugContext(ctx, "City or nearby city already exists, skipping creation", "city", cityName)
 			continue
 		}
 
 		// Create new city with circular boundary (10km radius)
-		if err := ap.createCityFromCoordinates(cityName, countryCode, avgLat, avgLng); err != nil {
-			log.Printf("Failed to create city %s: %v", cityName, err)
+		if err := ap.createCityFromCoordinates(ctx, cityName, countryCode, avgLat, avgLng); err != nil {
+			slog.WarnContext(ctx, "Failed to create city", "city", cityName, "error", err)
 			continue
 		}
 
 		citiesCreated++
-		log.Printf("Created new city: %s, %s", cityName, countryCode)
 	}
 
-	log.Printf("Found %d activity clusters for user %d, created %d new cities", clustersFound, userID, citiesCreated)
-	if clustersFound > 0 && citiesCreated == 0 {
-		log.Printf("Warning: Found activity clusters but no new cities were created - they may already exist or be too close to existing cities")
-	}
+	// Clusters without new cities may already have one, or be too close to an existing one
+	slog.InfoContext(ctx, "City discovery completed", "clusters", clustersFound, "created", citiesCreated)
 	return nil
 }
 
@@ -671,7 +618,7 @@ type NominatimResponse struct {
 }
 
 // reverseGeocodeCity attempts to get city name from coordinates using Nominatim API
-func (ap *AutoProcessor) reverseGeocodeCity(lat, lng float64) (string, string) {
+func (ap *AutoProcessor) reverseGeocodeCity(ctx context.Context, lat, lng float64) (string, string) {
 	// Use Nominatim (OpenStreetMap) reverse geocoding API
 	url := fmt.Sprintf("https://nominatim.openstreetmap.org/reverse?format=json&lat=%f&lon=%f&zoom=12&addressdetails=1", lat, lng)
 
@@ -680,13 +627,13 @@ func (ap *AutoProcessor) reverseGeocodeCity(lat, lng float64) (string, string) {
 		Get(url)
 
 	if err != nil || resp.StatusCode() != 200 {
-		log.Printf("Reverse geocoding API failed for lat=%f, lng=%f: %v", lat, lng, err)
+		slog.WarnContext(ctx, "Reverse geocoding failed", "lat", lat, "lng", lng, "error", err)
 		return ap.fallbackCityName(lat, lng)
 	}
 
 	var result NominatimResponse
 	if err := json.Unmarshal(resp.Body(), &result); err != nil {
-		log.Printf("Failed to parse reverse geocoding response for lat=%f, lng=%f: %v", lat, lng, err)
+		slog.WarnContext(ctx, "Failed to parse reverse geocoding response", "lat", lat, "lng", lng, "error", err)
 		return ap.fallbackCityName(lat, lng)
 	}
 
@@ -713,11 +660,11 @@ func (ap *AutoProcessor) reverseGeocodeCity(lat, lng float64) (string, string) {
 	}
 
 	if cityName == "" {
-		log.Printf("No city name found in API response for lat=%f, lng=%f", lat, lng)
+		slog.DebugContext(ctx, "No city name in reverse geocoding response", "lat", lat, "lng", lng)
 		return ap.fallbackCityName(lat, lng)
 	}
 
-	log.Printf("Reverse geocoded lat=%f, lng=%f to %s, %s", lat, lng, cityName, countryCode)
+	slog.DebugContext(ctx, "Reverse geocoded", "lat", lat, "lng", lng, "city", cityName, "country_code", countryCode)
 	return cityName, countryCode
 }
 
@@ -747,7 +694,7 @@ func (ap *AutoProcessor) fallbackCityName(lat, lng float64) (string, string) {
 	}
 	return fmt.Sprintf("Area_%.2f_%.2f", lat, lng), "XX"
 } // createCityFromCoordinates creates a new city in the database
-func (ap *AutoProcessor) createCityFromCoordinates(name, countryCode string, lat, lng float64) error {
+func (ap *AutoProcessor) createCityFromCoordinates(ctx context.Context, name, countryCode string, lat, lng float64) error {
 	// Create a circular boundary around the city center (10km radius)
 	query := `
 		INSERT INTO cities (name, country_code, boundary) 
@@ -760,6 +707,7 @@ func (ap *AutoProcessor) createCityFromCoordinates(name, countryCode string, lat
 		return fmt.Errorf("failed to insert city: %w", err)
 	}
 
-	log.Printf("Created city '%s' with ID %d at coordinates (%.6f, %.6f)", name, cityID, lat, lng)
+	slog.InfoContext(ctx, "Created city", "city_id", cityID, "city", name, "country_code", countryCode, "lat", lat, "lng", lng)
+	ap.Webhooks.CityCreated(cityID, name, countryCode, "detected")
 	return nil
 }
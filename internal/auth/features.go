@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
+)
+
+// Feature names
+const (
+	FeatureActivityImport    = "activity_import"
+	FeaturePrivateActivities = "private_activities"
+	FeatureActivityUpdates   = "activity_updates"
+)
+
+// Feature is something the app does with a user's Strava account and whether the scopes
+// they granted allow it
+type Feature struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// Scope is the Strava scope the feature needs
+	Scope string `json:"scope"`
+	// Reason explains why a disabled feature is off
+	Reason string `json:"reason,omitempty"`
+}
+
+// features lists the scope each feature needs and why it is off without it
+var features = []struct {
+	name   string
+	scope  string
+	reason string
+}{
+	{FeatureActivityImport, storage.ScopeActivityRead,
+		"Activities cannot be imported because access to them was not allowed on Strava"},
+	{FeaturePrivateActivities, storage.ScopeActivityReadAll,
+		"Private activities are not imported because access to them was not allowed on Strava"},
+	{FeatureActivityUpdates, storage.ScopeActivityWrite,
+		"Coverage comments and description updates are off because updating activities was not allowed on Strava"},
+}
+
+// Features reports which features the granted scopes allow
+func Features(scopes storage.Scopes) []Feature {
+	result := make([]Feature, 0, len(features))
+	for _, f := range features {
+		feature := Feature{Name: f.name, Enabled: scopes.Has(f.scope), Scope: f.scope}
+		if !feature.Enabled {
+			feature.Reason = f.reason
+		}
+		result = append(result, feature)
+	}
+	return result
+}
+
+// GetUserFeaturesHandler returns the scopes a user granted and the features they allow,
+// with a link to grant the missing ones
+func (s *Service) GetUserFeaturesHandler(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	scopes, err := s.db.GetUserScopes(userID)
+	if err != nil {
+		utils.NotFound(c, utils.CodeUserNotFound, "User not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":         userID,
+		"scopes":          scopes,
+		"features":        Features(scopes),
+		"reauthorize_url": s.reauthorizeURL(c.Query("return_to")),
+	})
+}
+
+// reauthorizeURL is where a user signs in with Strava again to grant missing scopes
+func (s *Service) reauthorizeURL(returnTo string) string {
+	query := url.Values{"prompt": {"force"}}
+	if returnTo != "" {
+		query.Set("return_to", returnTo)
+	}
+	return s.config.PublicURL + "/oauth/authorize?" + query.Encode()
+}
@@ -3,15 +3,22 @@ package auth
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	resty "github.com/go-resty/resty/v2"
 	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/logging"
+	"github.com/nikhilvedi/strava-coverage/internal/metrics"
+	"github.com/nikhilvedi/strava-coverage/internal/progress"
+	"github.com/nikhilvedi/strava-coverage/internal/session"
 	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/nikhilvedi/strava-coverage/internal/webhooks"
 )
 
 // StravaTokenResponse represents the OAuth token response from Strava
@@ -31,16 +38,19 @@ type Service struct {
 	config        *config.Config
 	client        *resty.Client
 	db            *storage.DB
+	sessions      *session.Manager
 	autoProcessor *AutoProcessor
 }
 
-// NewService creates a new auth service
-func NewService(cfg *config.Config, db *storage.DB) *Service {
+// NewService creates a new auth service issuing sessions through sessions. events receives
+// the webhook events of the login processing and broker its progress; either may be nil.
+func NewService(cfg *config.Config, db *storage.DB, sessions *session.Manager, events *webhooks.Dispatcher, broker *progress.Broker) *Service {
 	return &Service{
 		config:        cfg,
-		client:        resty.New(),
+		client:        metrics.NewStravaClient(cfg),
 		db:            db,
-		autoProcessor: NewAutoProcessor(db, cfg),
+		sessions:      sessions,
+		autoProcessor: NewAutoProcessor(db, cfg, events, broker),
 	}
 }
 
@@ -52,33 +62,92 @@ func (s *Service) SetupRoutes(r *gin.Engine) {
 		auth.GET("/callback", s.handleCallback)
 	}
 
+	// Session routes
+	r.GET("/api/me", s.GetCurrentUserHandler)
+	r.POST("/api/auth/logout", s.LogoutHandler)
+
 	// User info routes
 	users := r.Group("/api/users")
 	{
 		users.GET("/:id", s.GetUserHandler)
+		users.GET("/:id/features", s.GetUserFeaturesHandler)
+		users.GET("/:id/preferences", s.GetUserPreferencesHandler)
+		users.PUT("/:id/preferences", s.UpdateUserPreferencesHandler)
 		users.GET("/:id/processing-status", s.GetProcessingStatusHandler)
 		users.POST("/:id/discover-cities", s.DiscoverCitiesHandler)
 	}
 }
 
-// handleAuthorize redirects the user to Strava's authorization page
+// requestedScopes are the Strava scopes asked for at sign-in. Users may untick all but
+// read; features needing a scope they withheld are turned off.
+var requestedScopes = []string{
+	storage.ScopeRead,
+	storage.ScopeActivityRead,
+	storage.ScopeActivityReadAll,
+	storage.ScopeActivityWrite,
+}
+
+// handleAuthorize redirects the user to Strava's authorization page. The optional
+// return_to path is where the frontend sends them after signing in, and prompt=force shows
+// the scope choices again to users who already authorized the app.
 func (s *Service) handleAuthorize(c *gin.Context) {
-	url := fmt.Sprintf(
-		"https://www.strava.com/oauth/authorize?client_id=%s&response_type=code&redirect_uri=%s&scope=activity:read_all,activity:read",
-		s.config.StravaClientID,
-		s.config.StravaRedirectURI,
-	)
-	c.Redirect(http.StatusFound, url)
+	prompt := "auto"
+	if c.Query("prompt") == "force" {
+		prompt = "force"
+	}
+	query := url.Values{
+		"client_id":       {s.config.StravaClientID},
+		"response_type":   {"code"},
+		"redirect_uri":    {s.config.StravaRedirectURI},
+		"approval_prompt": {prompt},
+		"scope":           {strings.Join(requestedScopes, ",")},
+		"state":           {s.sessions.BeginOAuth(c, c.Query("return_to"))},
+	}
+	c.Redirect(http.StatusFound, s.config.StravaOAuth()+"/authorize?"+query.Encode())
+}
+
+// redirectToFrontend ends the sign-in on the frontend's callback page
+func (s *Service) redirectToFrontend(c *gin.Context, returnTo, failure string) {
+	query := url.Values{"success": {strconv.FormatBool(failure == "")}}
+	if failure != "" {
+		query.Set("error", failure)
+	}
+	if returnTo != "" && returnTo != "/" {
+		query.Set("return_to", returnTo)
+	}
+	c.Redirect(http.StatusFound, s.config.FrontendURL+"/oauth/callback?"+query.Encode())
 }
 
 // handleCallback processes the OAuth callback from Strava
 func (s *Service) handleCallback(c *gin.Context) {
+	// The state must be the one issued to this browser, so nobody can sign a user in to
+	// someone else's account by sending them a callback link
+	returnTo, err := s.sessions.FinishOAuth(c, c.Query("state"))
+	if err != nil {
+		slog.WarnContext(c.Request.Context(), "Rejected OAuth callback", "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired sign-in attempt, please sign in again"})
+		return
+	}
+
+	// The user declined on Strava's authorization page
+	if failure := c.Query("error"); failure != "" {
+		s.redirectToFrontend(c, returnTo, failure)
+		return
+	}
+
 	code := c.Query("code")
 	if code == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing authorization code"})
 		return
 	}
 
+	// Nothing works without reading activities
+	scopes := storage.ParseScopes(c.Query("scope"))
+	if !scopes.Has(storage.ScopeActivityRead) {
+		s.redirectToFrontend(c, returnTo, "insufficient_scope")
+		return
+	}
+
 	// Exchange auth code for token
 	resp, err := s.client.R().
 		SetFormData(map[string]string{
@@ -87,27 +156,34 @@ func (s *Service) handleCallback(c *gin.Context) {
 			"code":          code,
 			"grant_type":    "authorization_code",
 		}).
-		Post("https://www.strava.com/oauth/token")
+		Post(s.config.StravaOAuth() + "/token")
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to exchange token"})
 		return
 	}
+	if resp.StatusCode() != http.StatusOK {
+		slog.WarnContext(c.Request.Context(), "Strava refused the token exchange", "status", resp.StatusCode())
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Strava refused the authorization code, please sign in again"})
+		return
+	}
 
+	// Without a token and an athlete there is nobody to sign in
 	var tokenResp StravaTokenResponse
-	if err := json.Unmarshal(resp.Body(), &tokenResp); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid token response"})
+	if err := json.Unmarshal(resp.Body(), &tokenResp); err != nil || tokenResp.AccessToken == "" || tokenResp.Athlete.ID == 0 {
+		slog.WarnContext(c.Request.Context(), "Invalid token response from Strava", "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Invalid token response"})
 		return
 	}
 
 	// Fetch athlete details from Strava API to get their actual name
 	athleteResp, err := s.client.R().
 		SetHeader("Authorization", "Bearer "+tokenResp.AccessToken).
-		Get("https://www.strava.com/api/v3/athlete")
+		Get("/athlete")
 
 	var athleteName string
 	if err != nil {
-		fmt.Printf("Failed to fetch athlete details: %v\n", err)
+		slog.WarnContext(c.Request.Context(), "Failed to fetch athlete details", "error", err)
 		athleteName = "Strava User" // Fallback
 	} else {
 		var athlete struct {
@@ -115,7 +191,7 @@ func (s *Service) handleCallback(c *gin.Context) {
 			LastName  string `json:"lastname"`
 		}
 		if err := json.Unmarshal(athleteResp.Body(), &athlete); err != nil {
-			fmt.Printf("Failed to parse athlete details: %v\n", err)
+			slog.WarnContext(c.Request.Context(), "Failed to parse athlete details", "error", err)
 			athleteName = "Strava User" // Fallback
 		} else {
 			athleteName = fmt.Sprintf("%s %s", athlete.FirstName, athlete.LastName)
@@ -135,7 +211,7 @@ func (s *Service) handleCallback(c *gin.Context) {
 		// User exists, update their name if it's different or empty
 		if user.Name != athleteName && athleteName != "Strava User" {
 			if err := s.db.UpdateUserName(user.ID, athleteName); err != nil {
-				fmt.Printf("Failed to update user name: %v\n", err)
+				slog.WarnContext(c.Request.Context(), "Failed to update user name", "user_id", user.ID, "error", err)
 			} else {
 				user.Name = athleteName // Update the local copy
 			}
@@ -153,24 +229,35 @@ func (s *Service) handleCallback(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store token"})
 		return
 	}
+	if err := s.db.UpdateUserScopes(user.ID, scopes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store granted scopes"})
+		return
+	}
+	ctx := logging.With(c.Request.Context(), logging.KeyUserID, user.ID)
+	for _, scope := range requestedScopes {
+		if !scopes.Has(scope) {
+			slog.InfoContext(ctx, "Scope not granted; features needing it are disabled", "scope", scope)
+		}
+	}
 
 	// Start automatic processing in background (non-blocking)
+	ctx = logging.Detach(ctx)
 	go func() {
-		if err := s.autoProcessor.ProcessUserOnLogin(user.ID, tokenResp.AccessToken); err != nil {
-			fmt.Printf("Auto-processing failed for user %d: %v\n", user.ID, err)
+		if err := s.autoProcessor.ProcessUserOnLogin(ctx, user.ID, tokenResp.AccessToken); err != nil {
+			slog.ErrorContext(ctx, "Auto-processing failed", "error", err)
 		}
 	}()
 
-	// Redirect to frontend OAuth callback with user data
-	frontendURL := fmt.Sprintf(
-		"%s/oauth/callback?user_id=%d&user_name=%s&strava_id=%d&success=true",
-		s.config.FrontendURL,
-		user.ID,
-		user.Name, // Use the name we already fetched and stored/updated
-		user.StravaID,
-	)
+	// Sign the user in; the frontend finds out who they are from /api/me
+	generation, err := s.db.GetSessionGeneration(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
+		return
+	}
+	sessionToken, expires := s.sessions.Issue(user.ID, generation, time.Now())
+	s.sessions.SetCookie(c, sessionToken, expires)
 
-	c.Redirect(http.StatusFound, frontendURL)
+	s.redirectToFrontend(c, returnTo, "")
 }
 
 // GetProcessingStatusHandler returns the processing status for a user
@@ -244,12 +331,10 @@ func (s *Service) DiscoverCitiesHandler(c *gin.Context) {
 	}
 
 	// Run city discovery in background
+	ctx := logging.With(logging.Detach(c.Request.Context()), logging.KeyJobID, logging.NewJobID("discover"))
 	go func() {
-		log.Printf("Starting manual city discovery for user %d", userID)
-		if err := s.autoProcessor.mapActivitiesToCities(userID); err != nil {
-			log.Printf("City discovery failed for user %d: %v", userID, err)
-		} else {
-			log.Printf("City discovery completed for user %d", userID)
+		if err := s.autoProcessor.mapActivitiesToCities(ctx, userID); err != nil {
+			slog.ErrorContext(ctx, "City discovery failed", "error", err)
 		}
 	}()
 
@@ -1,12 +1,43 @@
 package auth
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/internal/i18n"
+	"github.com/nikhilvedi/strava-coverage/internal/session"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
 )
 
+// GetCurrentUserHandler returns the signed-in user
+func (s *Service) GetCurrentUserHandler(c *gin.Context) {
+	userID, ok := session.UserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+	s.writeUser(c, userID)
+}
+
+// LogoutHandler signs the user out by clearing the session cookie and revoking every
+// session they hold, so copies of the token stop working too
+func (s *Service) LogoutHandler(c *gin.Context) {
+	s.sessions.ClearCookie(c)
+	if userID, ok := session.UserID(c); ok {
+		if err := s.db.RevokeSessions(userID); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to revoke sessions", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign out"})
+			return
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
+
 // GetUserHandler returns user information by user ID
 func (s *Service) GetUserHandler(c *gin.Context) {
 	userIDStr := c.Param("id")
@@ -15,7 +46,11 @@ func (s *Service) GetUserHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
 		return
 	}
+	s.writeUser(c, userID)
+}
 
+// writeUser responds with a user's information
+func (s *Service) writeUser(c *gin.Context, userID int) {
 	// Get user from database by internal ID
 	var user struct {
 		ID       int    `db:"id"`
@@ -24,9 +59,14 @@ func (s *Service) GetUserHandler(c *gin.Context) {
 	}
 
 	query := "SELECT id, strava_id, name FROM users WHERE id = $1"
-	err = s.db.QueryRowx(query, userID).StructScan(&user)
+	if err := s.db.QueryRowx(query, userID).StructScan(&user); err != nil {
+		utils.NotFound(c, utils.CodeUserNotFound, "User not found")
+		return
+	}
+
+	scopes, err := s.db.GetUserScopes(userID)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get Strava scopes"})
 		return
 	}
 
@@ -35,7 +75,91 @@ func (s *Service) GetUserHandler(c *gin.Context) {
 		"strava_id": user.StravaID,
 		"name":      user.Name,
 		"email":     "", // We don't store email
+		"scopes":    scopes,
+		"features":  Features(scopes),
 	}
 
 	c.JSON(http.StatusOK, response)
 }
+
+// GetUserPreferencesHandler returns a user's language and distance units
+func (s *Service) GetUserPreferencesHandler(c *gin.Context) {
+	userIDStr := c.Param("id")
+	userID, err := strconv.Atoi(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	prefs, err := s.db.GetUserPreferences(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get preferences"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"preferences": prefs,
+		"languages":   i18n.Languages(),
+		"units":       []string{i18n.UnitsKm, i18n.UnitsMiles},
+	})
+}
+
+// UpdateUserPreferencesRequest holds the preferences to change; omitted ones are kept
+type UpdateUserPreferencesRequest struct {
+	Language *string `json:"language"`
+	Units    *string `json:"units"`
+}
+
+// UpdateUserPreferencesHandler changes a user's language and distance units
+func (s *Service) UpdateUserPreferencesHandler(c *gin.Context) {
+	userIDStr := c.Param("id")
+	userID, err := strconv.Atoi(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req UpdateUserPreferencesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Language != nil && !i18n.IsSupported(*req.Language) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unsupported language %q, use one of %v", *req.Language, i18n.Languages())})
+		return
+	}
+	if req.Units != nil && !i18n.ValidUnits(*req.Units) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "units must be km or miles"})
+		return
+	}
+
+	prefs, err := s.db.GetUserPreferences(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get preferences"})
+		return
+	}
+
+	if req.Language != nil {
+		prefs.Language = *req.Language
+	}
+	if req.Units != nil {
+		prefs.Units = *req.Units
+	}
+	if err := s.db.UpdateUserPreferences(prefs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update preferences"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Preferences updated successfully",
+		"preferences": prefs,
+	})
+}
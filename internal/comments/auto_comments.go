@@ -1,23 +1,20 @@
 package comments
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"log"
-	"net/http"
-	"strings"
+	"log/slog"
 	"time"
 
 	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/i18n"
 	"github.com/nikhilvedi/strava-coverage/internal/storage"
 )
 
-// AutoCommentService handles automatic commenting on Strava activities
+// AutoCommentService manages users' comment settings and triggers and renders comments.
+// Comments are sent by the notify pipeline.
 type AutoCommentService struct {
 	DB     *storage.DB
 	Config *config.Config
-	client *http.Client
 }
 
 // NewAutoCommentService creates a new auto comment service
@@ -25,10 +22,15 @@ func NewAutoCommentService(db *storage.DB, cfg *config.Config) *AutoCommentServi
 	return &AutoCommentService{
 		DB:     db,
 		Config: cfg,
-		client: &http.Client{Timeout: 30 * time.Second},
 	}
 }
 
+// Output modes: where a user's coverage notifications are written on Strava
+const (
+	OutputModeComment     = "comment"     // a comment on the activity
+	OutputModeDescription = "description" // a block in the activity description
+)
+
 // CommentSettings represents user preferences for auto-commenting and feature switches
 type CommentSettings struct {
 	UserID              int       `json:"user_id" db:"user_id"`
@@ -42,21 +44,23 @@ type CommentSettings struct {
 	CommentTemplate     string    `json:"comment_template" db:"comment_template"`
 	MinCoverageIncrease float64   `json:"min_coverage_increase" db:"min_coverage_increase"`
 	CustomAreasEnabled  bool      `json:"custom_areas_enabled" db:"custom_areas_enabled"`
+	OutputMode          string    `json:"output_mode" db:"output_mode"`
+	DryRun              bool      `json:"dry_run" db:"dry_run"` // render and record notifications without sending them
 	CreatedAt           time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt           time.Time `json:"updated_at" db:"updated_at"`
 }
 
 // CoverageIncrease represents a detected coverage increase
 type CoverageIncrease struct {
-	UserID           int       `json:"user_id"`
-	ActivityID       int64     `json:"activity_id"`
-	CityID           int       `json:"city_id"`
-	CityName         string    `json:"city_name"`
-	PreviousCoverage float64   `json:"previous_coverage"`
-	NewCoverage      float64   `json:"new_coverage"`
-	Increase         float64   `json:"increase"`
-	ActivityType     string    `json:"activity_type"`
-	ActivityDate     time.Time `json:"activity_date"`
+	UserID           int       `json:"user_id" db:"user_id"`
+	ActivityID       int64     `json:"activity_id" db:"activity_id"`
+	CityID           int       `json:"city_id" db:"city_id"`
+	CityName         string    `json:"city_name" db:"city_name"`
+	PreviousCoverage float64   `json:"previous_coverage" db:"previous_coverage"`
+	NewCoverage      float64   `json:"new_coverage" db:"new_coverage"`
+	Increase         float64   `json:"increase" db:"increase"`
+	ActivityType     string    `json:"activity_type" db:"activity_type"`
+	ActivityDate     time.Time `json:"activity_date" db:"activity_date"`
 }
 
 // GetUserCommentSettings retrieves user's auto-comment preferences
@@ -64,7 +68,7 @@ func (acs *AutoCommentService) GetUserCommentSettings(userID int) (*CommentSetti
 	query := `
 		SELECT user_id, enabled, running_enabled, cycling_enabled, walking_enabled, 
 		       hiking_enabled, ebiking_enabled, skiing_enabled, comment_template, 
-		       min_coverage_increase, custom_areas_enabled, created_at, updated_at
+		       min_coverage_increase, custom_areas_enabled, output_mode, dry_run, created_at, updated_at
 		FROM comment_settings 
 		WHERE user_id = $1`
 
@@ -81,9 +85,10 @@ func (acs *AutoCommentService) GetUserCommentSettings(userID int) (*CommentSetti
 			HikingEnabled:       true,
 			EBikingEnabled:      true,
 			SkiingEnabled:       true,
-			CommentTemplate:     "Your coverage of {city} is {coverage}%!",
+			CommentTemplate:     DefaultCommentTemplate,
 			MinCoverageIncrease: 0.1,
 			CustomAreasEnabled:  false,
+			OutputMode:          OutputModeComment,
 			CreatedAt:           time.Now(),
 			UpdatedAt:           time.Now(),
 		}, nil
@@ -95,16 +100,19 @@ func (acs *AutoCommentService) GetUserCommentSettings(userID int) (*CommentSetti
 func (acs *AutoCommentService) UpdateUserCommentSettings(userID int, settings *CommentSettings) error {
 	settings.UserID = userID
 	settings.UpdatedAt = time.Now()
+	if settings.OutputMode == "" {
+		settings.OutputMode = OutputModeComment
+	}
 
 	query := `
 		INSERT INTO comment_settings (
 			user_id, enabled, running_enabled, cycling_enabled, walking_enabled,
 			hiking_enabled, ebiking_enabled, skiing_enabled, comment_template,
-			min_coverage_increase, custom_areas_enabled, created_at, updated_at
+			min_coverage_increase, custom_areas_enabled, output_mode, dry_run, created_at, updated_at
 		) VALUES (
 			:user_id, :enabled, :running_enabled, :cycling_enabled, :walking_enabled,
 			:hiking_enabled, :ebiking_enabled, :skiing_enabled, :comment_template,
-			:min_coverage_increase, :custom_areas_enabled, :created_at, :updated_at
+			:min_coverage_increase, :custom_areas_enabled, :output_mode, :dry_run, :created_at, :updated_at
 		) ON CONFLICT (user_id) DO UPDATE SET
 			enabled = EXCLUDED.enabled,
 			running_enabled = EXCLUDED.running_enabled,
@@ -116,6 +124,8 @@ func (acs *AutoCommentService) UpdateUserCommentSettings(userID int, settings *C
 			comment_template = EXCLUDED.comment_template,
 			min_coverage_increase = EXCLUDED.min_coverage_increase,
 			custom_areas_enabled = EXCLUDED.custom_areas_enabled,
+			output_mode = EXCLUDED.output_mode,
+			dry_run = EXCLUDED.dry_run,
 			updated_at = EXCLUDED.updated_at`
 
 	_, err := acs.DB.NamedExec(query, settings)
@@ -140,34 +150,31 @@ func (acs *AutoCommentService) DetectCoverageIncreases(userID int) ([]CoverageIn
 		)
 		SELECT 
 			a.user_id,
-			a.strava_id as activity_id,
+			a.strava_activity_id as activity_id,
 			a.city_id,
 			c.name as city_name,
 			COALESCE(pc.prev_coverage, 0) as previous_coverage,
 			a.coverage_percentage as new_coverage,
 			a.coverage_percentage - COALESCE(pc.prev_coverage, 0) as increase,
-			a.activity_type,
-			a.start_date as activity_date
+			COALESCE(a.sport_type, a.activity_type, '') as activity_type,
+			COALESCE(a.start_date, a.created_at) as activity_date
 		FROM activities a
 		JOIN cities c ON a.city_id = c.id
 		LEFT JOIN previous_coverage pc ON a.city_id = pc.city_id
 		WHERE a.user_id = $1
+			AND a.source = 'strava'
 			AND a.coverage_percentage IS NOT NULL
 			AND a.commented_at IS NULL
 			AND (a.coverage_percentage - COALESCE(pc.prev_coverage, 0)) > 0
-		ORDER BY a.start_date ASC`
+		ORDER BY COALESCE(a.start_date, a.created_at) ASC`
 
 	var increases []CoverageIncrease
 	err := acs.DB.Select(&increases, query, userID)
 	return increases, err
 }
 
-// ShouldCommentOnActivity checks if we should comment on this activity type
-func (acs *AutoCommentService) ShouldCommentOnActivity(settings *CommentSettings, activityType string, increase float64) bool {
-	if !settings.Enabled || increase < settings.MinCoverageIncrease {
-		return false
-	}
-
+// SportEnabled reports whether comments are enabled for an activity type
+func (settings *CommentSettings) SportEnabled(activityType string) bool {
 	switch activityType {
 	case "Run", "VirtualRun":
 		return settings.RunningEnabled
@@ -186,95 +193,48 @@ func (acs *AutoCommentService) ShouldCommentOnActivity(settings *CommentSettings
 	}
 }
 
-// PostCommentToStrava posts a comment to a Strava activity
-func (acs *AutoCommentService) PostCommentToStrava(accessToken string, activityID int64, comment string) error {
-	url := fmt.Sprintf("https://www.strava.com/api/v3/activities/%d/comments", activityID)
-
-	payload := map[string]string{
-		"text": comment,
-	}
-
-	jsonPayload, err := json.Marshal(payload)
-	if err != nil {
-		return fmt.Errorf("failed to marshal comment payload: %w", err)
-	}
+// ValidOutputMode reports whether mode is a known output mode
+func ValidOutputMode(mode string) bool {
+	return mode == OutputModeComment || mode == OutputModeDescription
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonPayload))
+// RenderActivityComment renders a comment template for an activity in the owner's language
+// and units. Templates saved before validation existed may not parse; those fall back to
+// the default template.
+func RenderActivityComment(db *storage.DB, template string, activityID int64) (string, error) {
+	stats, err := db.GetActivityCommentStats(activityID)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return "", fmt.Errorf("failed to load activity stats: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := acs.client.Do(req)
+	locale, units := commentLocale(db, stats.UserID)
+	tmpl, err := ParseCommentTemplate(localizedTemplate(template, locale))
 	if err != nil {
-		return fmt.Errorf("failed to post comment: %w", err)
+		slog.Warn("Invalid comment template, using default", "template", template, "error", err)
+		tmpl, _ = ParseCommentTemplate(locale.Message("comment.default"))
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("failed to post comment, status: %d", resp.StatusCode)
-	}
-
-	log.Printf("Successfully posted comment to activity %d", activityID)
-	return nil
-}
-
-// FormatComment formats the comment template with actual values
-func (acs *AutoCommentService) FormatComment(template, cityName string, coverage float64) string {
-	comment := template
-	comment = strings.ReplaceAll(comment, "{city}", cityName)
-	comment = strings.ReplaceAll(comment, "{coverage}", fmt.Sprintf("%.1f", coverage))
-	return comment
-}
 
-// MarkActivityAsCommented marks an activity as having been commented on
-func (acs *AutoCommentService) MarkActivityAsCommented(activityID int64) error {
-	query := `UPDATE activities SET commented_at = NOW() WHERE strava_id = $1`
-	_, err := acs.DB.Exec(query, activityID)
-	return err
+	vars := NewTemplateVars(stats)
+	vars.SetUnits(units, locale)
+	return tmpl.Render(vars, locale), nil
 }
 
-// ProcessAutoCommentsForUser processes all pending auto-comments for a user
-func (acs *AutoCommentService) ProcessAutoCommentsForUser(userID int, accessToken string) error {
-	// Get user's comment settings
-	settings, err := acs.GetUserCommentSettings(userID)
+// commentLocale loads the language and units a user's comments are written in, defaulting
+// to English and km
+func commentLocale(db *storage.DB, userID int) (*i18n.Locale, string) {
+	prefs, err := db.GetUserPreferences(userID)
 	if err != nil {
-		return fmt.Errorf("failed to get comment settings: %w", err)
+		slog.Warn("Failed to load preferences, using defaults", "user_id", userID, "error", err)
+		return i18n.Get(i18n.DefaultLanguage), i18n.UnitsKm
 	}
+	return i18n.Get(prefs.Language), prefs.Units
+}
 
-	if !settings.Enabled {
-		return nil // Auto-comments disabled
-	}
-
-	// Detect coverage increases
-	increases, err := acs.DetectCoverageIncreases(userID)
-	if err != nil {
-		return fmt.Errorf("failed to detect coverage increases: %w", err)
-	}
-
-	commentsPosted := 0
-	for _, increase := range increases {
-		if acs.ShouldCommentOnActivity(settings, increase.ActivityType, increase.Increase) {
-			comment := acs.FormatComment(settings.CommentTemplate, increase.CityName, increase.NewCoverage)
-
-			if err := acs.PostCommentToStrava(accessToken, increase.ActivityID, comment); err != nil {
-				log.Printf("Failed to post comment to activity %d: %v", increase.ActivityID, err)
-				continue
-			}
-
-			if err := acs.MarkActivityAsCommented(increase.ActivityID); err != nil {
-				log.Printf("Failed to mark activity %d as commented: %v", increase.ActivityID, err)
-			}
-
-			commentsPosted++
-
-			// Rate limiting: wait between comments
-			time.Sleep(2 * time.Second)
-		}
+// localizedTemplate returns the comment template to render. The default template, as saved
+// in any language, is replaced by the default in the locale's language.
+func localizedTemplate(template string, locale *i18n.Locale) string {
+	if template == "" || i18n.IsAnyTranslation("comment.default", template) {
+		return locale.Message("comment.default")
 	}
-
-	log.Printf("Posted %d auto-comments for user %d", commentsPosted, userID)
-	return nil
+	return template
 }
@@ -1,23 +1,42 @@
 package comments
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/logging"
+	"github.com/nikhilvedi/strava-coverage/internal/pagination"
 	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
 )
 
+// ActivityNotifier is the part of the notify pipeline the handlers use
+type ActivityNotifier interface {
+	// NotifyPending sends the notifications of a user's activities that have not had them yet
+	NotifyPending(ctx context.Context, userID int) (int, error)
+	// RemoveDescriptionBlocks removes the coverage blocks written to a user's activity descriptions
+	RemoveDescriptionBlocks(userID int) (int, error)
+}
+
 // Handler provides HTTP handlers for auto-comment functionality
 type Handler struct {
-	service *AutoCommentService
+	service  *AutoCommentService
+	notifier ActivityNotifier
 }
 
 // NewHandler creates a new comment handler
-func NewHandler(db *storage.DB, cfg *config.Config) *Handler {
+func NewHandler(db *storage.DB, cfg *config.Config, notifier ActivityNotifier) *Handler {
 	return &Handler{
-		service: NewAutoCommentService(db, cfg),
+		service:  NewAutoCommentService(db, cfg),
+		notifier: notifier,
 	}
 }
 
@@ -27,7 +46,11 @@ func (h *Handler) RegisterRoutes(router *gin.Engine) {
 	{
 		comments.GET("/settings/user/:userId", h.GetCommentSettingsHandler)
 		comments.PUT("/settings/user/:userId", h.UpdateCommentSettingsHandler)
+		comments.POST("/settings/:userId/preview", h.PreviewCommentHandler)
+		comments.GET("/triggers/user/:userId", h.GetCommentTriggersHandler)
+		comments.PUT("/triggers/user/:userId", h.UpdateCommentTriggersHandler)
 		comments.POST("/process/user/:userId", h.ProcessCommentsHandler)
+		comments.GET("/history/user/:userId", h.GetCommentHistoryHandler)
 		comments.GET("/increases/user/:userId", h.GetCoverageIncreasesHandler)
 	}
 }
@@ -65,19 +88,115 @@ func (h *Handler) UpdateCommentSettingsHandler(c *gin.Context) {
 		return
 	}
 
+	if _, err := ParseCommentTemplate(settings.CommentTemplate); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid comment template: %v", err)})
+		return
+	}
+	if settings.OutputMode != "" && !ValidOutputMode(settings.OutputMode) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "output_mode must be comment or description"})
+		return
+	}
+
+	previous, err := h.service.GetUserCommentSettings(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get comment settings"})
+		return
+	}
+
 	if err := h.service.UpdateUserCommentSettings(userID, &settings); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update comment settings"})
 		return
 	}
 
+	// Leaving description mode takes the coverage blocks back out of the descriptions
+	if previous.OutputMode == OutputModeDescription && settings.OutputMode != OutputModeDescription {
+		ctx := logging.Detach(c.Request.Context())
+		go func() {
+			removed, err := h.notifier.RemoveDescriptionBlocks(userID)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to remove description blocks", "error", err)
+			}
+			slog.InfoContext(ctx, "Removed description blocks", "removed", removed)
+		}()
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message":  "Comment settings updated successfully",
 		"settings": settings,
 	})
 }
 
-// ProcessCommentsHandler manually triggers comment processing for a user
-func (h *Handler) ProcessCommentsHandler(c *gin.Context) {
+// GetCommentTriggersHandler lists a user's comment triggers
+func (h *Handler) GetCommentTriggersHandler(c *gin.Context) {
+	userIDStr := c.Param("userId")
+	userID, err := strconv.Atoi(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	triggers, err := h.service.GetCommentTriggers(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get comment triggers"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"triggers": triggers})
+}
+
+// UpdateCommentTriggersRequest holds the triggers to save
+type UpdateCommentTriggersRequest struct {
+	Triggers []CommentTrigger `json:"triggers" binding:"required"`
+}
+
+// UpdateCommentTriggersHandler saves some or all of a user's comment triggers
+func (h *Handler) UpdateCommentTriggersHandler(c *gin.Context) {
+	userIDStr := c.Param("userId")
+	userID, err := strconv.Atoi(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req UpdateCommentTriggersRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	for i := range req.Triggers {
+		if err := ValidateCommentTrigger(&req.Triggers[i]); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := h.service.UpdateCommentTriggers(userID, req.Triggers); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update comment triggers"})
+		return
+	}
+
+	triggers, err := h.service.GetCommentTriggers(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get comment triggers"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Comment triggers updated successfully",
+		"triggers": triggers,
+	})
+}
+
+// PreviewCommentRequest selects the template and activity to preview. Both are optional:
+// the user's saved template and most recent activity with coverage are used by default.
+type PreviewCommentRequest struct {
+	Template   *string `json:"template"`
+	ActivityID int64   `json:"activity_id"`
+}
+
+// PreviewCommentHandler renders a comment template against one of the user's past activities
+func (h *Handler) PreviewCommentHandler(c *gin.Context) {
 	userIDStr := c.Param("userId")
 	userID, err := strconv.Atoi(userIDStr)
 	if err != nil {
@@ -85,22 +204,79 @@ func (h *Handler) ProcessCommentsHandler(c *gin.Context) {
 		return
 	}
 
-	// Get access token from request (you might want to get this from user session/db)
-	accessToken := c.GetHeader("Authorization")
-	if accessToken == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Access token required"})
+	var req PreviewCommentRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	locale, units := commentLocale(h.service.DB, userID)
+
+	template := ""
+	if req.Template != nil {
+		template = *req.Template
+	} else {
+		settings, err := h.service.GetUserCommentSettings(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get comment settings"})
+			return
+		}
+		template = localizedTemplate(settings.CommentTemplate, locale)
+	}
+
+	tmpl, err := ParseCommentTemplate(template)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid comment template: %v", err)})
 		return
 	}
 
-	// Remove "Bearer " prefix if present
-	if len(accessToken) > 7 && accessToken[:7] == "Bearer " {
-		accessToken = accessToken[7:]
+	activityID := req.ActivityID
+	if activityID == 0 {
+		activityID, err = h.service.DB.GetLatestCoveredActivityID(userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No activities with coverage to preview"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find an activity to preview"})
+			return
+		}
+	}
+
+	stats, err := h.service.DB.GetActivityCommentStats(activityID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && stats.UserID != userID) {
+		utils.NotFound(c, utils.CodeActivityNotFound, "Activity not found")
+		return
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load activity stats"})
+		return
+	}
+
+	vars := NewTemplateVars(stats)
+	vars.SetUnits(units, locale)
+	c.JSON(http.StatusOK, gin.H{
+		"comment":     tmpl.Render(vars, locale),
+		"template":    template,
+		"activity_id": activityID,
+		"variables":   vars,
+	})
+}
 
-	// Process comments in background
+// ProcessCommentsHandler manually triggers comment processing for a user
+func (h *Handler) ProcessCommentsHandler(c *gin.Context) {
+	userIDStr := c.Param("userId")
+	userID, err := strconv.Atoi(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	// Process comments in background; tokens are loaded by the notifier
+	ctx := logging.Detach(c.Request.Context())
 	go func() {
-		if err := h.service.ProcessAutoCommentsForUser(userID, accessToken); err != nil {
-			// Log error but don't return it to client since this is async
+		if _, err := h.notifier.NotifyPending(ctx, userID); err != nil {
+			slog.ErrorContext(ctx, "Comment processing failed", "error", err)
 		}
 	}()
 
@@ -110,6 +286,46 @@ func (h *Handler) ProcessCommentsHandler(c *gin.Context) {
 	})
 }
 
+// GetCommentHistoryHandler lists a user's outbox: every notification rendered for them,
+// where it was sent and how delivery went
+func (h *Handler) GetCommentHistoryHandler(c *gin.Context) {
+	userIDStr := c.Param("userId")
+	userID, err := strconv.Atoi(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	status := c.Query("status")
+	switch status {
+	case "", storage.OutboxStatusPending, storage.OutboxStatusSending, storage.OutboxStatusSent,
+		storage.OutboxStatusFailed, storage.OutboxStatusDryRun:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status filter"})
+		return
+	}
+
+	params, err := pagination.Parse(c, storage.OutboxPages)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	entries, page, err := h.service.DB.PageOutboxEntries(userID, status, params)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get comment history"})
+		return
+	}
+
+	pagination.SetHeaders(c, page)
+	c.JSON(http.StatusOK, gin.H{
+		"history":     entries,
+		"count":       len(entries),
+		"total":       page.Total,
+		"next_cursor": page.Next,
+	})
+}
+
 // GetCoverageIncreasesHandler gets pending coverage increases for a user
 func (h *Handler) GetCoverageIncreasesHandler(c *gin.Context) {
 	userIDStr := c.Param("userId")
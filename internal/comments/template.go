@@ -0,0 +1,411 @@
+package comments
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nikhilvedi/strava-coverage/internal/i18n"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+// MaxCommentTemplateLength limits the size of a stored comment template
+const MaxCommentTemplateLength = 1000
+
+// DefaultCommentTemplate is used when a user has not saved a template. It is the English
+// comment.default message; users see it in their own language (see localizedTemplate).
+const DefaultCommentTemplate = "Your coverage of {city} is {coverage}%!"
+
+// coverageMilestones are the coverage percentages announced by the {milestone} variable
+var coverageMilestones = []float64{1, 5, 10, 25, 50, 75, 90, 100}
+
+// varKind is the type of a template variable
+type varKind int
+
+const (
+	kindText varKind = iota
+	kindNumber
+	kindFlag
+)
+
+// templateVariables lists every variable a comment template can use
+var templateVariables = map[string]struct {
+	kind        varKind
+	description string
+}{
+	"city":              {kindText, "Name of the city the activity was in"},
+	"activity_name":     {kindText, "Name of the activity"},
+	"activity_type":     {kindText, "Sport type, e.g. Run or Ride"},
+	"distance_km":       {kindNumber, "Distance of the activity in km"},
+	"distance":          {kindNumber, "Distance of the activity in the user's units"},
+	"unit":              {kindText, "Label of the user's distance unit, e.g. km or mi"},
+	"coverage":          {kindNumber, "City coverage after the activity, in percent"},
+	"previous_coverage": {kindNumber, "City coverage before the activity, in percent"},
+	"coverage_delta":    {kindNumber, "Coverage gained by the activity, in percentage points"},
+	"new_km":            {kindNumber, "Km of the city covered for the first time"},
+	"new_distance":      {kindNumber, "Distance of the city covered for the first time, in the user's units"},
+	"streets_completed": {kindNumber, "Streets completed by the activity"},
+	"streets":           {kindText, "Names of the streets completed by the activity"},
+	"tiles":             {kindNumber, "Map tiles explored so far, including the activity"},
+	"new_tiles":         {kindNumber, "Map tiles explored for the first time by the activity"},
+	"city_rank":         {kindNumber, "Rank among athletes by coverage of the city"},
+	"city_athletes":     {kindNumber, "Athletes with coverage of the city"},
+	"milestone":         {kindNumber, "Highest coverage milestone passed (1, 5, 10, 25, 50, 75, 90 or 100), 0 if none"},
+	"pb_distance":       {kindFlag, "The activity is the longest in the city so far"},
+	"pb_coverage_delta": {kindFlag, "The activity gained the most coverage in the city so far"},
+	"personal_best":     {kindFlag, "Either personal best applies"},
+}
+
+// TemplateVariableNames returns the names of all template variables, sorted
+func TemplateVariableNames() []string {
+	names := make([]string, 0, len(templateVariables))
+	for name := range templateVariables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TemplateVars holds the values a template is rendered with: strings, float64s, ints or bools
+type TemplateVars map[string]interface{}
+
+// NewTemplateVars builds the template variables for an activity
+func NewTemplateVars(stats *storage.ActivityCommentStats) TemplateVars {
+	vars := TemplateVars{
+		"city":              "",
+		"activity_name":     stats.Name,
+		"activity_type":     stats.ActivityType,
+		"distance_km":       stats.DistanceKm,
+		"distance":          stats.DistanceKm,
+		"unit":              i18n.UnitsKm,
+		"coverage":          0.0,
+		"previous_coverage": stats.PreviousCoverage,
+		"coverage_delta":    0.0,
+		"new_km":            stats.NewKm,
+		"new_distance":      stats.NewKm,
+		"streets_completed": len(stats.CompletedStreets),
+		"streets":           strings.Join(stats.CompletedStreets, ", "),
+		"tiles":             stats.TilesTotal,
+		"new_tiles":         stats.TilesNew,
+		"city_rank":         stats.CityRank,
+		"city_athletes":     stats.CityAthletes,
+		"milestone":         0,
+		"pb_distance":       stats.LongestInCity,
+		"pb_coverage_delta": stats.BiggestIncrease,
+		"personal_best":     stats.LongestInCity || stats.BiggestIncrease,
+	}
+	if stats.CityName != nil {
+		vars["city"] = *stats.CityName
+	}
+	if stats.Coverage != nil {
+		coverage := *stats.Coverage
+		vars["coverage"] = coverage
+		vars["coverage_delta"] = coverage - stats.PreviousCoverage
+		for _, m := range coverageMilestones {
+			if stats.PreviousCoverage < m && coverage >= m {
+				vars["milestone"] = int(m)
+			}
+		}
+	}
+	return vars
+}
+
+// SetUnits expresses the distance variables in the given units, labelled in the locale's language
+func (vars TemplateVars) SetUnits(units string, locale *i18n.Locale) {
+	vars["distance"] = i18n.ConvertKm(number(vars["distance_km"]), units)
+	vars["new_distance"] = i18n.ConvertKm(number(vars["new_km"]), units)
+	vars["unit"] = locale.UnitLabel(units)
+}
+
+// CommentTemplate is a parsed comment template.
+//
+// Templates are plain text with tags in braces:
+//
+//	{coverage}                        a variable
+//	{if new_km > 1}...{end}           a conditional; operators are > >= < <= == !=
+//	{if personal_best}...{else}...{end}
+//	{if not milestone}...{elif coverage_delta >= 1}...{end}
+//	{{                                a literal {
+//
+// A condition on a variable alone is true for non-empty text, non-zero numbers and true flags.
+type CommentTemplate struct {
+	nodes []templateNode
+}
+
+type templateNode interface {
+	render(vars TemplateVars, locale *i18n.Locale, sb *strings.Builder)
+}
+
+type textNode string
+
+func (n textNode) render(_ TemplateVars, _ *i18n.Locale, sb *strings.Builder) {
+	sb.WriteString(string(n))
+}
+
+type varNode string
+
+func (n varNode) render(vars TemplateVars, locale *i18n.Locale, sb *strings.Builder) {
+	switch v := vars[string(n)].(type) {
+	case float64:
+		sb.WriteString(locale.FormatDecimal(v, 1))
+	case nil:
+	default:
+		fmt.Fprint(sb, v)
+	}
+}
+
+type condition struct {
+	name    string
+	negate  bool
+	op      string // empty for a truthiness check
+	operand float64
+}
+
+func (c condition) eval(vars TemplateVars) bool {
+	var result bool
+	if c.op == "" {
+		result = truthy(vars[c.name])
+	} else {
+		v := number(vars[c.name])
+		switch c.op {
+		case ">":
+			result = v > c.operand
+		case ">=":
+			result = v >= c.operand
+		case "<":
+			result = v < c.operand
+		case "<=":
+			result = v <= c.operand
+		case "==":
+			result = v == c.operand
+		case "!=":
+			result = v != c.operand
+		}
+	}
+	return result != c.negate
+}
+
+type ifBranch struct {
+	cond condition
+	body []templateNode
+}
+
+type ifNode struct {
+	branches []ifBranch
+	elseBody []templateNode
+}
+
+func (n *ifNode) render(vars TemplateVars, locale *i18n.Locale, sb *strings.Builder) {
+	body := n.elseBody
+	for _, b := range n.branches {
+		if b.cond.eval(vars) {
+			body = b.body
+			break
+		}
+	}
+	for _, node := range body {
+		node.render(vars, locale, sb)
+	}
+}
+
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	}
+	return number(v) != 0
+}
+
+func number(v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	}
+	return 0
+}
+
+// Render renders the template. Surrounding whitespace left by conditionals is trimmed.
+func (t *CommentTemplate) Render(vars TemplateVars, locale *i18n.Locale) string {
+	if locale == nil {
+		locale = i18n.Get(i18n.DefaultLanguage)
+	}
+	var sb strings.Builder
+	for _, node := range t.nodes {
+		node.render(vars, locale, &sb)
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// ParseCommentTemplate parses and validates a comment template
+func ParseCommentTemplate(src string) (*CommentTemplate, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, errors.New("template is empty")
+	}
+	if len(src) > MaxCommentTemplateLength {
+		return nil, fmt.Errorf("template is longer than %d characters", MaxCommentTemplateLength)
+	}
+
+	p := &templateParser{src: src}
+	nodes, closer, err := p.parseNodes()
+	if err != nil {
+		return nil, err
+	}
+	if closer != "" {
+		return nil, fmt.Errorf("{%s} without {if}", closer)
+	}
+	return &CommentTemplate{nodes: nodes}, nil
+}
+
+// templateParser is a recursive descent parser over the template source
+type templateParser struct {
+	src         string
+	pos         int
+	pendingCond string // condition of the {elif} that ended the last parseNodes call
+}
+
+// parseNodes parses until the end of input or a closing tag ({elif}, {else} or {end}),
+// which it returns without its arguments for the caller to handle
+func (p *templateParser) parseNodes() ([]templateNode, string, error) {
+	var nodes []templateNode
+	var text strings.Builder
+
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, textNode(text.String()))
+			text.Reset()
+		}
+	}
+
+	for p.pos < len(p.src) {
+		open := strings.IndexByte(p.src[p.pos:], '{')
+		if open < 0 {
+			text.WriteString(p.src[p.pos:])
+			p.pos = len(p.src)
+			break
+		}
+		text.WriteString(p.src[p.pos : p.pos+open])
+		p.pos += open
+
+		if strings.HasPrefix(p.src[p.pos:], "{{") {
+			text.WriteByte('{')
+			p.pos += 2
+			continue
+		}
+
+		end := strings.IndexByte(p.src[p.pos:], '}')
+		if end < 0 {
+			return nil, "", fmt.Errorf("unclosed tag at position %d", p.pos)
+		}
+		tag := strings.TrimSpace(p.src[p.pos+1 : p.pos+end])
+		p.pos += end + 1
+
+		keyword, args, _ := strings.Cut(tag, " ")
+		args = strings.TrimSpace(args)
+		switch keyword {
+		case "if":
+			flush()
+			node, err := p.parseIf(args)
+			if err != nil {
+				return nil, "", err
+			}
+			nodes = append(nodes, node)
+		case "elif":
+			flush()
+			p.pendingCond = args
+			return nodes, keyword, nil
+		case "else", "end":
+			if args != "" {
+				return nil, "", fmt.Errorf("unexpected text after {%s}", keyword)
+			}
+			flush()
+			return nodes, keyword, nil
+		default:
+			if _, ok := templateVariables[tag]; !ok {
+				return nil, "", fmt.Errorf("unknown variable {%s}", tag)
+			}
+			flush()
+			nodes = append(nodes, varNode(tag))
+		}
+	}
+
+	flush()
+	return nodes, "", nil
+}
+
+// parseIf parses the branches of an {if} whose condition has been read, up to its {end}
+func (p *templateParser) parseIf(cond string) (*ifNode, error) {
+	node := &ifNode{}
+	for {
+		parsedCond, err := parseCondition(cond)
+		if err != nil {
+			return nil, err
+		}
+		body, closer, err := p.parseNodes()
+		if err != nil {
+			return nil, err
+		}
+		node.branches = append(node.branches, ifBranch{cond: parsedCond, body: body})
+
+		switch closer {
+		case "elif":
+			cond = p.pendingCond
+			continue
+		case "else":
+			body, closer, err := p.parseNodes()
+			if err != nil {
+				return nil, err
+			}
+			if closer != "end" {
+				return nil, errors.New("{else} must be followed by {end}")
+			}
+			node.elseBody = body
+			return node, nil
+		case "end":
+			return node, nil
+		}
+		return nil, errors.New("{if} without {end}")
+	}
+}
+
+// parseCondition parses "[not] variable [operator number]"
+func parseCondition(src string) (condition, error) {
+	fields := strings.Fields(src)
+	var c condition
+	if len(fields) > 0 && fields[0] == "not" {
+		c.negate = true
+		fields = fields[1:]
+	}
+
+	switch len(fields) {
+	case 1:
+	case 3:
+		switch fields[1] {
+		case ">", ">=", "<", "<=", "==", "!=":
+		default:
+			return c, fmt.Errorf("unknown operator %q in condition %q", fields[1], src)
+		}
+		operand, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return c, fmt.Errorf("condition %q must compare with a number", src)
+		}
+		c.op, c.operand = fields[1], operand
+	default:
+		return c, fmt.Errorf("invalid condition %q", src)
+	}
+
+	c.name = fields[0]
+	v, ok := templateVariables[c.name]
+	if !ok {
+		return c, fmt.Errorf("unknown variable %q in condition", c.name)
+	}
+	if c.op != "" && v.kind != kindNumber {
+		return c, fmt.Errorf("%s is not a number and cannot be compared", c.name)
+	}
+	return c, nil
+}
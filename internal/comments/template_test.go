@@ -0,0 +1,151 @@
+package comments
+
+import (
+	"testing"
+
+	"github.com/nikhilvedi/strava-coverage/internal/i18n"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStats() *storage.ActivityCommentStats {
+	city := "Sheffield"
+	coverage := 10.46
+	return &storage.ActivityCommentStats{
+		ActivityID:       42,
+		UserID:           1,
+		Name:             "Morning Run",
+		ActivityType:     "Run",
+		DistanceKm:       8.25,
+		CityName:         &city,
+		Coverage:         &coverage,
+		PreviousCoverage: 9.1,
+		NewKm:            3.04,
+		CompletedStreets: []string{"Division Street", "Fargate"},
+		CityRank:         3,
+		CityAthletes:     12,
+		LongestInCity:    true,
+	}
+}
+
+func TestNewTemplateVars(t *testing.T) {
+	vars := NewTemplateVars(testStats())
+
+	assert.Equal(t, "Sheffield", vars["city"])
+	assert.InDelta(t, 1.36, vars["coverage_delta"], 1e-9)
+	assert.Equal(t, 10, vars["milestone"])
+	assert.Equal(t, true, vars["personal_best"])
+	assert.Equal(t, false, vars["pb_coverage_delta"])
+
+	// Every declared variable has a value
+	for _, name := range TemplateVariableNames() {
+		assert.Contains(t, vars, name)
+	}
+
+	t.Run("No coverage", func(t *testing.T) {
+		stats := testStats()
+		stats.Coverage = nil
+		stats.CityName = nil
+		vars := NewTemplateVars(stats)
+		assert.Equal(t, "", vars["city"])
+		assert.Equal(t, 0, vars["milestone"])
+	})
+}
+
+func TestRenderCommentTemplate(t *testing.T) {
+	vars := NewTemplateVars(testStats())
+
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"Legacy variables", "Your coverage of {city} is {coverage}%!", "Your coverage of Sheffield is 10.5%!"},
+		{"Numbers", "{new_km} km new, {streets_completed} streets, rank {city_rank}/{city_athletes}", "3.0 km new, 2 streets, rank 3/12"},
+		{"Flag", "{activity_name}{if personal_best} - longest yet!{end}", "Morning Run - longest yet!"},
+		{"Else", "{if pb_coverage_delta}Record gain{else}+{coverage_delta}%{end}", "+1.4%"},
+		{"Comparison", "{if new_km >= 3}Lots of new ground{end}", "Lots of new ground"},
+		{"Negation", "{if not streets_completed}none{else}some{end}", "some"},
+		{"Elif", "{if milestone == 25}25{elif milestone == 10}10{else}none{end}", "10"},
+		{"Nested", "{if city}{if city_rank == 1}Top{else}#{city_rank}{end} in {city}{end}", "#3 in Sheffield"},
+		{"Escaped brace", "{{city}", "{city}"},
+		{"Trimmed", "  {if not city}x{end}Hi  ", "Hi"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParseCommentTemplate(tt.template)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, tmpl.Render(vars, nil))
+		})
+	}
+}
+
+func TestRenderLocalized(t *testing.T) {
+	tests := []struct {
+		language string
+		units    string
+		expected string
+	}{
+		{"en", i18n.UnitsKm, "Your coverage of Sheffield is 10.5%! 3.0 km"},
+		{"fr", i18n.UnitsKm, "Ta couverture de Sheffield est de 10,5\u00a0%\u00a0! 3,0 km"},
+		{"de", i18n.UnitsMiles, "Deine Abdeckung von Sheffield liegt bei 10,5\u00a0%! 1,9 mi"},
+		{"es", i18n.UnitsMiles, "¡Tu cobertura de Sheffield es del 10,5\u00a0%! 1,9 mi"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.language, func(t *testing.T) {
+			locale := i18n.Get(tt.language)
+			tmpl, err := ParseCommentTemplate(localizedTemplate(DefaultCommentTemplate, locale) + " {new_distance} {unit}")
+			require.NoError(t, err)
+
+			vars := NewTemplateVars(testStats())
+			vars.SetUnits(tt.units, locale)
+			assert.Equal(t, tt.expected, tmpl.Render(vars, locale))
+		})
+	}
+
+	t.Run("Own template is kept", func(t *testing.T) {
+		assert.Equal(t, "{coverage}!", localizedTemplate("{coverage}!", i18n.Get("fr")))
+	})
+}
+
+func TestDefaultTemplatesParse(t *testing.T) {
+	assert.Equal(t, DefaultCommentTemplate, i18n.Get(i18n.DefaultLanguage).Message("comment.default"))
+
+	for _, language := range i18n.Languages() {
+		_, err := ParseCommentTemplate(i18n.Get(language).Message("comment.default"))
+		assert.NoError(t, err, language)
+	}
+}
+
+func TestParseCommentTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		errorMsg string
+	}{
+		{"Empty", "   ", "template is empty"},
+		{"Unknown variable", "Hi {athlete}", "unknown variable {athlete}"},
+		{"Unclosed tag", "Hi {city", "unclosed tag"},
+		{"Missing end", "{if city}Hi", "{if} without {end}"},
+		{"Stray end", "Hi{end}", "{end} without {if}"},
+		{"Stray else", "Hi{else}", "{else} without {if}"},
+		{"Bad operator", "{if coverage ~ 5}x{end}", "unknown operator"},
+		{"Compare text", "{if city == 5}x{end}", "city is not a number"},
+		{"Compare with text", "{if coverage > lots}x{end}", "must compare with a number"},
+		{"Empty condition", "{if}x{end}", "invalid condition"},
+		{"Unknown in condition", "{if kudos}x{end}", "unknown variable \"kudos\""},
+		{"Else then elif", "{if city}a{else}b{elif coverage}c{end}", "{else} must be followed by {end}"},
+		{"Too long", string(make([]byte, MaxCommentTemplateLength+1)), "longer than"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseCommentTemplate(tt.template)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errorMsg)
+		})
+	}
+}
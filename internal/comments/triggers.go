@@ -0,0 +1,349 @@
+package comments
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nikhilvedi/strava-coverage/internal/i18n"
+)
+
+// Comment trigger types
+const (
+	TriggerEveryActivity     = "every_activity"
+	TriggerFirstCity         = "first_city"
+	TriggerCoverageMilestone = "coverage_milestone"
+	TriggerNewKmRecord       = "new_km_record"
+	TriggerStreetCompleted   = "street_completed"
+	TriggerExploredTiles     = "explored_tiles"
+)
+
+// triggerMilestones are the city coverage percentages announced by coverage_milestone
+var triggerMilestones = []float64{5, 10, 25, 50}
+
+// defaultTileInterval is how many explored tiles apart explored_tiles announcements are
+const defaultTileInterval = 100
+
+// CommentTrigger is a rule that makes an activity worth commenting on, with its message
+type CommentTrigger struct {
+	UserID      int    `json:"user_id" db:"user_id"`
+	TriggerType string `json:"trigger_type" db:"trigger_type"`
+	Enabled     bool   `json:"enabled" db:"enabled"`
+	// Threshold is the tile interval of explored_tiles, e.g. 100 announces 100, 200, 300... tiles
+	Threshold *int `json:"threshold,omitempty" db:"threshold"`
+	// Message is a comment template. Empty uses the trigger's default message, which for
+	// every_activity is the comment settings template.
+	Message   string    `json:"message" db:"message"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// defaultTriggers lists every trigger in the order its message appears in a comment, with
+// default messages in the locale's language. Commenting on every activity that gains at
+// least the settings' minimum coverage increase stays the default, as before triggers existed.
+func defaultTriggers(userID int, locale *i18n.Locale) []CommentTrigger {
+	tileInterval := defaultTileInterval
+	now := time.Now()
+	triggers := []CommentTrigger{
+		{TriggerType: TriggerEveryActivity, Enabled: true},
+		{TriggerType: TriggerFirstCity},
+		{TriggerType: TriggerCoverageMilestone},
+		{TriggerType: TriggerNewKmRecord},
+		{TriggerType: TriggerStreetCompleted},
+		{TriggerType: TriggerExploredTiles, Threshold: &tileInterval},
+	}
+	for i := range triggers {
+		triggers[i].UserID = userID
+		triggers[i].CreatedAt = now
+		triggers[i].UpdatedAt = now
+		if triggers[i].TriggerType != TriggerEveryActivity {
+			triggers[i].Message = locale.Message(triggerMessageKey(triggers[i].TriggerType))
+		}
+	}
+	return triggers
+}
+
+// triggerMessageKey is the catalog key of a trigger's default message
+func triggerMessageKey(triggerType string) string {
+	return "trigger." + triggerType
+}
+
+// ValidateCommentTrigger checks a trigger's type, threshold and message
+func ValidateCommentTrigger(trigger *CommentTrigger) error {
+	known := false
+	for _, d := range defaultTriggers(0, i18n.Get(i18n.DefaultLanguage)) {
+		known = known || d.TriggerType == trigger.TriggerType
+	}
+	if !known {
+		return fmt.Errorf("unknown trigger type %q", trigger.TriggerType)
+	}
+
+	if trigger.TriggerType == TriggerExploredTiles && trigger.Threshold != nil && *trigger.Threshold <= 0 {
+		return fmt.Errorf("%s threshold must be positive", trigger.TriggerType)
+	}
+
+	if trigger.Message != "" {
+		if _, err := ParseCommentTemplate(trigger.Message); err != nil {
+			return fmt.Errorf("invalid %s message: %v", trigger.TriggerType, err)
+		}
+	}
+	return nil
+}
+
+// GetCommentTriggers returns all of a user's triggers, with defaults for those never saved.
+// Default messages, as saved in any language, are given in the user's language.
+func (acs *AutoCommentService) GetCommentTriggers(userID int) ([]CommentTrigger, error) {
+	query := `
+		SELECT user_id, trigger_type, enabled, threshold, message, created_at, updated_at
+		FROM comment_triggers
+		WHERE user_id = $1`
+
+	var saved []CommentTrigger
+	if err := acs.DB.Select(&saved, query, userID); err != nil {
+		return nil, err
+	}
+
+	locale, _ := commentLocale(acs.DB, userID)
+	triggers := defaultTriggers(userID, locale)
+	for i := range triggers {
+		for _, s := range saved {
+			if s.TriggerType != triggers[i].TriggerType {
+				continue
+			}
+			if s.Message == "" || i18n.IsAnyTranslation(triggerMessageKey(s.TriggerType), s.Message) {
+				s.Message = triggers[i].Message
+			}
+			if s.Threshold == nil {
+				s.Threshold = triggers[i].Threshold
+			}
+			triggers[i] = s
+		}
+	}
+	return triggers, nil
+}
+
+// UpdateCommentTriggers saves the given triggers; triggers not included are left unchanged
+func (acs *AutoCommentService) UpdateCommentTriggers(userID int, triggers []CommentTrigger) error {
+	query := `
+		INSERT INTO comment_triggers (user_id, trigger_type, enabled, threshold, message, created_at, updated_at)
+		VALUES (:user_id, :trigger_type, :enabled, :threshold, :message, :created_at, :updated_at)
+		ON CONFLICT (user_id, trigger_type) DO UPDATE SET
+			enabled = EXCLUDED.enabled,
+			threshold = EXCLUDED.threshold,
+			message = EXCLUDED.message,
+			updated_at = EXCLUDED.updated_at`
+
+	tx, err := acs.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for i := range triggers {
+		triggers[i].UserID = userID
+		triggers[i].CreatedAt = now
+		triggers[i].UpdatedAt = now
+		if _, err := tx.NamedExec(query, &triggers[i]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// triggerCandidate is a milestone a trigger could announce, with the value its message shows
+type triggerCandidate struct {
+	key   string
+	value interface{}
+}
+
+// Announcement is a milestone announced by a triggered comment
+type Announcement struct {
+	TriggerType string
+	Key         string
+}
+
+// TriggeredComment is the comment an activity's triggers produced. Text is empty when no
+// trigger fired.
+type TriggeredComment struct {
+	UserID        int
+	ActivityID    int64
+	Text          string
+	Triggers      []string
+	Announcements []Announcement
+}
+
+// EvaluateTriggers works out which of the user's triggers an activity fires and renders
+// their messages. Milestones that were announced before are skipped, so they can be
+// evaluated again after a recalculation. Call RecordAnnouncements once the comment is posted.
+func (acs *AutoCommentService) EvaluateTriggers(activityID int64) (*TriggeredComment, error) {
+	stats, err := acs.DB.GetActivityCommentStats(activityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load activity stats: %w", err)
+	}
+	if err := acs.DB.SetActivityNewKm(activityID, stats.NewKm); err != nil {
+		slog.Error("Failed to store new km", "activity_id", activityID, "error", err)
+	}
+
+	triggers, err := acs.GetCommentTriggers(stats.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get comment triggers: %w", err)
+	}
+	settings, err := acs.GetUserCommentSettings(stats.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get comment settings: %w", err)
+	}
+	locale, units := commentLocale(acs.DB, stats.UserID)
+
+	// Work out the milestones each trigger could announce
+	candidates := make(map[string][]triggerCandidate)
+	var keys []string
+	addKey := func(triggerType, key string, value interface{}) {
+		candidates[triggerType] = append(candidates[triggerType], triggerCandidate{key: key, value: value})
+		keys = append(keys, key)
+	}
+
+	hasCity := stats.CityID != nil && stats.Coverage != nil
+	for _, t := range triggers {
+		if !t.Enabled {
+			continue
+		}
+		switch t.TriggerType {
+		case TriggerFirstCity:
+			if hasCity && stats.EarlierInCity == 0 {
+				addKey(t.TriggerType, fmt.Sprintf("first_city:city:%d", *stats.CityID), nil)
+			}
+		case TriggerCoverageMilestone:
+			if hasCity {
+				for _, m := range triggerMilestones {
+					if stats.PreviousCoverage < m && *stats.Coverage >= m {
+						addKey(t.TriggerType, fmt.Sprintf("coverage_milestone:city:%d:%g", *stats.CityID, m), int(m))
+					}
+				}
+			}
+		case TriggerNewKmRecord:
+			if stats.PreviousBestNewKm != nil && stats.NewKm > *stats.PreviousBestNewKm {
+				addKey(t.TriggerType, fmt.Sprintf("new_km_record:activity:%d", activityID), nil)
+			}
+		case TriggerStreetCompleted:
+			if hasCity {
+				for _, street := range stats.CompletedStreets {
+					addKey(t.TriggerType, fmt.Sprintf("street_completed:city:%d:%s", *stats.CityID, street), street)
+				}
+			}
+		case TriggerExploredTiles:
+			interval := defaultTileInterval
+			if t.Threshold != nil && *t.Threshold > 0 {
+				interval = *t.Threshold
+			}
+			before := stats.TilesTotal - stats.TilesNew
+			if reached := stats.TilesTotal / interval; reached > before/interval {
+				addKey(t.TriggerType, fmt.Sprintf("explored_tiles:%d", reached*interval), nil)
+			}
+		}
+	}
+
+	announced, err := acs.announcedKeys(stats.UserID, keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check announced milestones: %w", err)
+	}
+
+	result := &TriggeredComment{UserID: stats.UserID, ActivityID: activityID}
+	var messages []string
+	for _, t := range triggers {
+		if !t.Enabled {
+			continue
+		}
+
+		vars := NewTemplateVars(stats)
+		vars.SetUnits(units, locale)
+		message := t.Message
+		fired := false
+
+		if t.TriggerType == TriggerEveryActivity {
+			fired = hasCity && *stats.Coverage > 0 &&
+				*stats.Coverage-stats.PreviousCoverage >= settings.MinCoverageIncrease
+			if message == "" {
+				message = localizedTemplate(settings.CommentTemplate, locale)
+			}
+		} else {
+			var fresh []triggerCandidate
+			for _, c := range candidates[t.TriggerType] {
+				if !announced[c.key] {
+					fresh = append(fresh, c)
+				}
+				// Milestones passed together are all recorded so none is announced later
+				result.Announcements = append(result.Announcements, Announcement{TriggerType: t.TriggerType, Key: c.key})
+			}
+			fired = len(fresh) > 0
+
+			switch t.TriggerType {
+			case TriggerCoverageMilestone:
+				if fired {
+					vars["milestone"] = fresh[len(fresh)-1].value
+				}
+			case TriggerStreetCompleted:
+				var streets []string
+				for _, c := range fresh {
+					streets = append(streets, c.value.(string))
+				}
+				vars["streets"] = strings.Join(streets, ", ")
+				vars["streets_completed"] = len(streets)
+			}
+		}
+		if !fired {
+			continue
+		}
+
+		tmpl, err := ParseCommentTemplate(message)
+		if err != nil {
+			slog.Warn("Invalid trigger message, skipping", "trigger", t.TriggerType, "user_id", stats.UserID, "error", err)
+			continue
+		}
+		if text := tmpl.Render(vars, locale); text != "" {
+			messages = append(messages, text)
+			result.Triggers = append(result.Triggers, t.TriggerType)
+		}
+	}
+
+	result.Text = strings.Join(messages, "\n")
+	if result.Text == "" {
+		result.Announcements = nil
+	}
+	return result, nil
+}
+
+// announcedKeys returns which of the given milestone keys were already announced
+func (acs *AutoCommentService) announcedKeys(userID int, keys []string) (map[string]bool, error) {
+	announced := make(map[string]bool)
+	if len(keys) == 0 {
+		return announced, nil
+	}
+
+	var found []string
+	query := `SELECT milestone_key FROM announced_milestones WHERE user_id = $1 AND milestone_key = ANY($2)`
+	if err := acs.DB.Select(&found, query, userID, pq.Array(keys)); err != nil {
+		return nil, err
+	}
+	for _, key := range found {
+		announced[key] = true
+	}
+	return announced, nil
+}
+
+// RecordAnnouncements stores the milestones a posted comment announced
+func (acs *AutoCommentService) RecordAnnouncements(comment *TriggeredComment) error {
+	query := `
+		INSERT INTO announced_milestones (user_id, trigger_type, milestone_key, strava_activity_id)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, milestone_key) DO NOTHING`
+
+	for _, a := range comment.Announcements {
+		if _, err := acs.DB.Exec(query, comment.UserID, a.TriggerType, a.Key, comment.ActivityID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
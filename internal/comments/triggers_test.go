@@ -0,0 +1,42 @@
+package comments
+
+import (
+	"testing"
+
+	"github.com/nikhilvedi/strava-coverage/internal/i18n"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultTriggerMessagesParse(t *testing.T) {
+	for _, language := range i18n.Languages() {
+		for _, trigger := range defaultTriggers(1, i18n.Get(language)) {
+			assert.NoError(t, ValidateCommentTrigger(&trigger), "%s %s", language, trigger.TriggerType)
+		}
+	}
+}
+
+func TestValidateCommentTrigger(t *testing.T) {
+	zero := 0
+
+	tests := []struct {
+		name     string
+		trigger  CommentTrigger
+		errorMsg string
+	}{
+		{"Unknown type", CommentTrigger{TriggerType: "kudos"}, "unknown trigger type"},
+		{"Bad message", CommentTrigger{TriggerType: TriggerFirstCity, Message: "{if city}"}, "invalid first_city message"},
+		{"Bad tile interval", CommentTrigger{TriggerType: TriggerExploredTiles, Threshold: &zero}, "threshold must be positive"},
+		{"Default message", CommentTrigger{TriggerType: TriggerStreetCompleted, Enabled: true}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateCommentTrigger(&tt.trigger)
+			if tt.errorMsg == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errorMsg)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package coverage
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/nikhilvedi/strava-coverage/internal/pagination"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+// ActivityService lists a user's activity history
+type ActivityService struct {
+	DB *storage.DB
+}
+
+// NewActivityService creates a new activity service
+func NewActivityService(db *storage.DB) *ActivityService {
+	return &ActivityService{DB: db}
+}
+
+// RegisterActivityRoutes adds the activity history endpoint
+func (s *ActivityService) RegisterActivityRoutes(r *gin.Engine) {
+	r.GET("/api/activities/user/:userId", s.ListUserActivitiesHandler)
+}
+
+// activitySorts are the ways activity lists can be sorted. Activities without a start
+// date sort by when they were imported.
+var activitySorts = []pagination.Sort{
+	{Name: "start_date", Column: "COALESCE(a.start_date, a.created_at)", Type: "timestamptz"},
+	{Name: "distance_km", Column: "COALESCE(a.distance_km, 0)", Type: "numeric"},
+	{Name: "coverage", Column: "COALESCE(a.coverage_percentage, 0)", Type: "numeric"},
+}
+
+// ActivityPages pages through a user's activity history, newest first by default
+var ActivityPages = pagination.Options{
+	Sorts:        activitySorts,
+	Default:      "-start_date",
+	DefaultLimit: 50,
+	MaxLimit:     500,
+}
+
+// ActivityMapPages pages through the activity routes drawn on the map
+var ActivityMapPages = pagination.Options{
+	Sorts:        activitySorts,
+	Default:      "-start_date",
+	DefaultLimit: 100,
+	MaxLimit:     1000,
+}
+
+// ActivityFilter narrows an activity list
+type ActivityFilter struct {
+	From, To      *time.Time
+	SportTypes    []string
+	CityID        *int
+	MinDistanceKm *float64
+}
+
+// ParseActivityFilter reads ?from=, ?to= (RFC 3339 or YYYY-MM-DD, to inclusive),
+// ?sport_type= (comma-separated), ?city_id= or the :cityId of the path, and
+// ?min_distance_km=
+func ParseActivityFilter(c *gin.Context) (ActivityFilter, error) {
+	var filter ActivityFilter
+
+	if value := c.Query("from"); value != "" {
+		from, _, err := parseDateParam(value)
+		if err != nil {
+			return filter, errors.New("from must be a date (YYYY-MM-DD) or RFC 3339 time")
+		}
+		filter.From = &from
+	}
+	if value := c.Query("to"); value != "" {
+		to, dateOnly, err := parseDateParam(value)
+		if err != nil {
+			return filter, errors.New("to must be a date (YYYY-MM-DD) or RFC 3339 time")
+		}
+		if dateOnly {
+			// The whole day
+			to = to.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		filter.To = &to
+	}
+
+	for _, sport := range strings.Split(c.Query("sport_type"), ",") {
+		if sport = strings.TrimSpace(sport); sport != "" {
+			filter.SportTypes = append(filter.SportTypes, sport)
+		}
+	}
+
+	cityParam := c.Param("cityId")
+	if cityParam == "" {
+		cityParam = c.Query("city_id")
+	}
+	if cityParam != "" {
+		cityID, err := strconv.Atoi(cityParam)
+		if err != nil {
+			return filter, errors.New("city_id must be an integer")
+		}
+		filter.CityID = &cityID
+	}
+
+	if value := c.Query("min_distance_km"); value != "" {
+		distance, err := strconv.ParseFloat(value, 64)
+		if err != nil || distance < 0 {
+			return filter, errors.New("min_distance_km must be a non-negative number")
+		}
+		filter.MinDistanceKm = &distance
+	}
+	return filter, nil
+}
+
+func parseDateParam(value string) (time.Time, bool, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, false, err
+}
+
+// Where returns the filter's conditions on activities aliased a, appending their
+// arguments to args
+func (f ActivityFilter) Where(args *[]interface{}) string {
+	conditions := []string{"TRUE"}
+	add := func(condition string, value interface{}) {
+		*args = append(*args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(*args)))
+	}
+
+	if f.From != nil {
+		add("COALESCE(a.start_date, a.created_at) >= $%d", *f.From)
+	}
+	if f.To != nil {
+		add("COALESCE(a.start_date, a.created_at) <= $%d", *f.To)
+	}
+	if len(f.SportTypes) > 0 {
+		add("COALESCE(a.sport_type, a.activity_type) = ANY($%d)", pq.Array(f.SportTypes))
+	}
+	if f.CityID != nil {
+		add("a.city_id = $%d", *f.CityID)
+	}
+	if f.MinDistanceKm != nil {
+		add("COALESCE(a.distance_km, 0) >= $%d", *f.MinDistanceKm)
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// ActivitySummary is one activity in a user's history
+type ActivitySummary struct {
+	ID                 int        `json:"id"`
+	StravaActivityID   int64      `json:"strava_activity_id"`
+	Name               *string    `json:"name"`
+	ActivityType       *string    `json:"activity_type"`
+	SportType          *string    `json:"sport_type"`
+	StartDate          *time.Time `json:"start_date"`
+	DistanceKm         *float64   `json:"distance_km"`
+	MovingTimeSeconds  *int       `json:"moving_time_seconds"`
+	CityID             *int       `json:"city_id"`
+	CityName           *string    `json:"city_name"`
+	CoveragePercentage *float64   `json:"coverage_percentage"`
+	NewKm              *float64   `json:"new_km"`
+	HasPath            bool       `json:"has_path"`
+}
+
+// ListUserActivitiesHandler pages through a user's activities, filtered and sorted
+func (s *ActivityService) ListUserActivitiesHandler(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	filter, err := ParseActivityFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	params, err := pagination.Parse(c, ActivityPages)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var page pagination.Page
+	countArgs := []interface{}{userID}
+	countQuery := `SELECT COUNT(*) FROM activities a WHERE a.user_id = $1 AND ` + filter.Where(&countArgs)
+	if err := s.DB.Get(&page.Total, countQuery, countArgs...); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count activities"})
+		return
+	}
+
+	args := []interface{}{userID}
+	where := filter.Where(&args)
+	query := fmt.Sprintf(`
+		SELECT
+			a.id, a.strava_activity_id, a.name, a.activity_type, a.sport_type,
+			a.start_date, a.distance_km, a.moving_time_seconds,
+			a.city_id, c.name, a.coverage_percentage, a.new_km,
+			a.path IS NOT NULL,
+			(%s)::text
+		FROM activities a
+		LEFT JOIN cities c ON a.city_id = c.id
+		WHERE a.user_id = $1 AND %s AND %s
+		ORDER BY %s
+		LIMIT %d`, params.Sort.Column, where, params.Where("a.id", &args), params.OrderBy("a.id"), params.Fetch())
+
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch activities"})
+		return
+	}
+	defer rows.Close()
+
+	activities := []ActivitySummary{}
+	var sortKeys []string
+	for rows.Next() {
+		var activity ActivitySummary
+		var sortKey string
+		if err := rows.Scan(
+			&activity.ID, &activity.StravaActivityID, &activity.Name, &activity.ActivityType, &activity.SportType,
+			&activity.StartDate, &activity.DistanceKm, &activity.MovingTimeSeconds,
+			&activity.CityID, &activity.CityName, &activity.CoveragePercentage, &activity.NewKm,
+			&activity.HasPath, &sortKey); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read activities"})
+			return
+		}
+		activities = append(activities, activity)
+		sortKeys = append(sortKeys, sortKey)
+	}
+
+	keep, next := params.Trim(len(activities), func(i int) (string, int64) {
+		return sortKeys[i], int64(activities[i].ID)
+	})
+	activities, page.Next = activities[:keep], next
+
+	pagination.SetHeaders(c, page)
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":     userID,
+		"activities":  activities,
+		"count":       len(activities),
+		"total":       page.Total,
+		"next_cursor": page.Next,
+	})
+}
@@ -0,0 +1,380 @@
+package coverage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+// trackPoint is one GPS sample read from an activity file
+type trackPoint struct {
+	Lat, Lng    float64
+	Altitude    *float64
+	Distance    *float64 // metres since start, when the file records it
+	Time        time.Time
+	HasPosition bool
+}
+
+// parsedActivityFile is the content of a GPX or FIT file
+type parsedActivityFile struct {
+	Name   string
+	Sport  string // Strava sport type
+	Points []trackPoint
+}
+
+// parseActivityFile parses a GPX or FIT file based on its extension
+func parseActivityFile(path string, data []byte) (*parsedActivityFile, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gpx":
+		return parseGPX(data)
+	case ".fit":
+		return parseFIT(data)
+	}
+	return nil, fmt.Errorf("unsupported activity file type: %s", filepath.Ext(path))
+}
+
+// isActivityFile reports whether a file name has an extension parseActivityFile understands
+func isActivityFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".gpx" || ext == ".fit"
+}
+
+// sportFromFileType maps the sport names used by GPX writers and FIT sport codes to Strava sport types
+func sportFromFileType(value string) string {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "running", "run", "1":
+		return "Run"
+	case "trail_running", "trailrun":
+		return "TrailRun"
+	case "cycling", "biking", "ride", "road_biking", "2":
+		return "Ride"
+	case "mountain_biking":
+		return "MountainBikeRide"
+	case "walking", "walk", "11":
+		return "Walk"
+	case "hiking", "hike", "17":
+		return "Hike"
+	}
+	return "Workout"
+}
+
+// gpxFile is the subset of GPX 1.1 read here
+type gpxFile struct {
+	Metadata struct {
+		Name string `xml:"name"`
+	} `xml:"metadata"`
+	Tracks []struct {
+		Name     string `xml:"name"`
+		Type     string `xml:"type"`
+		Segments []struct {
+			Points []struct {
+				Lat       float64  `xml:"lat,attr"`
+				Lon       float64  `xml:"lon,attr"`
+				Elevation *float64 `xml:"ele"`
+				Time      string   `xml:"time"`
+			} `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+// parseGPX reads the track points of a GPX file
+func parseGPX(data []byte) (*parsedActivityFile, error) {
+	var gpx gpxFile
+	if err := xml.Unmarshal(data, &gpx); err != nil {
+		return nil, fmt.Errorf("invalid GPX: %v", err)
+	}
+
+	parsed := &parsedActivityFile{Name: gpx.Metadata.Name}
+	for _, trk := range gpx.Tracks {
+		if parsed.Name == "" {
+			parsed.Name = trk.Name
+		}
+		if parsed.Sport == "" && trk.Type != "" {
+			parsed.Sport = sportFromFileType(trk.Type)
+		}
+		for _, seg := range trk.Segments {
+			for _, pt := range seg.Points {
+				point := trackPoint{Lat: pt.Lat, Lng: pt.Lon, Altitude: pt.Elevation, HasPosition: true}
+				if pt.Time != "" {
+					if t, err := time.Parse(time.RFC3339, strings.TrimSpace(pt.Time)); err == nil {
+						point.Time = t
+					}
+				}
+				parsed.Points = append(parsed.Points, point)
+			}
+		}
+	}
+	return parsed, nil
+}
+
+// FIT protocol constants used by parseFIT
+const (
+	fitMesgSession   = 18
+	fitMesgRecord    = 20
+	fitEpochOffset   = 631065600 // seconds between the Unix epoch and 1989-12-31T00:00:00Z
+	fitSemicircleDeg = 180.0 / (1 << 31)
+)
+
+// fitField is a field in a FIT definition message
+type fitField struct {
+	num, size, baseType byte
+}
+
+// fitDefinition describes the layout of a local message type
+type fitDefinition struct {
+	globalNum uint16
+	order     binary.ByteOrder
+	fields    []fitField
+	devSize   int
+}
+
+// parseFIT reads the record and session messages of a FIT activity file. It implements
+// only the parts of the FIT protocol needed for GPS tracks.
+func parseFIT(data []byte) (*parsedActivityFile, error) {
+	if len(data) < 12 || string(data[8:12]) != ".FIT" {
+		return nil, errors.New("invalid FIT: missing header")
+	}
+	headerSize := int(data[0])
+	dataSize := int(binary.LittleEndian.Uint32(data[4:8]))
+	if headerSize < 12 || headerSize+dataSize > len(data) {
+		return nil, errors.New("invalid FIT: truncated file")
+	}
+
+	r := bytes.NewReader(data[headerSize : headerSize+dataSize])
+	defs := make(map[byte]*fitDefinition)
+	parsed := &parsedActivityFile{}
+	var lastTimestamp uint32
+
+	for r.Len() > 0 {
+		header, _ := r.ReadByte()
+
+		var local byte
+		compressedOffset := -1
+		switch {
+		case header&0x80 != 0: // compressed timestamp data message
+			local = (header >> 5) & 0x03
+			compressedOffset = int(header & 0x1f)
+		case header&0x40 != 0: // definition message
+			def, err := readFITDefinition(r, header&0x20 != 0)
+			if err != nil {
+				return nil, err
+			}
+			defs[header&0x0f] = def
+			continue
+		default:
+			local = header & 0x0f
+		}
+
+		def, ok := defs[local]
+		if !ok {
+			return nil, fmt.Errorf("invalid FIT: data for undefined local message %d", local)
+		}
+
+		values := make(map[byte]uint64, len(def.fields))
+		for _, f := range def.fields {
+			buf := make([]byte, f.size)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, errors.New("invalid FIT: truncated message")
+			}
+			if v, ok := fitValue(buf, f, def.order); ok {
+				values[f.num] = v
+			}
+		}
+		if _, err := r.Seek(int64(def.devSize), io.SeekCurrent); err != nil {
+			return nil, err
+		}
+
+		if ts, ok := values[253]; ok {
+			lastTimestamp = uint32(ts)
+		} else if compressedOffset >= 0 {
+			ts := lastTimestamp&^0x1f + uint32(compressedOffset)
+			if uint32(compressedOffset) < lastTimestamp&0x1f {
+				ts += 0x20
+			}
+			lastTimestamp = ts
+			values[253] = uint64(ts)
+		}
+
+		switch def.globalNum {
+		case fitMesgRecord:
+			parsed.Points = append(parsed.Points, fitRecordPoint(values))
+		case fitMesgSession:
+			if sport, ok := values[5]; ok && parsed.Sport == "" {
+				parsed.Sport = sportFromFileType(fmt.Sprint(sport))
+			}
+		}
+	}
+
+	return parsed, nil
+}
+
+// readFITDefinition reads a definition message following its record header
+func readFITDefinition(r *bytes.Reader, hasDevFields bool) (*fitDefinition, error) {
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, errors.New("invalid FIT: truncated definition")
+	}
+
+	def := &fitDefinition{order: binary.LittleEndian}
+	if head[1] == 1 {
+		def.order = binary.BigEndian
+	}
+	def.globalNum = def.order.Uint16(head[2:4])
+
+	fields := make([]byte, int(head[4])*3)
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return nil, errors.New("invalid FIT: truncated definition")
+	}
+	for i := 0; i < len(fields); i += 3 {
+		def.fields = append(def.fields, fitField{num: fields[i], size: fields[i+1], baseType: fields[i+2]})
+	}
+
+	if hasDevFields {
+		count, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.New("invalid FIT: truncated definition")
+		}
+		devFields := make([]byte, int(count)*3)
+		if _, err := io.ReadFull(r, devFields); err != nil {
+			return nil, errors.New("invalid FIT: truncated definition")
+		}
+		for i := 0; i < len(devFields); i += 3 {
+			def.devSize += int(devFields[i+1])
+		}
+	}
+	return def, nil
+}
+
+// fitValue decodes a single-value integer field, reporting false for arrays, strings and
+// the protocol's invalid-value markers
+func fitValue(buf []byte, f fitField, order binary.ByteOrder) (uint64, bool) {
+	switch f.size {
+	case 1:
+		if buf[0] == 0xff || (f.baseType&0x1f == 0x01 && buf[0] == 0x7f) {
+			return 0, false
+		}
+		return uint64(buf[0]), true
+	case 2:
+		v := order.Uint16(buf)
+		if v == 0xffff || (f.baseType&0x1f == 0x03 && v == 0x7fff) {
+			return 0, false
+		}
+		return uint64(v), true
+	case 4:
+		v := order.Uint32(buf)
+		if v == 0xffffffff || (f.baseType&0x1f == 0x05 && v == 0x7fffffff) {
+			return 0, false
+		}
+		return uint64(v), true
+	}
+	return 0, false
+}
+
+// fitRecordPoint converts the fields of a record message to a track point
+func fitRecordPoint(values map[byte]uint64) trackPoint {
+	var point trackPoint
+	if ts, ok := values[253]; ok {
+		point.Time = time.Unix(int64(ts)+fitEpochOffset, 0).UTC()
+	}
+	lat, latOK := values[0]
+	lng, lngOK := values[1]
+	if latOK && lngOK {
+		point.Lat = float64(int32(uint32(lat))) * fitSemicircleDeg
+		point.Lng = float64(int32(uint32(lng))) * fitSemicircleDeg
+		point.HasPosition = true
+	}
+	// enhanced_altitude (78) supersedes altitude (2); both are scale 5, offset 500
+	if alt, ok := values[78]; ok {
+		v := float64(alt)/5 - 500
+		point.Altitude = &v
+	} else if alt, ok := values[2]; ok {
+		v := float64(alt)/5 - 500
+		point.Altitude = &v
+	}
+	if dist, ok := values[5]; ok {
+		v := float64(dist) / 100
+		point.Distance = &v
+	}
+	return point
+}
+
+// toImportedActivity converts a parsed file to an activity for the import pipeline
+func (f *parsedActivityFile) toImportedActivity(source, ref, fileName string) (*ImportedActivity, error) {
+	streams := &ActivityStreams{}
+	var times []time.Time
+	hasTime, hasAltitude, hasDistance := true, true, true
+
+	for _, p := range f.Points {
+		if !p.HasPosition {
+			continue
+		}
+		streams.LatLng = append(streams.LatLng, []float64{p.Lat, p.Lng})
+		times = append(times, p.Time)
+		hasTime = hasTime && !p.Time.IsZero()
+		hasAltitude = hasAltitude && p.Altitude != nil
+		hasDistance = hasDistance && p.Distance != nil
+		if p.Altitude != nil {
+			streams.Altitude = append(streams.Altitude, *p.Altitude)
+		}
+		if p.Distance != nil {
+			streams.Distance = append(streams.Distance, *p.Distance)
+		}
+	}
+	if len(streams.LatLng) < 2 {
+		return nil, errors.New("file has fewer than two GPS points")
+	}
+
+	if hasTime {
+		for _, t := range times {
+			streams.Time = append(streams.Time, int(t.Sub(times[0]).Seconds()))
+		}
+	}
+	if !hasAltitude {
+		streams.Altitude = nil
+	}
+	if !hasDistance {
+		streams.Distance = nil
+	}
+
+	stats := streams.Stats()
+	first, last := streams.LatLng[0], streams.LatLng[len(streams.LatLng)-1]
+
+	name := f.Name
+	if name == "" {
+		name = strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	}
+	sport := f.Sport
+	if sport == "" {
+		sport = "Workout"
+	}
+
+	meta := &storage.ActivityMetadata{
+		Name:                name,
+		ActivityType:        sport,
+		SportType:           sport,
+		DistanceKm:          math.Round(stats.DistanceM) / 1000,
+		MovingTimeSeconds:   stats.DurationSeconds,
+		ElapsedTimeSeconds:  stats.DurationSeconds,
+		TotalElevationGainM: math.Round(stats.ElevationGainM*10) / 10,
+		Visibility:          "only_me",
+		StartLatitude:       &first[0],
+		StartLongitude:      &first[1],
+		EndLatitude:         &last[0],
+		EndLongitude:        &last[1],
+	}
+	if hasTime {
+		start := times[0]
+		meta.StartDate = &start
+	}
+
+	return &ImportedActivity{Source: source, Ref: ref, Metadata: meta, Streams: streams}, nil
+}
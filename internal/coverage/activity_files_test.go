@@ -0,0 +1,109 @@
+package coverage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testGPX = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="test" xmlns="http://www.topografix.com/GPX/1/1">
+  <metadata><name>Lunch Walk</name></metadata>
+  <trk>
+    <type>walking</type>
+    <trkseg>
+      <trkpt lat="51.5000" lon="-0.1000"><ele>10</ele><time>2024-05-01T12:00:00Z</time></trkpt>
+      <trkpt lat="51.5009" lon="-0.1000"><ele>14</ele><time>2024-05-01T12:01:00Z</time></trkpt>
+      <trkpt lat="51.5018" lon="-0.1000"><ele>12</ele><time>2024-05-01T12:02:00Z</time></trkpt>
+    </trkseg>
+  </trk>
+</gpx>`
+
+// buildTestFIT writes a FIT file with one session message and a record per point
+func buildTestFIT(points [][2]float64, start time.Time) []byte {
+	var body bytes.Buffer
+	le := binary.LittleEndian
+
+	// Definition: local 0 = record (timestamp, position_lat, position_long)
+	body.Write([]byte{0x40, 0, 0})
+	binary.Write(&body, le, uint16(fitMesgRecord))
+	body.Write([]byte{3, 253, 4, 0x86, 0, 4, 0x85, 1, 4, 0x85})
+	for i, p := range points {
+		body.WriteByte(0x00)
+		binary.Write(&body, le, uint32(start.Unix()-fitEpochOffset)+uint32(i*10))
+		binary.Write(&body, le, int32(math.Round(p[0]/fitSemicircleDeg)))
+		binary.Write(&body, le, int32(math.Round(p[1]/fitSemicircleDeg)))
+	}
+
+	// Definition: local 1 = session (sport)
+	body.Write([]byte{0x41, 0, 0})
+	binary.Write(&body, le, uint16(fitMesgSession))
+	body.Write([]byte{1, 5, 1, 0x00})
+	body.Write([]byte{0x01, 1})
+
+	header := make([]byte, 12)
+	header[0] = 12
+	header[1] = 0x10
+	le.PutUint32(header[4:8], uint32(body.Len()))
+	copy(header[8:], ".FIT")
+	return append(header, body.Bytes()...)
+}
+
+func TestParseGPX(t *testing.T) {
+	parsed, err := parseActivityFile("walk.GPX", []byte(testGPX))
+	require.NoError(t, err)
+
+	assert.Equal(t, "Lunch Walk", parsed.Name)
+	assert.Equal(t, "Walk", parsed.Sport)
+	require.Len(t, parsed.Points, 3)
+	assert.Equal(t, 51.5009, parsed.Points[1].Lat)
+	assert.Equal(t, 14.0, *parsed.Points[1].Altitude)
+
+	activity, err := parsed.toImportedActivity("directory", "abc", "walk.GPX")
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 60, 120}, activity.Streams.Time)
+	assert.Equal(t, []float64{10, 14, 12}, activity.Streams.Altitude)
+	assert.Nil(t, activity.Streams.Distance)
+	assert.Equal(t, "Walk", activity.Metadata.SportType)
+	assert.Equal(t, 120, activity.Metadata.MovingTimeSeconds)
+	assert.InDelta(t, 0.2, activity.Metadata.DistanceKm, 0.001)
+	assert.Equal(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), *activity.Metadata.StartDate)
+}
+
+func TestParseFIT(t *testing.T) {
+	start := time.Date(2024, 6, 2, 8, 0, 0, 0, time.UTC)
+	data := buildTestFIT([][2]float64{{53.38, -1.47}, {53.381, -1.47}, {53.382, -1.471}}, start)
+
+	parsed, err := parseActivityFile("run.fit", data)
+	require.NoError(t, err)
+
+	assert.Equal(t, "Run", parsed.Sport)
+	require.Len(t, parsed.Points, 3)
+	assert.InDelta(t, 53.381, parsed.Points[1].Lat, 1e-6)
+	assert.InDelta(t, -1.471, parsed.Points[2].Lng, 1e-6)
+	assert.Equal(t, start.Add(20*time.Second), parsed.Points[2].Time)
+
+	activity, err := parsed.toImportedActivity("directory", "abc", "run.fit")
+	require.NoError(t, err)
+	assert.Equal(t, "run", activity.Metadata.Name)
+	assert.Equal(t, []int{0, 10, 20}, activity.Streams.Time)
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := parseActivityFile("run.fit", []byte("not a fit file"))
+		assert.Error(t, err)
+
+		_, err = parseActivityFile("run.fit", data[:len(data)-4])
+		assert.Error(t, err)
+	})
+}
+
+func TestToImportedActivityNeedsGPS(t *testing.T) {
+	parsed := &parsedActivityFile{Points: []trackPoint{{Lat: 1, Lng: 2, HasPosition: true}, {Time: time.Now()}}}
+	_, err := parsed.toImportedActivity("directory", "abc", "indoor.fit")
+	assert.Error(t, err)
+}
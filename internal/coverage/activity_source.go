@@ -0,0 +1,283 @@
+package coverage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+	"github.com/nikhilvedi/strava-coverage/internal/logging"
+	"github.com/nikhilvedi/strava-coverage/internal/metrics"
+	"github.com/nikhilvedi/strava-coverage/internal/progress"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+// ActivitySource is an origin of activities for the import pipeline. Sources are created
+// per user, so they carry whatever credentials or paths that user needs.
+type ActivitySource interface {
+	// Name identifies the source and is stored in activities.source
+	Name() string
+	// List returns the activities on the given page (starting at 1) and whether more pages follow
+	List(page int) ([]SourceActivity, bool, error)
+	// Load fetches an activity listed by List, including its streams
+	Load(activity SourceActivity) (*ImportedActivity, error)
+}
+
+// activityReporter is implemented by sources that track which of their activities are
+// done. importFromSource calls Done once for each listed activity, with a nil error when
+// it was imported or already existed.
+type activityReporter interface {
+	Done(activity SourceActivity, err error)
+}
+
+// retryableError marks a failure that a later attempt may not hit, such as a database
+// error, as opposed to an activity that can never be imported
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// retryable marks err as retryable
+func retryable(err error) error {
+	return &retryableError{err: err}
+}
+
+// isRetryable reports whether err was marked by retryable
+func isRetryable(err error) bool {
+	var r *retryableError
+	return errors.As(err, &r)
+}
+
+// SourceActivity is an activity as listed by a source, before it is loaded
+type SourceActivity struct {
+	Ref  string // identifier within the source, stored in activities.source_ref
+	Name string
+	// summary is whatever the source needs to load the activity
+	summary interface{}
+}
+
+// ImportedActivity is a fully loaded activity, ready to be stored
+type ImportedActivity struct {
+	Source   string
+	Ref      string
+	Metadata *storage.ActivityMetadata
+	Streams  *ActivityStreams
+}
+
+// ImportResult counts the outcome of importing from a source
+type ImportResult struct {
+	Imported int
+	Skipped  int
+	Failed   int
+}
+
+// storeImportedActivity saves an activity and its streams. It reports the activity's ID
+// and whether it was newly created.
+func storeImportedActivity(db *storage.DB, userID int, activity *ImportedActivity) (int64, bool, error) {
+	linestring := latLngToWKT(activity.Streams.LatLng)
+
+	var inserted bool
+	var err error
+	if activity.Source == storage.ActivitySourceStrava {
+		inserted, err = db.UpsertActivity(userID, activity.Metadata, linestring)
+	} else {
+		inserted, err = db.InsertSourcedActivity(userID, activity.Source, activity.Ref, activity.Metadata, linestring)
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to store activity: %v", err)
+	}
+
+	// A sourced activity that already existed is left untouched and has no ID here
+	activityID := activity.Metadata.StravaActivityID
+	if linestring != "" && activityID != 0 {
+		saveActivityStreams(db, activityID, activity.Streams)
+		if err := db.RecordActivityTiles(activityID); err != nil {
+			slog.Warn("Failed to record explored tiles", "activity_id", activityID, "error", err)
+		}
+	}
+	return activityID, inserted, nil
+}
+
+// stravaSource lists and loads a user's activities through the Strava API
+type stravaSource struct {
+	client      *resty.Client
+	accessToken string
+	scopes      storage.Scopes
+	perPage     int
+}
+
+// newStravaSource creates a Strava source authenticated as one athlete who granted scopes
+func newStravaSource(client *resty.Client, accessToken string, scopes storage.Scopes) *stravaSource {
+	return &stravaSource{client: client, accessToken: accessToken, scopes: scopes, perPage: 100}
+}
+
+func (s *stravaSource) Name() string {
+	return storage.ActivitySourceStrava
+}
+
+// List returns one page of the athlete's activities, keeping only GPS activities of the
+// sports coverage is tracked for. Private activities are left out unless the athlete
+// granted activity:read_all.
+func (s *stravaSource) List(page int) ([]SourceActivity, bool, error) {
+	summaries, hasMore, err := fetchActivitiesPage(s.client, s.accessToken, page, s.perPage)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var activities []SourceActivity
+	for i := range summaries {
+		if !shouldImportActivity(summaries[i]) || !s.scopes.AllowsActivity(summaries[i].Private) {
+			continue
+		}
+		activities = append(activities, SourceActivity{
+			Ref:     strconv.FormatInt(summaries[i].ID, 10),
+			Name:    summaries[i].Name,
+			summary: &summaries[i],
+		})
+	}
+	return activities, hasMore, nil
+}
+
+// Load fetches the activity's streams
+func (s *stravaSource) Load(activity SourceActivity) (*ImportedActivity, error) {
+	summary, ok := activity.summary.(*storage.StravaActivity)
+	if !ok {
+		return nil, fmt.Errorf("activity %s was not listed by the Strava source", activity.Ref)
+	}
+
+	// Rate limiting - Strava allows 1000 requests per 15 minutes
+	defer time.Sleep(100 * time.Millisecond)
+
+	return loadStravaActivity(s.client, s.accessToken, summary)
+}
+
+// loadStravaActivity fetches the streams of a Strava activity
+func loadStravaActivity(client *resty.Client, accessToken string, summary *storage.StravaActivity) (*ImportedActivity, error) {
+	streams, err := fetchActivityStreams(client, accessToken, summary.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &ImportedActivity{
+		Source:   storage.ActivitySourceStrava,
+		Ref:      strconv.FormatInt(summary.ID, 10),
+		Metadata: summary.Metadata(),
+		Streams:  streams,
+	}, nil
+}
+
+// importFromSource imports every activity a source lists that the user does not have yet.
+// With processCoverage set, each new activity is assigned a city and its coverage calculated.
+// onPage, if set, is called after each page. Every activity imported or failed is published
+// to the progress broker as it happens.
+func (s *InitialImportService) importFromSource(ctx context.Context, userID int, source ActivitySource, processCoverage bool, onPage func(page int, result ImportResult)) ImportResult {
+	var result ImportResult
+	ctx = logging.With(ctx, "source", source.Name())
+
+	reporter, _ := source.(activityReporter)
+	done := func(listed SourceActivity, err error) {
+		if reporter != nil {
+			reporter.Done(listed, err)
+		}
+	}
+
+	for page := 1; ; page++ {
+		activities, hasMore, err := source.List(page)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to list activities", "page", page, "error", err)
+			break
+		}
+
+		for _, listed := range activities {
+			exists, err := s.DB.ActivityExistsForSource(userID, source.Name(), listed.Ref)
+			if err != nil {
+				slog.WarnContext(ctx, "Failed to check existing activity", "ref", listed.Ref, "error", err)
+				result.Failed++
+				metrics.ImportedActivities.WithLabelValues(source.Name(), "failed").Inc()
+				s.publishActivityFailed(userID, listed, err)
+				done(listed, retryable(err))
+				continue
+			}
+			if exists {
+				result.Skipped++
+				metrics.ImportedActivities.WithLabelValues(source.Name(), "skipped").Inc()
+				done(listed, nil)
+				continue
+			}
+
+			activity, err := source.Load(listed)
+			if err != nil {
+				slog.WarnContext(ctx, "Failed to load activity", "ref", listed.Ref, "error", err)
+				result.Failed++
+				metrics.ImportedActivities.WithLabelValues(source.Name(), "failed").Inc()
+				s.publishActivityFailed(userID, listed, err)
+				done(listed, err)
+				continue
+			}
+
+			activityID, inserted, err := storeImportedActivity(s.DB, userID, activity)
+			if err != nil {
+				slog.WarnContext(ctx, "Failed to import activity", "ref", listed.Ref, "error", err)
+				result.Failed++
+				metrics.ImportedActivities.WithLabelValues(source.Name(), "failed").Inc()
+				s.publishActivityFailed(userID, listed, err)
+				done(listed, retryable(err))
+				continue
+			}
+			if !inserted {
+				result.Skipped++
+				metrics.ImportedActivities.WithLabelValues(source.Name(), "skipped").Inc()
+				done(listed, nil)
+				continue
+			}
+
+			result.Imported++
+			metrics.ImportedActivities.WithLabelValues(source.Name(), "imported").Inc()
+			done(listed, nil)
+			slog.DebugContext(ctx, "Imported activity", "ref", listed.Ref, "activity_id", activityID)
+
+			if processCoverage && len(activity.Streams.LatLng) >= 2 {
+				if err := s.calculateActivityCoverage(activityID, userID); err != nil {
+					slog.InfoContext(ctx, "Coverage not calculated", "activity_id", activityID, "error", err)
+				} else {
+					s.Webhooks.ActivityProcessed(activityID)
+				}
+			}
+			s.publishImport(userID, progress.TypeActivity, progress.ActivityResult{
+				ActivityID: activityID,
+				Name:       listed.Name,
+				Status:     progress.StatusImported,
+			})
+		}
+
+		if onPage != nil {
+			onPage(page, result)
+		}
+
+		if !hasMore {
+			break
+		}
+
+		// Additional safety check to prevent infinite loops
+		if page >= 1000 {
+			slog.WarnContext(ctx, "Stopping import, reached page limit", "page", page)
+			break
+		}
+	}
+
+	return result
+}
+
+// publishActivityFailed publishes an activity that could not be imported
+func (s *InitialImportService) publishActivityFailed(userID int, listed SourceActivity, err error) {
+	s.publishImport(userID, progress.TypeActivity, progress.ActivityResult{
+		Ref:    listed.Ref,
+		Name:   listed.Name,
+		Status: progress.StatusFailed,
+		Error:  err.Error(),
+	})
+}
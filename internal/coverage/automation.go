@@ -1,18 +1,35 @@
 package coverage
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	resty "github.com/go-resty/resty/v2"
 	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/logging"
+	"github.com/nikhilvedi/strava-coverage/internal/metrics"
+	"github.com/nikhilvedi/strava-coverage/internal/notify"
+	"github.com/nikhilvedi/strava-coverage/internal/pagination"
 	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
+	"github.com/nikhilvedi/strava-coverage/internal/webhooks"
+)
+
+const (
+	// staleWebhookEventAfter is how long an event may stay received or processing before it
+	// is taken to have been lost, e.g. by a restart, and may be processed again
+	staleWebhookEventAfter = 15 * time.Minute
+
+	// recoveryBatchSize caps how many lost events are processed per recovery run
+	recoveryBatchSize = 50
 )
 
 // AutomationService handles background processing and webhooks
@@ -20,18 +37,20 @@ type AutomationService struct {
 	DB              *storage.DB
 	Config          *config.Config
 	CoverageService *CoverageService
-	CommentService  *CommentService
+	Notifier        *notify.Notifier
+	Webhooks        *webhooks.Dispatcher
 	client          *resty.Client
 }
 
 // NewAutomationService creates a new automation service
-func NewAutomationService(db *storage.DB, cfg *config.Config, coverageService *CoverageService, commentService *CommentService) *AutomationService {
+func NewAutomationService(db *storage.DB, cfg *config.Config, coverageService *CoverageService, notifier *notify.Notifier, events *webhooks.Dispatcher) *AutomationService {
 	return &AutomationService{
 		DB:              db,
 		Config:          cfg,
 		CoverageService: coverageService,
-		CommentService:  commentService,
-		client:          resty.New(),
+		Notifier:        notifier,
+		Webhooks:        events,
+		client:          metrics.NewStravaClient(cfg),
 	}
 }
 
@@ -44,6 +63,13 @@ func (s *AutomationService) RegisterAutomationRoutes(r *gin.Engine) {
 		automation.POST("/process-user/:userId", s.ProcessAllUserActivitiesHandler)
 		automation.POST("/sync-recent/:userId", s.SyncRecentActivitiesHandler)
 	}
+
+	webhookEvents := r.Group("/api/admin/webhook-events")
+	{
+		webhookEvents.GET("", s.ListWebhookEventsHandler)
+		webhookEvents.GET("/:eventId", s.GetWebhookEventHandler)
+		webhookEvents.POST("/:eventId/replay", s.ReplayWebhookEventHandler)
+	}
 }
 
 // StravaWebhookEvent represents a webhook event from Strava
@@ -82,54 +108,300 @@ func (s *AutomationService) StravaWebhookHandler(c *gin.Context) {
 		return
 	}
 
-	log.Printf("Received webhook event: %+v", event)
+	// Anyone can post here, so only events of our own push subscription are trusted
+	if !s.fromSubscription(event) {
+		slog.WarnContext(c.Request.Context(), "Rejecting webhook event of another subscription",
+			"subscription_id", event.SubscriptionID, "object_id", event.ObjectID)
+		metrics.WebhookEventsReceived.WithLabelValues("rejected").Inc()
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unknown subscription"})
+		return
+	}
+
+	record := event.toRecord()
+	inserted, err := s.DB.RecordWebhookEvent(record)
+	if err != nil {
+		// Let Strava retry the delivery rather than losing the event
+		slog.ErrorContext(c.Request.Context(), "Failed to record webhook event", "object_id", event.ObjectID, "error", err)
+		metrics.WebhookEventsReceived.WithLabelValues("error").Inc()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record event"})
+		return
+	}
+
+	if !inserted {
+		metrics.WebhookEventsReceived.WithLabelValues("duplicate").Inc()
+		slog.InfoContext(c.Request.Context(), "Ignoring duplicate webhook event", "object_type", event.ObjectType,
+			"aspect_type", event.AspectType, "object_id", event.ObjectID, "event_time", event.EventTime)
+		c.JSON(http.StatusOK, gin.H{"message": "Duplicate event ignored"})
+		return
+	}
+
+	metrics.WebhookEventsReceived.WithLabelValues("recorded").Inc()
+	ctx := logging.Detach(c.Request.Context())
+	slog.InfoContext(ctx, "Received webhook event", "event_id", record.ID, "object_type", event.ObjectType,
+		"aspect_type", event.AspectType, "object_id", event.ObjectID, "athlete_id", event.OwnerID)
+
+	go func() {
+		_ = s.processWebhookEvent(ctx, record)
+	}()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Event received", "event_id": record.ID})
+}
+
+// fromSubscription reports whether an event belongs to the configured push subscription.
+// Every event is accepted while no subscription is configured.
+func (s *AutomationService) fromSubscription(event StravaWebhookEvent) bool {
+	expected := s.Config.StravaWebhookSubscriptionID
+	return expected == 0 || event.SubscriptionID == expected
+}
+
+// toRecord converts a webhook payload into its persisted form
+func (e StravaWebhookEvent) toRecord() *storage.WebhookEvent {
+	record := &storage.WebhookEvent{
+		ObjectType:     e.ObjectType,
+		ObjectID:       e.ObjectID,
+		AspectType:     e.AspectType,
+		OwnerID:        e.OwnerID,
+		SubscriptionID: e.SubscriptionID,
+		EventTime:      e.EventTime,
+	}
+	if len(e.Updates) > 0 {
+		if updates, err := json.Marshal(e.Updates); err == nil {
+			record.Updates = updates
+		}
+	}
+	return record
+}
+
+// processWebhookEvent processes a recorded event and stores the outcome
+func (s *AutomationService) processWebhookEvent(ctx context.Context, event *storage.WebhookEvent) error {
+	ctx = logging.With(ctx, logging.KeyJobID, fmt.Sprintf("webhook_event_%d", event.ID))
 
 	// Only process activity creation events
-	if event.ObjectType == "activity" && event.AspectType == "create" {
-		go s.processNewActivity(event.ObjectID, event.OwnerID)
+	if event.ObjectType != "activity" || event.AspectType != "create" {
+		if err := s.DB.FinishWebhookEvent(event.ID, storage.WebhookStatusSkipped, nil); err != nil {
+			slog.ErrorContext(ctx, "Failed to mark webhook event as skipped", "error", err)
+		}
+		metrics.WebhookEventsProcessed.WithLabelValues(storage.WebhookStatusSkipped).Inc()
+		return nil
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Event received"})
+	claimed, err := s.DB.ClaimWebhookEvent(event.ID, event.Status)
+	if err != nil {
+		return fmt.Errorf("failed to claim webhook event %d: %w", event.ID, err)
+	}
+	if !claimed {
+		slog.InfoContext(ctx, "Webhook event is already being processed")
+		return nil
+	}
+
+	status := storage.WebhookStatusProcessed
+	procErr := s.processNewActivity(ctx, event.ObjectID, event.OwnerID)
+	if errors.Is(procErr, errPrivateActivity) || errors.Is(procErr, errAutoImportOff) {
+		slog.InfoContext(ctx, "Webhook event skipped", "reason", procErr)
+		status, procErr = storage.WebhookStatusSkipped, nil
+	} else if procErr != nil {
+		slog.ErrorContext(ctx, "Webhook event failed", "error", procErr)
+		status = storage.WebhookStatusFailed
+	}
+	metrics.WebhookEventsProcessed.WithLabelValues(status).Inc()
+
+	if err := s.DB.FinishWebhookEvent(event.ID, status, procErr); err != nil {
+		slog.ErrorContext(ctx, "Failed to record outcome of webhook event", "error", err)
+	}
+	return procErr
 }
 
 // processNewActivity handles a new activity from webhook
-func (s *AutomationService) processNewActivity(activityID int64, athleteID int64) {
-	log.Printf("Processing new activity %d for athlete %d", activityID, athleteID)
+func (s *AutomationService) processNewActivity(ctx context.Context, activityID int64, athleteID int64) error {
+	ctx = logging.With(ctx, logging.KeyActivityID, activityID)
+	slog.InfoContext(ctx, "Processing new activity", "athlete_id", athleteID)
 
 	// Find user by Strava athlete ID
 	var userID int
 	err := s.DB.QueryRow("SELECT id FROM users WHERE strava_id = $1", athleteID).Scan(&userID)
 	if err != nil {
-		log.Printf("User not found for athlete ID %d: %v", athleteID, err)
-		return
+		return fmt.Errorf("user not found for athlete ID %d: %w", athleteID, err)
+	}
+	ctx = logging.With(ctx, logging.KeyUserID, userID)
+	enabled, err := s.DB.UserFeatureEnabled(userID, storage.FeatureAutoImport)
+	if err != nil {
+		return fmt.Errorf("failed to check features of user %d: %w", userID, err)
+	}
+	if !enabled {
+		return errAutoImportOff
 	}
 
 	// Import the activity
 	err = s.importActivityByID(activityID, userID)
 	if err != nil {
-		log.Printf("Failed to import activity %d: %v", activityID, err)
-		return
+		return fmt.Errorf("failed to import activity %d: %w", activityID, err)
 	}
 
 	// Calculate coverage
 	result, err := s.calculateAndStoreCoverage(activityID)
+	if errors.Is(err, sql.ErrNoRows) {
+		slog.InfoContext(ctx, "Activity does not intersect any tracked city")
+	} else if err != nil {
+		return fmt.Errorf("failed to calculate coverage for activity %d: %w", activityID, err)
+	} else {
+		slog.InfoContext(ctx, "Calculated activity coverage", "city", result.CityName, "coverage_percent", result.CoveragePercent)
+		s.Webhooks.ActivityProcessed(activityID)
+	}
+
+	// Notify if the activity fires any of the user's triggers
+	notified, err := s.Notifier.NotifyActivity(ctx, activityID, notify.Options{})
 	if err != nil {
-		log.Printf("Failed to calculate coverage for activity %d: %v", activityID, err)
+		return fmt.Errorf("failed to notify about activity %d: %w", activityID, err)
+	}
+	if notified.Status == notify.StatusFailed {
+		return fmt.Errorf("failed to post comment for activity %d: %v", activityID, notified.Channels)
+	}
+	slog.InfoContext(ctx, "Notified about activity", "status", notified.Status, "reason", notified.Reason)
+
+	return nil
+}
+
+// ListWebhookEventsHandler lists recorded webhook events, optionally filtered by status
+func (s *AutomationService) ListWebhookEventsHandler(c *gin.Context) {
+	status := c.Query("status")
+	switch status {
+	case "", storage.WebhookStatusReceived, storage.WebhookStatusProcessing,
+		storage.WebhookStatusProcessed, storage.WebhookStatusSkipped, storage.WebhookStatusFailed:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status filter"})
 		return
 	}
 
-	// Post comment if coverage was calculated
-	if result != nil && result.CoveragePercent > 0 {
-		err = s.postCoverageComment(activityID, result)
-		if err != nil {
-			log.Printf("Failed to post comment for activity %d: %v", activityID, err)
-		} else {
-			log.Printf("Successfully processed activity %d: %.1f%% coverage in %s",
-				activityID, result.CoveragePercent, result.CityName)
+	params, err := pagination.Parse(c, storage.WebhookEventPages)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	events, page, err := s.DB.ListWebhookEvents(status, params)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list webhook events"})
+		return
+	}
+
+	pagination.SetHeaders(c, page)
+	c.JSON(http.StatusOK, gin.H{
+		"events":      events,
+		"count":       len(events),
+		"total":       page.Total,
+		"next_cursor": page.Next,
+	})
+}
+
+// GetWebhookEventHandler returns a single recorded webhook event
+func (s *AutomationService) GetWebhookEventHandler(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("eventId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+
+	event, err := s.DB.GetWebhookEvent(eventID)
+	if err != nil {
+		utils.NotFound(c, utils.CodeWebhookEventNotFound, "Webhook event not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, event)
+}
+
+// ReplayWebhookEventHandler re-runs processing for a failed or lost webhook event
+func (s *AutomationService) ReplayWebhookEventHandler(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("eventId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+
+	event, err := s.DB.GetWebhookEvent(eventID)
+	if err != nil {
+		utils.NotFound(c, utils.CodeWebhookEventNotFound, "Webhook event not found")
+		return
+	}
+
+	if err := replayable(event, time.Now()); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if event.Status == storage.WebhookStatusProcessing {
+		if err := s.DB.ReleaseStaleWebhookEvents(staleWebhookEventAfter); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release webhook event"})
+			return
+		}
+		event.Status = storage.WebhookStatusReceived
+	}
+
+	ctx := logging.Detach(c.Request.Context())
+	go func() {
+		_ = s.processWebhookEvent(ctx, event)
+	}()
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":  "Replay started",
+		"event_id": event.ID,
+		"attempts": event.Attempts,
+	})
+}
+
+// replayable reports why an event may not be replayed, or nil if it may. Failed events can
+// always be replayed; events left received or processing only once they are stale, since
+// replaying one still being processed, or a successful one, would post a second comment.
+func replayable(event *storage.WebhookEvent, now time.Time) error {
+	switch event.Status {
+	case storage.WebhookStatusFailed:
+		return nil
+	case storage.WebhookStatusReceived, storage.WebhookStatusProcessing:
+		if now.Sub(event.UpdatedAt) >= staleWebhookEventAfter {
+			return nil
+		}
+		return fmt.Errorf("Event is still %s; it can be replayed once it has not changed for %s", event.Status, staleWebhookEventAfter)
+	default:
+		return fmt.Errorf("Only failed or stale events can be replayed (status is %s)", event.Status)
+	}
+}
+
+// RunRecoveryWorker processes events lost by a restart every interval until ctx is
+// cancelled: events stuck in processing are released, then stale received events processed
+func (s *AutomationService) RunRecoveryWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if recovered, err := s.recoverWebhookEvents(ctx); err != nil {
+			slog.ErrorContext(ctx, "Webhook event recovery failed", "error", err)
+		} else if recovered > 0 {
+			slog.InfoContext(ctx, "Processed lost webhook events", "events", recovered)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
 	}
 }
 
+// recoverWebhookEvents processes one batch of lost events and returns how many it processed
+func (s *AutomationService) recoverWebhookEvents(ctx context.Context) (int, error) {
+	if err := s.DB.ReleaseStaleWebhookEvents(staleWebhookEventAfter); err != nil {
+		return 0, fmt.Errorf("failed to release stale webhook events: %w", err)
+	}
+	events, err := s.DB.GetStaleWebhookEvents(staleWebhookEventAfter, recoveryBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list stale webhook events: %w", err)
+	}
+
+	for i := range events {
+		_ = s.processWebhookEvent(ctx, &events[i])
+	}
+	return len(events), nil
+}
+
 // importActivityByID imports a specific activity by its Strava ID
 func (s *AutomationService) importActivityByID(activityID int64, userID int) error {
 	// Get user's access token
@@ -138,93 +410,21 @@ func (s *AutomationService) importActivityByID(activityID int64, userID int) err
 		return fmt.Errorf("no access token for user %d: %v", userID, err)
 	}
 
-	// Fetch activity streams from Strava
-	resp, err := s.client.R().
-		SetAuthToken(tokenPtr.AccessToken).
-		SetQueryParam("keys", "latlng").
-		Get(fmt.Sprintf("https://www.strava.com/api/v3/activities/%d/streams", activityID))
-
-	if err != nil || resp.StatusCode() != 200 {
-		return fmt.Errorf("failed to fetch activity stream: %v, status: %d", err, resp.StatusCode())
-	}
-
-	// Parse the response (reuse logic from import.go)
-	var rawJSON []map[string]interface{}
-	if err := json.Unmarshal(resp.Body(), &rawJSON); err != nil {
-		return fmt.Errorf("failed to parse stream response: %v", err)
-	}
-
-	var latlngData [][]float64
-	for _, stream := range rawJSON {
-		if stream["type"] == "latlng" {
-			if dataRaw, ok := stream["data"].([]interface{}); ok {
-				for _, pointRaw := range dataRaw {
-					if point, ok := pointRaw.([]interface{}); ok && len(point) == 2 {
-						lat, latOk := point[0].(float64)
-						lng, lngOk := point[1].(float64)
-						if latOk && lngOk {
-							latlngData = append(latlngData, []float64{lat, lng})
-						}
-					}
-				}
-			}
-		}
+	scopes, err := s.DB.GetUserScopes(userID)
+	if err != nil {
+		return fmt.Errorf("failed to get Strava scopes for user %d: %v", userID, err)
 	}
 
-	// Handle activities with or without GPS data
-	var query string
-
-	if len(latlngData) == 0 {
-		// Indoor activity - no GPS data
-		query = `
-			INSERT INTO activities (
-				user_id, 
-				strava_activity_id, 
-				path,
-				city_id,
-				coverage_percentage,
-				comment_posted,
-				created_at,
-				updated_at
-			) VALUES (
-				$1, $2, NULL,
-				NULL, NULL, false,
-				CURRENT_TIMESTAMP,
-				CURRENT_TIMESTAMP
-			) ON CONFLICT (strava_activity_id) DO NOTHING`
-
-		_, err = s.DB.Exec(query, userID, activityID)
-	} else {
-		// Outdoor activity - has GPS data
-		// Convert to WKT LINESTRING
-		var points []string
-		for _, ll := range latlngData {
-			if len(ll) == 2 {
-				points = append(points, fmt.Sprintf("%f %f", ll[1], ll[0])) // WKT: lon lat
-			}
-		}
-		linestring := fmt.Sprintf("LINESTRING(%s)", strings.Join(points, ", "))
-
-		query = `
-			INSERT INTO activities (
-				user_id, 
-				strava_activity_id, 
-				path,
-				city_id,
-				coverage_percentage,
-				comment_posted,
-				created_at,
-				updated_at
-			) VALUES (
-				$1, $2, ST_GeomFromText($3, 4326),
-				NULL, NULL, false,
-				CURRENT_TIMESTAMP,
-				CURRENT_TIMESTAMP
-			) ON CONFLICT (strava_activity_id) DO NOTHING`
-
-		_, err = s.DB.Exec(query, userID, activityID, linestring)
+	// Webhooks only carry the ID, so fetch the summary fields first
+	activity, err := fetchStravaActivity(s.client, tokenPtr.AccessToken, activityID)
+	if err != nil {
+		return err
+	}
+	if !scopes.AllowsActivity(activity.Private) {
+		return errPrivateActivity
 	}
 
+	_, _, err = storeStravaActivity(s.DB, s.client, tokenPtr.AccessToken, userID, activity)
 	return err
 }
 
@@ -268,40 +468,12 @@ func (s *AutomationService) calculateAndStoreCoverage(activityID int64) (*Covera
 
 	_, err = s.DB.Exec(updateQuery, cityID, result.CoveragePercent, activityID)
 	if err != nil {
-		log.Printf("Warning: Failed to update activity coverage: %v", err)
+		slog.Warn("Failed to update activity coverage", "activity_id", activityID, "error", err)
 	}
 
 	return result, nil
 }
 
-// postCoverageComment posts a coverage comment for an activity
-func (s *AutomationService) postCoverageComment(activityID int64, result *CoverageResult) error {
-	// Get activity details
-	var userID int
-	query := `SELECT user_id FROM activities WHERE strava_activity_id = $1`
-	err := s.DB.QueryRow(query, activityID).Scan(&userID)
-	if err != nil {
-		return err
-	}
-
-	// Get user's access token
-	tokenPtr, err := s.DB.GetStravaToken(userID)
-	if err != nil {
-		return err
-	}
-
-	// Generate and post comment
-	commentText := s.CommentService.generateCoverageComment(result.CityName, result.CoveragePercent, userID)
-	err = s.CommentService.postStravaComment(activityID, commentText, tokenPtr.AccessToken)
-	if err != nil {
-		return err
-	}
-
-	// Mark as commented
-	_, err = s.DB.Exec("UPDATE activities SET comment_posted = true WHERE strava_activity_id = $1", activityID)
-	return err
-}
-
 // ProcessAllUserActivitiesHandler processes all activities for a user
 func (s *AutomationService) ProcessAllUserActivitiesHandler(c *gin.Context) {
 	userIDStr := c.Param("userId")
@@ -312,25 +484,26 @@ func (s *AutomationService) ProcessAllUserActivitiesHandler(c *gin.Context) {
 	}
 
 	// Process in background
-	go s.processAllUserActivities(userID)
+	ctx := logging.With(logging.Detach(c.Request.Context()), logging.KeyUserID, userID, logging.KeyJobID, logging.NewJobID("process"))
+	go s.processAllUserActivities(ctx, userID)
 
 	c.JSON(http.StatusAccepted, gin.H{"message": "Processing started for user activities"})
 }
 
 // processAllUserActivities processes all activities for a user
-func (s *AutomationService) processAllUserActivities(userID int) {
-	log.Printf("Processing all activities for user %d", userID)
+func (s *AutomationService) processAllUserActivities(ctx context.Context, userID int) {
+	slog.InfoContext(ctx, "Processing all activities")
 
-	// Get activities without coverage
+	// Get activities without coverage, oldest first so triggers see them in order
 	query := `
-		SELECT strava_activity_id 
+		SELECT strava_activity_id
 		FROM activities 
 		WHERE user_id = $1 AND coverage_percentage IS NULL
-		ORDER BY created_at DESC`
+		ORDER BY COALESCE(start_date, created_at) ASC`
 
 	rows, err := s.DB.Query(query, userID)
 	if err != nil {
-		log.Printf("Failed to fetch activities for user %d: %v", userID, err)
+		slog.ErrorContext(ctx, "Failed to fetch activities", "error", err)
 		return
 	}
 	defer rows.Close()
@@ -343,25 +516,22 @@ func (s *AutomationService) processAllUserActivities(userID int) {
 			continue
 		}
 
-		result, err := s.calculateAndStoreCoverage(activityID)
-		if err != nil {
-			log.Printf("Failed to calculate coverage for activity %d: %v", activityID, err)
+		if _, err := s.calculateAndStoreCoverage(activityID); err != nil {
+			slog.WarnContext(ctx, "Failed to calculate coverage", "activity_id", activityID, "error", err)
 			failed++
 			continue
 		}
+		s.Webhooks.ActivityProcessed(activityID)
 
-		if result != nil && result.CoveragePercent > 0 {
-			err = s.postCoverageComment(activityID, result)
-			if err != nil {
-				log.Printf("Failed to post comment for activity %d: %v", activityID, err)
-			}
+		if _, err := s.Notifier.NotifyActivity(ctx, activityID, notify.Options{}); err != nil {
+			slog.WarnContext(ctx, "Failed to notify about activity", "activity_id", activityID, "error", err)
 		}
 
 		processed++
 		time.Sleep(time.Second) // Rate limiting
 	}
 
-	log.Printf("Completed processing for user %d: %d processed, %d failed", userID, processed, failed)
+	slog.InfoContext(ctx, "Completed processing", "processed", processed, "failed", failed)
 }
 
 // SyncRecentActivitiesHandler syncs recent activities from Strava
@@ -373,19 +543,35 @@ func (s *AutomationService) SyncRecentActivitiesHandler(c *gin.Context) {
 		return
 	}
 
+	tokenPtr, err := s.DB.GetStravaToken(userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No access token found for user"})
+		return
+	}
+	scopes, err := s.DB.GetUserScopes(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get Strava scopes"})
+		return
+	}
+
 	// Get recent activities from Strava API
-	activities, err := s.fetchRecentActivities(userID)
+	activities, err := s.fetchRecentActivities(tokenPtr.AccessToken)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch activities: %v", err)})
 		return
 	}
 
 	// Process each activity
-	var imported, failed int
-	for _, activity := range activities {
-		err := s.importActivityByID(activity.ID, userID)
+	var imported, skipped, failed int
+	for i := range activities {
+		activity := &activities[i]
+		if !scopes.AllowsActivity(activity.Private) {
+			skipped++
+			continue
+		}
+		_, _, err := storeStravaActivity(s.DB, s.client, tokenPtr.AccessToken, userID, activity)
 		if err != nil {
-			log.Printf("Failed to import activity %d: %v", activity.ID, err)
+			slog.WarnContext(c.Request.Context(), "Failed to import activity", "activity_id", activity.ID, "error", err)
 			failed++
 			continue
 		}
@@ -395,35 +581,24 @@ func (s *AutomationService) SyncRecentActivitiesHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"message":  "Sync completed",
 		"imported": imported,
+		"skipped":  skipped,
 		"failed":   failed,
 		"total":    len(activities),
 	})
 }
 
-// StravaActivity represents a basic Strava activity
-type StravaActivity struct {
-	ID   int64  `json:"id"`
-	Name string `json:"name"`
-	Type string `json:"type"`
-}
-
 // fetchRecentActivities fetches recent activities from Strava
-func (s *AutomationService) fetchRecentActivities(userID int) ([]StravaActivity, error) {
-	tokenPtr, err := s.DB.GetStravaToken(userID)
-	if err != nil {
-		return nil, err
-	}
-
+func (s *AutomationService) fetchRecentActivities(accessToken string) ([]storage.StravaActivity, error) {
 	resp, err := s.client.R().
-		SetAuthToken(tokenPtr.AccessToken).
+		SetAuthToken(accessToken).
 		SetQueryParam("per_page", "30").
-		Get("https://www.strava.com/api/v3/athlete/activities")
+		Get("/athlete/activities")
 
 	if err != nil || resp.StatusCode() != 200 {
 		return nil, fmt.Errorf("failed to fetch activities: %v, status: %d", err, resp.StatusCode())
 	}
 
-	var activities []StravaActivity
+	var activities []storage.StravaActivity
 	err = json.Unmarshal(resp.Body(), &activities)
 	return activities, err
 }
@@ -0,0 +1,60 @@
+package coverage
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStravaWebhookHandlerRejectsOtherSubscriptions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := &config.Config{StravaWebhookSubscriptionID: 7}
+	service := NewAutomationService(&storage.DB{}, cfg, nil, nil, nil)
+	router := gin.New()
+	service.RegisterAutomationRoutes(router)
+
+	body := `{"object_type":"activity","object_id":1,"aspect_type":"create","owner_id":1001,"subscription_id":8,"event_time":1700000000}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/automation/webhook", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	assert.True(t, service.fromSubscription(StravaWebhookEvent{SubscriptionID: 7}))
+	assert.False(t, service.fromSubscription(StravaWebhookEvent{}))
+
+	// Without a configured subscription every event is accepted
+	service.Config = &config.Config{}
+	assert.True(t, service.fromSubscription(StravaWebhookEvent{SubscriptionID: 8}))
+}
+
+func TestReplayable(t *testing.T) {
+	now := time.Now()
+	fresh, stale := now.Add(-time.Minute), now.Add(-staleWebhookEventAfter)
+
+	tests := []struct {
+		status    string
+		updatedAt time.Time
+		allowed   bool
+	}{
+		{storage.WebhookStatusFailed, fresh, true},
+		{storage.WebhookStatusReceived, fresh, false},
+		{storage.WebhookStatusReceived, stale, true},
+		{storage.WebhookStatusProcessing, fresh, false},
+		{storage.WebhookStatusProcessing, stale, true},
+		{storage.WebhookStatusProcessed, stale, false},
+		{storage.WebhookStatusSkipped, stale, false},
+	}
+
+	for _, tt := range tests {
+		err := replayable(&storage.WebhookEvent{Status: tt.status, UpdatedAt: tt.updatedAt}, now)
+		assert.Equal(t, tt.allowed, err == nil, "%s updated %s ago", tt.status, now.Sub(tt.updatedAt))
+	}
+}
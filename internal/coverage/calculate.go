@@ -1,14 +1,20 @@
 package coverage
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/internal/logging"
+	"github.com/nikhilvedi/strava-coverage/internal/metrics"
+	"github.com/nikhilvedi/strava-coverage/internal/progress"
 	"github.com/nikhilvedi/strava-coverage/internal/storage"
 	"github.com/nikhilvedi/strava-coverage/internal/utils"
 )
@@ -16,7 +22,8 @@ import (
 // RecalculationStatus tracks the progress of bulk coverage recalculation
 type RecalculationStatus struct {
 	JobID      string     `json:"job_id"`
-	Status     string     `json:"status"` // "running", "completed", "error"
+	UserID     int        `json:"user_id,omitempty"` // 0 when every user's activities are recalculated
+	Status     string     `json:"status"`            // "running", "completed", "error"
 	Progress   int        `json:"progress"`
 	Total      int        `json:"total"`
 	Updated    int        `json:"updated"`
@@ -28,16 +35,19 @@ type RecalculationStatus struct {
 
 // CoverageService handles coverage calculation operations
 type CoverageService struct {
-	DB     *storage.DB
-	jobs   map[string]*RecalculationStatus
-	jobsMu sync.RWMutex
+	DB       *storage.DB
+	Progress *progress.Broker
+	jobs     map[string]*RecalculationStatus
+	jobsMu   sync.RWMutex
 }
 
-// NewCoverageService creates a new coverage service
-func NewCoverageService(db *storage.DB) *CoverageService {
+// NewCoverageService creates a new coverage service. broker receives the progress of
+// recalculation jobs and may be nil.
+func NewCoverageService(db *storage.DB, broker *progress.Broker) *CoverageService {
 	return &CoverageService{
-		DB:   db,
-		jobs: make(map[string]*RecalculationStatus),
+		DB:       db,
+		Progress: broker,
+		jobs:     make(map[string]*RecalculationStatus),
 	}
 }
 
@@ -48,8 +58,10 @@ func (s *CoverageService) RegisterCoverageRoutes(r *gin.Engine) {
 		coverage.POST("/calculate/:activityId", s.CalculateCoverageHandler)
 		coverage.POST("/recalculate-all", s.RecalculateAllCoverageHandler)
 		coverage.GET("/recalculate-status/:jobId", s.GetRecalculationStatusHandler)
+		coverage.GET("/recalculate-status/:jobId/stream", s.StreamRecalculationHandler)
 		coverage.GET("/user/:userId/city/:cityId", s.GetUserCityCoverageHandler)
 		coverage.GET("/activity/:activityId", s.GetActivityCoverageHandler)
+		coverage.GET("/activity/:activityId/streams", s.GetActivityStreamsHandler)
 	}
 }
 
@@ -66,8 +78,6 @@ type CoverageResult struct {
 
 // CalculateCoverageHandler calculates coverage for a specific activity
 func (s *CoverageService) CalculateCoverageHandler(c *gin.Context) {
-	logger := utils.NewLogger("CoverageService")
-
 	activityIDStr := c.Param("activityId")
 	activityID, err := strconv.ParseInt(activityIDStr, 10, 64)
 	if err != nil {
@@ -76,7 +86,8 @@ func (s *CoverageService) CalculateCoverageHandler(c *gin.Context) {
 		return
 	}
 
-	logger.Info("Calculating coverage for activity %d", activityID)
+	ctx := logging.With(c.Request.Context(), logging.KeyActivityID, activityID)
+	slog.DebugContext(ctx, "Calculating coverage")
 
 	// First, check if the activity exists and get its details
 	var userID int
@@ -88,7 +99,7 @@ func (s *CoverageService) CalculateCoverageHandler(c *gin.Context) {
 			apiErr := utils.NewAPIError(404, "Activity not found", fmt.Sprintf("No activity found with ID %d", activityID))
 			utils.ErrorResponse(c, apiErr)
 		} else {
-			logger.Error("Failed to fetch activity %d: %v", activityID, err)
+			slog.ErrorContext(ctx, "Failed to fetch activity", "error", err)
 			apiErr := utils.NewAPIError(500, "Database error", "Failed to retrieve activity data")
 			utils.ErrorResponse(c, apiErr)
 		}
@@ -112,19 +123,19 @@ func (s *CoverageService) CalculateCoverageHandler(c *gin.Context) {
 			apiErr := utils.NewAPIError(404, "No city intersection", "Activity does not intersect with any tracked city")
 			utils.ErrorResponse(c, apiErr)
 		} else {
-			logger.Error("Failed to find intersecting city for activity %d: %v", activityID, err)
+			slog.ErrorContext(ctx, "Failed to find intersecting city", "error", err)
 			apiErr := utils.NewAPIError(500, "Database error", "Failed to find intersecting city")
 			utils.ErrorResponse(c, apiErr)
 		}
 		return
 	}
 
-	logger.Info("Activity %d intersects with city %s (ID: %d)", activityID, cityName, cityID)
+	slog.DebugContext(ctx, "Activity intersects city", "city_id", cityID, "city", cityName)
 
 	// Calculate coverage using a grid-based approach
 	result, err := s.calculateGridBasedCoverage(userID, activityID, cityID, cityName)
 	if err != nil {
-		logger.Error("Failed to calculate coverage for activity %d: %v", activityID, err)
+		slog.ErrorContext(ctx, "Failed to calculate coverage", "city_id", cityID, "error", err)
 		apiErr := utils.NewAPIError(500, "Coverage calculation failed", "Unable to calculate street coverage")
 		utils.ErrorResponse(c, apiErr)
 		return
@@ -138,7 +149,7 @@ func (s *CoverageService) CalculateCoverageHandler(c *gin.Context) {
 
 	_, err = s.DB.Exec(updateQuery, cityID, result.CoveragePercent, activityID)
 	if err != nil {
-		fmt.Printf("Warning: Failed to update activity coverage: %v\n", err)
+		slog.WarnContext(ctx, "Failed to update activity coverage", "error", err)
 	}
 
 	c.JSON(http.StatusOK, result)
@@ -206,17 +217,84 @@ func (s *CoverageService) calculateGridBasedCoverage(userID int, activityID int6
 		UniqueStreetsKm: coveredStreetsKm,
 	}
 
+	if err := s.recordFirstReached(userID, activityID, cityID); err != nil {
+		slog.Warn("Failed to record first-reached times", "activity_id", activityID, "error", err)
+	}
+
 	return result, nil
 }
 
+// recordFirstReached stores when the activity first reached each street of the city it
+// passed and each tile it is credited with. Activities without a time stream are skipped.
+func (s *CoverageService) recordFirstReached(userID int, activityID int64, cityID int) error {
+	streams, err := StoredActivityStreams(s.DB, activityID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load streams: %w", err)
+	}
+	if len(streams.Time) == 0 {
+		return nil
+	}
+
+	var startDate sql.NullTime
+	if err := s.DB.Get(&startDate, `SELECT start_date FROM activities WHERE strava_activity_id = $1`, activityID); err != nil {
+		return fmt.Errorf("failed to load start date: %w", err)
+	}
+	if !startDate.Valid {
+		return nil
+	}
+
+	streets, err := s.DB.GetStreetEntries(activityID, cityID)
+	if err != nil {
+		return fmt.Errorf("failed to locate streets: %w", err)
+	}
+	for _, street := range streets {
+		if reachedAt, ok := streams.TimeAtFraction(startDate.Time, street.Fraction); ok {
+			if err := s.DB.RecordStreetReached(userID, street.StreetID, activityID, reachedAt); err != nil {
+				return fmt.Errorf("failed to record street %d: %w", street.StreetID, err)
+			}
+		}
+	}
+
+	tiles, err := s.DB.GetTileEntries(activityID)
+	if err != nil {
+		return fmt.Errorf("failed to locate tiles: %w", err)
+	}
+	for _, tile := range tiles {
+		if reachedAt, ok := streams.TimeAtFraction(startDate.Time, tile.Fraction); ok {
+			if err := s.DB.SetTileReached(activityID, tile.X, tile.Y, reachedAt); err != nil {
+				return fmt.Errorf("failed to record tile %d/%d: %w", tile.X, tile.Y, err)
+			}
+		}
+	}
+	return nil
+}
+
 // RecalculateAllCoverageHandler starts an asynchronous recalculation job
 func (s *CoverageService) RecalculateAllCoverageHandler(c *gin.Context) {
-	// Generate unique job ID
-	jobID := fmt.Sprintf("recalc_%d", time.Now().Unix())
+	jobID := s.StartRecalculation(c.Request.Context(), 0)
+
+	c.JSON(http.StatusOK, gin.H{
+		"job_id":  jobID,
+		"status":  "started",
+		"message": "Recalculation job started in background",
+	})
+}
+
+// StartRecalculation recalculates the coverage of a user's activities, or every user's
+// for a userID of 0, in the background and returns the job ID. The job logs with the
+// attributes of ctx and its ID.
+func (s *CoverageService) StartRecalculation(ctx context.Context, userID int) string {
+	jobID := fmt.Sprintf("recalc_%d", time.Now().UnixNano())
+	if userID != 0 {
+		jobID = fmt.Sprintf("recalc_user%d_%d", userID, time.Now().UnixNano())
+	}
 
-	// Create initial job status
 	job := &RecalculationStatus{
 		JobID:     jobID,
+		UserID:    userID,
 		Status:    "running",
 		StartedAt: time.Now(),
 		Message:   "Starting recalculation...",
@@ -226,14 +304,38 @@ func (s *CoverageService) RecalculateAllCoverageHandler(c *gin.Context) {
 	s.jobs[jobID] = job
 	s.jobsMu.Unlock()
 
-	// Start background job
-	go s.performRecalculation(jobID)
+	ctx = logging.With(logging.Detach(ctx), logging.KeyJobID, jobID)
+	if userID != 0 {
+		ctx = logging.With(ctx, logging.KeyUserID, userID)
+	}
+	go s.performRecalculation(ctx, jobID, userID)
+	return jobID
+}
+
+// Jobs returns the recalculation jobs since the server started, newest first
+func (s *CoverageService) Jobs() []RecalculationStatus {
+	s.jobsMu.RLock()
+	jobs := make([]RecalculationStatus, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, *job)
+	}
+	s.jobsMu.RUnlock()
 
-	c.JSON(http.StatusOK, gin.H{
-		"job_id":  jobID,
-		"status":  "started",
-		"message": "Recalculation job started in background",
-	})
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].StartedAt.After(jobs[j].StartedAt) })
+	return jobs
+}
+
+// JobOwner returns the user whose activities a recalculation job covers, or 0 for a job
+// covering every user. It returns sql.ErrNoRows for unknown jobs.
+func (s *CoverageService) JobOwner(jobID string) (int, error) {
+	s.jobsMu.RLock()
+	defer s.jobsMu.RUnlock()
+
+	job, exists := s.jobs[jobID]
+	if !exists {
+		return 0, sql.ErrNoRows
+	}
+	return job.UserID, nil
 }
 
 // GetRecalculationStatusHandler returns the status of a recalculation job
@@ -245,26 +347,61 @@ func (s *CoverageService) GetRecalculationStatusHandler(c *gin.Context) {
 	s.jobsMu.RUnlock()
 
 	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		utils.NotFound(c, utils.CodeJobNotFound, "Job not found")
 		return
 	}
 
 	c.JSON(http.StatusOK, job)
 }
 
+// StreamRecalculationHandler streams a recalculation job's progress as server-sent events
+// from its start, ending after the job completes
+func (s *CoverageService) StreamRecalculationHandler(c *gin.Context) {
+	jobID := c.Param("jobId")
+
+	s.jobsMu.RLock()
+	_, exists := s.jobs[jobID]
+	s.jobsMu.RUnlock()
+
+	if !exists {
+		utils.NotFound(c, utils.CodeJobNotFound, "Job not found")
+		return
+	}
+
+	progress.Stream(c, s.Progress, progress.Filter{JobID: jobID}, true, func(e progress.Event) bool {
+		return e.UserID == 0 && e.Terminal()
+	})
+}
+
+// publishRecalculation publishes a recalculation job's progress
+func (s *CoverageService) publishRecalculation(jobID string, userID int, eventType string, data interface{}) {
+	s.Progress.Publish(progress.Event{
+		Kind:   progress.KindRecalculation,
+		Type:   eventType,
+		UserID: userID,
+		JobID:  jobID,
+		Data:   data,
+	})
+}
+
 // performRecalculation runs the actual recalculation in the background
-func (s *CoverageService) performRecalculation(jobID string) {
+func (s *CoverageService) performRecalculation(ctx context.Context, jobID string, userID int) {
+	slog.InfoContext(ctx, "Starting recalculation")
+	metrics.RecalculationsRunning.Inc()
+	defer metrics.RecalculationsRunning.Dec()
 
 	// Get all activities that have been assigned to cities
 	query := `
 		SELECT a.strava_activity_id, a.user_id, a.city_id, ci.name
 		FROM activities a
 		JOIN cities ci ON a.city_id = ci.id
-		WHERE a.city_id IS NOT NULL`
+		WHERE a.city_id IS NOT NULL AND ($1 = 0 OR a.user_id = $1)`
 
-	rows, err := s.DB.Query(query)
+	rows, err := s.DB.Query(query, userID)
 	if err != nil {
+		slog.ErrorContext(ctx, "Failed to fetch activities", "error", err)
 		s.updateJobStatus(jobID, "error", 0, 0, 0, 0, "Failed to fetch activities")
+		s.publishRecalculation(jobID, 0, progress.TypeFailed, progress.Failure{Error: "Failed to fetch activities"})
 		return
 	}
 	defer rows.Close()
@@ -294,14 +431,22 @@ func (s *CoverageService) performRecalculation(jobID string) {
 
 	total := len(activities)
 	s.updateJobStatus(jobID, "running", 0, total, 0, 0, fmt.Sprintf("Processing %d activities", total))
+	s.publishRecalculation(jobID, 0, progress.TypeStarted, progress.Counts{Total: total})
 
 	var updated, errors int
 
 	for i, activity := range activities {
 		// Recalculate coverage for this activity
+		outcome := progress.ActivityResult{
+			ActivityID: activity.activityID,
+			Status:     progress.StatusUpdated,
+			CityName:   activity.cityName,
+		}
 		result, err := s.calculateGridBasedCoverage(activity.userID, activity.activityID, activity.cityID, activity.cityName)
 		if err != nil {
+			slog.WarnContext(ctx, "Failed to recalculate coverage", "activity_id", activity.activityID, "error", err)
 			errors++
+			outcome.Status, outcome.Error = progress.StatusFailed, err.Error()
 		} else {
 			// Update the activity with the new coverage
 			updateQuery := `
@@ -311,17 +456,28 @@ func (s *CoverageService) performRecalculation(jobID string) {
 
 			_, err = s.DB.Exec(updateQuery, result.CoveragePercent, activity.activityID)
 			if err != nil {
+				slog.WarnContext(ctx, "Failed to update activity coverage", "activity_id", activity.activityID, "error", err)
 				errors++
+				outcome.Status, outcome.Error = progress.StatusFailed, err.Error()
 			} else {
 				updated++
+				outcome.CoveragePercent = &result.CoveragePercent
 			}
 		}
+		s.publishRecalculation(jobID, activity.userID, progress.TypeActivity, outcome)
 
 		// Update progress every 5 activities or at the end (more frequent updates)
 		if (i+1)%5 == 0 || i == total-1 {
-			progress := ((i + 1) * 100) / total
+			percent := ((i + 1) * 100) / total
 			message := fmt.Sprintf("Processed %d/%d activities (updated: %d, errors: %d)", i+1, total, updated, errors)
-			s.updateJobStatus(jobID, "running", progress, total, updated, errors, message)
+			s.updateJobStatus(jobID, "running", percent, total, updated, errors, message)
+			s.publishRecalculation(jobID, 0, progress.TypeProgress, progress.Counts{
+				Processed: i + 1,
+				Total:     total,
+				Percent:   percent,
+				Updated:   updated,
+				Failed:    errors,
+			})
 		}
 	}
 
@@ -335,6 +491,14 @@ func (s *CoverageService) performRecalculation(jobID string) {
 		job.Message = fmt.Sprintf("Recalculation complete: %d updated, %d errors", updated, errors)
 	}
 	s.jobsMu.Unlock()
+	slog.InfoContext(ctx, "Completed recalculation", "updated", updated, "failed", errors)
+	s.publishRecalculation(jobID, 0, progress.TypeCompleted, progress.Counts{
+		Processed: total,
+		Total:     total,
+		Percent:   100,
+		Updated:   updated,
+		Failed:    errors,
+	})
 }
 
 // updateJobStatus updates the job status thread-safely
@@ -435,7 +599,7 @@ func (s *CoverageService) GetActivityCoverageHandler(c *gin.Context) {
 	err = s.DB.QueryRow(query, activityID).Scan(&activityID, &cityID, &cityName, &coveragePercent)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Activity not found"})
+			utils.NotFound(c, utils.CodeActivityNotFound, "Activity not found")
 		} else {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch activity coverage"})
 		}
@@ -29,18 +29,35 @@ func (m *MockDB) Close() error {
 
 func TestNewCoverageService(t *testing.T) {
 	db := &storage.DB{} // This would be mocked in a real test
-	service := NewCoverageService(db)
+	service := NewCoverageService(db, nil)
 
 	assert.NotNil(t, service)
 	assert.Equal(t, db, service.DB)
 }
 
+func TestJobOwner(t *testing.T) {
+	service := NewCoverageService(&storage.DB{}, nil)
+	service.jobs["recalc_user2_1"] = &RecalculationStatus{JobID: "recalc_user2_1", UserID: 2}
+	service.jobs["recalc_1"] = &RecalculationStatus{JobID: "recalc_1"}
+
+	owner, err := service.JobOwner("recalc_user2_1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, owner)
+
+	owner, err = service.JobOwner("recalc_1")
+	require.NoError(t, err)
+	assert.Equal(t, 0, owner, "recalculations of every user belong to no one")
+
+	_, err = service.JobOwner("recalc_missing")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
 func TestCoverageService_RegisterCoverageRoutes(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	router := gin.New()
 	db := &storage.DB{}
-	service := NewCoverageService(db)
+	service := NewCoverageService(db, nil)
 
 	service.RegisterCoverageRoutes(router)
 
@@ -54,8 +71,10 @@ func TestCoverageService_RegisterCoverageRoutes(t *testing.T) {
 		{"POST", "/api/coverage/calculate/:activityId"},
 		{"POST", "/api/coverage/recalculate-all"},
 		{"GET", "/api/coverage/recalculate-status/:jobId"},
-		{"GET", "/api/coverage/user/:userId/city/:cityId"},
+		{"GET", "/api/coverage/recalculate-status/:jobId/stream"},
 		{"GET", "/api/coverage/activity/:activityId"},
+		{"GET", "/api/coverage/activity/:activityId/streams"},
+		{"GET", "/api/coverage/user/:userId/city/:cityId"},
 	}
 
 	assert.Len(t, routes, len(expectedRoutes))
@@ -91,7 +110,7 @@ func TestCalculateCoverageHandler_InvalidActivityID(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	db := &storage.DB{}
-	service := NewCoverageService(db)
+	service := NewCoverageService(db, nil)
 
 	router := gin.New()
 	router.POST("/api/coverage/calculate/:activityId", service.CalculateCoverageHandler)
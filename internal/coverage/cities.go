@@ -3,6 +3,7 @@ package coverage
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
@@ -10,13 +11,17 @@ import (
 
 	"github.com/gin-gonic/gin"
 	resty "github.com/go-resty/resty/v2"
+	"github.com/nikhilvedi/strava-coverage/internal/pagination"
 	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
+	"github.com/nikhilvedi/strava-coverage/internal/webhooks"
 )
 
 // CityService handles city-related operations
 type CityService struct {
-	DB     *storage.DB
-	client *resty.Client
+	DB       *storage.DB
+	Webhooks *webhooks.Dispatcher
+	client   *resty.Client
 }
 
 // ExternalCityData represents city data from external API
@@ -30,10 +35,11 @@ type ExternalCityData struct {
 }
 
 // NewCityService creates a new city service
-func NewCityService(db *storage.DB) *CityService {
+func NewCityService(db *storage.DB, events *webhooks.Dispatcher) *CityService {
 	return &CityService{
-		DB:     db,
-		client: resty.New(),
+		DB:       db,
+		Webhooks: events,
+		client:   resty.New(),
 	}
 }
 
@@ -62,36 +68,23 @@ type City struct {
 	// as it would be too large. Use separate endpoint for geometry if needed.
 }
 
-// GetCitiesHandler returns all cities
-func (s *CityService) GetCitiesHandler(c *gin.Context) {
-	query := `
-		SELECT 
-			id, 
-			name, 
-			country_code,
-			ST_Area(ST_Transform(boundary, 3857)) / 1000000 AS area_km2
-		FROM cities 
-		ORDER BY name`
-
-	rows, err := s.DB.Query(query)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cities"})
-		return
-	}
-	defer rows.Close()
+// citySorts are the ways city lists can be sorted
+var citySorts = []pagination.Sort{
+	{Name: "name", Column: "c.name", Type: "text"},
+	{Name: "area_km2", Column: "COALESCE(ST_Area(ST_Transform(c.boundary, 3857)) / 1000000, 0)", Type: "double precision"},
+}
 
-	var cities []City
-	for rows.Next() {
-		var city City
-		err := rows.Scan(&city.ID, &city.Name, &city.CountryCode, &city.AreaKm2)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan city"})
-			return
-		}
-		cities = append(cities, city)
-	}
+// CityPages pages through city lists, alphabetically by default
+var CityPages = pagination.Options{
+	Sorts:        citySorts,
+	Default:      "name",
+	DefaultLimit: 100,
+	MaxLimit:     1000,
+}
 
-	c.JSON(http.StatusOK, cities)
+// GetCitiesHandler returns a page of cities, optionally in one country (?country_code=)
+func (s *CityService) GetCitiesHandler(c *gin.Context) {
+	s.listCities(c, "($1 = '' OR c.country_code = UPPER($1))", c.Query("country_code"))
 }
 
 // GetUserCitiesHandler returns only cities where the user has activities/coverage
@@ -103,36 +96,88 @@ func (s *CityService) GetUserCitiesHandler(c *gin.Context) {
 		return
 	}
 
-	query := `
-		SELECT DISTINCT
+	s.listCities(c, "EXISTS (SELECT 1 FROM activities a WHERE a.city_id = c.id AND a.user_id = $1)", userID)
+}
+
+// listCities writes the page of cities matching condition, whose one argument is arg
+func (s *CityService) listCities(c *gin.Context, condition string, arg interface{}) {
+	params, err := pagination.Parse(c, CityPages)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var page pagination.Page
+	if err := s.DB.Get(&page.Total, `SELECT COUNT(*) FROM cities c WHERE `+condition, arg); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cities"})
+		return
+	}
+
+	args := []interface{}{arg}
+	query := fmt.Sprintf(`
+		SELECT 
 			c.id, 
 			c.name, 
 			c.country_code,
-			ST_Area(ST_Transform(c.boundary, 3857)) / 1000000 AS area_km2
+			COALESCE(ST_Area(ST_Transform(c.boundary, 3857)) / 1000000, 0) AS area_km2,
+			(%s)::text
 		FROM cities c
-		INNER JOIN activities a ON a.city_id = c.id 
-		WHERE a.user_id = $1
-		ORDER BY c.name`
+		WHERE %s AND %s
+		ORDER BY %s
+		LIMIT %d`, params.Sort.Column, condition, params.Where("c.id", &args), params.OrderBy("c.id"), params.Fetch())
 
-	rows, err := s.DB.Query(query, userID)
+	rows, err := s.DB.Query(query, args...)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user cities"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cities"})
 		return
 	}
 	defer rows.Close()
 
-	var cities []City
+	cities := []City{}
+	var sortKeys []string
 	for rows.Next() {
 		var city City
-		err := rows.Scan(&city.ID, &city.Name, &city.CountryCode, &city.AreaKm2)
+		var sortKey string
+		err := rows.Scan(&city.ID, &city.Name, &city.CountryCode, &city.AreaKm2, &sortKey)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan city"})
 			return
 		}
 		cities = append(cities, city)
+		sortKeys = append(sortKeys, sortKey)
 	}
 
-	c.JSON(http.StatusOK, cities)
+	keep, next := params.Trim(len(cities), func(i int) (string, int64) {
+		return sortKeys[i], int64(cities[i].ID)
+	})
+	page.Next = next
+
+	pagination.SetHeaders(c, page)
+	c.JSON(http.StatusOK, cities[:keep])
+}
+
+// CityWithCoverage is a city with a user's activity and coverage statistics in it
+type CityWithCoverage struct {
+	City
+	ActivityCount          int     `json:"activity_count"`
+	AverageCoveragePercent float64 `json:"average_coverage_percent"`
+	MaxCoveragePercent     float64 `json:"max_coverage_percent"`
+	TotalDistanceKm        float64 `json:"total_distance_km"`
+	LastActivityDate       string  `json:"last_activity_date"`
+}
+
+// CityCoveragePages pages through a user's cities with their coverage, the most active
+// first by default
+var CityCoveragePages = pagination.Options{
+	Sorts: []pagination.Sort{
+		{Name: "activity_count", Column: "t.activity_count", Type: "bigint"},
+		{Name: "coverage", Column: "t.avg_coverage_percentage", Type: "numeric"},
+		{Name: "last_activity", Column: "t.last_activity_date", Type: "timestamptz"},
+		{Name: "name", Column: "t.name", Type: "text"},
+	},
+	Default:      "-activity_count",
+	DefaultLimit: 4,
+	MaxLimit:     100,
 }
 
 // GetUserCitiesWithCoverageHandler returns cities where the user has activities with coverage statistics
@@ -143,49 +188,60 @@ func (s *CityService) GetUserCitiesWithCoverageHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
 		return
 	}
+	params, err := pagination.Parse(c, CityCoveragePages)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	query := `
-		SELECT 
-			c.id,
-			c.name,
-			c.country_code,
-			ST_Area(ST_Transform(c.boundary, 3857)) / 1000000 AS area_km2,
-			COUNT(a.id) as activity_count,
-			COALESCE(AVG(a.coverage_percentage), 0) as avg_coverage_percentage,
-			COALESCE(MAX(a.coverage_percentage), 0) as max_coverage_percentage,
-			COALESCE(SUM(a.distance_km), 0) as total_distance_km,
-			MAX(a.created_at) as last_activity_date
-		FROM cities c
-		INNER JOIN activities a ON a.city_id = c.id 
-		WHERE a.user_id = $1
-		GROUP BY c.id, c.name, c.country_code, c.boundary
-		ORDER BY activity_count DESC, avg_coverage_percentage DESC
-		LIMIT 4`
+	var page pagination.Page
+	countQuery := `SELECT COUNT(DISTINCT city_id) FROM activities WHERE user_id = $1 AND city_id IS NOT NULL`
+	if err := s.DB.Get(&page.Total, countQuery, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user cities with coverage"})
+		return
+	}
 
-	rows, err := s.DB.Query(query, userID)
+	args := []interface{}{userID}
+	query := fmt.Sprintf(`
+		SELECT t.id, t.name, t.country_code, t.area_km2, t.activity_count, t.avg_coverage_percentage,
+			t.max_coverage_percentage, t.total_distance_km, t.last_activity_date, (%s)::text
+		FROM (
+			SELECT 
+				c.id,
+				c.name,
+				c.country_code,
+				ST_Area(ST_Transform(c.boundary, 3857)) / 1000000 AS area_km2,
+				COUNT(a.id) as activity_count,
+				COALESCE(AVG(a.coverage_percentage), 0) as avg_coverage_percentage,
+				COALESCE(MAX(a.coverage_percentage), 0) as max_coverage_percentage,
+				COALESCE(SUM(a.distance_km), 0) as total_distance_km,
+				MAX(COALESCE(a.start_date, a.created_at)) as last_activity_date
+			FROM cities c
+			INNER JOIN activities a ON a.city_id = c.id 
+			WHERE a.user_id = $1
+			GROUP BY c.id, c.name, c.country_code, c.boundary
+		) t
+		WHERE %s
+		ORDER BY %s
+		LIMIT %d`, params.Sort.Column, params.Where("t.id", &args), params.OrderBy("t.id"), params.Fetch())
+
+	rows, err := s.DB.Query(query, args...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user cities with coverage"})
 		return
 	}
 	defer rows.Close()
 
-	type CityWithCoverage struct {
-		City
-		ActivityCount          int     `json:"activity_count"`
-		AverageCoveragePercent float64 `json:"average_coverage_percent"`
-		MaxCoveragePercent     float64 `json:"max_coverage_percent"`
-		TotalDistanceKm        float64 `json:"total_distance_km"`
-		LastActivityDate       string  `json:"last_activity_date"`
-	}
-
-	var cities []CityWithCoverage
+	cities := []CityWithCoverage{}
+	var sortKeys []string
 	for rows.Next() {
 		var city CityWithCoverage
 		var lastActivityDate *time.Time
+		var sortKey string
 		err := rows.Scan(
 			&city.ID, &city.Name, &city.CountryCode, &city.AreaKm2,
 			&city.ActivityCount, &city.AverageCoveragePercent, &city.MaxCoveragePercent,
-			&city.TotalDistanceKm, &lastActivityDate)
+			&city.TotalDistanceKm, &lastActivityDate, &sortKey)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan city with coverage"})
 			return
@@ -196,12 +252,21 @@ func (s *CityService) GetUserCitiesWithCoverageHandler(c *gin.Context) {
 		}
 
 		cities = append(cities, city)
+		sortKeys = append(sortKeys, sortKey)
 	}
 
+	keep, next := params.Trim(len(cities), func(i int) (string, int64) {
+		return sortKeys[i], int64(cities[i].ID)
+	})
+	cities, page.Next = cities[:keep], next
+
+	pagination.SetHeaders(c, page)
 	c.JSON(http.StatusOK, gin.H{
-		"user_id": userID,
-		"cities":  cities,
-		"count":   len(cities),
+		"user_id":     userID,
+		"cities":      cities,
+		"count":       len(cities),
+		"total":       page.Total,
+		"next_cursor": page.Next,
 	})
 }
 
@@ -219,14 +284,12 @@ func (s *CityService) SearchCitiesHandler(c *gin.Context) {
 		return
 	}
 
-	fmt.Printf("Searching for cities with query: %s\n", searchQuery)
-
 	// First search local database
 	localCities := s.searchLocalCities(searchQuery)
 
 	// If we have good local results, return them
 	if len(localCities) >= 3 {
-		fmt.Printf("Found %d cities in local database\n", len(localCities))
+		slog.DebugContext(c.Request.Context(), "Found cities in local database", "query", searchQuery, "local", len(localCities))
 		c.JSON(http.StatusOK, localCities)
 		return
 	}
@@ -237,7 +300,7 @@ func (s *CityService) SearchCitiesHandler(c *gin.Context) {
 	// Combine and deduplicate results
 	allCities := s.combineAndDeduplicateCities(localCities, externalCities)
 
-	fmt.Printf("Found %d total cities (local: %d, external: %d)\n", len(allCities), len(localCities), len(externalCities))
+	slog.DebugContext(c.Request.Context(), "Found cities", "query", searchQuery, "total", len(allCities), "local", len(localCities), "external", len(externalCities))
 	c.JSON(http.StatusOK, allCities)
 }
 
@@ -267,7 +330,7 @@ func (s *CityService) searchLocalCities(query string) []City {
 
 	rows, err := s.DB.Query(sqlQuery, searchPattern, exactMatch, prefixMatch)
 	if err != nil {
-		fmt.Printf("Error searching local cities: %v\n", err)
+		slog.Error("Failed to search local cities", "error", err)
 		return []City{}
 	}
 	defer rows.Close()
@@ -276,7 +339,7 @@ func (s *CityService) searchLocalCities(query string) []City {
 	for rows.Next() {
 		var city City
 		if err := rows.Scan(&city.ID, &city.Name, &city.CountryCode, &city.AreaKm2); err != nil {
-			fmt.Printf("Error scanning city row: %v\n", err)
+			slog.Error("Failed to scan city row", "error", err)
 			continue
 		}
 		cities = append(cities, city)
@@ -302,7 +365,7 @@ func (s *CityService) searchExternalCities(query string) []City {
 		Get(url)
 
 	if err != nil {
-		fmt.Printf("Error calling external geocoding API: %v\n", err)
+		slog.Warn("Failed to call external geocoding API", "error", err)
 		return []City{}
 	}
 
@@ -316,7 +379,7 @@ func (s *CityService) searchExternalCities(query string) []City {
 	}
 
 	if err := json.Unmarshal(resp.Body(), &nominatimResults); err != nil {
-		fmt.Printf("Error parsing geocoding response: %v\n", err)
+		slog.Warn("Failed to parse geocoding response", "error", err)
 		return []City{}
 	}
 
@@ -337,7 +400,7 @@ func (s *CityService) searchExternalCities(query string) []City {
 		lon, lonErr := strconv.ParseFloat(result.Lon, 64)
 
 		if latErr != nil || lonErr != nil {
-			fmt.Printf("Error parsing coordinates for %s: lat=%s, lon=%s\n", result.Name, result.Lat, result.Lon)
+			slog.Warn("Failed to parse geocoded coordinates", "city", result.Name, "lat", result.Lat, "lng", result.Lon)
 			continue // Skip cities with invalid coordinates
 		}
 
@@ -408,7 +471,7 @@ func (s *CityService) GetCityHandler(c *gin.Context) {
 	var city City
 	err = s.DB.QueryRow(query, id).Scan(&city.ID, &city.Name, &city.CountryCode, &city.AreaKm2)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "City not found"})
+		utils.NotFound(c, utils.CodeCityNotFound, "City not found")
 		return
 	}
 
@@ -449,6 +512,8 @@ func (s *CityService) CreateCityHandler(c *gin.Context) {
 		return
 	}
 
+	s.Webhooks.CityCreated(cityID, req.Name, req.CountryCode, "manual")
+
 	c.JSON(http.StatusCreated, gin.H{"id": cityID, "message": "City created successfully"})
 }
 
@@ -469,7 +534,7 @@ func (s *CityService) GetCityBoundaryHandler(c *gin.Context) {
 	var boundaryGeoJSON string
 	err = s.DB.QueryRow(query, id).Scan(&boundaryGeoJSON)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "City not found"})
+		utils.NotFound(c, utils.CodeCityNotFound, "City not found")
 		return
 	}
 
@@ -497,8 +562,6 @@ func (s *CityService) CreateCityFromExternalHandler(c *gin.Context) {
 		return
 	}
 
-	fmt.Printf("Creating city from external data: %s, %s (%f, %f)\n", req.Name, req.CountryCode, req.Latitude, req.Longitude)
-
 	// Create a circular boundary around the city center (approximately 10km radius)
 	query := `
 		INSERT INTO cities (name, country_code, boundary) 
@@ -510,11 +573,12 @@ func (s *CityService) CreateCityFromExternalHandler(c *gin.Context) {
 		Scan(&city.ID, &city.Name, &city.CountryCode, &city.AreaKm2)
 
 	if err != nil {
-		fmt.Printf("Error creating city: %v\n", err)
+		slog.ErrorContext(c.Request.Context(), "Failed to create city", "city", req.Name, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create city: %v", err)})
 		return
 	}
 
-	fmt.Printf("Successfully created city with ID %d\n", city.ID)
+	slog.InfoContext(c.Request.Context(), "Created city", "city_id", city.ID, "city", city.Name, "country_code", city.CountryCode, "lat", req.Latitude, "lng", req.Longitude)
+	s.Webhooks.CityCreated(city.ID, city.Name, city.CountryCode, "geocoded")
 	c.JSON(http.StatusCreated, city)
 }
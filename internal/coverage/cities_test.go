@@ -14,7 +14,7 @@ import (
 
 func setupCityTestService() *CityService {
 	db := &storage.DB{} // Mock database for testing
-	return NewCityService(db)
+	return NewCityService(db, nil)
 }
 
 func setupCityTestRouter() *gin.Engine {
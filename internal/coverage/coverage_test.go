@@ -14,7 +14,7 @@ import (
 
 func setupTestService() *CoverageService {
 	db := &storage.DB{} // Mock database for testing
-	return NewCoverageService(db)
+	return NewCoverageService(db, nil)
 }
 
 func setupTestRouter() *gin.Engine {
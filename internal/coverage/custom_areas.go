@@ -1,13 +1,19 @@
 package coverage
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/internal/logging"
+	"github.com/nikhilvedi/strava-coverage/internal/pagination"
 	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
 )
 
 // CustomAreasService handles custom drawn areas functionality
@@ -85,7 +91,7 @@ func (s *CustomAreasService) createCustomArea(c *gin.Context) {
 	var area storage.CustomArea
 	err = s.db.QueryRowx(query, userID, req.Name, polygonWKT).StructScan(&area)
 	if err != nil {
-		fmt.Printf("Error creating custom area: %v\n", err)
+		slog.ErrorContext(c.Request.Context(), "Failed to create custom area", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create custom area"})
 		return
 	}
@@ -95,6 +101,17 @@ func (s *CustomAreasService) createCustomArea(c *gin.Context) {
 	c.JSON(http.StatusCreated, response)
 }
 
+// CustomAreaPages pages through a user's custom areas, newest first by default
+var CustomAreaPages = pagination.Options{
+	Sorts: []pagination.Sort{
+		{Name: "created_at", Column: "created_at", Type: "timestamptz"},
+		{Name: "name", Column: "name", Type: "text"},
+	},
+	Default:      "-created_at",
+	DefaultLimit: 50,
+	MaxLimit:     500,
+}
+
 // getUserCustomAreas gets all custom areas for a user
 func (s *CustomAreasService) getUserCustomAreas(c *gin.Context) {
 	userIDStr := c.Param("userId")
@@ -104,27 +121,50 @@ func (s *CustomAreasService) getUserCustomAreas(c *gin.Context) {
 		return
 	}
 
-	query := `
+	params, err := pagination.Parse(c, CustomAreaPages)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var page pagination.Page
+	if err := s.db.Get(&page.Total, `SELECT COUNT(*) FROM custom_areas WHERE user_id = $1`, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch custom areas"})
+		return
+	}
+
+	args := []interface{}{userID}
+	query := fmt.Sprintf(`
 		SELECT id, user_id, name, ST_AsText(geometry) as geometry,
 			   coverage_percentage, activities_count, created_at, updated_at
 		FROM custom_areas 
-		WHERE user_id = $1
-		ORDER BY created_at DESC`
+		WHERE user_id = $1 AND %s
+		ORDER BY %s
+		LIMIT %d`, params.Where("id", &args), params.OrderBy("id"), params.Fetch())
 
 	var areas []storage.CustomArea
-	err = s.db.Select(&areas, query, userID)
+	err = s.db.Select(&areas, query, args...)
 	if err != nil {
-		fmt.Printf("Error fetching custom areas: %v\n", err)
+		slog.ErrorContext(c.Request.Context(), "Failed to fetch custom areas", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch custom areas"})
 		return
 	}
 
+	keep, next := params.Trim(len(areas), func(i int) (string, int64) {
+		if params.Sort.Name == "name" {
+			return areas[i].Name, int64(areas[i].ID)
+		}
+		return areas[i].CreatedAt.UTC().Format(time.RFC3339Nano), int64(areas[i].ID)
+	})
+	page.Next = next
+
 	// Convert to response format
-	var response []CustomAreaResponse
-	for _, area := range areas {
+	response := []CustomAreaResponse{}
+	for _, area := range areas[:keep] {
 		response = append(response, customAreaToResponse(&area))
 	}
 
+	pagination.SetHeaders(c, page)
 	c.JSON(http.StatusOK, response)
 }
 
@@ -146,7 +186,7 @@ func (s *CustomAreasService) getCustomArea(c *gin.Context) {
 	var area storage.CustomArea
 	err = s.db.QueryRowx(query, id).StructScan(&area)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Custom area not found"})
+		utils.NotFound(c, utils.CodeCustomAreaNotFound, "Custom area not found")
 		return
 	}
 
@@ -208,7 +248,7 @@ func (s *CustomAreasService) deleteCustomArea(c *gin.Context) {
 
 	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Custom area not found"})
+		utils.NotFound(c, utils.CodeCustomAreaNotFound, "Custom area not found")
 		return
 	}
 
@@ -233,12 +273,13 @@ func (s *CustomAreasService) calculateCustomAreaCoverage(c *gin.Context) {
 
 	err = s.db.QueryRowx(areaQuery, id).StructScan(&area)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Custom area not found"})
+		utils.NotFound(c, utils.CodeCustomAreaNotFound, "Custom area not found")
 		return
 	}
 
 	// Start coverage calculation in background
-	go s.calculateCoverageAsync(id, area.UserID)
+	ctx := logging.With(logging.Detach(c.Request.Context()), logging.KeyUserID, area.UserID, logging.KeyJobID, logging.NewJobID("area"))
+	go s.calculateCoverageAsync(ctx, id, area.UserID)
 
 	// Return immediately with current area data
 	response := customAreaToResponse(&area)
@@ -249,8 +290,9 @@ func (s *CustomAreasService) calculateCustomAreaCoverage(c *gin.Context) {
 }
 
 // calculateCoverageAsync performs the actual coverage calculation in background
-func (s *CustomAreasService) calculateCoverageAsync(areaID, userID int) {
-	fmt.Printf("Starting coverage calculation for area %d, user %d\n", areaID, userID)
+func (s *CustomAreasService) calculateCoverageAsync(ctx context.Context, areaID, userID int) {
+	ctx = logging.With(ctx, "area_id", areaID)
+	slog.InfoContext(ctx, "Starting custom area coverage calculation")
 
 	// Most complex and detailed grid-based coverage calculation
 	// High-resolution grid with multiple coverage layers and detailed analysis
@@ -380,7 +422,7 @@ func (s *CustomAreasService) calculateCoverageAsync(areaID, userID int) {
 
 	err := s.db.QueryRowx(coverageQuery, userID, areaID).StructScan(&coverage)
 	if err != nil {
-		fmt.Printf("Error calculating coverage for area %d: %v\n", areaID, err)
+		slog.ErrorContext(ctx, "Failed to calculate custom area coverage", "error", err)
 		return
 	}
 
@@ -392,16 +434,21 @@ func (s *CustomAreasService) calculateCoverageAsync(areaID, userID int) {
 
 	_, err = s.db.Exec(updateQuery, areaID, coverage.CoveragePercentage, coverage.ActivitiesCount)
 	if err != nil {
-		fmt.Printf("Error updating coverage for area %d: %v\n", areaID, err)
+		slog.ErrorContext(ctx, "Failed to update custom area coverage", "error", err)
 		return
 	}
 
-	fmt.Printf("Coverage calculation completed for area %d: %.2f%% (%d activities)\n",
-		areaID, coverage.CoveragePercentage, coverage.ActivitiesCount)
-	fmt.Printf("  Grid analysis: %d total points, %d direct covered, %d close covered, %d moderate covered\n",
-		coverage.GridPointsTotal, coverage.DirectCoveredPoints, coverage.CloseCoveredPoints, coverage.ModerateCoveredPoints)
-	fmt.Printf("  Weighted coverage: %.2f%%, Activity diversity: %.2f avg / %d max, Density: %.2f per sq km\n",
-		coverage.WeightedCoveragePercentage, coverage.AvgActivityDiversity, coverage.MaxActivityDiversity, coverage.CoverageDensityPerSqkm)
+	slog.InfoContext(ctx, "Completed custom area coverage calculation",
+		"coverage_percent", coverage.CoveragePercentage, "activities", coverage.ActivitiesCount)
+	slog.DebugContext(ctx, "Custom area grid analysis",
+		"grid_points", coverage.GridPointsTotal,
+		"direct_covered_points", coverage.DirectCoveredPoints,
+		"close_covered_points", coverage.CloseCoveredPoints,
+		"moderate_covered_points", coverage.ModerateCoveredPoints,
+		"weighted_coverage_percent", coverage.WeightedCoveragePercentage,
+		"avg_activity_diversity", coverage.AvgActivityDiversity,
+		"max_activity_diversity", coverage.MaxActivityDiversity,
+		"coverage_density_per_sqkm", coverage.CoverageDensityPerSqkm)
 }
 
 // Helper function to convert coordinates to WKT polygon format
@@ -0,0 +1,237 @@
+package coverage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nikhilvedi/strava-coverage/internal/logging"
+	"github.com/nikhilvedi/strava-coverage/internal/metrics"
+	"github.com/nikhilvedi/strava-coverage/internal/progress"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+// fileSettleTime is how long a file must be unmodified before it is imported, so files
+// still being written or synced are not read half-way
+const fileSettleTime = 5 * time.Second
+
+// watchedFile is an activity file found by the watcher, identified by the SHA-256 of its
+// content so a renamed or re-synced copy of an imported file is not imported twice
+type watchedFile struct {
+	path  string
+	stamp fileStamp
+	ref   string
+}
+
+// directorySource reads GPX and FIT files found by the watcher
+type directorySource struct {
+	files []watchedFile
+	done  func(file watchedFile, err error)
+}
+
+func (s *directorySource) Name() string {
+	return storage.ActivitySourceDirectory
+}
+
+// List returns every file at once
+func (s *directorySource) List(page int) ([]SourceActivity, bool, error) {
+	if page > 1 {
+		return nil, false, nil
+	}
+
+	activities := make([]SourceActivity, 0, len(s.files))
+	for _, file := range s.files {
+		activities = append(activities, SourceActivity{
+			Ref:     file.ref,
+			Name:    filepath.Base(file.path),
+			summary: file,
+		})
+	}
+	return activities, false, nil
+}
+
+// Load parses the file. A file that cannot be read is retried; one that cannot be parsed
+// is not.
+func (s *directorySource) Load(activity SourceActivity) (*ImportedActivity, error) {
+	file, ok := activity.summary.(watchedFile)
+	if !ok {
+		return nil, fmt.Errorf("activity %s was not listed by the directory source", activity.Ref)
+	}
+
+	data, err := os.ReadFile(file.path)
+	if err != nil {
+		return nil, retryable(err)
+	}
+	parsed, err := parseActivityFile(file.path, data)
+	if err != nil {
+		return nil, err
+	}
+	return parsed.toImportedActivity(s.Name(), activity.Ref, filepath.Base(file.path))
+}
+
+// Done passes the outcome of a file to the watcher
+func (s *directorySource) Done(activity SourceActivity, err error) {
+	if file, ok := activity.summary.(watchedFile); ok && s.done != nil {
+		s.done(file, err)
+	}
+}
+
+// fileStamp identifies a version of a file seen by the watcher
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// DirectoryWatcher imports GPX and FIT files dropped into per-user folders, named after
+// the user ID, under a root directory: e.g. <root>/42/morning-run.gpx is imported for
+// user 42 with coverage and city detection. Folders of users that do not exist are skipped.
+type DirectoryWatcher struct {
+	Root     string
+	Interval time.Duration
+	importer *InitialImportService
+	seen     map[string]fileStamp   // files imported or that can never be, by path
+	pending  map[string]watchedFile // files hashed but not yet done, by path
+	unknown  map[int]bool           // users whose missing account was already logged
+}
+
+// NewDirectoryWatcher creates a watcher that polls root every interval
+func NewDirectoryWatcher(root string, interval time.Duration, importer *InitialImportService) *DirectoryWatcher {
+	return &DirectoryWatcher{
+		Root:     root,
+		Interval: interval,
+		importer: importer,
+		seen:     make(map[string]fileStamp),
+		pending:  make(map[string]watchedFile),
+		unknown:  make(map[int]bool),
+	}
+}
+
+// Run polls the root directory until the context is cancelled
+func (w *DirectoryWatcher) Run(ctx context.Context) {
+	slog.Info("Watching for activity files", "root", w.Root, "interval", w.Interval.String())
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		w.Scan()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Scan imports the new or changed files in every user folder
+func (w *DirectoryWatcher) Scan() {
+	entries, err := os.ReadDir(w.Root)
+	if err != nil {
+		slog.Error("Failed to read activity watch directory", "root", w.Root, "error", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		userID, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		files := w.pendingFiles(filepath.Join(w.Root, entry.Name()))
+		if len(files) == 0 {
+			continue
+		}
+
+		exists, err := w.importer.DB.UserExists(userID)
+		if err != nil {
+			slog.Error("Failed to check activity folder user", "user_id", userID, "error", err)
+			continue
+		}
+		if !exists {
+			if !w.unknown[userID] {
+				slog.Warn("Skipping activity folder of unknown user", "user_id", userID, "path", filepath.Join(w.Root, entry.Name()))
+				w.unknown[userID] = true
+			}
+			continue
+		}
+		delete(w.unknown, userID)
+
+		ctx := logging.With(context.Background(), logging.KeyUserID, userID, logging.KeyJobID, logging.NewJobID("directory"))
+		w.importer.publishImport(userID, progress.TypeStarted, progress.Counts{Source: storage.ActivitySourceDirectory})
+		result := w.importer.importFromSource(ctx, userID, &directorySource{files: files, done: w.done}, true, nil)
+		w.importer.publishImport(userID, progress.TypeCompleted, importCounts(storage.ActivitySourceDirectory, 0, result))
+		slog.InfoContext(ctx, "Directory import completed", "imported", result.Imported, "skipped", result.Skipped, "failed", result.Failed)
+		metrics.Imports.WithLabelValues(storage.ActivitySourceDirectory, "completed").Inc()
+		if result.Imported > 0 {
+			w.importer.Webhooks.ImportCompleted(userID, storage.ActivitySourceDirectory, result.Imported, result.Skipped, result.Failed)
+		}
+	}
+}
+
+// done records the outcome of importing a file. Files imported, already imported or that
+// cannot be parsed are not returned again until they change; files that failed for a
+// retryable reason, such as a database error, are returned by the next scan.
+func (w *DirectoryWatcher) done(file watchedFile, err error) {
+	if err != nil && isRetryable(err) {
+		return
+	}
+	w.seen[file.path] = file.stamp
+	delete(w.pending, file.path)
+}
+
+// pendingFiles lists the activity files in a user folder that have settled and are not
+// done in their current version. Files are hashed once per version, however many scans
+// they stay pending for.
+func (w *DirectoryWatcher) pendingFiles(dir string) []watchedFile {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Error("Failed to read activity directory", "path", dir, "error", err)
+		return nil
+	}
+
+	var files []watchedFile
+	for _, entry := range entries {
+		if entry.IsDir() || !isActivityFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if time.Since(info.ModTime()) < fileSettleTime {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		stamp := fileStamp{size: info.Size(), modTime: info.ModTime()}
+		if w.seen[path] == stamp {
+			continue
+		}
+
+		file, ok := w.pending[path]
+		if !ok || file.stamp != stamp {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				slog.Warn("Failed to read activity file", "path", path, "error", err)
+				continue
+			}
+			sum := sha256.Sum256(data)
+			file = watchedFile{path: path, stamp: stamp, ref: hex.EncodeToString(sum[:])}
+			w.pending[path] = file
+		}
+		files = append(files, file)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	return files
+}
@@ -0,0 +1,91 @@
+package coverage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectoryWatcherPendingFiles(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Minute)
+	write := func(name, content string, modTime time.Time) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	paths := func(files []watchedFile) []string {
+		var paths []string
+		for _, file := range files {
+			paths = append(paths, file.path)
+		}
+		return paths
+	}
+
+	write("a.gpx", testGPX, old)
+	write("b.fit", testGPX, old)
+	write("notes.txt", testGPX, old)
+	write("syncing.gpx", testGPX, time.Now())
+
+	w := NewDirectoryWatcher(dir, time.Minute, nil)
+	files := w.pendingFiles(dir)
+	assert.Equal(t, []string{filepath.Join(dir, "a.gpx"), filepath.Join(dir, "b.fit")}, paths(files))
+	assert.Equal(t, files[0].ref, files[1].ref, "files with the same content share a ref")
+
+	// Files stay pending until they are done, without being hashed again
+	write("a.gpx", testGPX[:len(testGPX)-1]+"X", old)
+	again := w.pendingFiles(dir)
+	assert.Equal(t, files, again)
+
+	w.done(files[0], nil)
+	w.done(files[1], errors.New("not a FIT file"))
+	assert.Empty(t, w.pendingFiles(dir))
+
+	// A changed file is pending again
+	write("a.gpx", testGPX+"\n", old.Add(time.Second))
+	changed := w.pendingFiles(dir)
+	require.Len(t, changed, 1)
+	assert.NotEqual(t, files[0].ref, changed[0].ref)
+
+	// Retryable failures leave it pending
+	w.done(changed[0], retryable(errors.New("connection refused")))
+	assert.Equal(t, changed, w.pendingFiles(dir))
+}
+
+func TestDirectorySourceLoad(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "walk.gpx")
+	broken := filepath.Join(dir, "broken.gpx")
+	require.NoError(t, os.WriteFile(good, []byte(testGPX), 0o644))
+	require.NoError(t, os.WriteFile(broken, []byte("not gpx"), 0o644))
+
+	var outcomes []error
+	source := &directorySource{
+		files: []watchedFile{{path: good, ref: "a"}, {path: broken, ref: "b"}, {path: filepath.Join(dir, "gone.gpx"), ref: "c"}},
+		done:  func(file watchedFile, err error) { outcomes = append(outcomes, err) },
+	}
+	listed, more, err := source.List(1)
+	require.NoError(t, err)
+	assert.False(t, more)
+	require.Len(t, listed, 3)
+
+	activity, err := source.Load(listed[0])
+	require.NoError(t, err)
+	assert.Equal(t, "a", activity.Ref)
+
+	_, err = source.Load(listed[1])
+	require.Error(t, err)
+	assert.False(t, isRetryable(err), "a file that cannot be parsed is not retried")
+
+	_, err = source.Load(listed[2])
+	require.Error(t, err)
+	assert.True(t, isRetryable(err), "a file that cannot be read is retried")
+
+	source.Done(listed[2], err)
+	assert.Equal(t, []error{err}, outcomes)
+}
@@ -1,17 +1,16 @@
 package coverage
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/metrics"
 	"github.com/nikhilvedi/strava-coverage/internal/storage"
-
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
 	// "github.com/jmoiron/sqlx"
-	resty "github.com/go-resty/resty/v2"
 )
 
 type ImportService struct {
@@ -45,162 +44,64 @@ func (s *ImportService) ImportActivityHandler(c *gin.Context) {
 		return
 	}
 
-	client := resty.New()
-	resp, err := client.R().
-		SetAuthToken(token.AccessToken).
-		SetQueryParam("keys", "latlng"). // Changed from types to keys - this is the correct parameter name
-		Get(fmt.Sprintf("https://www.strava.com/api/v3/activities/%s/streams", activityID))
-	if err != nil || resp.StatusCode() != 200 {
-		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Failed to fetch activity stream: %v, status: %d", err, resp.StatusCode())})
+	// Convert activityID to int64
+	var activityIDInt int64
+	if _, err := fmt.Sscanf(activityID, "%d", &activityIDInt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid activity ID format: %v", err)})
 		return
 	}
 
-	// Debug logging
-	respBody := resp.Body()
-	fmt.Printf("Strava API Response Status: %d\n", resp.StatusCode())
-	fmt.Printf("Strava API Response Headers: %v\n", resp.Header())
-	fmt.Printf("Strava API Response Body: %s\n", string(respBody))
-
-	// Try parsing as generic JSON first to see the structure
-	fmt.Printf("Raw response: %s\n", string(respBody))
-
-	var rawJSON []map[string]interface{}
-	if err := json.Unmarshal(respBody, &rawJSON); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to parse JSON: %v", err)})
+	// Get internal user ID from strava_id
+	var userIDInt int
+	err = s.DB.QueryRow("SELECT id FROM users WHERE strava_id = $1", userID).Scan(&userIDInt)
+	if err != nil {
+		utils.NotFound(c, utils.CodeUserNotFound, "User not found")
 		return
 	}
 
-	var latlngData [][]float64
-	for _, stream := range rawJSON {
-		if stream["type"] == "latlng" {
-			if dataRaw, ok := stream["data"].([]interface{}); ok {
-				for _, pointRaw := range dataRaw {
-					if point, ok := pointRaw.([]interface{}); ok && len(point) == 2 {
-						lat, latOk := point[0].(float64)
-						lng, lngOk := point[1].(float64)
-						if latOk && lngOk {
-							latlngData = append(latlngData, []float64{lat, lng})
-						}
-					}
-				}
-			}
-		}
-	}
-
-	// Handle activities with or without GPS data
-	var linestring string
-	var query string
-
-	if len(latlngData) == 0 {
-		fmt.Printf("No GPS data found - importing activity without path (indoor activity)\n")
-		// Insert activity without path for indoor activities
-		query = `INSERT INTO activities (
-			user_id, 
-			strava_activity_id, 
-			path,
-			city_id,
-			coverage_percentage,
-			comment_posted,
-			created_at,
-			updated_at
-		) VALUES (
-			$1, $2, NULL,
-			NULL, -- city_id - no coverage for indoor activities
-			NULL, -- coverage_percentage - no coverage for indoor activities
-			false,
-			CURRENT_TIMESTAMP,
-			CURRENT_TIMESTAMP
-		)`
-	} else {
-		// Convert to WKT LINESTRING
-		var points []string
-		for _, ll := range latlngData {
-			if len(ll) == 2 {
-				points = append(points, fmt.Sprintf("%f %f", ll[1], ll[0])) // WKT: lon lat
-			}
-		}
-		linestring = fmt.Sprintf("LINESTRING(%s)", strings.Join(points, ", "))
-		fmt.Printf("GPS data found - importing activity with path\n")
-
-		// Insert activity with path for outdoor activities
-		query = `INSERT INTO activities (
-			user_id, 
-			strava_activity_id, 
-			path,
-			city_id,
-			coverage_percentage,
-			comment_posted,
-			created_at,
-			updated_at
-		) VALUES (
-			$1, $2, ST_GeomFromText($3, 4326),
-			NULL, -- city_id will be updated later
-			NULL, -- coverage_percentage will be calculated later
-			false,
-			CURRENT_TIMESTAMP,
-			CURRENT_TIMESTAMP
-		)`
-	}
-	fmt.Printf("Executing query with userID=%s, activityID=%s\n", userID, activityID)
-	fmt.Printf("Linestring sample: %.100s...\n", linestring)
-
-	// First verify that the user exists
-	var exists bool
-	err = s.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE strava_id = $1)", userID).Scan(&exists)
+	exists, err := s.DB.ActivityExistsForSource(userIDInt, storage.ActivitySourceStrava, strconv.FormatInt(activityIDInt, 10))
 	if err != nil {
-		fmt.Printf("Database error checking user: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to verify user: %v", err)})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to check activity: %v", err)})
 		return
 	}
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	if exists {
+		c.JSON(http.StatusConflict, gin.H{"error": "Activity already exists"})
 		return
 	}
 
-	// Get internal user ID from strava_id
-	var userIDInt int
-	err = s.DB.QueryRow("SELECT id FROM users WHERE strava_id = $1", userID).Scan(&userIDInt)
+	client := metrics.NewStravaClient(s.Config)
+	activity, err := fetchStravaActivity(client, token.AccessToken, activityIDInt)
 	if err != nil {
-		fmt.Printf("Database error getting user ID: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get user ID: %v", err)})
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Failed to fetch activity: %v", err)})
 		return
 	}
-
-	// Convert activityID to int64
-	var activityIDInt int64
-	if _, err := fmt.Sscanf(activityID, "%d", &activityIDInt); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid activity ID format: %v", err)})
-		return
-	}
-
-	// Verify the activity doesn't already exist
-	err = s.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM activities WHERE strava_activity_id = $1)", activityIDInt).Scan(&exists)
+	scopes, err := s.DB.GetUserScopes(userIDInt)
 	if err != nil {
-		fmt.Printf("Database error checking activity: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to check activity: %v", err)})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get Strava scopes"})
 		return
 	}
-	if exists {
-		c.JSON(http.StatusConflict, gin.H{"error": "Activity already exists"})
+	if !scopes.AllowsActivity(activity.Private) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":         "Private activities can only be imported after allowing access to them on Strava",
+			"missing_scope": storage.ScopeActivityReadAll,
+		})
 		return
 	}
 
-	// Execute query with appropriate parameters
-	if len(latlngData) == 0 {
-		// Indoor activity - no path
-		_, err = s.DB.Exec(query, userIDInt, activityIDInt)
-	} else {
-		// Outdoor activity - with path
-		_, err = s.DB.Exec(query, userIDInt, activityIDInt, linestring)
+	imported, err := loadStravaActivity(client, token.AccessToken, activity)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Failed to fetch activity stream: %v", err)})
+		return
 	}
 
-	if err != nil {
-		fmt.Printf("Database error: %v\n", err)
+	// Stored like every other import: activities without GPS data (indoor activities) get no path
+	if _, _, err := storeImportedActivity(s.DB, userIDInt, imported); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to insert activity: %v", err)})
 		return
 	}
 
-	if len(latlngData) == 0 {
+	linestring := latLngToWKT(imported.Streams.LatLng)
+	if linestring == "" {
 		c.JSON(http.StatusOK, gin.H{"message": "Indoor activity imported (no GPS data)", "has_path": false})
 	} else {
 		c.JSON(http.StatusOK, gin.H{"message": "Activity imported", "linestring": linestring, "has_path": true})
@@ -1,18 +1,25 @@
 package coverage
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	resty "github.com/go-resty/resty/v2"
 	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/logging"
+	"github.com/nikhilvedi/strava-coverage/internal/metrics"
+	"github.com/nikhilvedi/strava-coverage/internal/notify"
+	"github.com/nikhilvedi/strava-coverage/internal/progress"
 	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/nikhilvedi/strava-coverage/internal/webhooks"
 )
 
 // InitialImportService handles bulk import of user's historical activities
@@ -20,20 +27,28 @@ type InitialImportService struct {
 	DB               *storage.DB
 	Config           *config.Config
 	CoverageService  *CoverageService
-	CommentService   *CommentService
+	Notifier         *notify.Notifier
 	DetectionService *CityDetectionService
+	Webhooks         *webhooks.Dispatcher
+	Progress         *progress.Broker
 	client           *resty.Client
+
+	// backfills holds the IDs of users whose metadata backfill is running
+	backfills sync.Map
 }
 
-// NewInitialImportService creates a new initial import service
-func NewInitialImportService(db *storage.DB, cfg *config.Config, coverageService *CoverageService, commentService *CommentService, detectionService *CityDetectionService) *InitialImportService {
+// NewInitialImportService creates a new initial import service. broker receives the
+// progress of imports and may be nil.
+func NewInitialImportService(db *storage.DB, cfg *config.Config, coverageService *CoverageService, notifier *notify.Notifier, detectionService *CityDetectionService, events *webhooks.Dispatcher, broker *progress.Broker) *InitialImportService {
 	return &InitialImportService{
 		DB:               db,
 		Config:           cfg,
 		CoverageService:  coverageService,
-		CommentService:   commentService,
+		Notifier:         notifier,
 		DetectionService: detectionService,
-		client:           resty.New(),
+		Webhooks:         events,
+		Progress:         broker,
+		client:           metrics.NewStravaClient(cfg),
 	}
 }
 
@@ -44,30 +59,10 @@ func (s *InitialImportService) RegisterInitialImportRoutes(r *gin.Engine) {
 		imports.POST("/initial/:userId", s.InitialImportHandler)
 		imports.GET("/status/:userId", s.ImportStatusHandler)
 		imports.POST("/process-imported/:userId", s.ProcessImportedActivitiesHandler)
+		imports.POST("/backfill-metadata/:userId", s.BackfillMetadataHandler)
 	}
 }
 
-// StravaActivitySummary represents a Strava activity from the list endpoint
-type StravaActivitySummary struct {
-	ID                 int64     `json:"id"`
-	Name               string    `json:"name"`
-	Distance           float64   `json:"distance"`
-	MovingTime         int       `json:"moving_time"`
-	ElapsedTime        int       `json:"elapsed_time"`
-	TotalElevationGain float64   `json:"total_elevation_gain"`
-	Type               string    `json:"type"`
-	SportType          string    `json:"sport_type"`
-	StartDate          string    `json:"start_date"`
-	StartDateLocal     string    `json:"start_date_local"`
-	StartLatlng        []float64 `json:"start_latlng"`
-	EndLatlng          []float64 `json:"end_latlng"`
-	Map                struct {
-		ID              string `json:"id"`
-		SummaryPolyline string `json:"summary_polyline"`
-		ResourceState   int    `json:"resource_state"`
-	} `json:"map"`
-}
-
 // ImportStatus represents the status of an import operation
 type ImportStatus struct {
 	UserID             int       `json:"user_id"`
@@ -90,16 +85,11 @@ func (s *InitialImportService) InitialImportHandler(c *gin.Context) {
 		return
 	}
 
-	// Check if import is already in progress
-	status, err := s.getImportStatus(userID)
-	if err == nil && status.InProgress {
+	if err := s.StartImport(c.Request.Context(), userID, false); err != nil {
 		c.JSON(http.StatusConflict, gin.H{"error": "Import already in progress for this user"})
 		return
 	}
 
-	// Start the import in background
-	go s.performInitialImport(userID)
-
 	c.JSON(http.StatusAccepted, gin.H{
 		"message": "Initial import started",
 		"user_id": userID,
@@ -107,9 +97,27 @@ func (s *InitialImportService) InitialImportHandler(c *gin.Context) {
 	})
 }
 
+// ErrImportInProgress is returned when starting an import for a user who has one running
+var ErrImportInProgress = errors.New("import already in progress")
+
+// StartImport starts a user's initial import in the background. It returns
+// ErrImportInProgress if one is running, unless force is set: forcing restarts imports
+// left marked in progress by a server that stopped mid-import. The import logs with the
+// attributes of ctx and a job ID of its own.
+func (s *InitialImportService) StartImport(ctx context.Context, userID int, force bool) error {
+	status, err := s.getImportStatus(userID)
+	if err == nil && status.InProgress && !force {
+		return ErrImportInProgress
+	}
+
+	ctx = logging.With(logging.Detach(ctx), logging.KeyUserID, userID, logging.KeyJobID, logging.NewJobID("import"))
+	go s.performInitialImport(ctx, userID)
+	return nil
+}
+
 // performInitialImport performs the actual import process
-func (s *InitialImportService) performInitialImport(userID int) {
-	log.Printf("Starting initial import for user %d", userID)
+func (s *InitialImportService) performInitialImport(ctx context.Context, userID int) {
+	slog.InfoContext(ctx, "Starting initial import")
 
 	// Mark import as in progress
 	s.setImportInProgress(userID, true)
@@ -118,75 +126,66 @@ func (s *InitialImportService) performInitialImport(userID int) {
 	// Get user's access token
 	tokenPtr, err := s.DB.GetStravaToken(userID)
 	if err != nil {
-		log.Printf("Failed to get token for user %d: %v", userID, err)
+		slog.ErrorContext(ctx, "Failed to get token", "error", err)
+		metrics.Imports.WithLabelValues(storage.ActivitySourceStrava, "failed").Inc()
+		s.publishImport(userID, progress.TypeFailed, progress.Failure{Error: "Failed to get Strava token"})
 		return
 	}
 
-	var totalImported, totalFailed int
-	page := 1
-	perPage := 100 // Strava's max per page
-
-	for {
-		log.Printf("Fetching page %d for user %d", page, userID)
-
-		// Fetch activities from Strava
-		activities, hasMore, err := s.fetchActivitiesPage(tokenPtr.AccessToken, page, perPage)
-		if err != nil {
-			log.Printf("Failed to fetch activities page %d for user %d: %v", page, userID, err)
-			break
-		}
-
-		if len(activities) == 0 {
-			break
-		}
+	scopes, err := s.DB.GetUserScopes(userID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get Strava scopes", "error", err)
+		metrics.Imports.WithLabelValues(storage.ActivitySourceStrava, "failed").Inc()
+		s.publishImport(userID, progress.TypeFailed, progress.Failure{Error: "Failed to get Strava scopes"})
+		return
+	}
 
-		// Import each activity
-		for _, activity := range activities {
-			// Only import running/cycling activities with GPS data
-			if s.shouldImportActivity(activity) {
-				err := s.importSingleActivity(userID, activity.ID, activity.Type, activity.SportType, tokenPtr.AccessToken)
-				if err != nil {
-					log.Printf("Failed to import activity %d: %v", activity.ID, err)
-					totalFailed++
-				} else {
-					totalImported++
-					log.Printf("Imported activity %d (%s)", activity.ID, activity.Name)
-				}
-
-				// Rate limiting - Strava allows 1000 requests per 15 minutes
-				time.Sleep(100 * time.Millisecond)
-			}
-		}
+	source := newStravaSource(s.client, tokenPtr.AccessToken, scopes)
+	s.publishImport(userID, progress.TypeStarted, progress.Counts{Source: source.Name()})
+	result := s.importFromSource(ctx, userID, source, false, func(page int, result ImportResult) {
+		s.updateImportStatus(userID, page, result.Imported, result.Failed)
+		s.publishImport(userID, progress.TypeProgress, importCounts(source.Name(), page, result))
+	})
+	totalImported, totalFailed := result.Imported, result.Failed
 
-		// Update status
-		s.updateImportStatus(userID, page, totalImported, totalFailed)
+	slog.InfoContext(ctx, "Completed initial import", "imported", totalImported, "skipped", result.Skipped, "failed", totalFailed)
+	metrics.Imports.WithLabelValues(source.Name(), "completed").Inc()
 
-		if !hasMore {
-			break
-		}
+	// Mark import as complete
+	s.finalizeImportStatus(userID, totalImported, totalFailed)
+	s.publishImport(userID, progress.TypeCompleted, importCounts(source.Name(), 0, result))
+	s.Webhooks.ImportCompleted(userID, source.Name(), totalImported, result.Skipped, totalFailed)
+}
 
-		page++
+// publishImport publishes the progress of a user's import
+func (s *InitialImportService) publishImport(userID int, eventType string, data interface{}) {
+	s.Progress.Publish(progress.Event{
+		Kind:   progress.KindImport,
+		Type:   eventType,
+		UserID: userID,
+		Data:   data,
+	})
+}
 
-		// Additional safety check to prevent infinite loops
-		if page > 1000 {
-			log.Printf("Stopping import for user %d - reached page limit", userID)
-			break
-		}
+// importCounts is the progress data of an import after page, or of the whole import if
+// page is 0
+func importCounts(source string, page int, result ImportResult) progress.Counts {
+	return progress.Counts{
+		Source:   source,
+		Page:     page,
+		Imported: result.Imported,
+		Skipped:  result.Skipped,
+		Failed:   result.Failed,
 	}
-
-	log.Printf("Completed initial import for user %d: %d imported, %d failed", userID, totalImported, totalFailed)
-
-	// Mark import as complete
-	s.finalizeImportStatus(userID, totalImported, totalFailed)
 }
 
 // fetchActivitiesPage fetches a page of activities from Strava
-func (s *InitialImportService) fetchActivitiesPage(accessToken string, page, perPage int) ([]StravaActivitySummary, bool, error) {
-	resp, err := s.client.R().
+func fetchActivitiesPage(client *resty.Client, accessToken string, page, perPage int) ([]storage.StravaActivity, bool, error) {
+	resp, err := client.R().
 		SetAuthToken(accessToken).
 		SetQueryParam("page", strconv.Itoa(page)).
 		SetQueryParam("per_page", strconv.Itoa(perPage)).
-		Get("https://www.strava.com/api/v3/athlete/activities")
+		Get("/athlete/activities")
 
 	if err != nil {
 		return nil, false, fmt.Errorf("HTTP request failed: %v", err)
@@ -196,7 +195,7 @@ func (s *InitialImportService) fetchActivitiesPage(accessToken string, page, per
 		return nil, false, fmt.Errorf("strava API error: %d - %s", resp.StatusCode(), string(resp.Body()))
 	}
 
-	var activities []StravaActivitySummary
+	var activities []storage.StravaActivity
 	err = json.Unmarshal(resp.Body(), &activities)
 	if err != nil {
 		return nil, false, fmt.Errorf("failed to parse activities: %v", err)
@@ -209,7 +208,7 @@ func (s *InitialImportService) fetchActivitiesPage(accessToken string, page, per
 }
 
 // shouldImportActivity determines if an activity should be imported
-func (s *InitialImportService) shouldImportActivity(activity StravaActivitySummary) bool {
+func shouldImportActivity(activity storage.StravaActivity) bool {
 	// Only import activities with GPS data
 	if len(activity.StartLatlng) == 0 || activity.Map.SummaryPolyline == "" {
 		return false
@@ -226,125 +225,108 @@ func (s *InitialImportService) shouldImportActivity(activity StravaActivitySumma
 	return false
 }
 
-// importSingleActivity imports a single activity with streams
-func (s *InitialImportService) importSingleActivity(userID int, activityID int64, activityType, sportType, accessToken string) error {
-	// Check if activity already exists
-	var count int
-	err := s.DB.QueryRow("SELECT COUNT(*) FROM activities WHERE strava_activity_id = $1", activityID).Scan(&count)
+// BackfillMetadataHandler syncs Strava summary fields onto a user's previously imported activities
+func (s *InitialImportService) BackfillMetadataHandler(c *gin.Context) {
+	userIDStr := c.Param("userId")
+	userID, err := strconv.Atoi(userIDStr)
 	if err != nil {
-		return fmt.Errorf("failed to check existing activity: %v", err)
-	}
-	if count > 0 {
-		return nil // Already imported
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
 	}
 
-	// Fetch activity streams
-	resp, err := s.client.R().
-		SetAuthToken(accessToken).
-		SetQueryParam("keys", "latlng,time,distance").
-		Get(fmt.Sprintf("https://www.strava.com/api/v3/activities/%d/streams", activityID))
-
+	missing, err := s.DB.CountActivitiesMissingMetadata(userID)
 	if err != nil {
-		return fmt.Errorf("failed to fetch streams: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count activities"})
+		return
 	}
 
-	if resp.StatusCode() != 200 {
-		return fmt.Errorf("strava API error: %d", resp.StatusCode())
-	}
+	ctx := logging.With(logging.Detach(c.Request.Context()), logging.KeyUserID, userID, logging.KeyJobID, logging.NewJobID("backfill"))
+	go s.backfillActivityMetadata(ctx, userID)
 
-	// Parse streams
-	latlngData, err := s.parseActivityStreams(resp.Body())
-	if err != nil {
-		return fmt.Errorf("failed to parse streams: %v", err)
-	}
-
-	// Handle activities with or without GPS data
-	var query string
-
-	if len(latlngData) == 0 {
-		// Indoor activity - no GPS data
-		query = `
-			INSERT INTO activities (
-				user_id, 
-				strava_activity_id, 
-				path,
-				activity_type,
-				sport_type,
-				city_id,
-				coverage_percentage,
-				comment_posted,
-				created_at,
-				updated_at
-			) VALUES (
-				$1, $2, NULL,
-				$3, $4,
-				NULL, NULL, false,
-				CURRENT_TIMESTAMP,
-				CURRENT_TIMESTAMP
-			)`
-
-		_, err = s.DB.Exec(query, userID, activityID, activityType, sportType)
-	} else {
-		// Outdoor activity - has GPS data
-		// Convert to WKT LINESTRING
-		var points []string
-		for _, ll := range latlngData {
-			if len(ll) == 2 {
-				points = append(points, fmt.Sprintf("%f %f", ll[1], ll[0])) // WKT: lon lat
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":          "Metadata backfill started",
+		"user_id":          userID,
+		"missing_metadata": missing,
+	})
+}
+
+// RunMetadataBackfillWorker backfills the metadata of every user's activities stored
+// before it was synced, then again every interval for activities still missing it, until
+// ctx is cancelled
+func (s *InitialImportService) RunMetadataBackfillWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		userIDs, err := s.DB.UsersMissingMetadata()
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to list users missing activity metadata", "error", err)
+		}
+		for _, userID := range userIDs {
+			if ctx.Err() != nil {
+				return
 			}
+			s.backfillActivityMetadata(logging.With(ctx, logging.KeyUserID, userID, logging.KeyJobID, logging.NewJobID("backfill")), userID)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
-		linestring := fmt.Sprintf("LINESTRING(%s)", strings.Join(points, ", "))
-
-		query = `
-			INSERT INTO activities (
-				user_id, 
-				strava_activity_id, 
-				path,
-				activity_type,
-				sport_type,
-				city_id,
-				coverage_percentage,
-				comment_posted,
-				created_at,
-				updated_at
-			) VALUES (
-				$1, $2, ST_GeomFromText($3, 4326),
-				$4, $5,
-				NULL, NULL, false,
-				CURRENT_TIMESTAMP,
-				CURRENT_TIMESTAMP
-			)`
-
-		_, err = s.DB.Exec(query, userID, activityID, linestring, activityType, sportType)
 	}
-	return err
 }
 
-// parseActivityStreams parses Strava activity streams response
-func (s *InitialImportService) parseActivityStreams(body []byte) ([][]float64, error) {
-	var rawJSON []map[string]interface{}
-	if err := json.Unmarshal(body, &rawJSON); err != nil {
-		return nil, err
+// backfillActivityMetadata pages through the athlete's Strava activities and updates
+// the metadata of every matching activity that is already stored, until none is missing.
+// It does nothing while a backfill for the same user is running.
+func (s *InitialImportService) backfillActivityMetadata(ctx context.Context, userID int) {
+	if _, running := s.backfills.LoadOrStore(userID, true); running {
+		slog.InfoContext(ctx, "Metadata backfill already running")
+		return
+	}
+	defer s.backfills.Delete(userID)
+
+	tokenPtr, err := s.DB.GetStravaToken(userID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get token", "error", err)
+		return
 	}
 
-	var latlngData [][]float64
-	for _, stream := range rawJSON {
-		if stream["type"] == "latlng" {
-			if dataRaw, ok := stream["data"].([]interface{}); ok {
-				for _, pointRaw := range dataRaw {
-					if point, ok := pointRaw.([]interface{}); ok && len(point) == 2 {
-						lat, latOk := point[0].(float64)
-						lng, lngOk := point[1].(float64)
-						if latOk && lngOk {
-							latlngData = append(latlngData, []float64{lat, lng})
-						}
-					}
-				}
+	var updated int
+	page := 1
+	perPage := 100
+
+	for {
+		activities, hasMore, err := fetchActivitiesPage(s.client, tokenPtr.AccessToken, page, perPage)
+		if err != nil {
+			slog.WarnContext(ctx, "Metadata backfill stopped", "page", page, "error", err)
+			break
+		}
+
+		for _, activity := range activities {
+			found, err := s.DB.UpdateActivityMetadata(userID, activity.Metadata())
+			if err != nil {
+				slog.WarnContext(ctx, "Failed to update activity metadata", "activity_id", activity.ID, "error", err)
+				continue
 			}
+			if found {
+				updated++
+			}
+		}
+
+		// Stop paging once every stored activity has been synced
+		missing, err := s.DB.CountActivitiesMissingMetadata(userID)
+		if err == nil && missing == 0 {
+			break
 		}
+		if !hasMore || page >= 1000 {
+			break
+		}
+		page++
 	}
 
-	return latlngData, nil
+	slog.InfoContext(ctx, "Metadata backfill completed", "updated", updated)
 }
 
 // ImportStatusHandler returns the current import status for a user
@@ -375,7 +357,8 @@ func (s *InitialImportService) ProcessImportedActivitiesHandler(c *gin.Context)
 	}
 
 	// Start processing in background
-	go s.processAllImportedActivities(userID)
+	ctx := logging.With(logging.Detach(c.Request.Context()), logging.KeyUserID, userID, logging.KeyJobID, logging.NewJobID("process"))
+	go s.processAllImportedActivities(ctx, userID)
 
 	c.JSON(http.StatusAccepted, gin.H{
 		"message": "Processing started for imported activities",
@@ -384,19 +367,19 @@ func (s *InitialImportService) ProcessImportedActivitiesHandler(c *gin.Context)
 }
 
 // processAllImportedActivities calculates coverage for all imported activities
-func (s *InitialImportService) processAllImportedActivities(userID int) {
-	log.Printf("Processing imported activities for user %d", userID)
+func (s *InitialImportService) processAllImportedActivities(ctx context.Context, userID int) {
+	slog.InfoContext(ctx, "Processing imported activities")
 
 	// Get all activities without coverage
 	query := `
 		SELECT strava_activity_id 
 		FROM activities 
 		WHERE user_id = $1 AND coverage_percentage IS NULL
-		ORDER BY created_at ASC`
+		ORDER BY COALESCE(start_date, created_at) ASC`
 
 	rows, err := s.DB.Query(query, userID)
 	if err != nil {
-		log.Printf("Failed to fetch activities for user %d: %v", userID, err)
+		slog.ErrorContext(ctx, "Failed to fetch activities", "error", err)
 		return
 	}
 	defer rows.Close()
@@ -412,7 +395,7 @@ func (s *InitialImportService) processAllImportedActivities(userID int) {
 		// Calculate coverage for this activity
 		err := s.calculateActivityCoverage(activityID, userID)
 		if err != nil {
-			log.Printf("Failed to calculate coverage for activity %d: %v", activityID, err)
+			slog.WarnContext(ctx, "Failed to calculate coverage", "activity_id", activityID, "error", err)
 			failed++
 		} else {
 			processed++
@@ -422,11 +405,11 @@ func (s *InitialImportService) processAllImportedActivities(userID int) {
 		time.Sleep(100 * time.Millisecond)
 
 		if processed%10 == 0 {
-			log.Printf("Processed %d activities for user %d", processed, userID)
+			slog.DebugContext(ctx, "Processed activities", "processed", processed)
 		}
 	}
 
-	log.Printf("Completed processing for user %d: %d processed, %d failed", userID, processed, failed)
+	slog.InfoContext(ctx, "Completed processing", "processed", processed, "failed", failed)
 }
 
 // calculateActivityCoverage calculates coverage for a specific activity
@@ -528,7 +511,7 @@ func (s *InitialImportService) setImportInProgress(userID int, inProgress bool)
 				updated_at = CURRENT_TIMESTAMP`
 		_, err := s.DB.Exec(query, userID)
 		if err != nil {
-			log.Printf("Failed to set import in progress for user %d: %v", userID, err)
+			slog.Error("Failed to set import in progress", "user_id", userID, "error", err)
 		}
 	} else {
 		// Mark as completed
@@ -538,7 +521,7 @@ func (s *InitialImportService) setImportInProgress(userID int, inProgress bool)
 			WHERE user_id = $1`
 		_, err := s.DB.Exec(query, userID)
 		if err != nil {
-			log.Printf("Failed to mark import complete for user %d: %v", userID, err)
+			slog.Error("Failed to mark import complete", "user_id", userID, "error", err)
 		}
 	}
 }
@@ -556,7 +539,7 @@ func (s *InitialImportService) updateImportStatus(userID, currentPage, imported,
 
 	_, err := s.DB.Exec(query, userID, currentPage, imported, failed)
 	if err != nil {
-		log.Printf("Failed to update import status for user %d: %v", userID, err)
+		slog.Error("Failed to update import status", "user_id", userID, "error", err)
 	}
 }
 
@@ -573,7 +556,6 @@ func (s *InitialImportService) finalizeImportStatus(userID, imported, failed int
 
 	_, err := s.DB.Exec(query, userID, imported, failed)
 	if err != nil {
-		log.Printf("Failed to finalize import status for user %d: %v", userID, err)
+		slog.Error("Failed to finalize import status", "user_id", userID, "error", err)
 	}
-	log.Printf("Import completed for user %d: imported %d, failed %d", userID, imported, failed)
 }
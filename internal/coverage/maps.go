@@ -3,10 +3,12 @@ package coverage
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/internal/pagination"
 	"github.com/nikhilvedi/strava-coverage/internal/storage"
 	"github.com/nikhilvedi/strava-coverage/internal/utils"
 )
@@ -105,9 +107,6 @@ type Bounds struct {
 
 // GetCitiesGeoJSONHandler returns all cities as GeoJSON
 func (s *MapService) GetCitiesGeoJSONHandler(c *gin.Context) {
-	logger := utils.NewLogger("MapService")
-	logger.Info("Fetching cities GeoJSON data")
-
 	query := `
 		SELECT 
 			id, name, country_code,
@@ -118,7 +117,7 @@ func (s *MapService) GetCitiesGeoJSONHandler(c *gin.Context) {
 
 	rows, err := s.DB.Query(query)
 	if err != nil {
-		logger.Error("Failed to fetch cities: %v", err)
+		slog.ErrorContext(c.Request.Context(), "Failed to fetch cities", "error", err)
 		apiErr := utils.NewAPIError(500, "Database error", "Failed to fetch cities data")
 		utils.ErrorResponse(c, apiErr)
 		return
@@ -159,7 +158,6 @@ func (s *MapService) GetCitiesGeoJSONHandler(c *gin.Context) {
 		Features: features,
 	}
 
-	c.Header("Access-Control-Allow-Origin", "*")
 	c.JSON(http.StatusOK, collection)
 }
 
@@ -186,7 +184,7 @@ func (s *MapService) GetCityGeoJSONHandler(c *gin.Context) {
 
 	err = s.DB.QueryRow(query, cityID).Scan(&id, &name, &countryCode, &boundaryJSON, &areaKm2)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "City not found"})
+		utils.NotFound(c, utils.CodeCityNotFound, "City not found")
 		return
 	}
 
@@ -213,11 +211,11 @@ func (s *MapService) GetCityGeoJSONHandler(c *gin.Context) {
 		Features: []GeoJSONFeature{feature},
 	}
 
-	c.Header("Access-Control-Allow-Origin", "*")
 	c.JSON(http.StatusOK, collection)
 }
 
-// GetUserActivitiesGeoJSONHandler returns user activities as GeoJSON
+// GetUserActivitiesGeoJSONHandler returns a page of user activities as GeoJSON, filtered
+// and sorted like the activity history
 func (s *MapService) GetUserActivitiesGeoJSONHandler(c *gin.Context) {
 	userIDStr := c.Param("userId")
 	userID, err := strconv.Atoi(userIDStr)
@@ -226,12 +224,30 @@ func (s *MapService) GetUserActivitiesGeoJSONHandler(c *gin.Context) {
 		return
 	}
 
-	// Optional filters
-	limit := c.DefaultQuery("limit", "100")
-	cityID := c.Query("city_id")
+	filter, err := ParseActivityFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	params, err := pagination.Parse(c, ActivityMapPages)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	query := `
+	var page pagination.Page
+	countArgs := []interface{}{userID}
+	countQuery := `SELECT COUNT(*) FROM activities a WHERE a.user_id = $1 AND a.path IS NOT NULL AND ` + filter.Where(&countArgs)
+	if err := s.DB.Get(&page.Total, countQuery, countArgs...); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count activities"})
+		return
+	}
+
+	args := []interface{}{userID}
+	where := filter.Where(&args)
+	query := fmt.Sprintf(`
 		SELECT 
+			a.id,
 			a.strava_activity_id,
 			ST_AsGeoJSON(a.path) as path_geojson,
 			a.coverage_percentage,
@@ -239,24 +255,13 @@ func (s *MapService) GetUserActivitiesGeoJSONHandler(c *gin.Context) {
 			c.country_code,
 			ST_Length(ST_Transform(a.path, 3857)) / 1000 as distance_km,
 			a.activity_type,
-			a.sport_type
+			a.sport_type,
+			(%s)::text
 		FROM activities a
 		LEFT JOIN cities c ON a.city_id = c.id
-		WHERE a.user_id = $1 AND a.path IS NOT NULL`
-
-	args := []interface{}{userID}
-	argIndex := 2
-
-	if cityID != "" {
-		query += fmt.Sprintf(" AND a.city_id = $%d", argIndex)
-		cityIDInt, _ := strconv.Atoi(cityID)
-		args = append(args, cityIDInt)
-		argIndex++
-	}
-
-	query += fmt.Sprintf(" ORDER BY a.created_at DESC LIMIT $%d", argIndex)
-	limitInt, _ := strconv.Atoi(limit)
-	args = append(args, limitInt)
+		WHERE a.user_id = $1 AND a.path IS NOT NULL AND %s AND %s
+		ORDER BY %s
+		LIMIT %d`, params.Sort.Column, where, params.Where("a.id", &args), params.OrderBy("a.id"), params.Fetch())
 
 	rows, err := s.DB.Query(query, args...)
 	if err != nil {
@@ -266,15 +271,18 @@ func (s *MapService) GetUserActivitiesGeoJSONHandler(c *gin.Context) {
 	defer rows.Close()
 
 	var features []GeoJSONFeature
+	var ids []int64
+	var sortKeys []string
 	for rows.Next() {
-		var activityID int64
+		var id, activityID int64
 		var pathJSON string
 		var coverage *float64
 		var cityName, countryCode *string
 		var distanceKm float64
 		var activityType, sportType *string
+		var sortKey string
 
-		if err := rows.Scan(&activityID, &pathJSON, &coverage, &cityName, &countryCode, &distanceKm, &activityType, &sportType); err != nil {
+		if err := rows.Scan(&id, &activityID, &pathJSON, &coverage, &cityName, &countryCode, &distanceKm, &activityType, &sportType, &sortKey); err != nil {
 			continue
 		}
 
@@ -309,21 +317,27 @@ func (s *MapService) GetUserActivitiesGeoJSONHandler(c *gin.Context) {
 			Properties: properties,
 		}
 		features = append(features, feature)
+		ids = append(ids, id)
+		sortKeys = append(sortKeys, sortKey)
 	}
 
+	keep, next := params.Trim(len(features), func(i int) (string, int64) {
+		return sortKeys[i], ids[i]
+	})
+	features, page.Next = features[:keep], next
+
 	collection := GeoJSONFeatureCollection{
 		Type:     "FeatureCollection",
 		Features: features,
 	}
 
-	c.Header("Access-Control-Allow-Origin", "*")
+	pagination.SetHeaders(c, page)
 	c.JSON(http.StatusOK, collection)
 }
 
-// GetUserCityActivitiesGeoJSONHandler returns user activities for a specific city
+// GetUserCityActivitiesGeoJSONHandler returns user activities for a specific city. The
+// filter reads the city from the path.
 func (s *MapService) GetUserCityActivitiesGeoJSONHandler(c *gin.Context) {
-	// Set city_id parameter and call general activities handler
-	c.Set("city_id", c.Param("cityId"))
 	s.GetUserActivitiesGeoJSONHandler(c)
 }
 
@@ -444,7 +458,6 @@ func (s *MapService) GetCoverageGeoJSONHandler(c *gin.Context) {
 		Features: features,
 	}
 
-	c.Header("Access-Control-Allow-Origin", "*")
 	c.JSON(http.StatusOK, collection)
 }
 
@@ -553,7 +566,6 @@ func (s *MapService) GetMapConfigHandler(c *gin.Context) {
 		InteractionModes: []string{"pan", "zoom", "click", "popup"},
 	}
 
-	c.Header("Access-Control-Allow-Origin", "*")
 	c.JSON(http.StatusOK, config)
 }
 
@@ -602,7 +614,6 @@ func (s *MapService) GetMapStylesHandler(c *gin.Context) {
 		},
 	}
 
-	c.Header("Access-Control-Allow-Origin", "*")
 	c.JSON(http.StatusOK, styles)
 }
 
@@ -627,11 +638,10 @@ func (s *MapService) GetCityBoundsHandler(c *gin.Context) {
 	var bounds Bounds
 	err = s.DB.QueryRow(query, cityID).Scan(&bounds.North, &bounds.South, &bounds.East, &bounds.West)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "City not found"})
+		utils.NotFound(c, utils.CodeCityNotFound, "City not found")
 		return
 	}
 
-	c.Header("Access-Control-Allow-Origin", "*")
 	c.JSON(http.StatusOK, bounds)
 }
 
@@ -660,6 +670,5 @@ func (s *MapService) GetUserActivityBoundsHandler(c *gin.Context) {
 		return
 	}
 
-	c.Header("Access-Control-Allow-Origin", "*")
 	c.JSON(http.StatusOK, bounds)
 }
@@ -3,6 +3,8 @@ package coverage
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/nikhilvedi/strava-coverage/internal/storage"
@@ -85,51 +87,18 @@ type CityStats struct {
 func (s *MultiCityCoverageService) GetUserCoverageSummaryHandler(c *gin.Context) {
 	userID := c.Param("userId")
 
-	// Simplified query to get user's city coverage
-	query := `
-		SELECT 
-			c.id,
-			c.name,
-			c.country_code,
-			COUNT(a.id) as activity_count,
-			COALESCE(SUM(ST_Length(ST_Transform(a.path, 3857)) / 1000), 0) as distance_covered,
-			ST_Area(ST_Transform(c.boundary, 3857)) / 1000000 * 12 as estimated_total_distance,
-			CASE 
-				WHEN (ST_Area(ST_Transform(c.boundary, 3857)) / 1000000 * 12) > 0 THEN
-					LEAST((COALESCE(SUM(ST_Length(ST_Transform(a.path, 3857)) / 1000), 0) / 
-						  (ST_Area(ST_Transform(c.boundary, 3857)) / 1000000 * 12)) * 100, 100)
-				ELSE 0
-			END as coverage_percent,
-			COALESCE(MAX(a.created_at)::text, '') as last_activity
-		FROM cities c
-		LEFT JOIN activities a ON a.city_id = c.id AND a.user_id = $1
-		WHERE EXISTS (SELECT 1 FROM activities a2 WHERE a2.user_id = $1 AND a2.city_id = c.id)
-		GROUP BY c.id, c.name, c.country_code, c.boundary
-		ORDER BY coverage_percent DESC`
-
-	rows, err := s.DB.Query(query, userID)
+	cityCoverage, err := s.UserCityCoverage(userID, nil)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get coverage summary"})
 		return
 	}
-	defer rows.Close()
 
-	var cityCoverage []CityCoverageInfo
 	var totalDistanceCovered float64
 	var totalCoverage float64
 	var bestCity string
 	var bestCoverage float64
 
-	for rows.Next() {
-		var info CityCoverageInfo
-		err := rows.Scan(&info.CityID, &info.CityName, &info.CountryCode,
-			&info.ActivityCount, &info.DistanceCovered, &info.TotalDistance,
-			&info.CoveragePercent, &info.LastActivity)
-		if err != nil {
-			continue
-		}
-
-		cityCoverage = append(cityCoverage, info)
+	for _, info := range cityCoverage {
 		totalDistanceCovered += info.DistanceCovered
 		totalCoverage += info.CoveragePercent
 
@@ -159,16 +128,106 @@ func (s *MultiCityCoverageService) GetUserCoverageSummaryHandler(c *gin.Context)
 	c.JSON(http.StatusOK, summary)
 }
 
+// UserCityCoverage aggregates a user's coverage of every city they have activities in, best
+// covered first. With until set, only activities started before it count, giving the
+// coverage as it was then.
+func (s *MultiCityCoverageService) UserCityCoverage(userID string, until *time.Time) ([]CityCoverageInfo, error) {
+	// Simplified query to get user's city coverage
+	query := `
+		SELECT 
+			c.id,
+			c.name,
+			c.country_code,
+			COUNT(a.id) as activity_count,
+			COALESCE(SUM(ST_Length(ST_Transform(a.path, 3857)) / 1000), 0) as distance_covered,
+			ST_Area(ST_Transform(c.boundary, 3857)) / 1000000 * 12 as estimated_total_distance,
+			CASE 
+				WHEN (ST_Area(ST_Transform(c.boundary, 3857)) / 1000000 * 12) > 0 THEN
+					LEAST((COALESCE(SUM(ST_Length(ST_Transform(a.path, 3857)) / 1000), 0) / 
+						  (ST_Area(ST_Transform(c.boundary, 3857)) / 1000000 * 12)) * 100, 100)
+				ELSE 0
+			END as coverage_percent,
+			COALESCE(COALESCE(MAX(a.start_date), MAX(a.created_at))::text, '') as last_activity
+		FROM cities c
+		LEFT JOIN activities a ON a.city_id = c.id AND a.user_id = $1
+			AND ($2::timestamptz IS NULL OR COALESCE(a.start_date, a.created_at) < $2)
+		WHERE EXISTS (
+			SELECT 1 FROM activities a2
+			WHERE a2.user_id = $1 AND a2.city_id = c.id
+			AND ($2::timestamptz IS NULL OR COALESCE(a2.start_date, a2.created_at) < $2)
+		)
+		GROUP BY c.id, c.name, c.country_code, c.boundary
+		ORDER BY coverage_percent DESC`
+
+	rows, err := s.DB.Query(query, userID, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cityCoverage []CityCoverageInfo
+	for rows.Next() {
+		var info CityCoverageInfo
+		err := rows.Scan(&info.CityID, &info.CityName, &info.CountryCode,
+			&info.ActivityCount, &info.DistanceCovered, &info.TotalDistance,
+			&info.CoveragePercent, &info.LastActivity)
+		if err != nil {
+			continue
+		}
+		cityCoverage = append(cityCoverage, info)
+	}
+	return cityCoverage, rows.Err()
+}
+
 // GetUserCityLeaderboardHandler returns leaderboard for a specific city
 func (s *MultiCityCoverageService) GetUserCityLeaderboardHandler(c *gin.Context) {
 	userID := c.Param("userId")
 	cityIDStr := c.Query("city_id")
-	limit := c.DefaultQuery("limit", "50")
 
 	if cityIDStr == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "city_id parameter required"})
 		return
 	}
+	cityID, err := strconv.Atoi(cityIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid city_id"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+
+	leaderboard, err := s.CityLeaderboard(cityID, limit, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get leaderboard"})
+		return
+	}
+
+	var userRank int
+	for _, entry := range leaderboard {
+		if entry.UserID == userID {
+			userRank = entry.Rank
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"city_id":       cityIDStr,
+		"user_rank":     userRank,
+		"leaderboard":   leaderboard,
+		"total_entries": len(leaderboard),
+	})
+}
+
+// CityLeaderboard ranks the users with activities in a city by coverage. A limit of 0
+// returns every user. With until set, only activities started before it count, giving
+// the standings as they were then.
+func (s *MultiCityCoverageService) CityLeaderboard(cityID int, limit int, until *time.Time) ([]CityLeaderboardEntry, error) {
+	var limitArg interface{} // NULL is LIMIT ALL
+	if limit > 0 {
+		limitArg = limit
+	}
 
 	query := `
 		WITH user_stats AS (
@@ -177,10 +236,11 @@ func (s *MultiCityCoverageService) GetUserCityLeaderboardHandler(c *gin.Context)
 				u.strava_id as athlete_id,
 				COUNT(a.id) as activity_count,
 				COALESCE(SUM(ST_Length(ST_Transform(a.path, 3857)) / 1000), 0) as distance_covered,
-				(SELECT ST_Area(ST_Transform(boundary, 3857)) / 1000000 * 12 FROM cities WHERE id = $2) as estimated_total
+				(SELECT ST_Area(ST_Transform(boundary, 3857)) / 1000000 * 12 FROM cities WHERE id = $1) as estimated_total
 			FROM activities a
 			JOIN users u ON u.id = a.user_id
-			WHERE a.city_id = $2
+			WHERE a.city_id = $1
+				AND ($3::timestamptz IS NULL OR COALESCE(a.start_date, a.created_at) < $3)
 			GROUP BY a.user_id, u.strava_id
 		),
 		ranked_stats AS (
@@ -211,17 +271,15 @@ func (s *MultiCityCoverageService) GetUserCityLeaderboardHandler(c *gin.Context)
 			activity_count
 		FROM ranked_stats
 		ORDER BY rank
-		LIMIT $3`
+		LIMIT $2`
 
-	rows, err := s.DB.Query(query, userID, cityIDStr, limit)
+	rows, err := s.DB.Query(query, cityID, limitArg, until)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get leaderboard"})
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
 	var leaderboard []CityLeaderboardEntry
-	var userRank int
 	for rows.Next() {
 		var entry CityLeaderboardEntry
 		err := rows.Scan(&entry.UserID, &entry.AthleteID, &entry.Rank,
@@ -229,20 +287,9 @@ func (s *MultiCityCoverageService) GetUserCityLeaderboardHandler(c *gin.Context)
 		if err != nil {
 			continue
 		}
-
-		if entry.UserID == userID {
-			userRank = entry.Rank
-		}
-
 		leaderboard = append(leaderboard, entry)
 	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"city_id":       cityIDStr,
-		"user_rank":     userRank,
-		"leaderboard":   leaderboard,
-		"total_entries": len(leaderboard),
-	})
+	return leaderboard, rows.Err()
 }
 
 // CalculateAllUserCoverageHandler recalculates coverage for all user's cities
@@ -0,0 +1,81 @@
+package coverage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	resty "github.com/go-resty/resty/v2"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+// errPrivateActivity is returned for private activities of users who did not grant
+// activity:read_all
+var errPrivateActivity = errors.New("activity is private and activity:read_all was not granted")
+
+// errAutoImportOff is returned for pushed activities of users an admin switched
+// auto_import off for
+var errAutoImportOff = errors.New("auto_import is switched off for the user")
+
+// fetchStravaActivity fetches a single activity's summary fields from Strava
+func fetchStravaActivity(client *resty.Client, accessToken string, activityID int64) (*storage.StravaActivity, error) {
+	resp, err := client.R().
+		SetAuthToken(accessToken).
+		Get(fmt.Sprintf("/activities/%d", activityID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch activity: %v", err)
+	}
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("strava API error: %d - %s", resp.StatusCode(), string(resp.Body()))
+	}
+
+	var activity storage.StravaActivity
+	if err := json.Unmarshal(resp.Body(), &activity); err != nil {
+		return nil, fmt.Errorf("failed to parse activity: %v", err)
+	}
+	return &activity, nil
+}
+
+// latLngToWKT converts [lat, lng] points to a WKT LINESTRING, or "" if there is no usable path
+func latLngToWKT(latlngData [][]float64) string {
+	var points []string
+	for _, ll := range latlngData {
+		if len(ll) == 2 {
+			points = append(points, fmt.Sprintf("%f %f", ll[1], ll[0])) // WKT: lon lat
+		}
+	}
+	// A LINESTRING needs at least two points
+	if len(points) < 2 {
+		return ""
+	}
+	return fmt.Sprintf("LINESTRING(%s)", strings.Join(points, ", "))
+}
+
+// storeStravaActivity fetches an activity's streams and saves them with its metadata.
+// It reports whether the activity was newly created and whether it has a path.
+func storeStravaActivity(db *storage.DB, client *resty.Client, accessToken string, userID int, activity *storage.StravaActivity) (bool, bool, error) {
+	imported, err := loadStravaActivity(client, accessToken, activity)
+	if err != nil {
+		return false, false, err
+	}
+
+	_, inserted, err := storeImportedActivity(db, userID, imported)
+	if err != nil {
+		return false, false, err
+	}
+	return inserted, len(imported.Streams.LatLng) >= 2, nil
+}
+
+// saveActivityStreams stores the full streams of an activity. Failures are only logged:
+// the path used for coverage has already been saved.
+func saveActivityStreams(db *storage.DB, activityID int64, streams *ActivityStreams) {
+	record, err := streamsRecord(activityID, streams)
+	if err == nil {
+		err = db.SaveActivityStreams(record)
+	}
+	if err != nil {
+		slog.Warn("Failed to store streams", "activity_id", activityID, "error", err)
+	}
+}
@@ -0,0 +1,385 @@
+package coverage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	resty "github.com/go-resty/resty/v2"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+// streamKeys are the Strava streams requested for every imported activity
+const streamKeys = "latlng,time,altitude,distance"
+
+// ActivityStreams holds the per-point streams of an activity. All non-empty streams
+// have the same length; index i of each refers to the same GPS sample.
+type ActivityStreams struct {
+	LatLng   [][]float64 `json:"latlng,omitempty"`
+	Time     []int       `json:"time,omitempty"`     // seconds since the activity start
+	Altitude []float64   `json:"altitude,omitempty"` // metres
+	Distance []float64   `json:"distance,omitempty"` // metres since the activity start
+}
+
+// StreamStats summarises an activity's streams
+type StreamStats struct {
+	PointCount      int     `json:"point_count"`
+	DurationSeconds int     `json:"duration_seconds"`
+	DistanceM       float64 `json:"distance_m"`
+	ElevationGainM  float64 `json:"elevation_gain_m"`
+	ElevationLossM  float64 `json:"elevation_loss_m"`
+	MinAltitudeM    float64 `json:"min_altitude_m"`
+	MaxAltitudeM    float64 `json:"max_altitude_m"`
+	MaxSpeedMps     float64 `json:"max_speed_mps"`
+	AvgSpeedMps     float64 `json:"avg_speed_mps"`
+}
+
+// fetchActivityStreams fetches an activity's GPS, time, altitude and distance streams from Strava
+func fetchActivityStreams(client *resty.Client, accessToken string, activityID int64) (*ActivityStreams, error) {
+	resp, err := client.R().
+		SetAuthToken(accessToken).
+		SetQueryParam("keys", streamKeys).
+		Get(fmt.Sprintf("/activities/%d/streams", activityID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch streams: %v", err)
+	}
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("strava API error: %d", resp.StatusCode())
+	}
+
+	return parseActivityStreams(resp.Body())
+}
+
+// parseActivityStreams decodes a Strava streams response. Both the default list form
+// and the key_by_type=true object form are accepted.
+func parseActivityStreams(body []byte) (*ActivityStreams, error) {
+	type rawStream struct {
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+
+	var list []rawStream
+	if err := json.Unmarshal(body, &list); err != nil {
+		var byType map[string]rawStream
+		if err := json.Unmarshal(body, &byType); err != nil {
+			return nil, err
+		}
+		for key, stream := range byType {
+			stream.Type = key
+			list = append(list, stream)
+		}
+	}
+
+	streams := &ActivityStreams{}
+	for _, stream := range list {
+		var err error
+		switch stream.Type {
+		case "latlng":
+			err = json.Unmarshal(stream.Data, &streams.LatLng)
+		case "time":
+			err = json.Unmarshal(stream.Data, &streams.Time)
+		case "altitude":
+			err = json.Unmarshal(stream.Data, &streams.Altitude)
+		case "distance":
+			err = json.Unmarshal(stream.Data, &streams.Distance)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s stream: %v", stream.Type, err)
+		}
+	}
+
+	// Drop malformed points; once a point is dropped the other streams no longer
+	// line up with the GPS points, so they are dropped too
+	total := len(streams.LatLng)
+	points := streams.LatLng[:0]
+	for _, ll := range streams.LatLng {
+		if len(ll) == 2 {
+			points = append(points, ll)
+		}
+	}
+	streams.LatLng = points
+	if len(points) != total || len(streams.Time) != len(points) {
+		streams.Time = nil
+	}
+	if len(points) != total || len(streams.Altitude) != len(points) {
+		streams.Altitude = nil
+	}
+	if len(points) != total || len(streams.Distance) != len(points) {
+		streams.Distance = nil
+	}
+
+	return streams, nil
+}
+
+// encodeStreams compresses streams for storage
+func encodeStreams(streams *ActivityStreams) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(streams); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeStreams reverses encodeStreams
+func decodeStreams(data []byte) (*ActivityStreams, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	streams := &ActivityStreams{}
+	if err := json.Unmarshal(raw, streams); err != nil {
+		return nil, err
+	}
+	return streams, nil
+}
+
+// StoredActivityStreams loads the streams stored for an activity. It returns sql.ErrNoRows
+// if none are stored.
+func StoredActivityStreams(db *storage.DB, activityID int64) (*ActivityStreams, error) {
+	record, err := db.GetActivityStreams(activityID)
+	if err != nil {
+		return nil, err
+	}
+	return decodeStreams(record.Data)
+}
+
+// streamsRecord prepares streams for storage
+func streamsRecord(activityID int64, streams *ActivityStreams) (*storage.ActivityStreamsRecord, error) {
+	data, err := encodeStreams(streams)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.ActivityStreamsRecord{
+		StravaActivityID: activityID,
+		PointCount:       len(streams.LatLng),
+		HasTime:          len(streams.Time) > 0,
+		HasAltitude:      len(streams.Altitude) > 0,
+		HasDistance:      len(streams.Distance) > 0,
+		Data:             data,
+	}, nil
+}
+
+// Stats computes duration, distance, elevation and speed figures for the streams
+func (s *ActivityStreams) Stats() StreamStats {
+	return s.statsWhere(func(int) bool { return true })
+}
+
+// StatsInSpeedRange computes stats over the segments whose speed lies within
+// [minMps, maxMps]; a zero maxMps means no upper bound. Segments are the stretches
+// between consecutive points, so a stop or a car ride can be excluded.
+func (s *ActivityStreams) StatsInSpeedRange(minMps, maxMps float64) StreamStats {
+	return s.statsWhere(func(i int) bool {
+		speed, ok := s.segmentSpeed(i)
+		if !ok {
+			return false
+		}
+		return speed >= minMps && (maxMps == 0 || speed <= maxMps)
+	})
+}
+
+// statsWhere accumulates stats over the segments (i-1, i) accepted by include
+func (s *ActivityStreams) statsWhere(include func(i int) bool) StreamStats {
+	stats := StreamStats{PointCount: len(s.LatLng)}
+	if len(s.Altitude) > 0 {
+		stats.MinAltitudeM = math.Inf(1)
+		stats.MaxAltitudeM = math.Inf(-1)
+	}
+
+	var movingSeconds int
+	for i := 1; i < len(s.LatLng); i++ {
+		if !include(i) {
+			continue
+		}
+		stats.DistanceM += s.segmentDistance(i)
+		if len(s.Time) > 0 {
+			dt := s.Time[i] - s.Time[i-1]
+			movingSeconds += dt
+		}
+		if len(s.Altitude) > 0 {
+			delta := s.Altitude[i] - s.Altitude[i-1]
+			if delta > 0 {
+				stats.ElevationGainM += delta
+			} else {
+				stats.ElevationLossM -= delta
+			}
+			stats.MinAltitudeM = math.Min(stats.MinAltitudeM, math.Min(s.Altitude[i-1], s.Altitude[i]))
+			stats.MaxAltitudeM = math.Max(stats.MaxAltitudeM, math.Max(s.Altitude[i-1], s.Altitude[i]))
+		}
+		if speed, ok := s.segmentSpeed(i); ok && speed > stats.MaxSpeedMps {
+			stats.MaxSpeedMps = speed
+		}
+	}
+
+	if math.IsInf(stats.MinAltitudeM, 0) {
+		stats.MinAltitudeM, stats.MaxAltitudeM = 0, 0
+	}
+	stats.DurationSeconds = movingSeconds
+	if movingSeconds > 0 {
+		stats.AvgSpeedMps = stats.DistanceM / float64(movingSeconds)
+	}
+	return stats
+}
+
+// segmentDistance returns the length in metres of the segment ending at point i,
+// using the distance stream when available
+func (s *ActivityStreams) segmentDistance(i int) float64 {
+	if len(s.Distance) > 0 {
+		return s.Distance[i] - s.Distance[i-1]
+	}
+	return haversineMeters(s.LatLng[i-1], s.LatLng[i])
+}
+
+// segmentSpeed returns the speed over the segment ending at point i. It is not
+// available without a time stream or when two samples share a timestamp.
+func (s *ActivityStreams) segmentSpeed(i int) (float64, bool) {
+	if len(s.Time) == 0 {
+		return 0, false
+	}
+	dt := s.Time[i] - s.Time[i-1]
+	if dt <= 0 {
+		return 0, false
+	}
+	return s.segmentDistance(i) / float64(dt), true
+}
+
+// TimeAtFraction returns when the athlete reached the given fraction (0-1) of the
+// activity's length, e.g. as reported by PostGIS ST_LineLocatePoint on the path.
+// It returns false when the streams carry no time data.
+func (s *ActivityStreams) TimeAtFraction(start time.Time, fraction float64) (time.Time, bool) {
+	if len(s.Time) == 0 || len(s.LatLng) == 0 {
+		return time.Time{}, false
+	}
+
+	cumulative := make([]float64, len(s.LatLng))
+	for i := 1; i < len(s.LatLng); i++ {
+		cumulative[i] = cumulative[i-1] + s.segmentDistance(i)
+	}
+	target := fraction * cumulative[len(cumulative)-1]
+
+	for i, d := range cumulative {
+		if d >= target {
+			return start.Add(time.Duration(s.Time[i]) * time.Second), true
+		}
+	}
+	return start.Add(time.Duration(s.Time[len(s.Time)-1]) * time.Second), true
+}
+
+// haversineMeters returns the great-circle distance between two [lat, lng] points
+func haversineMeters(a, b []float64) float64 {
+	const earthRadiusM = 6371000.0
+	lat1, lat2 := a[0]*math.Pi/180, b[0]*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b[1] - a[1]) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusM * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// GetActivityStreamsHandler returns stream stats for an activity, optionally restricted to a
+// speed range (min_speed_kmh, max_speed_kmh), and when the activity first entered its city
+func (s *CoverageService) GetActivityStreamsHandler(c *gin.Context) {
+	activityID, err := strconv.ParseInt(c.Param("activityId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid activity ID"})
+		return
+	}
+
+	var minSpeed, maxSpeed float64
+	for param, dest := range map[string]*float64{"min_speed_kmh": &minSpeed, "max_speed_kmh": &maxSpeed} {
+		if value := c.Query(param); value != "" {
+			kmh, err := strconv.ParseFloat(value, 64)
+			if err != nil || kmh < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %s", param)})
+				return
+			}
+			*dest = kmh / 3.6
+		}
+	}
+
+	record, err := s.DB.GetActivityStreams(activityID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No streams stored for this activity"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch activity streams"})
+		}
+		return
+	}
+
+	streams, err := decodeStreams(record.Data)
+	if err != nil {
+		slog.Warn("Failed to decode streams", "activity_id", activityID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode activity streams"})
+		return
+	}
+
+	result := gin.H{
+		"activity_id":  activityID,
+		"has_time":     record.HasTime,
+		"has_altitude": record.HasAltitude,
+		"has_distance": record.HasDistance,
+		"stats":        streams.Stats(),
+	}
+	if c.Query("min_speed_kmh") != "" || c.Query("max_speed_kmh") != "" {
+		result["speed_filtered_stats"] = streams.StatsInSpeedRange(minSpeed, maxSpeed)
+	}
+
+	// Locate the first point of the path inside the activity's city and convert it to a time
+	query := `
+		SELECT c.id, c.name, a.start_date, first_entry_fraction(a.path, c.boundary)
+		FROM activities a
+		JOIN cities c ON c.id = a.city_id
+		WHERE a.strava_activity_id = $1 AND a.start_date IS NOT NULL
+		AND ST_Intersects(a.path, c.boundary)`
+
+	var cityID int
+	var cityName string
+	var startDate time.Time
+	var fraction sql.NullFloat64
+	err = s.DB.QueryRow(query, activityID).Scan(&cityID, &cityName, &startDate, &fraction)
+	if err != nil && err != sql.ErrNoRows {
+		slog.Warn("Failed to locate city entry", "activity_id", activityID, "error", err)
+	}
+	if err == nil && fraction.Valid {
+		if reachedAt, ok := streams.TimeAtFraction(startDate, fraction.Float64); ok {
+			result["city_first_reached"] = gin.H{
+				"city_id":    cityID,
+				"city_name":  cityName,
+				"reached_at": reachedAt,
+			}
+		}
+	}
+
+	// Streets and tiles this activity reached first, stored when its coverage was calculated
+	if reached, err := s.DB.GetStreetsReachedBy(activityID); err != nil {
+		slog.Warn("Failed to load streets first reached", "activity_id", activityID, "error", err)
+	} else {
+		result["streets_first_reached"] = reached
+	}
+	if reached, err := s.DB.GetTilesReachedBy(activityID); err != nil {
+		slog.Warn("Failed to load tiles first reached", "activity_id", activityID, "error", err)
+	} else {
+		result["tiles_first_reached"] = reached
+	}
+
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,103 @@
+package coverage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testStreamsBody = `[
+	{"type": "latlng", "data": [[51.5000, -0.1000], [51.5009, -0.1000], [51.5018, -0.1000], [51.5027, -0.1000]]},
+	{"type": "time", "data": [0, 30, 60, 70]},
+	{"type": "altitude", "data": [10.0, 15.0, 12.0, 20.0]},
+	{"type": "distance", "data": [0.0, 100.0, 200.0, 400.0]}
+]`
+
+func TestParseActivityStreams(t *testing.T) {
+	t.Run("List form", func(t *testing.T) {
+		streams, err := parseActivityStreams([]byte(testStreamsBody))
+		require.NoError(t, err)
+
+		assert.Len(t, streams.LatLng, 4)
+		assert.Equal(t, []int{0, 30, 60, 70}, streams.Time)
+		assert.Equal(t, []float64{10, 15, 12, 20}, streams.Altitude)
+		assert.Equal(t, []float64{0, 100, 200, 400}, streams.Distance)
+	})
+
+	t.Run("Keyed by type", func(t *testing.T) {
+		body := `{"latlng": {"data": [[1, 2], [3, 4]]}, "time": {"data": [0, 5]}}`
+		streams, err := parseActivityStreams([]byte(body))
+		require.NoError(t, err)
+
+		assert.Equal(t, [][]float64{{1, 2}, {3, 4}}, streams.LatLng)
+		assert.Equal(t, []int{0, 5}, streams.Time)
+		assert.Nil(t, streams.Altitude)
+	})
+
+	t.Run("Misaligned streams are dropped", func(t *testing.T) {
+		body := `[{"type": "latlng", "data": [[1, 2], [3], [5, 6]]}, {"type": "time", "data": [0, 1, 2]}]`
+		streams, err := parseActivityStreams([]byte(body))
+		require.NoError(t, err)
+
+		assert.Len(t, streams.LatLng, 2)
+		assert.Nil(t, streams.Time)
+	})
+
+	t.Run("Invalid JSON", func(t *testing.T) {
+		_, err := parseActivityStreams([]byte("not json"))
+		assert.Error(t, err)
+	})
+}
+
+func TestStreamsEncodeRoundTrip(t *testing.T) {
+	streams, err := parseActivityStreams([]byte(testStreamsBody))
+	require.NoError(t, err)
+
+	data, err := encodeStreams(streams)
+	require.NoError(t, err)
+
+	decoded, err := decodeStreams(data)
+	require.NoError(t, err)
+	assert.Equal(t, streams, decoded)
+}
+
+func TestActivityStreamsStats(t *testing.T) {
+	streams, err := parseActivityStreams([]byte(testStreamsBody))
+	require.NoError(t, err)
+
+	stats := streams.Stats()
+	assert.Equal(t, 4, stats.PointCount)
+	assert.Equal(t, 70, stats.DurationSeconds)
+	assert.InDelta(t, 400, stats.DistanceM, 0.001)
+	assert.InDelta(t, 13, stats.ElevationGainM, 0.001)
+	assert.InDelta(t, 3, stats.ElevationLossM, 0.001)
+	assert.InDelta(t, 10, stats.MinAltitudeM, 0.001)
+	assert.InDelta(t, 20, stats.MaxAltitudeM, 0.001)
+	assert.InDelta(t, 20, stats.MaxSpeedMps, 0.001) // 200m in 10s
+
+	// Only the two slow segments (100m in 30s)
+	slow := streams.StatsInSpeedRange(0, 5)
+	assert.Equal(t, 60, slow.DurationSeconds)
+	assert.InDelta(t, 200, slow.DistanceM, 0.001)
+	assert.InDelta(t, 5, slow.ElevationGainM, 0.001)
+}
+
+func TestActivityStreamsTimeAtFraction(t *testing.T) {
+	streams, err := parseActivityStreams([]byte(testStreamsBody))
+	require.NoError(t, err)
+
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+
+	reached, ok := streams.TimeAtFraction(start, 0.5)
+	require.True(t, ok)
+	assert.Equal(t, start.Add(60*time.Second), reached)
+
+	reached, ok = streams.TimeAtFraction(start, 0)
+	require.True(t, ok)
+	assert.Equal(t, start, reached)
+
+	_, ok = (&ActivityStreams{LatLng: streams.LatLng}).TimeAtFraction(start, 0.5)
+	assert.False(t, ok)
+}
@@ -0,0 +1,281 @@
+// Package digest builds and emails the opt-in weekly digest: new ground explored, coverage
+// and leaderboard changes per city, streets completed and unexplored streets near the
+// user's usual routes.
+package digest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/coverage"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+const (
+	// Period is the span each digest covers and how often it is sent
+	Period = 7 * 24 * time.Hour
+
+	// sendWindow lets a digest go out up to this much early, so the hourly worker does not
+	// push each week's digest an hour later than the last
+	sendWindow = time.Hour
+
+	maxSuggestions = 5
+)
+
+// ErrNotConfigured means no SMTP server is configured
+var ErrNotConfigured = errors.New("no SMTP server configured")
+
+// Digest is the content of one user's digest for the period ending at PeriodEnd
+type Digest struct {
+	UserID           int                  `json:"user_id"`
+	Name             string               `json:"name"`
+	PeriodStart      time.Time            `json:"period_start"`
+	PeriodEnd        time.Time            `json:"period_end"`
+	Activities       int                  `json:"activities"`
+	NewKm            float64              `json:"new_km"`
+	Cities           []CityChange         `json:"cities"`
+	CompletedStreets []storage.CityStreet `json:"completed_streets"`
+	Suggestions      []storage.CityStreet `json:"suggestions"`
+}
+
+// CityChange is a city the user was active in during the period, with how their coverage
+// and leaderboard position moved
+type CityChange struct {
+	CityID           int     `json:"city_id"`
+	CityName         string  `json:"city_name"`
+	CoveragePercent  float64 `json:"coverage_percent"`
+	PreviousCoverage float64 `json:"previous_coverage_percent"`
+	Rank             int     `json:"rank"`
+	PreviousRank     int     `json:"previous_rank"` // 0 if the user had no activities in the city before
+	Athletes         int     `json:"athletes"`
+}
+
+// Change is the coverage gained in the period, in percentage points
+func (c CityChange) Change() float64 {
+	return c.CoveragePercent - c.PreviousCoverage
+}
+
+// RankChange is how many places the user moved up, negative for down
+func (c CityChange) RankChange() int {
+	if c.PreviousRank == 0 {
+		return 0
+	}
+	return c.PreviousRank - c.Rank
+}
+
+// IsEmpty reports whether there is nothing to tell the user
+func (d *Digest) IsEmpty() bool {
+	return d.Activities == 0 && len(d.Suggestions) == 0
+}
+
+// Service builds digests from the per-user city aggregation of the multi-city coverage
+// service and sends them through the mailer
+type Service struct {
+	DB       *storage.DB
+	Config   *config.Config
+	Coverage *coverage.MultiCityCoverageService
+	Mailer   Mailer
+}
+
+// NewService creates a digest service sending through the configured SMTP server, if any
+func NewService(db *storage.DB, cfg *config.Config, coverageService *coverage.MultiCityCoverageService) *Service {
+	s := &Service{
+		DB:       db,
+		Config:   cfg,
+		Coverage: coverageService,
+	}
+	if cfg.SMTPHost != "" {
+		s.Mailer = NewSMTPMailer(cfg)
+	}
+	return s
+}
+
+// Build gathers a user's digest for the period ending at end
+func (s *Service) Build(sub *storage.DigestSubscription, end time.Time) (*Digest, error) {
+	start := end.Add(-Period)
+	d := &Digest{
+		UserID:      sub.UserID,
+		Name:        sub.Name,
+		PeriodStart: start,
+		PeriodEnd:   end,
+	}
+
+	var err error
+	d.Activities, d.NewKm, err = s.DB.GetActivityTotals(sub.UserID, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count activities: %w", err)
+	}
+
+	userID := strconv.Itoa(sub.UserID)
+	current, err := s.Coverage.UserCityCoverage(userID, &end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get coverage: %w", err)
+	}
+	previous, err := s.Coverage.UserCityCoverage(userID, &start)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get previous coverage: %w", err)
+	}
+	before := make(map[int]coverage.CityCoverageInfo, len(previous))
+	for _, info := range previous {
+		before[info.CityID] = info
+	}
+
+	for _, info := range current {
+		prev, existed := before[info.CityID]
+		if existed && prev.ActivityCount == info.ActivityCount {
+			continue // no activities in this city during the period
+		}
+		change := CityChange{
+			CityID:           info.CityID,
+			CityName:         info.CityName,
+			CoveragePercent:  info.CoveragePercent,
+			PreviousCoverage: prev.CoveragePercent,
+		}
+		if change.Rank, change.Athletes, err = s.rank(info.CityID, userID, &end); err != nil {
+			return nil, err
+		}
+		if existed {
+			if change.PreviousRank, _, err = s.rank(info.CityID, userID, &start); err != nil {
+				return nil, err
+			}
+		}
+		d.Cities = append(d.Cities, change)
+	}
+
+	if d.CompletedStreets, err = s.DB.GetStreetsCompletedBetween(sub.UserID, start, end); err != nil {
+		return nil, fmt.Errorf("failed to find completed streets: %w", err)
+	}
+	if d.Suggestions, err = s.DB.GetStreetSuggestions(sub.UserID, maxSuggestions); err != nil {
+		return nil, fmt.Errorf("failed to find street suggestions: %w", err)
+	}
+	return d, nil
+}
+
+// rank finds the user's position on a city's leaderboard and how many athletes are on it
+func (s *Service) rank(cityID int, userID string, until *time.Time) (int, int, error) {
+	leaderboard, err := s.Coverage.CityLeaderboard(cityID, 0, until)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get leaderboard of city %d: %w", cityID, err)
+	}
+	for _, entry := range leaderboard {
+		if entry.UserID == userID {
+			return entry.Rank, len(leaderboard), nil
+		}
+	}
+	return 0, len(leaderboard), nil
+}
+
+// Send builds and emails a user's digest for the period ending now. Digests with nothing
+// to tell are skipped but still count as sent, so the user is not checked again until next
+// week. It returns whether an email went out.
+func (s *Service) Send(sub *storage.DigestSubscription) (bool, error) {
+	if s.Mailer == nil {
+		return false, ErrNotConfigured
+	}
+	if sub.Email == nil || *sub.Email == "" {
+		return false, fmt.Errorf("user %d has no email address", sub.UserID)
+	}
+	if err := s.ensureUnsubscribeToken(sub); err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	d, err := s.Build(sub, now)
+	if err != nil {
+		return false, err
+	}
+
+	sent := false
+	if !d.IsEmpty() {
+		email, err := s.Render(d, sub)
+		if err != nil {
+			return false, err
+		}
+		if err := s.Mailer.Send(email.Message(*sub.Email)); err != nil {
+			return false, fmt.Errorf("failed to send digest: %w", err)
+		}
+		sent = true
+	}
+
+	if err := s.DB.MarkDigestSent(sub.UserID, now); err != nil {
+		slog.Error("Failed to record digest sent", "user_id", sub.UserID, "error", err)
+	}
+	return sent, nil
+}
+
+// ensureUnsubscribeToken gives the subscription an unsubscribe token if it has none
+func (s *Service) ensureUnsubscribeToken(sub *storage.DigestSubscription) error {
+	if sub.UnsubscribeToken != nil && *sub.UnsubscribeToken != "" {
+		return nil
+	}
+	token := NewUnsubscribeToken()
+	sub.UnsubscribeToken = &token
+	if err := s.DB.UpdateDigestSubscription(sub); err != nil {
+		return fmt.Errorf("failed to save unsubscribe token: %w", err)
+	}
+	return nil
+}
+
+// SendDue sends the digest of every opted-in user whose last one is a period old. It
+// returns how many emails went out.
+func (s *Service) SendDue() (int, error) {
+	subs, err := s.DB.GetDueDigestSubscriptions(time.Now().Add(-Period + sendWindow))
+	if err != nil {
+		return 0, fmt.Errorf("failed to list due digests: %w", err)
+	}
+
+	sent := 0
+	for i := range subs {
+		ok, err := s.Send(&subs[i])
+		if err != nil {
+			slog.Error("Failed to send digest", "user_id", subs[i].UserID, "error", err)
+			continue
+		}
+		if ok {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// RunWorker sends due digests every interval until ctx is cancelled. It does nothing
+// without an SMTP server.
+func (s *Service) RunWorker(ctx context.Context, interval time.Duration) {
+	if s.Mailer == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		sent, err := s.SendDue()
+		if err != nil {
+			slog.ErrorContext(ctx, "Digest run failed", "error", err)
+		} else if sent > 0 {
+			slog.InfoContext(ctx, "Sent weekly digests", "sent", sent)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// NewUnsubscribeToken returns a random unsubscribe token
+func NewUnsubscribeToken() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("digest: reading random bytes: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,100 @@
+package digest
+
+import (
+	"mime"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sampleDigest() *Digest {
+	end := time.Date(2025, 3, 10, 8, 0, 0, 0, time.UTC)
+	return &Digest{
+		UserID:      1,
+		Name:        "Sam",
+		PeriodStart: end.Add(-Period),
+		PeriodEnd:   end,
+		Activities:  3,
+		NewKm:       12.34,
+		Cities: []CityChange{
+			{CityID: 3, CityName: "Sheffield", CoveragePercent: 12.5, PreviousCoverage: 10.2, Rank: 2, PreviousRank: 4, Athletes: 9},
+			{CityID: 4, CityName: "Leeds", CoveragePercent: 1.5, Rank: 7, Athletes: 7},
+		},
+		CompletedStreets: []storage.CityStreet{{CityName: "Sheffield", StreetName: "Division Street", LengthKm: 0.6}},
+		Suggestions:      []storage.CityStreet{{CityName: "Sheffield", StreetName: "Ecclesall Road", LengthKm: 3.2, DistanceKm: 0.4}},
+	}
+}
+
+func TestRender(t *testing.T) {
+	s := &Service{Config: &config.Config{FrontendURL: "http://localhost:3000", PublicURL: "http://localhost:8080"}}
+	token := "abc123"
+	sub := &storage.DigestSubscription{UserID: 1, Language: "en", Units: "km", UnsubscribeToken: &token}
+
+	email, err := s.Render(sampleDigest(), sub)
+	require.NoError(t, err)
+	assert.Equal(t, "Your week of exploring: 12.3 km of new ground", email.Subject)
+	assert.Equal(t, "http://localhost:8080/api/digest/unsubscribe?token=abc123", email.UnsubscribeURL)
+
+	assert.Contains(t, email.Text, "3 activities, 12.3 km of new ground explored.")
+	assert.Contains(t, email.Text, "- Sheffield: 12.5% (+2.3%), up 2 to #2 of 9")
+	assert.Contains(t, email.Text, "- Leeds: 1.5% (+1.5%), #7 of 7")
+	assert.Contains(t, email.Text, "- Division Street, Sheffield")
+	assert.Contains(t, email.Text, "- Ecclesall Road, Sheffield: 3.2 km long, 0.4 km from your routes")
+	assert.Contains(t, email.HTML, `href="http://localhost:8080/api/digest/unsubscribe?token=abc123"`)
+	assert.Contains(t, email.HTML, "<strong>Sheffield</strong>")
+}
+
+func TestRenderLocalized(t *testing.T) {
+	s := &Service{Config: &config.Config{}}
+	d := sampleDigest()
+	d.Activities = 0
+	d.Name = ""
+
+	email, err := s.Render(d, &storage.DigestSubscription{Language: "fr", Units: "miles"})
+	require.NoError(t, err)
+	assert.Equal(t, "Ta semaine d'exploration : 7,7 mi de terrain inédit", email.Subject)
+	assert.True(t, strings.HasPrefix(email.Text, "Bonjour,\n"))
+	assert.Contains(t, email.Text, "Aucune activité cette semaine.")
+	assert.Contains(t, email.Text, "12,5 %")
+	assert.Empty(t, email.UnsubscribeURL)
+}
+
+func TestMessageBytes(t *testing.T) {
+	msg := &Message{
+		To:             "sam@example.com",
+		Subject:        "Ta semaine d'exploration",
+		Text:           "Bonjour",
+		HTML:           "<p>Bonjour</p>",
+		UnsubscribeURL: "http://localhost:8080/api/digest/unsubscribe?token=abc",
+	}
+	from := &mail.Address{Name: "Strava Coverage", Address: "digest@example.com"}
+	to := &mail.Address{Address: "sam@example.com"}
+
+	raw, err := msg.Bytes(from, to, time.Date(2025, 3, 10, 8, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	require.NoError(t, err)
+	assert.Equal(t, "<http://localhost:8080/api/digest/unsubscribe?token=abc>", parsed.Header.Get("List-Unsubscribe"))
+	assert.Equal(t, "List-Unsubscribe=One-Click", parsed.Header.Get("List-Unsubscribe-Post"))
+	assert.True(t, strings.HasPrefix(parsed.Header.Get("Content-Type"), "multipart/alternative"))
+	assert.True(t, strings.HasSuffix(parsed.Header.Get("Message-ID"), "@example.com>"))
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, "Ta semaine d'exploration", subject)
+	assert.Contains(t, string(raw), "text/plain; charset=utf-8")
+	assert.Contains(t, string(raw), "text/html; charset=utf-8")
+}
+
+func TestRankChange(t *testing.T) {
+	assert.Equal(t, 2, CityChange{Rank: 2, PreviousRank: 4}.RankChange())
+	assert.Equal(t, -1, CityChange{Rank: 5, PreviousRank: 4}.RankChange())
+	assert.Equal(t, 0, CityChange{Rank: 3}.RankChange())
+}
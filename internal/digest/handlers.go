@@ -0,0 +1,232 @@
+package digest
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/internal/i18n"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
+)
+
+// RegisterDigestRoutes adds digest settings, preview, send and unsubscribe endpoints
+func (s *Service) RegisterDigestRoutes(r *gin.Engine) {
+	digest := r.Group("/api/digest")
+	{
+		digest.GET("/user/:userId/settings", s.GetSettingsHandler)
+		digest.PUT("/user/:userId/settings", s.UpdateSettingsHandler)
+		digest.GET("/user/:userId/preview", s.PreviewHandler)
+		digest.POST("/user/:userId/send", s.SendNowHandler)
+		digest.GET("/unsubscribe", s.UnsubscribeHandler)
+		digest.POST("/unsubscribe", s.UnsubscribeHandler)
+	}
+}
+
+// UpdateSettingsRequest changes the fields that are set
+type UpdateSettingsRequest struct {
+	Email   *string `json:"email"`
+	Enabled *bool   `json:"enabled"`
+}
+
+// GetSettingsHandler returns a user's digest settings
+func (s *Service) GetSettingsHandler(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	sub, err := s.DB.GetDigestSubscription(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get digest settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"settings":       sub,
+		"smtp_available": s.Mailer != nil,
+	})
+}
+
+// UpdateSettingsHandler sets a user's digest address and opt-in
+func (s *Service) UpdateSettingsHandler(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req UpdateSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	sub, err := s.DB.GetDigestSubscription(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get digest settings"})
+		return
+	}
+
+	if req.Email != nil {
+		if *req.Email == "" {
+			sub.Email = nil
+		} else {
+			addr, err := mail.ParseAddress(*req.Email)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+				return
+			}
+			sub.Email = &addr.Address
+		}
+	}
+	if req.Enabled != nil {
+		sub.Enabled = *req.Enabled
+	}
+	if sub.Enabled && sub.Email == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "An email address is required to enable the digest"})
+		return
+	}
+	if sub.Enabled && sub.UnsubscribeToken == nil {
+		token := NewUnsubscribeToken()
+		sub.UnsubscribeToken = &token
+	}
+
+	if err := s.DB.UpdateDigestSubscription(sub); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update digest settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"settings": sub})
+}
+
+// PreviewHandler renders the digest the user would get now, as HTML, plain text
+// (format=text) or the underlying data (format=json), without sending it
+func (s *Service) PreviewHandler(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	sub, err := s.DB.GetDigestSubscription(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get digest settings"})
+		return
+	}
+
+	d, err := s.Build(sub, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build digest"})
+		return
+	}
+
+	switch c.DefaultQuery("format", "html") {
+	case "json":
+		c.JSON(http.StatusOK, gin.H{"digest": d})
+		return
+	case "html", "text":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be html, text or json"})
+		return
+	}
+
+	email, err := s.Render(d, sub)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render digest"})
+		return
+	}
+	if c.Query("format") == "text" {
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(email.Text))
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(email.HTML))
+}
+
+// SendNowHandler sends a user's digest straight away, whether or not it is due
+func (s *Service) SendNowHandler(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	sub, err := s.DB.GetDigestSubscription(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get digest settings"})
+		return
+	}
+	if sub.Email == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User has no email address"})
+		return
+	}
+
+	sent, err := s.Send(sub)
+	if errors.Is(err, ErrNotConfigured) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Email is not configured on this server"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	if !sent {
+		c.JSON(http.StatusOK, gin.H{"sent": false, "message": "Nothing to report this week; no email sent"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sent": true, "message": "Digest sent to " + *sub.Email})
+}
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.}}</title></head>
+<body style="font-family:-apple-system,Segoe UI,Helvetica,Arial,sans-serif;text-align:center;padding:48px;">
+<p>{{.}}</p>
+</body></html>`))
+
+// UnsubscribeHandler turns the digest off for the holder of the token in the link. GET
+// serves the link in the email; POST serves one-click unsubscribe from mail clients
+// (RFC 8058). Both answer the same way for unknown tokens, so tokens cannot be probed.
+func (s *Service) UnsubscribeHandler(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+		return
+	}
+
+	language, err := s.DB.UnsubscribeDigest(token)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unsubscribe"})
+		return
+	}
+
+	message := i18n.Get(language).Message("digest.unsubscribed")
+	if c.Request.Method == http.MethodPost {
+		c.JSON(http.StatusOK, gin.H{"message": message})
+		return
+	}
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	_ = unsubscribePage.Execute(c.Writer, message)
+}
@@ -0,0 +1,140 @@
+package digest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nikhilvedi/strava-coverage/config"
+)
+
+// Message is an email with plain-text and HTML alternatives
+type Message struct {
+	To             string
+	Subject        string
+	Text           string
+	HTML           string
+	UnsubscribeURL string // advertised for one-click unsubscribe when set
+}
+
+// Mailer sends emails
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// SMTPMailer sends emails through an SMTP server. It upgrades to TLS when the server
+// offers STARTTLS and authenticates when a username is configured, so it works with a
+// plain local catcher like MailHog as well as a real relay.
+type SMTPMailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+	Host     string
+}
+
+// NewSMTPMailer creates a mailer for the configured SMTP server
+func NewSMTPMailer(cfg *config.Config) *SMTPMailer {
+	return &SMTPMailer{
+		Addr:     net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort)),
+		From:     cfg.SMTPFrom,
+		Username: cfg.SMTPUsername,
+		Password: cfg.SMTPPassword,
+		Host:     cfg.SMTPHost,
+	}
+}
+
+// Send delivers a message
+func (m *SMTPMailer) Send(msg *Message) error {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP_FROM %q: %w", m.From, err)
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient %q: %w", msg.To, err)
+	}
+
+	body, err := msg.Bytes(from, to, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	return smtp.SendMail(m.Addr, auth, from.Address, []string{to.Address}, body)
+}
+
+// Bytes encodes the message as a multipart/alternative MIME email
+func (msg *Message) Bytes(from, to *mail.Address, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	headers := []struct{ name, value string }{
+		{"From", from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", date.Format(time.RFC1123Z)},
+		{"Message-ID", messageID(from)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + writer.Boundary()},
+	}
+	if msg.UnsubscribeURL != "" {
+		headers = append(headers,
+			struct{ name, value string }{"List-Unsubscribe", "<" + msg.UnsubscribeURL + ">"},
+			struct{ name, value string }{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"},
+		)
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h.name, h.value)
+	}
+	buf.WriteString("\r\n")
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		w, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// messageID returns a unique Message-ID in the sender's domain
+func messageID(from *mail.Address) string {
+	domain := "localhost"
+	if at := strings.LastIndex(from.Address, "@"); at >= 0 {
+		domain = from.Address[at+1:]
+	}
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
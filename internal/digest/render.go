@@ -0,0 +1,173 @@
+package digest
+
+import (
+	"bytes"
+	"embed"
+	htmltemplate "html/template"
+	"math"
+	"net/url"
+	"strconv"
+	texttemplate "text/template"
+
+	"github.com/nikhilvedi/strava-coverage/internal/i18n"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+//go:embed templates/*
+var templateFiles embed.FS
+
+var (
+	htmlTemplate = htmltemplate.Must(htmltemplate.ParseFS(templateFiles, "templates/digest.html"))
+	textTemplate = texttemplate.Must(texttemplate.ParseFS(templateFiles, "templates/digest.txt"))
+)
+
+// Email is a rendered digest
+type Email struct {
+	Subject        string
+	Text           string
+	HTML           string
+	UnsubscribeURL string
+}
+
+// Message addresses the email to a recipient
+func (e *Email) Message(to string) *Message {
+	return &Message{
+		To:             to,
+		Subject:        e.Subject,
+		Text:           e.Text,
+		HTML:           e.HTML,
+		UnsubscribeURL: e.UnsubscribeURL,
+	}
+}
+
+// view is the digest with every string localized, laid out by the templates
+type view struct {
+	Subject            string
+	Greeting           string
+	Intro              string
+	Summary            string
+	NoActivities       string
+	CitiesHeading      string
+	Cities             []cityLine
+	StreetsHeading     string
+	Streets            []storage.CityStreet
+	SuggestionsHeading string
+	Suggestions        []suggestionLine
+	MapURL             string
+	MapLabel           string
+	Footer             string
+	UnsubscribeURL     string
+	UnsubscribeLabel   string
+}
+
+type cityLine struct {
+	Name     string
+	Coverage string
+	Change   string
+	Rank     string
+}
+
+type suggestionLine struct {
+	Name   string
+	City   string
+	Detail string
+}
+
+// Render lays out a digest in the user's language and units
+func (s *Service) Render(d *Digest, sub *storage.DigestSubscription) (*Email, error) {
+	locale := i18n.Get(sub.Language)
+	f := formatter{locale: locale, units: sub.Units}
+
+	v := view{
+		Subject:            locale.Format("digest.subject", map[string]string{"new_distance": f.distance(d.NewKm)}),
+		Greeting:           locale.Format("digest.greeting", map[string]string{"name": d.Name}),
+		Intro:              locale.Format("digest.intro", map[string]string{"start": d.PeriodStart.Format("2006-01-02"), "end": d.PeriodEnd.Format("2006-01-02")}),
+		CitiesHeading:      locale.Message("digest.cities_heading"),
+		StreetsHeading:     locale.Message("digest.streets_heading"),
+		Streets:            d.CompletedStreets,
+		SuggestionsHeading: locale.Message("digest.suggestions_heading"),
+		MapURL:             s.Config.FrontendURL,
+		MapLabel:           locale.Message("digest.view_map"),
+		Footer:             locale.Message("digest.footer"),
+		UnsubscribeLabel:   locale.Message("digest.unsubscribe"),
+	}
+	if d.Name == "" {
+		v.Greeting = locale.Message("digest.greeting_anonymous")
+	}
+	if d.Activities > 0 {
+		v.Summary = locale.Format("digest.summary", map[string]string{
+			"activities":   strconv.Itoa(d.Activities),
+			"new_distance": f.distance(d.NewKm),
+		})
+	} else {
+		v.NoActivities = locale.Message("digest.no_activities")
+	}
+	if sub.UnsubscribeToken != nil {
+		v.UnsubscribeURL = s.Config.PublicURL + "/api/digest/unsubscribe?token=" + url.QueryEscape(*sub.UnsubscribeToken)
+	}
+
+	for _, city := range d.Cities {
+		v.Cities = append(v.Cities, cityLine{
+			Name:     city.CityName,
+			Coverage: f.percent(city.CoveragePercent),
+			Change:   "+" + f.percent(city.Change()),
+			Rank:     f.rank(city),
+		})
+	}
+	for _, street := range d.Suggestions {
+		v.Suggestions = append(v.Suggestions, suggestionLine{
+			Name: street.StreetName,
+			City: street.CityName,
+			Detail: locale.Format("digest.suggestion", map[string]string{
+				"length":   f.distance(street.LengthKm),
+				"distance": f.distance(street.DistanceKm),
+			}),
+		})
+	}
+
+	var html, text bytes.Buffer
+	if err := htmlTemplate.Execute(&html, v); err != nil {
+		return nil, err
+	}
+	if err := textTemplate.Execute(&text, v); err != nil {
+		return nil, err
+	}
+	return &Email{
+		Subject:        v.Subject,
+		Text:           text.String(),
+		HTML:           html.String(),
+		UnsubscribeURL: v.UnsubscribeURL,
+	}, nil
+}
+
+// formatter formats numbers in a locale and distance units
+type formatter struct {
+	locale *i18n.Locale
+	units  string
+}
+
+func (f formatter) distance(km float64) string {
+	return f.locale.FormatDecimal(i18n.ConvertKm(km, f.units), 1) + " " + f.locale.UnitLabel(f.units)
+}
+
+func (f formatter) percent(value float64) string {
+	return f.locale.Format("digest.percent", map[string]string{"value": f.locale.FormatDecimal(value, 1)})
+}
+
+func (f formatter) rank(city CityChange) string {
+	vars := map[string]string{
+		"rank":     strconv.Itoa(city.Rank),
+		"athletes": strconv.Itoa(city.Athletes),
+		"places":   strconv.Itoa(int(math.Abs(float64(city.RankChange())))),
+	}
+	switch {
+	case city.Rank == 0:
+		return ""
+	case city.RankChange() > 0:
+		return f.locale.Format("digest.rank_up", vars)
+	case city.RankChange() < 0:
+		return f.locale.Format("digest.rank_down", vars)
+	default:
+		return f.locale.Format("digest.rank_same", vars)
+	}
+}
@@ -0,0 +1,144 @@
+// Package i18n holds the message catalogs and number and unit formatting used for the text
+// posted to Strava. Catalogs are JSON files embedded in the binary, one per language.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLanguage is used for users without a language preference and for missing messages
+const DefaultLanguage = "en"
+
+// Distance units a user can choose
+const (
+	UnitsKm    = "km"
+	UnitsMiles = "miles"
+)
+
+// kmPerMile converts miles to km
+const kmPerMile = 1.609344
+
+//go:embed catalogs/*.json
+var catalogFiles embed.FS
+
+// Locale is a language's message catalog and number conventions
+type Locale struct {
+	Language         string            `json:"language"`
+	Name             string            `json:"name"`
+	DecimalSeparator string            `json:"decimal_separator"`
+	Messages         map[string]string `json:"messages"`
+}
+
+var locales = loadCatalogs()
+
+func loadCatalogs() map[string]*Locale {
+	files, err := catalogFiles.ReadDir("catalogs")
+	if err != nil {
+		panic(fmt.Sprintf("i18n: reading catalogs: %v", err))
+	}
+
+	loaded := make(map[string]*Locale)
+	for _, f := range files {
+		data, err := catalogFiles.ReadFile(path.Join("catalogs", f.Name()))
+		if err != nil {
+			panic(fmt.Sprintf("i18n: reading %s: %v", f.Name(), err))
+		}
+		var locale Locale
+		if err := json.Unmarshal(data, &locale); err != nil {
+			panic(fmt.Sprintf("i18n: parsing %s: %v", f.Name(), err))
+		}
+		loaded[locale.Language] = &locale
+	}
+	if loaded[DefaultLanguage] == nil {
+		panic("i18n: missing " + DefaultLanguage + " catalog")
+	}
+	return loaded
+}
+
+// Languages returns the codes of the available languages, sorted
+func Languages() []string {
+	codes := make([]string, 0, len(locales))
+	for code := range locales {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// IsSupported reports whether there is a catalog for a language
+func IsSupported(language string) bool {
+	_, ok := locales[language]
+	return ok
+}
+
+// Get returns the locale of a language, or the default language's if there is no catalog for it
+func Get(language string) *Locale {
+	if locale, ok := locales[language]; ok {
+		return locale
+	}
+	return locales[DefaultLanguage]
+}
+
+// Message returns a message in the locale's language, falling back to the default language
+func (l *Locale) Message(key string) string {
+	if msg, ok := l.Messages[key]; ok {
+		return msg
+	}
+	return locales[DefaultLanguage].Messages[key]
+}
+
+// Format returns a message with each {name} placeholder replaced by vars[name]
+func (l *Locale) Format(key string, vars map[string]string) string {
+	msg := l.Message(key)
+	for name, value := range vars {
+		msg = strings.ReplaceAll(msg, "{"+name+"}", value)
+	}
+	return msg
+}
+
+// IsAnyTranslation reports whether text is the message for key in any language. Text saved
+// from a default message is treated as the default, so it follows language changes.
+func IsAnyTranslation(key, text string) bool {
+	for _, locale := range locales {
+		if msg, ok := locale.Messages[key]; ok && msg == text {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatDecimal formats a number with the given number of decimals and the locale's decimal separator
+func (l *Locale) FormatDecimal(v float64, decimals int) string {
+	s := strconv.FormatFloat(v, 'f', decimals, 64)
+	if l.DecimalSeparator != "" && l.DecimalSeparator != "." {
+		s = strings.Replace(s, ".", l.DecimalSeparator, 1)
+	}
+	return s
+}
+
+// UnitLabel is the short label of a distance unit, e.g. km or mi
+func (l *Locale) UnitLabel(units string) string {
+	if units == UnitsMiles {
+		return l.Message("unit.miles")
+	}
+	return l.Message("unit.km")
+}
+
+// ValidUnits reports whether units is a known distance unit
+func ValidUnits(units string) bool {
+	return units == UnitsKm || units == UnitsMiles
+}
+
+// ConvertKm converts a distance in km to the given units
+func ConvertKm(km float64, units string) float64 {
+	if units == UnitsMiles {
+		return km / kmPerMile
+	}
+	return km
+}
@@ -0,0 +1,50 @@
+package i18n
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatalogsAreComplete(t *testing.T) {
+	assert.Equal(t, []string{"de", "en", "es", "fr"}, Languages())
+
+	english := Get(DefaultLanguage)
+	for _, language := range Languages() {
+		locale := Get(language)
+		assert.NotEmpty(t, locale.Name, language)
+		assert.NotEmpty(t, locale.DecimalSeparator, language)
+		for key := range english.Messages {
+			assert.NotEmpty(t, locale.Messages[key], "%s is missing %s", language, key)
+		}
+		for key := range locale.Messages {
+			assert.Contains(t, english.Messages, key, "%s has unknown message %s", language, key)
+		}
+	}
+}
+
+func TestFormatting(t *testing.T) {
+	assert.Equal(t, "10.5", Get("en").FormatDecimal(10.46, 1))
+	assert.Equal(t, "10,5", Get("fr").FormatDecimal(10.46, 1))
+	assert.Equal(t, "-0,3", Get("de").FormatDecimal(-0.26, 1))
+	assert.Equal(t, "mi", Get("es").UnitLabel(UnitsMiles))
+
+	// Unknown languages fall back to English
+	assert.Equal(t, "en", Get("pt").Language)
+	assert.False(t, IsSupported("pt"))
+
+	assert.InDelta(t, 6.2137, ConvertKm(10, UnitsMiles), 1e-4)
+	assert.Equal(t, 10.0, ConvertKm(10, UnitsKm))
+}
+
+func TestIsAnyTranslation(t *testing.T) {
+	assert.True(t, IsAnyTranslation("comment.default", Get("en").Message("comment.default")))
+	assert.True(t, IsAnyTranslation("comment.default", Get("de").Message("comment.default")))
+	assert.False(t, IsAnyTranslation("comment.default", "My own template"))
+}
+
+func TestFormat(t *testing.T) {
+	vars := map[string]string{"rank": "2", "athletes": "9", "places": "3"}
+	assert.Equal(t, "up 3 to #2 of 9", Get("en").Format("digest.rank_up", vars))
+	assert.Equal(t, "Platz 2 von 9", Get("de").Format("digest.rank_same", vars))
+}
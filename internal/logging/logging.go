@@ -0,0 +1,256 @@
+// Package logging sets up structured, leveled logging with log/slog. Lines carry the
+// attributes stored in their context, such as the request ID and the user, so a request
+// can be followed into the background jobs it starts. Tokens and secrets are redacted
+// before anything is written.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nikhilvedi/strava-coverage/config"
+)
+
+// Attribute keys for the IDs log lines are correlated by
+const (
+	KeyRequestID  = "request_id"
+	KeyUserID     = "user_id"
+	KeyActivityID = "activity_id"
+	KeyJobID      = "job_id"
+)
+
+// Options configure a logger
+type Options struct {
+	// Level is the least severe level logged
+	Level slog.Level
+	// Format is "json", or "text" for reading in a terminal
+	Format string
+	// DebugUsers are users whose lines are logged from the debug level whatever Level is
+	DebugUsers []int
+}
+
+// Setup makes a logger configured by LOG_LEVEL, LOG_FORMAT and LOG_DEBUG_USERS the default,
+// writing to stderr. Lines written with the log package go through it at the info level.
+func Setup(cfg *config.Config) *slog.Logger {
+	logger := New(os.Stderr, Options{
+		Level:      cfg.LogLevel,
+		Format:     cfg.LogFormat,
+		DebugUsers: cfg.LogDebugUsers,
+	})
+	slog.SetDefault(logger)
+	log.SetFlags(0)
+	return logger
+}
+
+// New creates a logger writing to w
+func New(w io.Writer, opts Options) *slog.Logger {
+	handlerOpts := &slog.HandlerOptions{
+		// The context handler decides what is logged
+		Level:       slog.LevelDebug,
+		ReplaceAttr: redactAttr,
+	}
+	var inner slog.Handler
+	if opts.Format == "text" {
+		inner = slog.NewTextHandler(w, handlerOpts)
+	} else {
+		inner = slog.NewJSONHandler(w, handlerOpts)
+	}
+
+	debugUsers := make(map[int64]bool, len(opts.DebugUsers))
+	for _, userID := range opts.DebugUsers {
+		debugUsers[int64(userID)] = true
+	}
+	return slog.New(&contextHandler{inner: inner, level: opts.Level, debugUsers: debugUsers})
+}
+
+type attrsKey struct{}
+
+// With returns a context whose log lines carry attributes, given as alternating keys and
+// values as for slog.Logger.With. Attributes of the parent context are kept; a key given
+// again replaces its value.
+func With(ctx context.Context, args ...any) context.Context {
+	added := slog.Group("", args...).Value.Group()
+	parent := attrsFrom(ctx)
+
+	attrs := make([]slog.Attr, 0, len(parent)+len(added))
+	for _, attr := range parent {
+		if !hasKey(added, attr.Key) {
+			attrs = append(attrs, attr)
+		}
+	}
+	attrs = append(attrs, added...)
+	return context.WithValue(ctx, attrsKey{}, attrs)
+}
+
+// Detach returns a context for background work started by a request. It carries the
+// request's log attributes but is not canceled when the request ends.
+func Detach(ctx context.Context) context.Context {
+	return context.WithoutCancel(ctx)
+}
+
+// NewJobID returns an ID for a background job of a kind, such as "import", to correlate
+// its log lines by
+func NewJobID(kind string) string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%s_%d", kind, time.Now().UnixNano())
+	}
+	return kind + "_" + hex.EncodeToString(b)
+}
+
+// RequestID returns the ID of the request a context belongs to, or ""
+func RequestID(ctx context.Context) string {
+	for _, attr := range attrsFrom(ctx) {
+		if attr.Key == KeyRequestID {
+			return attr.Value.String()
+		}
+	}
+	return ""
+}
+
+func attrsFrom(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	return attrs
+}
+
+func hasKey(attrs []slog.Attr, key string) bool {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// contextHandler adds the attributes of the context to every record, and logs below its
+// level for the debug users
+type contextHandler struct {
+	inner      slog.Handler
+	level      slog.Level
+	debugUsers map[int64]bool
+	// debug is set when attributes added with WithAttrs name a debug user
+	debug bool
+}
+
+func (h *contextHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level >= h.level || h.debug {
+		return true
+	}
+	if len(h.debugUsers) == 0 {
+		return false
+	}
+	for _, attr := range attrsFrom(ctx) {
+		if h.isDebugUser(attr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs := attrsFrom(ctx); len(attrs) > 0 {
+		record = record.Clone()
+		record.AddAttrs(attrs...)
+	}
+	return h.inner.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.inner = h.inner.WithAttrs(attrs)
+	for _, attr := range attrs {
+		if h.isDebugUser(attr) {
+			clone.debug = true
+		}
+	}
+	return &clone
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.inner = h.inner.WithGroup(name)
+	return &clone
+}
+
+func (h *contextHandler) isDebugUser(attr slog.Attr) bool {
+	if attr.Key != KeyUserID {
+		return false
+	}
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindInt64:
+		return h.debugUsers[value.Int64()]
+	case slog.KindUint64:
+		return h.debugUsers[int64(value.Uint64())]
+	}
+	return false
+}
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are parts of attribute keys whose values are never logged
+var sensitiveKeys = []string{"token", "secret", "password", "authorization", "cookie"}
+
+// sensitiveValues find tokens and secrets inside messages, errors and other strings, such
+// as a Strava response quoted in an error
+var sensitiveValues = []struct {
+	pattern *regexp.Regexp
+	replace string
+}{
+	{regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`), "${1}" + redacted},
+	{regexp.MustCompile(`(?i)((?:access_token|refresh_token|client_secret|password|secret)"?\s*[:=]\s*"?)[^"&\s,}]+`), "${1}" + redacted},
+}
+
+// redactAttr removes tokens and secrets from an attribute
+func redactAttr(_ []string, attr slog.Attr) slog.Attr {
+	if attr.Value.Kind() == slog.KindGroup {
+		return attr
+	}
+	if isSensitiveKey(attr.Key) {
+		return slog.String(attr.Key, redacted)
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		attr.Value = slog.StringValue(Redact(attr.Value.String()))
+	case slog.KindAny:
+		switch v := attr.Value.Any().(type) {
+		case error:
+			attr.Value = slog.StringValue(Redact(v.Error()))
+		case fmt.Stringer:
+			attr.Value = slog.StringValue(Redact(v.String()))
+		}
+	}
+	return attr
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact replaces bearer tokens, access and refresh tokens, client secrets and passwords
+// in s
+func Redact(s string) string {
+	for _, v := range sensitiveValues {
+		s = v.pattern.ReplaceAllString(s, v.replace)
+	}
+	return s
+}
@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lines decodes the JSON lines written to buf
+func lines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var decoded []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var fields map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &fields), line)
+		decoded = append(decoded, fields)
+	}
+	return decoded
+}
+
+func TestContextAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, Options{Level: slog.LevelInfo})
+
+	ctx := With(context.Background(), KeyRequestID, "req-1", KeyUserID, 7)
+	job := With(Detach(ctx), KeyJobID, "import_1", KeyUserID, 8)
+	logger.InfoContext(ctx, "Handled", "status", 200)
+	logger.InfoContext(job, "Imported activities", "imported", 3)
+
+	logged := lines(t, &buf)
+	require.Len(t, logged, 2)
+	assert.Equal(t, "Handled", logged[0]["msg"])
+	assert.Equal(t, "req-1", logged[0][KeyRequestID])
+	assert.Equal(t, float64(7), logged[0][KeyUserID])
+	assert.Equal(t, float64(200), logged[0]["status"])
+
+	// Jobs keep the request ID, and a key given again replaces its value
+	assert.Equal(t, "req-1", logged[1][KeyRequestID])
+	assert.Equal(t, "import_1", logged[1][KeyJobID])
+	assert.Equal(t, float64(8), logged[1][KeyUserID])
+
+	assert.Equal(t, "req-1", RequestID(job))
+	assert.Empty(t, RequestID(context.Background()))
+	assert.True(t, strings.HasPrefix(NewJobID("import"), "import_"))
+	assert.NotEqual(t, NewJobID("import"), NewJobID("import"))
+}
+
+func TestRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, Options{Level: slog.LevelInfo})
+
+	logger.Info("Refreshed token",
+		"access_token", "abc123",
+		"client_secret", "shh",
+		"error", errors.New(`strava API error: 401 - {"access_token":"abc123","expires_at":1}`),
+		"header", "Bearer abc.def-123",
+		"url", "https://example.com/cb?code=1&refresh_token=xyz&state=2",
+	)
+
+	logged := lines(t, &buf)
+	require.Len(t, logged, 1)
+	assert.Equal(t, "[REDACTED]", logged[0]["access_token"])
+	assert.Equal(t, "[REDACTED]", logged[0]["client_secret"])
+	assert.Equal(t, `strava API error: 401 - {"access_token":"[REDACTED]","expires_at":1}`, logged[0]["error"])
+	assert.Equal(t, "Bearer [REDACTED]", logged[0]["header"])
+	assert.Equal(t, "https://example.com/cb?code=1&refresh_token=[REDACTED]&state=2", logged[0]["url"])
+	assert.NotContains(t, buf.String(), "abc123")
+	assert.NotContains(t, buf.String(), "xyz")
+}
+
+func TestDebugUsers(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, Options{Level: slog.LevelWarn, DebugUsers: []int{42}})
+
+	logger.Info("Hidden")
+	logger.InfoContext(With(context.Background(), KeyUserID, 7), "Other user")
+	logger.DebugContext(With(context.Background(), KeyUserID, 42), "Debug user from context")
+	logger.With(KeyUserID, 42).Debug("Debug user from attributes")
+	logger.Warn("Warning")
+
+	var messages []any
+	for _, fields := range lines(t, &buf) {
+		messages = append(messages, fields["msg"])
+	}
+	assert.Equal(t, []any{"Debug user from context", "Debug user from attributes", "Warning"}, messages)
+}
+
+func TestTextFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, Options{Level: slog.LevelInfo, Format: "text"})
+
+	logger.InfoContext(With(context.Background(), KeyJobID, "recalc_1"), "Started", "password", "hunter2")
+	assert.Contains(t, buf.String(), "msg=Started")
+	assert.Contains(t, buf.String(), "job_id=recalc_1")
+	assert.Contains(t, buf.String(), "password=[REDACTED]")
+}
@@ -0,0 +1,176 @@
+// Package metrics exposes Prometheus metrics: HTTP requests, Strava API calls and rate
+// limits, imports, webhook events, notifications, background queues and the database
+// connection pool. Metrics are registered with the default registry and served at /metrics.
+package metrics
+
+import (
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes every metric name
+const namespace = "strava_coverage"
+
+var (
+	// HTTPRequests counts requests by method, route and status
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route and status.",
+	}, []string{"method", "route", "status"})
+
+	// HTTPDuration observes how long requests take by method and route
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// StravaRequests counts Strava API calls by endpoint and status, "error" when no
+	// response arrived
+	StravaRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "strava_requests_total",
+		Help:      "Strava API calls by endpoint and status.",
+	}, []string{"endpoint", "status"})
+
+	// StravaRateLimit is the last limit Strava reported, by limit ("overall" or "read")
+	// and window ("15m" or "daily")
+	StravaRateLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "strava_rate_limit",
+		Help:      "Last Strava rate limit seen in response headers.",
+	}, []string{"limit", "window"})
+
+	// StravaRateLimitUsage is the last usage Strava reported against StravaRateLimit
+	StravaRateLimitUsage = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "strava_rate_limit_usage",
+		Help:      "Last Strava rate limit usage seen in response headers.",
+	}, []string{"limit", "window"})
+
+	// ImportedActivities counts activities handled by imports, by source and result:
+	// imported, skipped or failed
+	ImportedActivities = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "import_activities_total",
+		Help:      "Activities handled by imports by source and result.",
+	}, []string{"source", "result"})
+
+	// Imports counts finished imports by source and status: completed or failed
+	Imports = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "imports_total",
+		Help:      "Finished imports by source and status.",
+	}, []string{"source", "status"})
+
+	// WebhookEventsReceived counts Strava push events by result: recorded, duplicate,
+	// rejected when they name another subscription or error when they could not be recorded
+	WebhookEventsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_events_received_total",
+		Help:      "Strava webhook events received by result.",
+	}, []string{"result"})
+
+	// WebhookEventsProcessed counts Strava push events processed, by the status stored
+	WebhookEventsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_events_processed_total",
+		Help:      "Strava webhook events processed by status.",
+	}, []string{"status"})
+
+	// CommentPosts counts attempts to post notifications, such as activity comments, by
+	// channel and outcome: sent, queued for a retry, failed or dry_run
+	CommentPosts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "comment_posts_total",
+		Help:      "Notification posts by channel and outcome.",
+	}, []string{"channel", "outcome"})
+
+	// RecalculationsRunning is the number of coverage recalculation jobs running
+	RecalculationsRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "recalculations_running",
+		Help:      "Coverage recalculation jobs running.",
+	})
+)
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
+
+// Middleware counts every request and observes its latency by route. Requests matching
+// no route share the route "unmatched".
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		HTTPRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		HTTPDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// RegisterDB adds the metrics read from the database when scraped: the connection pool
+// statistics and the backlog of each queue
+func RegisterDB(db *storage.DB) {
+	prometheus.MustRegister(
+		collectors.NewDBStatsCollector(db.DB.DB, "strava_coverage"),
+		&queueCollector{backlogs: db.QueueBacklogs},
+	)
+}
+
+var (
+	queueDepth = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "queue", "depth"),
+		"Work waiting or in progress by queue.",
+		[]string{"queue"}, nil,
+	)
+	queueOldestAge = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "queue", "oldest_age_seconds"),
+		"Age of the oldest work waiting or in progress by queue, 0 when empty.",
+		[]string{"queue"}, nil,
+	)
+)
+
+// queueCollector reports the depth and age of the background queues
+type queueCollector struct {
+	backlogs func() ([]storage.QueueBacklog, error)
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepth
+	ch <- queueOldestAge
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	backlogs, err := c.backlogs()
+	if err != nil {
+		slog.Error("Failed to read queue backlogs for metrics", "error", err)
+		return
+	}
+
+	now := time.Now()
+	for _, backlog := range backlogs {
+		var age float64
+		if backlog.Oldest != nil {
+			age = now.Sub(*backlog.Oldest).Seconds()
+		}
+		ch <- prometheus.MustNewConstMetric(queueDepth, prometheus.GaugeValue, float64(backlog.Depth), backlog.Queue)
+		ch <- prometheus.MustNewConstMetric(queueOldestAge, prometheus.GaugeValue, age, backlog.Queue)
+	}
+}
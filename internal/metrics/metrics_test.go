@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.Use(Middleware())
+	r.GET("/widgets/:id", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	before := testutil.ToFloat64(HTTPRequests.WithLabelValues("GET", "/widgets/:id", "204"))
+	unmatched := testutil.ToFloat64(HTTPRequests.WithLabelValues("GET", "unmatched", "404"))
+	for _, path := range []string{"/widgets/1", "/widgets/2", "/nothing"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Requests share their route's series whatever their IDs
+	assert.Equal(t, before+2, testutil.ToFloat64(HTTPRequests.WithLabelValues("GET", "/widgets/:id", "204")))
+	assert.Equal(t, unmatched+1, testutil.ToFloat64(HTTPRequests.WithLabelValues("GET", "unmatched", "404")))
+}
+
+func TestStravaClient(t *testing.T) {
+	strava := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "200,2000")
+		w.Header().Set("X-RateLimit-Usage", "12, 345")
+		if r.URL.Path == "/api/v3/activities/123/streams" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer strava.Close()
+
+	cfg := &config.Config{StravaAPIURL: strava.URL + "/api/v3", StravaOAuthURL: strava.URL + "/oauth"}
+	client := NewStravaClient(cfg)
+
+	streams := StravaRequests.WithLabelValues("/activities/:id/streams", "429")
+	token := StravaRequests.WithLabelValues("/oauth/token", "200")
+	beforeStreams, beforeToken := testutil.ToFloat64(streams), testutil.ToFloat64(token)
+
+	_, err := client.R().Get("/activities/123/streams")
+	require.NoError(t, err)
+	_, err = client.R().Post(cfg.StravaOAuth() + "/token")
+	require.NoError(t, err)
+
+	assert.Equal(t, beforeStreams+1, testutil.ToFloat64(streams))
+	assert.Equal(t, beforeToken+1, testutil.ToFloat64(token))
+	assert.Equal(t, 200.0, testutil.ToFloat64(StravaRateLimit.WithLabelValues("overall", "15m")))
+	assert.Equal(t, 2000.0, testutil.ToFloat64(StravaRateLimit.WithLabelValues("overall", "daily")))
+	assert.Equal(t, 12.0, testutil.ToFloat64(StravaRateLimitUsage.WithLabelValues("overall", "15m")))
+	assert.Equal(t, 345.0, testutil.ToFloat64(StravaRateLimitUsage.WithLabelValues("overall", "daily")))
+}
+
+func TestStravaEndpoints(t *testing.T) {
+	cfg := &config.Config{StravaAPIURL: "https://www.strava.com/api/v3"}
+	transport := newStravaTransport(cfg, http.DefaultTransport).(*stravaTransport)
+
+	for raw, want := range map[string]string{
+		"https://www.strava.com/api/v3/athlete/activities?page=2": "/athlete/activities",
+		"https://www.strava.com/api/v3/activities/987654321":      "/activities/:id",
+		"https://www.strava.com/oauth/deauthorize":                "/oauth/deauthorize",
+	} {
+		req, _ := http.NewRequest("GET", raw, nil)
+		endpoint, ok := transport.endpoint(req.URL)
+		assert.True(t, ok, raw)
+		assert.Equal(t, want, endpoint)
+	}
+
+	req, _ := http.NewRequest("GET", "https://nominatim.openstreetmap.org/reverse", nil)
+	_, ok := transport.endpoint(req.URL)
+	assert.False(t, ok)
+}
+
+func TestQueueCollector(t *testing.T) {
+	oldest := time.Now().Add(-90 * time.Second)
+	collector := &queueCollector{backlogs: func() ([]storage.QueueBacklog, error) {
+		return []storage.QueueBacklog{
+			{Queue: "comment_outbox", Depth: 3, Oldest: &oldest},
+			{Queue: "imports", Depth: 0},
+		}, nil
+	}}
+
+	expected := `
+# HELP strava_coverage_queue_depth Work waiting or in progress by queue.
+# TYPE strava_coverage_queue_depth gauge
+strava_coverage_queue_depth{queue="comment_outbox"} 3
+strava_coverage_queue_depth{queue="imports"} 0
+`
+	require.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected), "strava_coverage_queue_depth"))
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "strava_coverage_queue_oldest_age_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == "comment_outbox" {
+				assert.InDelta(t, 90, metric.GetGauge().GetValue(), 5)
+			} else {
+				assert.Zero(t, metric.GetGauge().GetValue())
+			}
+		}
+	}
+
+	// A failed query reports nothing rather than failing the scrape
+	failing := &queueCollector{backlogs: func() ([]storage.QueueBacklog, error) {
+		return nil, errors.New("connection refused")
+	}}
+	assert.Zero(t, testutil.CollectAndCount(failing))
+}
@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	resty "github.com/go-resty/resty/v2"
+	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NewStravaClient creates a client for the Strava API that counts its calls and records
+// the rate limit usage Strava reports. Calls to other hosts through it, such as
+// geocoding, are not counted.
+func NewStravaClient(cfg *config.Config) *resty.Client {
+	return resty.New().
+		SetBaseURL(cfg.StravaAPI()).
+		SetTransport(newStravaTransport(cfg, http.DefaultTransport))
+}
+
+// stravaTransport counts the calls made through it to Strava
+type stravaTransport struct {
+	next  http.RoundTripper
+	api   *url.URL
+	oauth *url.URL
+}
+
+// newStravaTransport wraps next to count calls to the Strava API and OAuth hosts by
+// endpoint and status, and to record the rate limit usage of their responses
+func newStravaTransport(cfg *config.Config, next http.RoundTripper) http.RoundTripper {
+	api, _ := url.Parse(cfg.StravaAPI())
+	oauth, _ := url.Parse(cfg.StravaOAuth())
+	return &stravaTransport{next: next, api: api, oauth: oauth}
+}
+
+func (t *stravaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+
+	endpoint, ok := t.endpoint(req.URL)
+	if !ok {
+		return resp, err
+	}
+	if err != nil {
+		StravaRequests.WithLabelValues(endpoint, "error").Inc()
+		return resp, err
+	}
+	StravaRequests.WithLabelValues(endpoint, strconv.Itoa(resp.StatusCode)).Inc()
+	recordRateLimits(resp.Header)
+	return resp, nil
+}
+
+// endpoint names a URL by its path relative to the API base, with IDs replaced by ":id"
+// so every activity shares one endpoint. OAuth paths start with "/oauth". It reports
+// false for URLs of other hosts.
+func (t *stravaTransport) endpoint(u *url.URL) (string, bool) {
+	path := u.Path
+	switch {
+	case t.api != nil && u.Host == t.api.Host && strings.HasPrefix(path, t.api.Path):
+		path = strings.TrimPrefix(path, t.api.Path)
+	case t.oauth != nil && u.Host == t.oauth.Host && strings.HasPrefix(path, t.oauth.Path):
+		path = "/oauth" + strings.TrimPrefix(path, t.oauth.Path)
+	default:
+		return "", false
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if _, err := strconv.ParseInt(segment, 10, 64); err == nil {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/"), true
+}
+
+// rateLimitHeaders are Strava's limit and usage headers, each holding the 15 minute and
+// daily values separated by a comma
+var rateLimitHeaders = []struct {
+	limit, limitHeader, usageHeader string
+}{
+	{"overall", "X-RateLimit-Limit", "X-RateLimit-Usage"},
+	{"read", "X-ReadRateLimit-Limit", "X-ReadRateLimit-Usage"},
+}
+
+// recordRateLimits sets the rate limit gauges from a response's headers
+func recordRateLimits(header http.Header) {
+	for _, h := range rateLimitHeaders {
+		setWindows(StravaRateLimit, h.limit, header.Get(h.limitHeader))
+		setWindows(StravaRateLimitUsage, h.limit, header.Get(h.usageHeader))
+	}
+}
+
+// setWindows sets a gauge's 15m and daily values from a header, leaving them alone when
+// the header is missing or malformed
+func setWindows(gauge *prometheus.GaugeVec, limit, header string) {
+	values := strings.Split(header, ",")
+	if len(values) != 2 {
+		return
+	}
+	for i, window := range []string{"15m", "daily"} {
+		value, err := strconv.ParseFloat(strings.TrimSpace(values[i]), 64)
+		if err != nil {
+			return
+		}
+		gauge.WithLabelValues(limit, window).Set(value)
+	}
+}
@@ -1,67 +1,80 @@
 package middleware
 
 import (
+	"fmt"
+	"log/slog"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/nikhilvedi/strava-coverage/internal/logging"
 	"github.com/nikhilvedi/strava-coverage/internal/utils"
 )
 
-// RequestIDMiddleware adds a unique request ID to each request
+// RequestIDMiddleware gives each request an ID, returned in X-Request-ID and carried by
+// the request's context into its log lines and the jobs it starts. A well-formed ID sent
+// by a proxy in X-Request-ID is kept.
 func RequestIDMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		requestID := uuid.New().String()
+		requestID := c.GetHeader("X-Request-ID")
+		if !validRequestID(requestID) {
+			requestID = uuid.New().String()
+		}
 		c.Set("request_id", requestID)
 		c.Header("X-Request-ID", requestID)
+		c.Request = c.Request.WithContext(logging.With(c.Request.Context(), logging.KeyRequestID, requestID))
 		c.Next()
 	}
 }
 
-// LoggingMiddleware provides structured request/response logging
-func LoggingMiddleware() gin.HandlerFunc {
-	logger := utils.NewLogger("HTTP")
+// validRequestID reports whether an incoming request ID is safe to log and echo
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
 
+// LoggingMiddleware logs every request once it completes: server errors at the error
+// level, client errors as warnings and everything else at the info level
+func LoggingMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		startTime := time.Now()
-
-		// Log request
-		logger.Info("Request started - Method: %s, Path: %s, IP: %s",
-			c.Request.Method, c.Request.URL.Path, c.ClientIP())
-
 		c.Next()
 
-		// Log response
-		duration := time.Since(startTime)
 		status := c.Writer.Status()
-
-		logLevel := "Info"
-		if status >= 400 {
-			logLevel = "Error"
-		} else if status >= 300 {
-			logLevel = "Warn"
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		} else if status >= 400 {
+			level = slog.LevelWarn
 		}
 
-		message := "Request completed - Method: %s, Path: %s, Status: %d, Duration: %v"
-		switch logLevel {
-		case "Error":
-			logger.Error(message, c.Request.Method, c.Request.URL.Path, status, duration)
-		case "Warn":
-			logger.Warn(message, c.Request.Method, c.Request.URL.Path, status, duration)
-		default:
-			logger.Info(message, c.Request.Method, c.Request.URL.Path, status, duration)
-		}
+		// Handlers and the session middleware add to the request's context, such as the
+		// signed-in user
+		slog.Log(c.Request.Context(), level, "Request completed",
+			"method", c.Request.Method,
+			"route", c.FullPath(),
+			"path", c.Request.URL.Path,
+			"status", status,
+			"duration_ms", time.Since(startTime).Milliseconds(),
+			"ip", c.ClientIP(),
+		)
 	}
 }
 
 // ErrorHandlingMiddleware provides centralized error handling
 func ErrorHandlingMiddleware() gin.HandlerFunc {
-	logger := utils.NewLogger("ErrorHandler")
-
 	return func(c *gin.Context) {
 		defer func() {
 			if err := recover(); err != nil {
-				logger.Error("Panic recovered: %v", err)
+				slog.ErrorContext(c.Request.Context(), "Panic recovered", "panic", fmt.Sprint(err))
 
 				apiErr := utils.NewAPIError(500, "Internal server error", "An unexpected error occurred")
 				utils.ErrorResponse(c, apiErr)
@@ -74,7 +87,7 @@ func ErrorHandlingMiddleware() gin.HandlerFunc {
 		// Handle any errors that were set during request processing
 		if len(c.Errors) > 0 {
 			err := c.Errors.Last()
-			logger.Error("Request error: %v", err.Error())
+			slog.ErrorContext(c.Request.Context(), "Request error", "error", err.Err)
 
 			// Convert to API error if not already
 			if apiErr, ok := err.Err.(utils.APIError); ok {
@@ -87,13 +100,27 @@ func ErrorHandlingMiddleware() gin.HandlerFunc {
 	}
 }
 
-// CORSMiddleware handles CORS headers
-func CORSMiddleware() gin.HandlerFunc {
+// CORSMiddleware handles CORS headers. Requests from the allowed origins may send the
+// session cookie; with no allowed origins any origin may call the API without it.
+func CORSMiddleware(allowedOrigins ...string) gin.HandlerFunc {
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		if origin != "" {
+			allowed[strings.TrimRight(origin, "/")] = true
+		}
+	}
+
 	return func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
+		if len(allowed) == 0 {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else if origin := c.GetHeader("Origin"); allowed[origin] {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Access-Control-Allow-Credentials", "true")
+			c.Header("Vary", "Origin")
+		}
 		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization, X-Request-ID")
-		c.Header("Access-Control-Expose-Headers", "X-Request-ID")
+		c.Header("Access-Control-Expose-Headers", "X-Request-ID, X-Total-Count, X-Next-Cursor, Link")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
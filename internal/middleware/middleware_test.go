@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/internal/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(logging.New(&buf, logging.Options{Level: slog.LevelInfo}))
+	defer slog.SetDefault(previous)
+
+	r := gin.New()
+	r.Use(RequestIDMiddleware(), LoggingMiddleware())
+	r.GET("/things/:id", func(c *gin.Context) {
+		c.String(http.StatusNotFound, logging.RequestID(c.Request.Context()))
+	})
+
+	// A well-formed ID from a proxy is kept
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/things/1", nil)
+	req.Header.Set("X-Request-ID", "proxy-id.1")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, "proxy-id.1", w.Header().Get("X-Request-ID"))
+	assert.Equal(t, "proxy-id.1", w.Body.String())
+
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &fields))
+	assert.Equal(t, "Request completed", fields["msg"])
+	assert.Equal(t, "WARN", fields["level"])
+	assert.Equal(t, "proxy-id.1", fields[logging.KeyRequestID])
+	assert.Equal(t, "/things/:id", fields["route"])
+	assert.Equal(t, float64(http.StatusNotFound), fields["status"])
+
+	// Anything else is replaced by a generated ID
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/things/1", nil)
+	req.Header.Set("X-Request-ID", "bad id\nwith a newline")
+	r.ServeHTTP(w, req)
+	assert.Len(t, w.Header().Get("X-Request-ID"), 36)
+	assert.Equal(t, w.Header().Get("X-Request-ID"), w.Body.String())
+}
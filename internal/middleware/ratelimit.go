@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/internal/session"
+)
+
+// CostStandard is the cost of routes without a cost of their own. Every client has one
+// token bucket and each request takes its route's cost from it, so a client can make many
+// cheap requests or a few expensive ones.
+const CostStandard = 1
+
+// BucketStore keeps token buckets. TakeRateLimitTokens refills the bucket named key at
+// refillPerSecond up to capacity, then takes cost from it if it holds enough. It returns
+// the tokens left and, when the bucket held too few, how long until it will hold cost.
+type BucketStore interface {
+	TakeRateLimitTokens(key string, capacity, refillPerSecond, cost float64) (remaining float64, wait time.Duration, err error)
+}
+
+// RateLimiter limits requests per signed-in user, or per client IP for anonymous requests
+type RateLimiter struct {
+	store    BucketStore
+	capacity float64
+	refill   float64
+	costs    map[string]float64
+	exempt   map[string]bool
+}
+
+// NewRateLimiter creates a limiter allowing perMinute requests of standard cost a minute
+// in bursts of up to burst. Buckets live in store, which is shared between instances when
+// it is backed by the database.
+func NewRateLimiter(store BucketStore, perMinute, burst int) *RateLimiter {
+	if burst <= 0 {
+		burst = perMinute
+	}
+	return &RateLimiter{
+		store:    store,
+		capacity: float64(burst),
+		refill:   float64(perMinute) / 60,
+		costs:    make(map[string]float64),
+		exempt:   make(map[string]bool),
+	}
+}
+
+// Cost sets the cost of routes, given as "METHOD /path" the way they were registered
+func (l *RateLimiter) Cost(cost float64, routes ...string) {
+	for _, route := range routes {
+		l.costs[route] = cost
+	}
+}
+
+// Exempt lets routes, given as "METHOD /path", through without taking any tokens
+func (l *RateLimiter) Exempt(routes ...string) {
+	for _, route := range routes {
+		l.exempt[route] = true
+	}
+}
+
+// Middleware enforces the limits. It must run after the session middleware.
+func (l *RateLimiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.Request.Method + " " + c.FullPath()
+		if l.exempt[route] {
+			c.Next()
+			return
+		}
+
+		cost, ok := l.costs[route]
+		if !ok {
+			cost = CostStandard
+		}
+		// A route costing more than a full bucket could never be called
+		cost = math.Min(cost, l.capacity)
+
+		remaining, wait, err := l.store.TakeRateLimitTokens(clientKey(c), l.capacity, l.refill, cost)
+		if err != nil {
+			// Failing open keeps the API up when the bucket store is down
+			slog.ErrorContext(c.Request.Context(), "Rate limiter failed, letting request through", "error", err)
+			c.Next()
+			return
+		}
+
+		c.Header("X-RateLimit-Limit", strconv.Itoa(int(l.capacity)))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(int(math.Floor(remaining))))
+		if wait > 0 {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error":       "Too many requests, please slow down",
+				"retry_after": retryAfter,
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// clientKey names the bucket a request draws from
+func clientKey(c *gin.Context) string {
+	if userID, ok := session.UserID(c); ok {
+		return "user:" + strconv.Itoa(userID)
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// MemoryBuckets keeps token buckets in memory, for single-instance deployments
+type MemoryBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewMemoryBuckets creates an empty in-memory bucket store
+func NewMemoryBuckets() *MemoryBuckets {
+	return &MemoryBuckets{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// TakeRateLimitTokens implements BucketStore
+func (m *MemoryBuckets) TakeRateLimitTokens(key string, capacity, refillPerSecond, cost float64) (float64, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now, capacity, refillPerSecond)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		m.buckets[key] = b
+	}
+	b.tokens = refill(b.tokens, now.Sub(b.updated), capacity, refillPerSecond)
+	b.updated = now
+
+	if b.tokens < cost {
+		return b.tokens, waitFor(cost-b.tokens, refillPerSecond), nil
+	}
+	b.tokens -= cost
+	return b.tokens, 0, nil
+}
+
+// sweep drops buckets that have refilled completely, at most once a minute
+func (m *MemoryBuckets) sweep(now time.Time, capacity, refillPerSecond float64) {
+	if now.Sub(m.swept) < time.Minute {
+		return
+	}
+	m.swept = now
+	for key, b := range m.buckets {
+		if refill(b.tokens, now.Sub(b.updated), capacity, refillPerSecond) >= capacity {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+func refill(tokens float64, elapsed time.Duration, capacity, refillPerSecond float64) float64 {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(capacity, tokens+elapsed.Seconds()*refillPerSecond)
+}
+
+// waitFor is how long refilling missing tokens takes
+func waitFor(missing, refillPerSecond float64) time.Duration {
+	if refillPerSecond <= 0 {
+		return time.Hour
+	}
+	return time.Duration(missing / refillPerSecond * float64(time.Second))
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBuckets(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	buckets := NewMemoryBuckets()
+	buckets.now = func() time.Time { return now }
+
+	// 2 tokens a second, up to 10
+	remaining, wait, err := buckets.TakeRateLimitTokens("user:1", 10, 2, 8)
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, remaining)
+	assert.Zero(t, wait)
+
+	remaining, wait, err = buckets.TakeRateLimitTokens("user:1", 10, 2, 5)
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, remaining)
+	assert.Equal(t, 1500*time.Millisecond, wait)
+
+	// Other clients have their own bucket
+	remaining, _, _ = buckets.TakeRateLimitTokens("ip:10.0.0.1", 10, 2, 1)
+	assert.Equal(t, 9.0, remaining)
+
+	now = now.Add(1500 * time.Millisecond)
+	remaining, wait, err = buckets.TakeRateLimitTokens("user:1", 10, 2, 5)
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, remaining)
+	assert.Zero(t, wait)
+
+	// Buckets never overfill
+	now = now.Add(time.Hour)
+	remaining, _, _ = buckets.TakeRateLimitTokens("user:1", 10, 2, 1)
+	assert.Equal(t, 9.0, remaining)
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	limiter := NewRateLimiter(NewMemoryBuckets(), 60, 3)
+	limiter.Cost(20, "POST /heavy")
+	limiter.Exempt("GET /health")
+
+	r := gin.New()
+	r.Use(limiter.Middleware())
+	for _, route := range []string{"/light", "/health"} {
+		r.GET(route, func(c *gin.Context) { c.Status(http.StatusOK) })
+	}
+	r.POST("/heavy", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	request := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("GET", "/light")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "3", w.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "2", w.Header().Get("X-RateLimit-Remaining"))
+
+	// A heavy route costs more than the whole bucket, so it needs the bucket full
+	w = request("POST", "/heavy")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), `"retry_after":1`)
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusOK, request("GET", "/light").Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, request("GET", "/light").Code)
+	assert.Equal(t, http.StatusOK, request("GET", "/health").Code)
+}
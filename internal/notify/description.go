@@ -0,0 +1,146 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	resty "github.com/go-resty/resty/v2"
+	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/comments"
+	"github.com/nikhilvedi/strava-coverage/internal/metrics"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+// Delimiters of the coverage block in an activity description. Everything between them
+// belongs to us; everything outside them is the athlete's own text and is left alone.
+const (
+	descriptionBlockStart = "[strava-coverage]"
+	descriptionBlockEnd   = "[/strava-coverage]"
+)
+
+// StravaDescriptionChannel writes notifications into a delimited block of the Strava
+// activity description, for users who would rather not have comments on their activities
+type StravaDescriptionChannel struct {
+	DB     *storage.DB
+	client *resty.Client
+}
+
+// NewStravaDescriptionChannel creates a channel updating descriptions through the configured Strava API
+func NewStravaDescriptionChannel(db *storage.DB, cfg *config.Config) *StravaDescriptionChannel {
+	return &StravaDescriptionChannel{
+		DB:     db,
+		client: metrics.NewStravaClient(cfg),
+	}
+}
+
+func (c *StravaDescriptionChannel) Name() string {
+	return "strava_description"
+}
+
+// Accepts Strava activities of users in description mode
+func (c *StravaDescriptionChannel) Accepts(n *Notification) bool {
+	return n.Source == storage.ActivitySourceStrava && n.OutputMode == comments.OutputModeDescription
+}
+
+// Send inserts the coverage block into the description, replacing any earlier block
+func (c *StravaDescriptionChannel) Send(n *Notification) (*Delivery, error) {
+	response, err := c.updateDescription(n.UserID, n.ActivityID, func(description string) string {
+		return SetCoverageBlock(description, n.Text)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.DB.SetDescriptionBlock(n.ActivityID, true); err != nil {
+		slog.Error("Failed to record description block", "user_id", n.UserID, "activity_id", n.ActivityID, "error", err)
+	}
+	return &Delivery{Response: response}, nil
+}
+
+// Remove takes the coverage block back out of an activity description
+func (c *StravaDescriptionChannel) Remove(userID int, activityID int64) error {
+	_, err := c.updateDescription(userID, activityID, RemoveCoverageBlock)
+	if err != nil && !errors.Is(err, errActivityGone) {
+		return err
+	}
+	return c.DB.SetDescriptionBlock(activityID, false)
+}
+
+// errActivityGone means the activity no longer exists on Strava
+var errActivityGone = errors.New("activity not found on Strava")
+
+// updateDescription reads the activity description, applies edit and writes it back if it
+// changed. It returns the body of the update response.
+func (c *StravaDescriptionChannel) updateDescription(userID int, activityID int64, edit func(string) string) (string, error) {
+	token, err := c.DB.GetStravaToken(userID)
+	if err != nil {
+		return "", fmt.Errorf("no access token for user %d: %v", userID, err)
+	}
+
+	var activity struct {
+		Description string `json:"description"`
+	}
+	resp, err := c.client.R().
+		SetAuthToken(token.AccessToken).
+		SetResult(&activity).
+		Get(fmt.Sprintf("/activities/%d", activityID))
+	if err == nil && resp.StatusCode() == http.StatusNotFound {
+		return "", errActivityGone
+	}
+	if err := stravaResponseError(resp, err); err != nil {
+		return "", err
+	}
+
+	updated := edit(activity.Description)
+	if updated == activity.Description {
+		return "", nil
+	}
+
+	resp, err = c.client.R().
+		SetAuthToken(token.AccessToken).
+		SetBody(map[string]string{"description": updated}).
+		Put(fmt.Sprintf("/activities/%d", activityID))
+	if err := stravaResponseError(resp, err); err != nil {
+		return "", err
+	}
+	return string(resp.Body()), nil
+}
+
+// SetCoverageBlock returns description with its coverage block replaced by one holding text.
+// The block goes at the end, separated from the athlete's text by a blank line.
+func SetCoverageBlock(description, text string) string {
+	own := strings.TrimRight(RemoveCoverageBlock(description), " \t\r\n")
+	block := descriptionBlockStart + "\n" + strings.TrimSpace(text) + "\n" + descriptionBlockEnd
+	if own == "" {
+		return block
+	}
+	return own + "\n\n" + block
+}
+
+// RemoveCoverageBlock returns description without any coverage blocks. A start delimiter
+// without an end is treated as a block running to the end of the description.
+func RemoveCoverageBlock(description string) string {
+	for {
+		start := strings.Index(description, descriptionBlockStart)
+		if start < 0 {
+			return description
+		}
+
+		before := strings.TrimRight(description[:start], " \t\r\n")
+		after := ""
+		if end := strings.Index(description[start:], descriptionBlockEnd); end >= 0 {
+			after = strings.TrimLeft(description[start+end+len(descriptionBlockEnd):], " \t\r\n")
+		}
+
+		switch {
+		case before == "":
+			description = after
+		case after == "":
+			description = before
+		default:
+			description = before + "\n\n" + after
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package notify
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetCoverageBlock(t *testing.T) {
+	block := "[strava-coverage]\nLondon: 12.5%\n[/strava-coverage]"
+
+	tests := []struct {
+		name        string
+		description string
+		expected    string
+	}{
+		{"Empty description", "", block},
+		{"Keeps own text", "Easy run  \n", "Easy run\n\n" + block},
+		{"Replaces old block", "Easy run\n\n[strava-coverage]\nLondon: 10%\n[/strava-coverage]", "Easy run\n\n" + block},
+		{"Keeps text after block", "[strava-coverage]\nold\n[/strava-coverage]\nPS: new shoes", "PS: new shoes\n\n" + block},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated := SetCoverageBlock(tt.description, "London: 12.5%\n")
+			assert.Equal(t, tt.expected, updated)
+			assert.Equal(t, updated, SetCoverageBlock(updated, "London: 12.5%"), "not idempotent")
+		})
+	}
+}
+
+func TestRemoveCoverageBlock(t *testing.T) {
+	assert.Equal(t, "Easy run", RemoveCoverageBlock("Easy run\n\n[strava-coverage]\nLondon: 12.5%\n[/strava-coverage]"))
+	assert.Equal(t, "Easy run\n\nPS", RemoveCoverageBlock("Easy run\n[strava-coverage]x[/strava-coverage]\nPS"))
+	assert.Equal(t, "Easy run", RemoveCoverageBlock("Easy run\n[strava-coverage]\nunterminated"))
+	assert.Equal(t, "", RemoveCoverageBlock("[strava-coverage]x[/strava-coverage]"))
+	assert.Equal(t, "No block here ", RemoveCoverageBlock("No block here "))
+}
@@ -0,0 +1,543 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/comments"
+	"github.com/nikhilvedi/strava-coverage/internal/logging"
+	"github.com/nikhilvedi/strava-coverage/internal/metrics"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+// Notification is a rendered message about an activity, ready to be delivered
+type Notification struct {
+	UserID       int
+	ActivityID   int64
+	Source       string // activities.source
+	ActivityType string
+	OutputMode   string // comments.OutputModeComment or comments.OutputModeDescription
+	Text         string
+	Triggers     []string // comment triggers that produced the text; empty for manual notifications
+}
+
+// Channel delivers notifications somewhere: a Strava comment, a webhook, an email...
+type Channel interface {
+	// Name identifies the channel in results, logs and the outbox
+	Name() string
+	// Accepts reports whether the channel can deliver a notification, e.g. Strava
+	// comments can only be posted on Strava activities
+	Accepts(n *Notification) bool
+	// Send delivers the notification. Failures worth retrying are reported as a
+	// *SendError whose Transient method returns true.
+	Send(n *Notification) (*Delivery, error)
+}
+
+// Delivery is what a channel reports about a delivered notification
+type Delivery struct {
+	ExternalID string // ID of what was created remotely, e.g. the Strava comment ID
+	Response   string // response body, kept in the outbox for auditing
+}
+
+// SendError is a delivery rejected by, or not answered by, a remote service
+type SendError struct {
+	StatusCode int           // HTTP status, 0 when no response was received
+	Response   string        // response body
+	RetryAfter time.Duration // earliest sensible retry, when the service says so
+	Err        error
+}
+
+func (e *SendError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("request failed: %v", e.Err)
+	}
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Response)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Transient reports whether the same delivery may succeed later: the request did not get
+// through, was rate limited or hit a server error
+func (e *SendError) Transient() bool {
+	return e.StatusCode == 0 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// Notification outcomes, overall and per channel
+const (
+	StatusSent    = "sent"
+	StatusQueued  = "queued" // a transient failure; the outbox retries it
+	StatusDryRun  = "dry_run"
+	StatusSkipped = "skipped"
+	StatusFailed  = "failed"
+)
+
+// Delivery retries: attempt n waits retryBaseDelay * 4^(n-1), at most retryMaxDelay, and
+// MaxDeliveryAttempts attempts are made in total
+const (
+	MaxDeliveryAttempts = 5
+	retryBaseDelay      = time.Minute
+	retryMaxDelay       = 6 * time.Hour
+	retryBatchSize      = 50
+	// maxStoredResponse caps the response bodies kept in the outbox
+	maxStoredResponse = 2000
+	// staleSendingAfter is when an entry left sending, e.g. by a restart mid-delivery, is retried
+	staleSendingAfter = 10 * time.Minute
+)
+
+// Reasons a notification was skipped
+const (
+	ReasonAlreadySent   = "already_sent"
+	ReasonNoCoverage    = "no_coverage"
+	ReasonDisabled      = "comments_disabled"
+	ReasonSportDisabled = "sport_disabled"
+	ReasonNotTriggered  = "no_trigger_fired"
+	ReasonNoChannel     = "no_channel"
+	// ReasonMissingScope means the user did not let us write to their activities
+	ReasonMissingScope = "missing_scope"
+	// ReasonFeatureOff means an admin switched comments off for the user
+	ReasonFeatureOff = "feature_disabled"
+)
+
+// ErrMissingWriteScope is returned for changes to Strava activities of users who did not
+// grant activity:write
+var ErrMissingWriteScope = errors.New("activity:write scope not granted")
+
+// Result is the outcome of notifying about an activity
+type Result struct {
+	ActivityID int64             `json:"activity_id"`
+	Status     string            `json:"status"`
+	Reason     string            `json:"reason,omitempty"`
+	Text       string            `json:"text,omitempty"`
+	Triggers   []string          `json:"triggers,omitempty"`
+	Channels   map[string]string `json:"channels,omitempty"` // channel name to its outcome
+}
+
+// Options controls how an activity is notified about
+type Options struct {
+	// Manual notifications were asked for explicitly. They skip the user's enabled switch,
+	// sport toggles and triggers, and render the comment settings template.
+	Manual bool
+}
+
+// Notifier is the single pipeline all activity notifications go through. It applies the
+// user's comment settings, renders the message, records it in the outbox for every channel
+// and then delivers it. Deliveries that fail transiently are retried by RunRetryWorker.
+type Notifier struct {
+	DB       *storage.DB
+	Config   *config.Config
+	comments *comments.AutoCommentService
+	channels []Channel
+}
+
+// NewNotifier creates a notifier delivering to Strava, as a comment or in the activity
+// description depending on the user's output mode
+func NewNotifier(db *storage.DB, cfg *config.Config) *Notifier {
+	return &Notifier{
+		DB:       db,
+		Config:   cfg,
+		comments: comments.NewAutoCommentService(db, cfg),
+		channels: []Channel{
+			NewStravaCommentChannel(db, cfg),
+			NewStravaDescriptionChannel(db, cfg),
+		},
+	}
+}
+
+// AddChannel adds an output channel
+func (n *Notifier) AddChannel(ch Channel) {
+	n.channels = append(n.channels, ch)
+}
+
+// NotifyActivity renders and sends the notification for an activity. Activities are
+// notified about at most once. A returned error means the activity could not be evaluated;
+// delivery failures are reported in the result.
+func (n *Notifier) NotifyActivity(ctx context.Context, activityID int64, opts Options) (*Result, error) {
+	result := &Result{ActivityID: activityID, Status: StatusSkipped}
+	ctx = logging.With(ctx, logging.KeyActivityID, activityID)
+
+	state, err := n.DB.GetActivityNotifyState(activityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load activity %d: %w", activityID, err)
+	}
+	if state.CommentedAt != nil {
+		result.Reason = ReasonAlreadySent
+		return result, nil
+	}
+	enabled, err := n.DB.UserFeatureEnabled(state.UserID, storage.FeatureComments)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check features: %w", err)
+	}
+	if !enabled {
+		result.Reason = ReasonFeatureOff
+		return result, nil
+	}
+
+	settings, err := n.comments.GetUserCommentSettings(state.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get comment settings: %w", err)
+	}
+
+	notification := &Notification{
+		UserID:       state.UserID,
+		ActivityID:   activityID,
+		Source:       state.Source,
+		ActivityType: state.ActivityType,
+		OutputMode:   settings.OutputMode,
+	}
+
+	var triggered *comments.TriggeredComment
+	if opts.Manual {
+		if state.Coverage == nil {
+			result.Reason = ReasonNoCoverage
+			return result, nil
+		}
+		notification.Text, err = comments.RenderActivityComment(n.DB, settings.CommentTemplate, activityID)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if !settings.Enabled {
+			result.Reason = ReasonDisabled
+			return result, nil
+		}
+		if !settings.SportEnabled(state.ActivityType) {
+			result.Reason = ReasonSportDisabled
+			return result, nil
+		}
+
+		triggered, err = n.comments.EvaluateTriggers(activityID)
+		if err != nil {
+			return nil, err
+		}
+		notification.Text = triggered.Text
+		notification.Triggers = triggered.Triggers
+	}
+
+	if notification.Text == "" {
+		result.Reason = ReasonNotTriggered
+		return result, nil
+	}
+	result.Text = notification.Text
+	result.Triggers = notification.Triggers
+
+	dryRun := settings.DryRun || (n.Config != nil && n.Config.CommentDryRun)
+	if !dryRun {
+		canWrite, err := n.canWrite(state.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if !canWrite {
+			result.Reason = ReasonMissingScope
+			return result, nil
+		}
+	}
+
+	entries, err := n.enqueue(notification, dryRun)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record notification: %w", err)
+	}
+	if len(entries) == 0 {
+		result.Reason = ReasonNoChannel
+		return result, nil
+	}
+
+	result.Channels = make(map[string]string)
+	for i := range entries {
+		if dryRun {
+			slog.InfoContext(ctx, "Dry run: notification not sent", "channel", entries[i].Channel, "text", notification.Text)
+			result.Channels[entries[i].Channel] = StatusDryRun
+			metrics.CommentPosts.WithLabelValues(entries[i].Channel, StatusDryRun).Inc()
+			continue
+		}
+		result.Channels[entries[i].Channel] = n.attempt(ctx, &entries[i], notification)
+	}
+	result.Status = summarize(result.Channels)
+
+	// Queued notifications will be retried from the outbox, so the activity is done either way
+	if result.Status != StatusSent && result.Status != StatusQueued {
+		return result, nil
+	}
+	if triggered != nil {
+		if err := n.comments.RecordAnnouncements(triggered); err != nil {
+			slog.ErrorContext(ctx, "Failed to record milestones announced", "error", err)
+		}
+	}
+	if err := n.DB.MarkActivityCommented(activityID); err != nil {
+		slog.ErrorContext(ctx, "Failed to mark activity as notified", "error", err)
+	}
+	return result, nil
+}
+
+// canWrite reports whether a user granted the scope needed to comment on and edit their
+// activities
+func (n *Notifier) canWrite(userID int) (bool, error) {
+	scopes, err := n.DB.GetUserScopes(userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get Strava scopes: %w", err)
+	}
+	return scopes.Has(storage.ScopeActivityWrite), nil
+}
+
+// enqueue records the notification in the outbox once for every channel accepting it
+func (n *Notifier) enqueue(notification *Notification, dryRun bool) ([]storage.OutboxEntry, error) {
+	status := storage.OutboxStatusPending
+	if dryRun {
+		status = storage.OutboxStatusDryRun
+	}
+
+	var entries []storage.OutboxEntry
+	for _, ch := range n.channels {
+		if !ch.Accepts(notification) {
+			continue
+		}
+		entry := storage.OutboxEntry{
+			UserID:     notification.UserID,
+			ActivityID: notification.ActivityID,
+			Channel:    ch.Name(),
+			Text:       notification.Text,
+			Triggers:   notification.Triggers,
+			Status:     status,
+		}
+		if err := n.DB.CreateOutboxEntry(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// attempt makes one delivery attempt for an outbox entry and records its outcome. It returns
+// the channel outcome for results: sent, queued or failed.
+func (n *Notifier) attempt(ctx context.Context, entry *storage.OutboxEntry, notification *Notification) string {
+	ctx = logging.With(ctx, logging.KeyUserID, entry.UserID, logging.KeyActivityID, entry.ActivityID, "outbox_entry_id", entry.ID)
+	claimed, err := n.DB.ClaimOutboxEntry(entry.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to claim outbox entry", "error", err)
+		return StatusQueued
+	}
+	if !claimed {
+		return StatusQueued // another worker is delivering it
+	}
+	entry.Attempts++
+
+	var delivery *Delivery
+	ch := n.channel(entry.Channel)
+	if ch == nil {
+		err = fmt.Errorf("unknown channel %q", entry.Channel)
+	} else {
+		delivery, err = ch.Send(notification)
+	}
+
+	status, nextAttempt := deliveryOutcome(err, entry.Attempts, time.Now())
+	var response, externalID, lastError *string
+	if delivery != nil {
+		response = truncated(delivery.Response)
+		if delivery.ExternalID != "" {
+			externalID = &delivery.ExternalID
+		}
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to send notification",
+			"channel", entry.Channel, "attempt", entry.Attempts, "status", status, "error", err)
+		msg := err.Error()
+		lastError = &msg
+		var sendErr *SendError
+		if errors.As(err, &sendErr) && sendErr.Response != "" {
+			response = truncated(sendErr.Response)
+		}
+	}
+
+	if err := n.DB.FinishOutboxEntry(entry.ID, status, response, externalID, lastError, nextAttempt); err != nil {
+		slog.ErrorContext(ctx, "Failed to record outcome of outbox entry", "error", err)
+	}
+
+	outcome := StatusFailed
+	switch status {
+	case storage.OutboxStatusSent:
+		outcome = StatusSent
+	case storage.OutboxStatusPending:
+		outcome = StatusQueued
+	}
+	metrics.CommentPosts.WithLabelValues(entry.Channel, outcome).Inc()
+	return outcome
+}
+
+// channel finds a channel by name
+func (n *Notifier) channel(name string) Channel {
+	for _, ch := range n.channels {
+		if ch.Name() == name {
+			return ch
+		}
+	}
+	return nil
+}
+
+// deliveryOutcome decides the outbox status after an attempt: sent, pending with the time
+// of the next attempt for transient failures, or failed once retrying is pointless
+func deliveryOutcome(err error, attempts int, now time.Time) (string, *time.Time) {
+	if err == nil {
+		return storage.OutboxStatusSent, nil
+	}
+
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || !sendErr.Transient() || attempts >= MaxDeliveryAttempts {
+		return storage.OutboxStatusFailed, nil
+	}
+
+	delay := retryBaseDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 4
+	}
+	if sendErr.RetryAfter > delay {
+		delay = sendErr.RetryAfter
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	next := now.Add(delay)
+	return storage.OutboxStatusPending, &next
+}
+
+// summarize combines per-channel outcomes: sent if any channel delivered, otherwise queued
+// if any will be retried, otherwise dry run or failed
+func summarize(channels map[string]string) string {
+	status := StatusFailed
+	for _, outcome := range channels {
+		switch {
+		case outcome == StatusSent:
+			return StatusSent
+		case outcome == StatusQueued:
+			status = StatusQueued
+		case outcome == StatusDryRun && status != StatusQueued:
+			status = StatusDryRun
+		}
+	}
+	return status
+}
+
+func truncated(s string) *string {
+	if len(s) > maxStoredResponse {
+		s = s[:maxStoredResponse]
+	}
+	return &s
+}
+
+// RetryDue makes the next attempt for every outbox entry whose retry is due. It returns how
+// many were sent.
+func (n *Notifier) RetryDue(ctx context.Context) (int, error) {
+	entries, err := n.DB.GetDueOutboxEntries(retryBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list due outbox entries: %w", err)
+	}
+
+	sent := 0
+	for i := range entries {
+		entry := &entries[i]
+		notification := &Notification{
+			UserID:     entry.UserID,
+			ActivityID: entry.ActivityID,
+			Text:       entry.Text,
+			Triggers:   entry.Triggers,
+		}
+		if n.attempt(ctx, entry, notification) == StatusSent {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// RunRetryWorker retries due outbox entries every interval until ctx is cancelled
+func (n *Notifier) RunRetryWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := n.DB.ReleaseStaleOutboxEntries(staleSendingAfter); err != nil {
+			slog.ErrorContext(ctx, "Failed to release stale outbox entries", "error", err)
+		}
+		sent, err := n.RetryDue(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Outbox retry failed", "error", err)
+		} else if sent > 0 {
+			slog.InfoContext(ctx, "Sent queued notifications", "sent", sent)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// NotifyPending notifies about each of a user's activities with coverage that has not been
+// notified about yet, oldest first. It returns how many notifications were sent.
+func (n *Notifier) NotifyPending(ctx context.Context, userID int) (int, error) {
+	ctx = logging.With(ctx, logging.KeyUserID, userID)
+	activities, err := n.DB.GetUncommentedActivities(userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list activities: %w", err)
+	}
+
+	sent := 0
+	var errs []error
+	for _, activity := range activities {
+		result, err := n.NotifyActivity(ctx, activity.StravaActivityID, Options{})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if result.Status == StatusSent {
+			sent++
+			// Rate limiting: wait between comments
+			time.Sleep(2 * time.Second)
+		}
+	}
+
+	slog.InfoContext(ctx, "Sent pending notifications", "sent", sent)
+	return sent, errors.Join(errs...)
+}
+
+// RemoveDescriptionBlocks removes the coverage block from every activity description it was
+// written to, e.g. when the user switches back to comments. It returns how many were removed.
+func (n *Notifier) RemoveDescriptionBlocks(userID int) (int, error) {
+	var description *StravaDescriptionChannel
+	for _, ch := range n.channels {
+		if d, ok := ch.(*StravaDescriptionChannel); ok {
+			description = d
+		}
+	}
+	if description == nil {
+		return 0, nil
+	}
+	canWrite, err := n.canWrite(userID)
+	if err != nil {
+		return 0, err
+	}
+	if !canWrite {
+		return 0, ErrMissingWriteScope
+	}
+
+	activityIDs, err := n.DB.GetDescriptionBlockActivities(userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list activities: %w", err)
+	}
+
+	removed := 0
+	var errs []error
+	for _, activityID := range activityIDs {
+		if err := description.Remove(userID, activityID); err != nil {
+			errs = append(errs, fmt.Errorf("activity %d: %w", activityID, err))
+			continue
+		}
+		removed++
+	}
+	return removed, errors.Join(errs...)
+}
@@ -0,0 +1,57 @@
+package notify
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryOutcome(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	rateLimited := &SendError{StatusCode: http.StatusTooManyRequests, RetryAfter: 10 * time.Minute}
+
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+		status   string
+		delay    time.Duration
+	}{
+		{"Sent", nil, 1, storage.OutboxStatusSent, 0},
+		{"Not a send error", errors.New("no access token"), 1, storage.OutboxStatusFailed, 0},
+		{"Rejected", &SendError{StatusCode: http.StatusBadRequest}, 1, storage.OutboxStatusFailed, 0},
+		{"Network error", &SendError{Err: errors.New("connection refused")}, 1, storage.OutboxStatusPending, time.Minute},
+		{"Server error backs off", &SendError{StatusCode: http.StatusBadGateway}, 3, storage.OutboxStatusPending, 16 * time.Minute},
+		{"Rate limit waits for the window", rateLimited, 1, storage.OutboxStatusPending, 10 * time.Minute},
+		{"Backoff beyond the window", rateLimited, 3, storage.OutboxStatusPending, 16 * time.Minute},
+		{"Gives up", rateLimited, MaxDeliveryAttempts, storage.OutboxStatusFailed, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, next := deliveryOutcome(tt.err, tt.attempts, now)
+			assert.Equal(t, tt.status, status)
+			if tt.delay == 0 {
+				assert.Nil(t, next)
+			} else if assert.NotNil(t, next) {
+				assert.Equal(t, tt.delay, next.Sub(now))
+			}
+		})
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	assert.Equal(t, StatusSent, summarize(map[string]string{"a": StatusFailed, "b": StatusSent}))
+	assert.Equal(t, StatusQueued, summarize(map[string]string{"a": StatusFailed, "b": StatusQueued}))
+	assert.Equal(t, StatusDryRun, summarize(map[string]string{"a": StatusDryRun}))
+	assert.Equal(t, StatusFailed, summarize(map[string]string{"a": StatusFailed}))
+}
+
+func TestStravaRateLimitReset(t *testing.T) {
+	assert.Equal(t, 3*time.Minute, stravaRateLimitReset(time.Date(2025, 3, 1, 12, 42, 0, 0, time.UTC)))
+	assert.Equal(t, 15*time.Minute, stravaRateLimitReset(time.Date(2025, 3, 1, 12, 45, 0, 0, time.UTC)))
+}
@@ -0,0 +1,91 @@
+package notify
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/comments"
+	"github.com/nikhilvedi/strava-coverage/internal/metrics"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+// StravaCommentChannel posts notifications as comments on the Strava activity
+type StravaCommentChannel struct {
+	DB     *storage.DB
+	client *resty.Client
+}
+
+// NewStravaCommentChannel creates a channel posting through the configured Strava API
+func NewStravaCommentChannel(db *storage.DB, cfg *config.Config) *StravaCommentChannel {
+	return &StravaCommentChannel{
+		DB:     db,
+		client: metrics.NewStravaClient(cfg),
+	}
+}
+
+func (c *StravaCommentChannel) Name() string {
+	return "strava_comment"
+}
+
+// Accepts Strava activities of users in comment mode; imported files have no Strava
+// activity to comment on
+func (c *StravaCommentChannel) Accepts(n *Notification) bool {
+	return n.Source == storage.ActivitySourceStrava && n.OutputMode != comments.OutputModeDescription
+}
+
+// Send posts the comment as the activity's owner
+func (c *StravaCommentChannel) Send(n *Notification) (*Delivery, error) {
+	token, err := c.DB.GetStravaToken(n.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("no access token for user %d: %v", n.UserID, err)
+	}
+
+	var comment struct {
+		ID int64 `json:"id"`
+	}
+	resp, err := c.client.R().
+		SetAuthToken(token.AccessToken).
+		SetFormData(map[string]string{
+			"text": n.Text,
+		}).
+		SetResult(&comment).
+		Post(fmt.Sprintf("/activities/%d/comments", n.ActivityID))
+	if err := stravaResponseError(resp, err); err != nil {
+		return nil, err
+	}
+
+	delivery := &Delivery{Response: string(resp.Body())}
+	if comment.ID != 0 {
+		delivery.ExternalID = strconv.FormatInt(comment.ID, 10)
+	}
+	return delivery, nil
+}
+
+// stravaResponseError turns a failed Strava request into a *SendError, or returns nil
+func stravaResponseError(resp *resty.Response, err error) error {
+	if err != nil {
+		return &SendError{Err: err}
+	}
+	if resp.IsSuccess() {
+		return nil
+	}
+
+	sendErr := &SendError{StatusCode: resp.StatusCode(), Response: string(resp.Body())}
+	if resp.StatusCode() == http.StatusTooManyRequests {
+		sendErr.RetryAfter = stravaRateLimitReset(time.Now())
+		if seconds, err := strconv.Atoi(resp.Header().Get("Retry-After")); err == nil {
+			sendErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+	}
+	return sendErr
+}
+
+// stravaRateLimitReset is the time until Strava's short-term rate limit resets. Its
+// 15-minute windows start on the hour and at 15, 30 and 45 minutes past.
+func stravaRateLimitReset(now time.Time) time.Duration {
+	return now.Truncate(15 * time.Minute).Add(15 * time.Minute).Sub(now)
+}
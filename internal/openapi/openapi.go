@@ -0,0 +1,320 @@
+// Package openapi describes the API as an OpenAPI 3 document, built alongside the route
+// registrations from the Go types handlers bind and return, and validates requests
+// against it.
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Version is the OpenAPI version documents are written in
+const Version = "3.0.3"
+
+// Document is an OpenAPI document
+type Document struct {
+	OpenAPI    string                `json:"openapi"`
+	Info       Info                  `json:"info"`
+	Servers    []Server              `json:"servers,omitempty"`
+	Tags       []Tag                 `json:"tags,omitempty"`
+	Paths      map[string]*PathItem  `json:"paths"`
+	Components Components            `json:"components"`
+	Security   []map[string][]string `json:"security,omitempty"`
+}
+
+// Info describes the API
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// Server is a base URL the API is served from
+type Server struct {
+	URL string `json:"url"`
+}
+
+// Tag groups operations
+type Tag struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// PathItem holds the operations on one path, by lower-case method
+type PathItem map[string]*Operation
+
+// Operation is one route
+type Operation struct {
+	OperationID string                 `json:"operationId"`
+	Summary     string                 `json:"summary,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Tags        []string               `json:"tags,omitempty"`
+	Parameters  []*Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody           `json:"requestBody,omitempty"`
+	Responses   map[string]*Response   `json:"responses"`
+	Security    *[]map[string][]string `json:"security,omitempty"`
+}
+
+// Parameter is a path or query parameter
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// RequestBody is the body an operation accepts
+type RequestBody struct {
+	Required bool                  `json:"required,omitempty"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+// Response is one response of an operation
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+// MediaType is the schema of a body in one content type
+type MediaType struct {
+	Schema *Schema `json:"schema,omitempty"`
+}
+
+// Components holds the named schemas operations refer to
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+// SecurityScheme is a way of signing requests
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	In           string `json:"in,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+// Spec builds a document route by route and serves and enforces it
+type Spec struct {
+	doc        *Document
+	schemas    *Generator
+	pathParams map[string]*Schema
+	operations map[string]*Operation
+
+	once sync.Once
+	json []byte
+}
+
+// New creates an empty spec
+func New(info Info) *Spec {
+	doc := &Document{
+		OpenAPI: Version,
+		Info:    info,
+		Paths:   make(map[string]*PathItem),
+		Components: Components{
+			Schemas:         make(map[string]*Schema),
+			SecuritySchemes: make(map[string]*SecurityScheme),
+		},
+	}
+	return &Spec{
+		doc:        doc,
+		schemas:    NewGenerator(doc.Components.Schemas),
+		pathParams: make(map[string]*Schema),
+		operations: make(map[string]*Operation),
+	}
+}
+
+// Document returns the document built so far
+func (s *Spec) Document() *Document {
+	return s.doc
+}
+
+// Schemas returns the generator that turns Go types into the spec's schemas
+func (s *Spec) Schemas() *Generator {
+	return s.schemas
+}
+
+// Tag describes a tag operations are grouped by
+func (s *Spec) Tag(name, description string) {
+	s.doc.Tags = append(s.doc.Tags, Tag{Name: name, Description: description})
+}
+
+// Security adds a way of signing requests, which every operation accepts unless it is
+// public
+func (s *Spec) Security(name string, scheme *SecurityScheme) {
+	s.doc.Components.SecuritySchemes[name] = scheme
+	s.doc.Security = append(s.doc.Security, map[string][]string{name: {}})
+}
+
+// PathParam sets the schema of a path parameter wherever it appears. Path parameters
+// without one are strings.
+func (s *Spec) PathParam(name string, schema *Schema) {
+	s.pathParams[name] = schema
+}
+
+// Route adds an operation for a route given the way it is registered with gin, such as
+// "GET /api/users/:id". Its path parameters are added from the path.
+func (s *Spec) Route(route, operationID, summary string) *OperationBuilder {
+	method, path, _ := strings.Cut(route, " ")
+	op := &Operation{
+		OperationID: operationID,
+		Summary:     summary,
+		Responses:   make(map[string]*Response),
+	}
+
+	for _, segment := range strings.Split(path, "/") {
+		if !strings.HasPrefix(segment, ":") {
+			continue
+		}
+		name := segment[1:]
+		schema := s.pathParams[name]
+		if schema == nil {
+			schema = String()
+		}
+		op.Parameters = append(op.Parameters, &Parameter{Name: name, In: "path", Required: true, Schema: schema})
+	}
+
+	oasPath := ginPathToOpenAPI(path)
+	item := s.doc.Paths[oasPath]
+	if item == nil {
+		item = &PathItem{}
+		s.doc.Paths[oasPath] = item
+	}
+	(*item)[strings.ToLower(method)] = op
+	s.operations[method+" "+path] = op
+
+	return &OperationBuilder{spec: s, op: op}
+}
+
+// Operation returns the operation of a route given as "METHOD /path", or nil
+func (s *Spec) Operation(route string) *Operation {
+	return s.operations[route]
+}
+
+// Routes lists the routes the spec describes, as "METHOD /path"
+func (s *Spec) Routes() []string {
+	routes := make([]string, 0, len(s.operations))
+	for route := range s.operations {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+// Public marks routes, given as "METHOD /path", as callable without signing in
+func (s *Spec) Public(routes ...string) {
+	for _, route := range routes {
+		if op := s.operations[route]; op != nil {
+			none := []map[string][]string{}
+			op.Security = &none
+		}
+	}
+}
+
+// Handler serves the document as JSON
+func (s *Spec) Handler(c *gin.Context) {
+	s.once.Do(func() {
+		s.json, _ = json.Marshal(s.doc)
+	})
+	c.Data(http.StatusOK, "application/json; charset=utf-8", s.json)
+}
+
+var ginParam = regexp.MustCompile(`[:*]([A-Za-z0-9_]+)`)
+
+// ginPathToOpenAPI turns /api/users/:id into /api/users/{id}
+func ginPathToOpenAPI(path string) string {
+	return ginParam.ReplaceAllString(path, "{$1}")
+}
+
+// OperationBuilder fills in an operation
+type OperationBuilder struct {
+	spec *Spec
+	op   *Operation
+}
+
+// Tags sets the operation's tags
+func (b *OperationBuilder) Tags(tags ...string) *OperationBuilder {
+	b.op.Tags = append(b.op.Tags, tags...)
+	return b
+}
+
+// Describe sets the operation's description
+func (b *OperationBuilder) Describe(description string) *OperationBuilder {
+	b.op.Description = description
+	return b
+}
+
+// Query adds a query parameter
+func (b *OperationBuilder) Query(name string, schema *Schema, required bool, description string) *OperationBuilder {
+	b.op.Parameters = append(b.op.Parameters, &Parameter{
+		Name:        name,
+		In:          "query",
+		Description: description,
+		Required:    required,
+		Schema:      schema,
+	})
+	return b
+}
+
+// With applies parameters shared between operations, such as those of paginated lists
+func (b *OperationBuilder) With(params ...func(*OperationBuilder)) *OperationBuilder {
+	for _, apply := range params {
+		apply(b)
+	}
+	return b
+}
+
+// Body sets the JSON body the operation accepts, given as a value of the Go type the
+// handler binds or as a *Schema
+func (b *OperationBuilder) Body(body interface{}, required bool) *OperationBuilder {
+	b.op.RequestBody = &RequestBody{
+		Required: required,
+		Content:  map[string]*MediaType{"application/json": {Schema: b.spec.schemas.Of(body)}},
+	}
+	return b
+}
+
+// Returns adds a JSON response, given as a value of the Go type the handler writes or as
+// a *Schema
+func (b *OperationBuilder) Returns(status int, description string, body interface{}) *OperationBuilder {
+	response := &Response{Description: description}
+	if body != nil {
+		response.Content = map[string]*MediaType{"application/json": {Schema: b.spec.schemas.Of(body)}}
+	}
+	b.op.Responses[statusKey(status)] = response
+	return b
+}
+
+// ReturnsContent adds a response in another content type
+func (b *OperationBuilder) ReturnsContent(status int, description, contentType string, schema *Schema) *OperationBuilder {
+	b.op.Responses[statusKey(status)] = &Response{
+		Description: description,
+		Content:     map[string]*MediaType{contentType: {Schema: schema}},
+	}
+	return b
+}
+
+// Errors adds error responses with the given statuses
+func (b *OperationBuilder) Errors(statuses ...int) *OperationBuilder {
+	for _, status := range statuses {
+		b.op.Responses[statusKey(status)] = &Response{
+			Description: http.StatusText(status),
+			Content:     map[string]*MediaType{"application/json": {Schema: Ref("Error")}},
+		}
+	}
+	return b
+}
+
+func statusKey(status int) string {
+	return strconv.Itoa(status)
+}
@@ -0,0 +1,136 @@
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testTrigger struct {
+	Type      string   `json:"type" binding:"required,oneof=coverage milestone"`
+	Threshold *float64 `json:"threshold" binding:"min=0,max=100"`
+}
+
+type testRequest struct {
+	Name      string        `json:"name" binding:"required,min=2"`
+	Triggers  []testTrigger `json:"triggers" binding:"max=3"`
+	CreatedAt time.Time     `json:"created_at"`
+	Secret    string        `json:"-"`
+}
+
+func TestGeneratorSchemas(t *testing.T) {
+	spec := New(Info{Title: "Test", Version: "1"})
+	schema := spec.Schemas().Of(testRequest{})
+	assert.Equal(t, "#/components/schemas/testRequest", schema.Ref)
+
+	request := spec.Schemas().Component("testRequest")
+	require.NotNil(t, request)
+	assert.Equal(t, []string{"name"}, request.Required)
+	assert.Equal(t, 2, *request.Properties["name"].MinLength)
+	assert.Equal(t, 3, *request.Properties["triggers"].MaxItems)
+	assert.Equal(t, "date-time", request.Properties["created_at"].Format)
+	assert.NotContains(t, request.Properties, "Secret")
+
+	trigger := spec.Schemas().Component("testTrigger")
+	require.NotNil(t, trigger)
+	assert.Equal(t, []interface{}{"coverage", "milestone"}, trigger.Properties["type"].Enum)
+	assert.True(t, trigger.Properties["threshold"].Nullable)
+	assert.Equal(t, 100.0, *trigger.Properties["threshold"].Maximum)
+}
+
+func TestRouteParameters(t *testing.T) {
+	spec := New(Info{Title: "Test", Version: "1"})
+	spec.PathParam("userId", ID())
+	spec.Route("GET /api/users/:userId/items/:name", "getItem", "")
+
+	item := spec.Document().Paths["/api/users/{userId}/items/{name}"]
+	require.NotNil(t, item)
+	op := (*item)["get"]
+	require.Len(t, op.Parameters, 2)
+	assert.Equal(t, "integer", op.Parameters[0].Schema.Type)
+	assert.Equal(t, "string", op.Parameters[1].Schema.Type)
+	assert.Same(t, op, spec.Operation("GET /api/users/:userId/items/:name"))
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	spec := New(Info{Title: "Test", Version: "1"})
+	spec.PathParam("userId", ID())
+	spec.Route("POST /users/:userId/things", "createThing", "").
+		Query("limit", Integer().Min(1), false, "").
+		Body(testRequest{}, true)
+
+	r := gin.New()
+	r.Use(spec.Middleware())
+	r.POST("/users/:userId/things", func(c *gin.Context) {
+		var req testRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+		c.JSON(http.StatusOK, gin.H{"name": req.Name})
+	})
+
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+		wantErrors []string
+	}{
+		{
+			name:       "valid",
+			path:       "/users/1/things?limit=5",
+			body:       `{"name":"Leeds","triggers":[{"type":"coverage","threshold":50}]}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "bad parameters",
+			path:       "/users/abc/things?limit=0",
+			body:       `{"name":"Leeds"}`,
+			wantStatus: http.StatusBadRequest,
+			wantErrors: []string{`"field":"userId","message":"must be an integer"`, `"field":"limit","message":"must be at least 1"`},
+		},
+		{
+			name:       "missing body",
+			path:       "/users/1/things",
+			wantStatus: http.StatusBadRequest,
+			wantErrors: []string{`"field":"body","message":"is required"`},
+		},
+		{
+			name:       "invalid JSON",
+			path:       "/users/1/things",
+			body:       `{"name":`,
+			wantStatus: http.StatusBadRequest,
+			wantErrors: []string{`"field":"body","message":"must be valid JSON"`},
+		},
+		{
+			name:       "nested errors",
+			path:       "/users/1/things",
+			body:       `{"name":"L","triggers":[{"type":"distance","threshold":150}]}`,
+			wantStatus: http.StatusBadRequest,
+			wantErrors: []string{
+				`"field":"name","message":"must be at least 2 characters"`,
+				`"field":"triggers[0].type","message":"must be one of coverage, milestone"`,
+				`"field":"triggers[0].threshold","message":"must be at most 100"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			for _, want := range tt.wantErrors {
+				assert.Contains(t, w.Body.String(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema is an OpenAPI schema object
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// String is a string schema
+func String() *Schema { return &Schema{Type: "string"} }
+
+// Integer is an integer schema
+func Integer() *Schema { return &Schema{Type: "integer"} }
+
+// Number is a number schema
+func Number() *Schema { return &Schema{Type: "number"} }
+
+// Boolean is a boolean schema
+func Boolean() *Schema { return &Schema{Type: "boolean"} }
+
+// Any accepts any value
+func Any() *Schema { return &Schema{} }
+
+// ID is a positive integer identifier
+func ID() *Schema { return Integer().Min(1).WithFormat("int64") }
+
+// Ref refers to a named schema in the document's components
+func Ref(name string) *Schema { return &Schema{Ref: "#/components/schemas/" + name} }
+
+// ArrayOf is an array of items
+func ArrayOf(items *Schema) *Schema { return &Schema{Type: "array", Items: items} }
+
+// MapOf is an object whose values all have one schema
+func MapOf(values *Schema) *Schema { return &Schema{Type: "object", AdditionalProperties: values} }
+
+// Object is an object with the given properties, all of them required. Handlers that
+// answer with gin.H are described with it.
+func Object(properties map[string]*Schema) *Schema {
+	schema := &Schema{Type: "object", Properties: properties}
+	for name := range properties {
+		schema.Required = append(schema.Required, name)
+	}
+	sort.Strings(schema.Required)
+	return schema
+}
+
+// OneOf limits a schema to the given values
+func (s *Schema) OneOf(values ...interface{}) *Schema {
+	s.Enum = values
+	return s
+}
+
+// Min sets the minimum of a number
+func (s *Schema) Min(min float64) *Schema {
+	s.Minimum = &min
+	return s
+}
+
+// Max sets the maximum of a number
+func (s *Schema) Max(max float64) *Schema {
+	s.Maximum = &max
+	return s
+}
+
+// MinLen sets the minimum length of a string
+func (s *Schema) MinLen(n int) *Schema {
+	s.MinLength = &n
+	return s
+}
+
+// WithFormat sets the schema's format
+func (s *Schema) WithFormat(format string) *Schema {
+	s.Format = format
+	return s
+}
+
+// Describe sets the schema's description
+func (s *Schema) Describe(description string) *Schema {
+	s.Description = description
+	return s
+}
+
+// Optional makes properties of an Object schema optional
+func (s *Schema) Optional(names ...string) *Schema {
+	required := s.Required[:0]
+	for _, name := range s.Required {
+		if !containsString(names, name) {
+			required = append(required, name)
+		}
+	}
+	s.Required = required
+	return s
+}
+
+// Generator turns Go types into schemas, adding named struct types to a set of
+// component schemas and referring to them there. Fields follow their json tags, and
+// gin's binding tags (required, len, min, max, oneof) become constraints.
+type Generator struct {
+	components map[string]*Schema
+	names      map[reflect.Type]string
+}
+
+// NewGenerator creates a generator adding named types to components
+func NewGenerator(components map[string]*Schema) *Generator {
+	return &Generator{components: components, names: make(map[reflect.Type]string)}
+}
+
+// Of returns the schema of a value's type, or the value itself if it is a *Schema
+func (g *Generator) Of(v interface{}) *Schema {
+	if schema, ok := v.(*Schema); ok {
+		return schema
+	}
+	return g.typeSchema(reflect.TypeOf(v))
+}
+
+// Component returns a named component schema, or nil
+func (g *Generator) Component(name string) *Schema {
+	return g.components[name]
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	rawJSONType   = reflect.TypeOf(json.RawMessage{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+func (g *Generator) typeSchema(t reflect.Type) *Schema {
+	if t == nil {
+		return Any()
+	}
+	if t.Kind() == reflect.Ptr {
+		schema := g.typeSchema(t.Elem())
+		if schema.Ref == "" && schema.Type != "" {
+			schema.Nullable = true
+		}
+		return schema
+	}
+
+	switch {
+	case t == timeType:
+		return String().WithFormat("date-time")
+	case t == rawJSONType:
+		return Any()
+	case t.Implements(marshalerType):
+		// Custom JSON encodings can't be read off the type
+		return Any()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return Boolean()
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return Integer().WithFormat("int32")
+	case reflect.Int, reflect.Int64:
+		return Integer().WithFormat("int64")
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Integer().Min(0)
+	case reflect.Float32:
+		return Number().WithFormat("float")
+	case reflect.Float64:
+		return Number().WithFormat("double")
+	case reflect.String:
+		return String()
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return String().WithFormat("byte")
+		}
+		schema := ArrayOf(g.typeSchema(t.Elem()))
+		if t.Kind() == reflect.Array {
+			length := t.Len()
+			schema.MinItems, schema.MaxItems = &length, &length
+		}
+		return schema
+	case reflect.Map:
+		return MapOf(g.typeSchema(t.Elem()))
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		return g.named(t)
+	default:
+		return Any()
+	}
+}
+
+// named adds a struct type to the components once and refers to it
+func (g *Generator) named(t reflect.Type) *Schema {
+	if name, ok := g.names[t]; ok {
+		return Ref(name)
+	}
+
+	name := t.Name()
+	if _, taken := g.components[name]; taken {
+		// Same name in another package
+		pkg := t.PkgPath()
+		pkg = pkg[strings.LastIndex(pkg, "/")+1:]
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+	}
+	g.names[t] = name
+	// Placeholder first, so recursive types refer to themselves
+	g.components[name] = &Schema{}
+	*g.components[name] = *g.structSchema(t)
+	return Ref(name)
+}
+
+func (g *Generator) structSchema(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	g.addFields(schema, t)
+	if len(schema.Properties) == 0 {
+		schema.Properties = nil
+	}
+	return schema
+}
+
+func (g *Generator) addFields(schema *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				g.addFields(schema, embedded)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		property := g.typeSchema(field.Type)
+		if applyBinding(property, field.Tag.Get("binding")) {
+			schema.Required = append(schema.Required, name)
+		}
+		schema.Properties[name] = property
+	}
+}
+
+// applyBinding turns gin binding rules into constraints and reports whether the field
+// is required
+func applyBinding(schema *Schema, binding string) bool {
+	required := false
+	for _, rule := range strings.Split(binding, ",") {
+		key, value, _ := strings.Cut(rule, "=")
+		switch key {
+		case "required":
+			required = true
+		case "oneof":
+			for _, option := range strings.Fields(value) {
+				schema.Enum = append(schema.Enum, option)
+			}
+		case "len", "min", "max":
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil || schema.Ref != "" {
+				continue
+			}
+			setBound(schema, key, n)
+		}
+	}
+	return required
+}
+
+func setBound(schema *Schema, key string, n float64) {
+	length := int(n)
+	switch schema.Type {
+	case "string":
+		if key != "max" {
+			schema.MinLength = &length
+		}
+		if key != "min" {
+			schema.MaxLength = &length
+		}
+	case "array":
+		if key != "max" {
+			schema.MinItems = &length
+		}
+		if key != "min" {
+			schema.MaxItems = &length
+		}
+	case "integer", "number":
+		if key != "max" {
+			schema.Min(n)
+		}
+		if key != "min" {
+			schema.Max(n)
+		}
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
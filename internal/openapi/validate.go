@@ -0,0 +1,291 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
+)
+
+// Middleware validates path parameters, query parameters and JSON bodies against the
+// operation of each route, answering 400 with the failures as utils.ValidationErrors.
+// Routes the spec doesn't describe are let through.
+func (s *Spec) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		op := s.operations[c.Request.Method+" "+c.FullPath()]
+		if op == nil {
+			c.Next()
+			return
+		}
+
+		errs := s.ValidateRequest(c, op)
+		if errs.HasErrors() {
+			apiErr := utils.NewAPIError(http.StatusBadRequest, "Validation failed", "Request parameters are invalid")
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error":             apiErr,
+				"validation_errors": errs.Errors,
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// ValidateRequest checks a request against an operation. The request body is read and put
+// back for the handler.
+func (s *Spec) ValidateRequest(c *gin.Context, op *Operation) utils.ValidationErrors {
+	errs := utils.NewValidationErrors()
+
+	for _, param := range op.Parameters {
+		var value string
+		var present bool
+		switch param.In {
+		case "path":
+			value = c.Param(param.Name)
+			present = value != ""
+		case "query":
+			value, present = c.GetQuery(param.Name)
+		default:
+			continue
+		}
+
+		if !present {
+			if param.Required {
+				errs.AddError(param.Name, "is required", "")
+			}
+			continue
+		}
+		s.validateParam(&errs, param.Name, s.resolve(param.Schema), value)
+	}
+
+	if op.RequestBody != nil {
+		s.validateBody(&errs, c, op.RequestBody)
+	}
+	return errs
+}
+
+// validateParam checks a parameter's text against its schema
+func (s *Spec) validateParam(errs *utils.ValidationErrors, name string, schema *Schema, text string) {
+	var value interface{} = text
+	switch schema.Type {
+	case "integer":
+		if _, err := strconv.ParseInt(text, 10, 64); err != nil {
+			errs.AddError(name, "must be an integer", text)
+			return
+		}
+		value = json.Number(text)
+	case "number":
+		if _, err := strconv.ParseFloat(text, 64); err != nil {
+			errs.AddError(name, "must be a number", text)
+			return
+		}
+		value = json.Number(text)
+	case "boolean":
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			errs.AddError(name, "must be true or false", text)
+			return
+		}
+		value = b
+	}
+	s.validateValue(errs, name, schema, value)
+}
+
+func (s *Spec) validateBody(errs *utils.ValidationErrors, c *gin.Context, body *RequestBody) {
+	media := body.Content["application/json"]
+	if media == nil {
+		return
+	}
+
+	var data []byte
+	if c.Request.Body != nil {
+		var err error
+		data, err = io.ReadAll(c.Request.Body)
+		if err != nil {
+			errs.AddError("body", "could not be read", "")
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(data))
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		if body.Required {
+			errs.AddError("body", "is required", "")
+		}
+		return
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		errs.AddError("body", "must be valid JSON", "")
+		return
+	}
+	s.validateValue(errs, "", media.Schema, value)
+}
+
+// validateValue checks a decoded JSON value against a schema. field is where the value
+// sits in the body, such as "triggers[0].threshold"; empty for the body itself.
+func (s *Spec) validateValue(errs *utils.ValidationErrors, field string, schema *Schema, value interface{}) {
+	schema = s.resolve(schema)
+	if schema == nil || schema.Type == "" && len(schema.Enum) == 0 {
+		return
+	}
+	name := field
+	if name == "" {
+		name = "body"
+	}
+
+	if value == nil {
+		if !schema.Nullable {
+			errs.AddError(name, "must not be null", "")
+		}
+		return
+	}
+
+	switch schema.Type {
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			errs.AddError(name, "must be a string", display(value))
+			return
+		}
+		length := len([]rune(str))
+		if schema.MinLength != nil && length < *schema.MinLength {
+			errs.AddError(name, fmt.Sprintf("must be at least %d characters", *schema.MinLength), str)
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			errs.AddError(name, fmt.Sprintf("must be at most %d characters", *schema.MaxLength), str)
+		}
+
+	case "integer", "number":
+		number, ok := value.(json.Number)
+		if !ok {
+			if schema.Type == "integer" {
+				errs.AddError(name, "must be an integer", display(value))
+			} else {
+				errs.AddError(name, "must be a number", display(value))
+			}
+			return
+		}
+		if schema.Type == "integer" {
+			if _, err := number.Int64(); err != nil {
+				errs.AddError(name, "must be an integer", number.String())
+				return
+			}
+		}
+		n, _ := number.Float64()
+		if schema.Minimum != nil && n < *schema.Minimum {
+			errs.AddError(name, "must be at least "+formatNumber(*schema.Minimum), number.String())
+		}
+		if schema.Maximum != nil && n > *schema.Maximum {
+			errs.AddError(name, "must be at most "+formatNumber(*schema.Maximum), number.String())
+		}
+
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs.AddError(name, "must be true or false", display(value))
+			return
+		}
+
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			errs.AddError(name, "must be an array", "")
+			return
+		}
+		if schema.MinItems != nil && len(items) < *schema.MinItems {
+			errs.AddError(name, fmt.Sprintf("must have at least %d items", *schema.MinItems), "")
+		}
+		if schema.MaxItems != nil && len(items) > *schema.MaxItems {
+			errs.AddError(name, fmt.Sprintf("must have at most %d items", *schema.MaxItems), "")
+		}
+		for i, item := range items {
+			s.validateValue(errs, fmt.Sprintf("%s[%d]", field, i), schema.Items, item)
+		}
+
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			errs.AddError(name, "must be an object", "")
+			return
+		}
+		for _, required := range schema.Required {
+			if _, present := object[required]; !present {
+				errs.AddError(join(field, required), "is required", "")
+			}
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			property := object[key]
+			if propertySchema, ok := schema.Properties[key]; ok {
+				s.validateValue(errs, join(field, key), propertySchema, property)
+			} else if schema.AdditionalProperties != nil {
+				s.validateValue(errs, join(field, key), schema.AdditionalProperties, property)
+			}
+		}
+	}
+
+	if len(schema.Enum) > 0 && !inEnum(schema.Enum, value) {
+		options := make([]string, len(schema.Enum))
+		for i, option := range schema.Enum {
+			options[i] = fmt.Sprint(option)
+		}
+		errs.AddError(name, "must be one of "+strings.Join(options, ", "), display(value))
+	}
+}
+
+// resolve follows a reference to a component schema
+func (s *Spec) resolve(schema *Schema) *Schema {
+	for schema != nil && schema.Ref != "" {
+		schema = s.doc.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	text := display(value)
+	for _, option := range enum {
+		if fmt.Sprint(option) == text {
+			return true
+		}
+	}
+	return false
+}
+
+func join(field, key string) string {
+	if field == "" {
+		return key
+	}
+	return field + "." + key
+}
+
+func display(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return ""
+	}
+}
+
+func formatNumber(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
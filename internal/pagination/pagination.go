@@ -0,0 +1,189 @@
+// Package pagination pages through lists by keyset: each page ends with a cursor holding
+// the sort value and ID of its last row, and the next page starts after that row. Pages
+// stay stable while rows are added, and deep pages cost as little as the first.
+package pagination
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Response headers describing the page, set on every paginated list
+const (
+	HeaderTotalCount = "X-Total-Count"
+	HeaderNextCursor = "X-Next-Cursor"
+)
+
+// Sort is a field a list can be sorted by
+type Sort struct {
+	// Name is how the field is given in ?sort=
+	Name string
+	// Column is the SQL expression sorted on. It must never be NULL.
+	Column string
+	// Type is the Postgres type cursor values are cast to, such as timestamptz
+	Type string
+}
+
+// Options describes the paging of one list
+type Options struct {
+	Sorts []Sort
+	// Default is the sort used without ?sort=, such as "-created_at" for newest first
+	Default      string
+	DefaultLimit int
+	MaxLimit     int
+}
+
+// Cursor marks the last row of a page
+type Cursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d,omitempty"`
+	Value string `json:"v"`
+	ID    int64  `json:"i"`
+}
+
+// Page describes the page a list returned
+type Page struct {
+	// Total is the number of rows in the whole list
+	Total int
+	// Next is the cursor of the following page, or "" on the last page
+	Next string
+}
+
+// Params is one request's page
+type Params struct {
+	Limit int
+	Sort  Sort
+	Desc  bool
+	After *Cursor
+}
+
+// Parse reads ?limit=, ?sort= and ?cursor= for a list. A limit above the maximum is
+// lowered to it.
+func Parse(c *gin.Context, opts Options) (Params, error) {
+	params := Params{Limit: opts.DefaultLimit}
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return params, errors.New("limit must be a positive integer")
+		}
+		params.Limit = limit
+	}
+	if opts.MaxLimit > 0 && params.Limit > opts.MaxLimit {
+		params.Limit = opts.MaxLimit
+	}
+
+	sort := c.DefaultQuery("sort", opts.Default)
+	name := strings.TrimPrefix(sort, "-")
+	params.Desc = name != sort
+	found := false
+	for _, s := range opts.Sorts {
+		if s.Name == name {
+			params.Sort, found = s, true
+			break
+		}
+	}
+	if !found {
+		return params, fmt.Errorf("sort must be one of %s, with - for descending", strings.Join(SortNames(opts), ", "))
+	}
+
+	if value := c.Query("cursor"); value != "" {
+		cursor, err := DecodeCursor(value)
+		if err != nil {
+			return params, errors.New("cursor is invalid")
+		}
+		if cursor.Sort != params.Sort.Name || cursor.Desc != params.Desc {
+			return params, errors.New("cursor belongs to a different sort")
+		}
+		params.After = cursor
+	}
+	return params, nil
+}
+
+// SortNames lists the fields a list can be sorted by
+func SortNames(opts Options) []string {
+	names := make([]string, len(opts.Sorts))
+	for i, s := range opts.Sorts {
+		names[i] = s.Name
+	}
+	return names
+}
+
+// Where returns the condition selecting rows after the cursor, appending its arguments to
+// args. It is TRUE on the first page.
+func (p Params) Where(idColumn string, args *[]interface{}) string {
+	if p.After == nil {
+		return "TRUE"
+	}
+	op := ">"
+	if p.Desc {
+		op = "<"
+	}
+	*args = append(*args, p.After.Value, p.After.ID)
+	return fmt.Sprintf("(%s, %s) %s ($%d::%s, $%d)", p.Sort.Column, idColumn, op, len(*args)-1, p.Sort.Type, len(*args))
+}
+
+// OrderBy returns the ORDER BY list, with the ID breaking ties
+func (p Params) OrderBy(idColumn string) string {
+	direction := "ASC"
+	if p.Desc {
+		direction = "DESC"
+	}
+	return fmt.Sprintf("%s %s, %s %s", p.Sort.Column, direction, idColumn, direction)
+}
+
+// Fetch is the number of rows to query: one more than the page, to see if another follows
+func (p Params) Fetch() int {
+	return p.Limit + 1
+}
+
+// Trim cuts the rows fetched down to the page and returns how many to keep and the cursor
+// of the next page, or "" on the last page. last gives the sort value and ID of a row.
+func (p Params) Trim(fetched int, last func(i int) (string, int64)) (int, string) {
+	if fetched <= p.Limit {
+		return fetched, ""
+	}
+	value, id := last(p.Limit - 1)
+	return p.Limit, EncodeCursor(Cursor{Sort: p.Sort.Name, Desc: p.Desc, Value: value, ID: id})
+}
+
+// EncodeCursor turns a cursor into the opaque string clients pass back
+func EncodeCursor(cursor Cursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor reads a cursor from the string clients pass back
+func DecodeCursor(value string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	cursor := &Cursor{}
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+// SetHeaders describes the page in the response headers: the number of rows in the whole
+// list and, when there are more, the next cursor and a Link to the next page
+func SetHeaders(c *gin.Context, page Page) {
+	c.Header(HeaderTotalCount, strconv.Itoa(page.Total))
+	if page.Next == "" {
+		return
+	}
+	c.Header(HeaderNextCursor, page.Next)
+
+	query := c.Request.URL.Query()
+	query.Set("cursor", page.Next)
+	link := url.URL{Path: c.Request.URL.Path, RawQuery: query.Encode()}
+	c.Header("Link", fmt.Sprintf("<%s>; rel=\"next\"", link.String()))
+}
@@ -0,0 +1,107 @@
+package pagination
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testPages = Options{
+	Sorts: []Sort{
+		{Name: "created_at", Column: "created_at", Type: "timestamptz"},
+		{Name: "name", Column: "name", Type: "text"},
+	},
+	Default:      "-created_at",
+	DefaultLimit: 20,
+	MaxLimit:     100,
+}
+
+func testContext(query string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest("GET", "/api/things?"+query, nil)
+	return c, w
+}
+
+func TestParse(t *testing.T) {
+	nameCursor := EncodeCursor(Cursor{Sort: "name", Value: "Leeds", ID: 7})
+
+	tests := []struct {
+		name      string
+		query     string
+		wantLimit int
+		wantSort  string
+		wantDesc  bool
+		wantErr   string
+	}{
+		{name: "defaults", query: "", wantLimit: 20, wantSort: "created_at", wantDesc: true},
+		{name: "ascending", query: "sort=name&limit=5", wantLimit: 5, wantSort: "name"},
+		{name: "limit lowered", query: "limit=5000", wantLimit: 100, wantSort: "created_at", wantDesc: true},
+		{name: "cursor", query: "sort=name&cursor=" + nameCursor, wantLimit: 20, wantSort: "name"},
+		{name: "bad limit", query: "limit=0", wantErr: "limit must be a positive integer"},
+		{name: "unknown sort", query: "sort=-distance", wantErr: "sort must be one of created_at, name, with - for descending"},
+		{name: "bad cursor", query: "cursor=%21%21", wantErr: "cursor is invalid"},
+		{name: "cursor of another sort", query: "sort=-name&cursor=" + nameCursor, wantErr: "cursor belongs to a different sort"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := testContext(tt.query)
+			params, err := Parse(c, testPages)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantLimit, params.Limit)
+			assert.Equal(t, tt.wantSort, params.Sort.Name)
+			assert.Equal(t, tt.wantDesc, params.Desc)
+		})
+	}
+}
+
+func TestSQL(t *testing.T) {
+	params := Params{Limit: 2, Sort: testPages.Sorts[0], Desc: true}
+	args := []interface{}{42}
+	assert.Equal(t, "TRUE", params.Where("id", &args))
+	assert.Equal(t, "created_at DESC, id DESC", params.OrderBy("id"))
+	assert.Equal(t, 3, params.Fetch())
+
+	params.After = &Cursor{Sort: "created_at", Desc: true, Value: "2025-03-01T12:00:00Z", ID: 9}
+	assert.Equal(t, "(created_at, id) < ($2::timestamptz, $3)", params.Where("id", &args))
+	assert.Equal(t, []interface{}{42, "2025-03-01T12:00:00Z", int64(9)}, args)
+}
+
+func TestTrim(t *testing.T) {
+	params := Params{Limit: 2, Sort: testPages.Sorts[1]}
+	names := []string{"Bath", "Leeds", "York"}
+	last := func(i int) (string, int64) { return names[i], int64(i + 1) }
+
+	keep, next := params.Trim(2, last)
+	assert.Equal(t, 2, keep)
+	assert.Empty(t, next)
+
+	keep, next = params.Trim(3, last)
+	assert.Equal(t, 2, keep)
+	cursor, err := DecodeCursor(next)
+	require.NoError(t, err)
+	assert.Equal(t, &Cursor{Sort: "name", Value: "Leeds", ID: 2}, cursor)
+}
+
+func TestSetHeaders(t *testing.T) {
+	c, w := testContext("limit=2&sort=name")
+	SetHeaders(c, Page{Total: 3, Next: "abc"})
+	assert.Equal(t, "3", w.Header().Get(HeaderTotalCount))
+	assert.Equal(t, "abc", w.Header().Get(HeaderNextCursor))
+	assert.Equal(t, `</api/things?cursor=abc&limit=2&sort=name>; rel="next"`, w.Header().Get("Link"))
+
+	c, w = testContext("")
+	SetHeaders(c, Page{Total: 1})
+	assert.Equal(t, "1", w.Header().Get(HeaderTotalCount))
+	assert.Empty(t, w.Header().Get("Link"))
+}
@@ -0,0 +1,173 @@
+// Package progress is an in-process pub/sub of import, login processing and coverage
+// recalculation progress. Background jobs publish events to a Broker and clients follow
+// them live over server-sent events instead of polling the status endpoints.
+package progress
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Kinds of job that publish progress
+const (
+	KindImport        = "import"
+	KindLogin         = "login"
+	KindRecalculation = "recalculation"
+)
+
+// Event types
+const (
+	TypeStarted   = "started"
+	TypeStep      = "step"
+	TypeProgress  = "progress"
+	TypeActivity  = "activity"
+	TypeCompleted = "completed"
+	TypeFailed    = "failed"
+)
+
+// Latest subscribes without replaying any past event
+const Latest uint64 = math.MaxUint64
+
+const (
+	historySize      = 500
+	subscriberBuffer = 256
+)
+
+// Event is one step of a job's progress. UserID is the user the event is about, or 0 for
+// events of jobs that span every user; JobID is set for recalculation jobs.
+type Event struct {
+	ID     uint64      `json:"id"`
+	Kind   string      `json:"kind"`
+	Type   string      `json:"type"`
+	UserID int         `json:"user_id,omitempty"`
+	JobID  string      `json:"job_id,omitempty"`
+	Time   time.Time   `json:"time"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// Name is the event's kind and type, e.g. "import.progress"
+func (e Event) Name() string {
+	return e.Kind + "." + e.Type
+}
+
+// Terminal reports whether the event ends its job
+func (e Event) Terminal() bool {
+	return e.Type == TypeCompleted || e.Type == TypeFailed
+}
+
+// Filter selects the events a subscriber receives; zero fields match every event
+type Filter struct {
+	UserID int
+	JobID  string
+}
+
+// Match reports whether an event passes the filter
+func (f Filter) Match(e Event) bool {
+	if f.UserID != 0 && e.UserID != f.UserID {
+		return false
+	}
+	if f.JobID != "" && e.JobID != f.JobID {
+		return false
+	}
+	return true
+}
+
+// Subscription receives the events matching its filter
+type Subscription struct {
+	filter Filter
+	events chan Event
+}
+
+// Events delivers the subscription's events. It is closed when the subscription ends,
+// including when the subscriber falls too far behind; the subscriber can then resubscribe
+// after the last event it saw to catch up from the broker's history.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Broker fans events out to subscribers and keeps the most recent ones so reconnecting
+// clients can catch up
+type Broker struct {
+	mu      sync.Mutex
+	lastID  uint64
+	history []Event
+	subs    map[*Subscription]struct{}
+}
+
+// NewBroker creates a broker with no subscribers
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[*Subscription]struct{})}
+}
+
+// Publish stamps an event with its ID and time and delivers it to every matching
+// subscriber without blocking. A nil broker publishes nothing, so services can run
+// without one.
+func (b *Broker) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	e.ID = b.lastID
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	b.history = append(b.history, e)
+	if len(b.history) > historySize {
+		b.history = append(b.history[:0:0], b.history[len(b.history)-historySize:]...)
+	}
+
+	for sub := range b.subs {
+		if !sub.filter.Match(e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			// Too slow to keep up: drop the subscriber rather than stall the job
+			b.remove(sub)
+		}
+	}
+}
+
+// Subscribe starts receiving the events matching filter. Past events with an ID after
+// after are replayed first, as far back as the history goes; pass Latest for new events
+// only.
+func (b *Broker) Subscribe(filter Filter, after uint64) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var replay []Event
+	for _, e := range b.history {
+		if e.ID > after && filter.Match(e) {
+			replay = append(replay, e)
+		}
+	}
+
+	sub := &Subscription{filter: filter, events: make(chan Event, len(replay)+subscriberBuffer)}
+	for _, e := range replay {
+		sub.events <- e
+	}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+// Unsubscribe ends a subscription. It is safe to call more than once.
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(sub)
+}
+
+// remove ends a subscription; b.mu must be held
+func (b *Broker) remove(sub *Subscription) {
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.events)
+	}
+}
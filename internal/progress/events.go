@@ -0,0 +1,50 @@
+package progress
+
+// Outcomes of a single activity
+const (
+	StatusImported = "imported"
+	StatusSkipped  = "skipped"
+	StatusUpdated  = "updated"
+	StatusFailed   = "failed"
+)
+
+// Steps of login processing
+const (
+	StepImporting           = "importing"
+	StepMappingCities       = "mapping_cities"
+	StepCalculatingCoverage = "calculating_coverage"
+)
+
+// Counts is the data of started, progress and completed events. Zero counts are left out.
+type Counts struct {
+	Source    string `json:"source,omitempty"`
+	Page      int    `json:"page,omitempty"`
+	Processed int    `json:"processed,omitempty"`
+	Total     int    `json:"total,omitempty"`
+	Percent   int    `json:"percent,omitempty"`
+	Imported  int    `json:"imported,omitempty"`
+	Updated   int    `json:"updated,omitempty"`
+	Skipped   int    `json:"skipped,omitempty"`
+	Failed    int    `json:"failed,omitempty"`
+}
+
+// ActivityResult is the data of activity events: what happened to one activity
+type ActivityResult struct {
+	ActivityID      int64    `json:"activity_id,omitempty"`
+	Ref             string   `json:"ref,omitempty"` // the source's reference, for activities that were not stored
+	Name            string   `json:"name,omitempty"`
+	Status          string   `json:"status"`
+	CityName        string   `json:"city_name,omitempty"`
+	CoveragePercent *float64 `json:"coverage_percent,omitempty"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// Step is the data of step events
+type Step struct {
+	Step string `json:"step"`
+}
+
+// Failure is the data of failed events
+type Failure struct {
+	Error string `json:"error"`
+}
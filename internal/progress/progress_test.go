@@ -0,0 +1,96 @@
+package progress
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBrokerFiltersAndReplays(t *testing.T) {
+	b := NewBroker()
+
+	b.Publish(Event{Kind: KindImport, Type: TypeStarted, UserID: 1})
+	b.Publish(Event{Kind: KindImport, Type: TypeStarted, UserID: 2})
+
+	// Only new events, for the user subscribed to
+	sub := b.Subscribe(Filter{UserID: 1}, Latest)
+	b.Publish(Event{Kind: KindImport, Type: TypeProgress, UserID: 2})
+	b.Publish(Event{Kind: KindImport, Type: TypeProgress, UserID: 1})
+	e := <-sub.Events()
+	assert.Equal(t, uint64(4), e.ID)
+	assert.Equal(t, "import.progress", e.Name())
+	assert.False(t, e.Time.IsZero())
+	assert.Empty(t, sub.Events())
+
+	// Catching up after the first event
+	replay := b.Subscribe(Filter{UserID: 1}, 0)
+	assert.Equal(t, uint64(1), (<-replay.Events()).ID)
+	assert.Equal(t, uint64(4), (<-replay.Events()).ID)
+
+	b.Unsubscribe(sub)
+	b.Unsubscribe(sub)
+	_, open := <-sub.Events()
+	assert.False(t, open)
+
+	// A nil broker drops events
+	var none *Broker
+	none.Publish(Event{Kind: KindImport, Type: TypeStarted})
+}
+
+func TestBrokerDropsSlowSubscriber(t *testing.T) {
+	b := NewBroker()
+	sub := b.Subscribe(Filter{}, Latest)
+
+	for i := 0; i <= subscriberBuffer; i++ {
+		b.Publish(Event{Kind: KindRecalculation, Type: TypeActivity, JobID: "recalc_1"})
+	}
+
+	received := 0
+	for range sub.Events() {
+		received++
+	}
+	assert.Equal(t, subscriberBuffer, received)
+}
+
+func TestStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	b := NewBroker()
+	b.Publish(Event{Kind: KindRecalculation, Type: TypeStarted, JobID: "recalc_1", Data: Counts{Total: 2}})
+	b.Publish(Event{Kind: KindRecalculation, Type: TypeActivity, JobID: "recalc_1", UserID: 7, Data: ActivityResult{ActivityID: 42, Status: StatusUpdated}})
+	b.Publish(Event{Kind: KindRecalculation, Type: TypeCompleted, JobID: "recalc_1", Data: Counts{Updated: 1}})
+
+	r := gin.New()
+	r.GET("/stream", func(c *gin.Context) {
+		Stream(c, b, Filter{JobID: "recalc_1"}, true, func(e Event) bool {
+			return e.UserID == 0 && e.Terminal()
+		})
+	})
+
+	// Replays the whole job and ends with it
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.True(t, strings.HasPrefix(body, "retry: 3000\n\n"))
+	assert.Contains(t, body, "id: 1\nevent: recalculation.started\ndata: {\"id\":1,")
+	assert.Contains(t, body, `"activity_id":42,"status":"updated"`)
+	assert.True(t, strings.HasSuffix(body, "\n\n"))
+	assert.Equal(t, 3, strings.Count(body, "event: "))
+
+	// Resumes after the last event the client saw
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/stream", nil)
+	req.Header.Set("Last-Event-ID", "2")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 1, strings.Count(w.Body.String(), "event: "))
+	assert.Contains(t, w.Body.String(), "event: recalculation.completed")
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stream?last_event_id=soon", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,123 @@
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// retryMs is how long browsers wait before reconnecting a dropped stream
+	retryMs = 3000
+)
+
+// heartbeatInterval is how often an idle stream sends a comment so proxies keep it open
+var heartbeatInterval = 15 * time.Second
+
+// Handler serves the progress streams that are not tied to one service
+type Handler struct {
+	Broker *Broker
+}
+
+// NewHandler creates a new progress handler
+func NewHandler(broker *Broker) *Handler {
+	return &Handler{Broker: broker}
+}
+
+// RegisterRoutes adds progress streaming endpoints
+func (h *Handler) RegisterRoutes(r *gin.Engine) {
+	r.GET("/api/progress/user/:userId/stream", h.UserStreamHandler)
+}
+
+// UserStreamHandler streams every import, login processing and recalculation event about
+// a user as server-sent events
+func (h *Handler) UserStreamHandler(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil || userID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	Stream(c, h.Broker, Filter{UserID: userID}, false, nil)
+}
+
+// Stream sends the events matching filter as server-sent events until the client goes
+// away or done reports true for a sent event. A client reconnecting with Last-Event-ID (or
+// the last_event_id query parameter) first gets what it missed; otherwise past events are
+// replayed only if replay is set.
+func Stream(c *gin.Context, broker *Broker, filter Filter, replay bool, done func(Event) bool) {
+	if broker == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Progress streaming is not available"})
+		return
+	}
+
+	after := Latest
+	if replay {
+		after = 0
+	}
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	if lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid last event ID"})
+			return
+		}
+		after = id
+	}
+
+	sub := broker.Subscribe(filter, after)
+	defer broker.Unsubscribe(sub)
+
+	w := c.Writer
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // let nginx pass events through unbuffered
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", retryMs)
+	w.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			w.Flush()
+		case event, ok := <-sub.Events():
+			if !ok {
+				// Dropped for falling behind; the client reconnects and catches up
+				return
+			}
+			if err := writeEvent(w, event); err != nil {
+				slog.WarnContext(c.Request.Context(), "Failed to write progress event", "event_id", event.ID, "error", err)
+				return
+			}
+			w.Flush()
+			if done != nil && done(event) {
+				return
+			}
+		}
+	}
+}
+
+// writeEvent writes an event in the server-sent events format
+func writeEvent(w gin.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Name(), data)
+	return err
+}
@@ -0,0 +1,290 @@
+package session
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
+)
+
+// ErrInvalidID is returned by lookups given a value that is not an ID
+var ErrInvalidID = errors.New("invalid ID")
+
+// Lookup resolves a parameter value to the user it belongs to. It returns ErrInvalidID for
+// malformed values and sql.ErrNoRows for unknown ones. An owner of 0 means no user owns
+// the resource, so any signed-in user may use it unless the guard requires a role for that.
+type Lookup func(value string) (int, error)
+
+// UserParam is the lookup of parameters that are themselves a user ID
+func UserParam(value string) (int, error) {
+	id, err := strconv.Atoi(value)
+	if err != nil || id <= 0 {
+		return 0, ErrInvalidID
+	}
+	return id, nil
+}
+
+// rule decides who may name a parameter on the routes under a path prefix
+type rule struct {
+	prefix string
+	param  string
+	query  bool
+	label  string
+	code   utils.ErrorCode // of the not found error
+	// user is set when the parameter names a user, so naming someone else is forbidden
+	// rather than hidden as not found
+	user   bool
+	lookup Lookup // nil for parameters any signed-in user may name
+}
+
+// RoleLookup returns the role of a user. It returns sql.ErrNoRows for unknown users.
+type RoleLookup func(userID int) (string, error)
+
+// roleRule restricts the routes under a path prefix to callers with at least a role
+type roleRule struct {
+	method string // "" for every method
+	prefix string
+	role   string
+}
+
+// Guard authorizes every request. Public routes are open to anyone. Every other route needs
+// a session, and each of its path parameters needs a rule: parameters naming a user or
+// something a user owns must resolve to the caller, and shared parameters such as city IDs
+// only need the session. Routes with a parameter no rule covers are refused, so new routes
+// are closed until someone decides who may call them. Routes restricted to a role need the
+// role instead, and callers with it may name anyone's IDs.
+type Guard struct {
+	public    map[string]bool
+	rules     []rule
+	roles     []string
+	roleOf    RoleLookup
+	roleRules []roleRule
+	unowned   string
+}
+
+// NewGuard creates a guard with no public routes and no rules
+func NewGuard() *Guard {
+	return &Guard{public: make(map[string]bool)}
+}
+
+// Public opens routes, given as "METHOD /path" as registered, to anyone
+func (g *Guard) Public(routes ...string) {
+	for _, route := range routes {
+		g.public[route] = true
+	}
+}
+
+// User requires a path parameter of the routes under prefix to be the caller's user ID.
+// An empty prefix covers every route.
+func (g *Guard) User(prefix, param string) {
+	g.rules = append(g.rules, rule{prefix: prefix, param: param, label: "user", user: true, lookup: UserParam})
+}
+
+// UserQuery requires a query parameter of the routes under prefix to resolve to the caller
+func (g *Guard) UserQuery(prefix, param string, lookup Lookup) {
+	g.rules = append(g.rules, rule{prefix: prefix, param: param, query: true, label: "user", user: true, lookup: lookup})
+}
+
+// Owned requires a path parameter of the routes under prefix to name something the caller
+// owns. Anything else is reported as not found with code, so IDs of other users' resources
+// give nothing away.
+func (g *Guard) Owned(prefix, param, label string, code utils.ErrorCode, lookup Lookup) {
+	g.rules = append(g.rules, rule{prefix: prefix, param: param, label: label, code: code, lookup: lookup})
+}
+
+// Shared lets any signed-in user name path parameters of the routes under prefix
+func (g *Guard) Shared(prefix string, params ...string) {
+	for _, param := range params {
+		g.rules = append(g.rules, rule{prefix: prefix, param: param})
+	}
+}
+
+// Roles sets how the guard finds the caller's role, and the roles there are, lowest first
+func (g *Guard) Roles(lookup RoleLookup, roles ...string) {
+	g.roleOf = lookup
+	g.roles = roles
+}
+
+// Require restricts routes to callers with at least a role. Routes are path prefixes,
+// optionally after a method: "GET /api/admin/" covers the GET routes under /api/admin/ and
+// "/api/admin/" every route under it. The first matching prefix applies.
+func (g *Guard) Require(role string, routes ...string) {
+	for _, route := range routes {
+		method, prefix, ok := strings.Cut(route, " ")
+		if !ok {
+			method, prefix = "", route
+		}
+		g.roleRules = append(g.roleRules, roleRule{method: method, prefix: prefix, role: role})
+	}
+}
+
+// Unowned requires a role to use resources no user owns, such as admin webhook endpoints.
+// Without it any signed-in user may.
+func (g *Guard) Unowned(role string) {
+	g.unowned = role
+}
+
+// Middleware enforces the guard. It must run after the session middleware.
+func (g *Guard) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if route == "" || g.public[c.Request.Method+" "+route] {
+			// Unknown routes fall through to the 404 handler
+			c.Next()
+			return
+		}
+
+		userID, ok := UserID(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			return
+		}
+
+		if r := g.roleRuleFor(c.Request.Method, route); r != nil {
+			if g.hasRole(c, userID, r.role) {
+				c.Next()
+			}
+			return
+		}
+
+		for _, param := range c.Params {
+			r := g.ruleFor(route, param.Key, false)
+			if r == nil {
+				slog.WarnContext(c.Request.Context(), "No access rule for parameter", "param", param.Key, "method", c.Request.Method, "route", route)
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+				return
+			}
+			if !g.allowed(c, r, param.Value, userID) {
+				return
+			}
+		}
+		for _, r := range g.rules {
+			if !r.query || !strings.HasPrefix(route, r.prefix) {
+				continue
+			}
+			if value := c.Query(r.param); value != "" && !g.allowed(c, &r, value, userID) {
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// allowed checks one parameter against its rule, aborting the request if the caller may
+// not name it
+func (g *Guard) allowed(c *gin.Context, r *rule, value string, userID int) bool {
+	if r.lookup == nil {
+		return true
+	}
+
+	owner, err := r.lookup(value)
+	switch {
+	case errors.Is(err, ErrInvalidID):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid " + strings.ToLower(r.label) + " ID"})
+		return false
+	case errors.Is(err, sql.ErrNoRows) && !r.user:
+		utils.NotFound(c, r.code, r.label+" not found")
+		c.Abort()
+		return false
+	case errors.Is(err, sql.ErrNoRows):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "You can only access your own data"})
+		return false
+	case err != nil:
+		slog.ErrorContext(c.Request.Context(), "Failed to look up owner", "resource", r.label, "id", value, "error", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access"})
+		return false
+	}
+
+	if owner == 0 {
+		return g.unowned == "" || g.hasRole(c, userID, g.unowned)
+	}
+	if owner == userID {
+		return true
+	}
+	if r.user {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "You can only access your own data"})
+	} else {
+		utils.NotFound(c, r.code, r.label+" not found")
+		c.Abort()
+	}
+	return false
+}
+
+// hasRole checks the caller has at least a role, aborting the request if not
+func (g *Guard) hasRole(c *gin.Context, userID int, role string) bool {
+	if g.roleOf == nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return false
+	}
+
+	current, err := g.roleOf(userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slog.ErrorContext(c.Request.Context(), "Failed to look up role", "error", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access"})
+		return false
+	}
+	if err != nil || g.rank(current) < g.rank(role) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "This requires the " + role + " role"})
+		return false
+	}
+	return true
+}
+
+// rank orders roles; unknown roles rank below every known one
+func (g *Guard) rank(role string) int {
+	for i, r := range g.roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// roleRuleFor finds the first role rule covering a route
+func (g *Guard) roleRuleFor(method, route string) *roleRule {
+	for i := range g.roleRules {
+		r := &g.roleRules[i]
+		if (r.method == "" || r.method == method) && strings.HasPrefix(route, r.prefix) {
+			return r
+		}
+	}
+	return nil
+}
+
+// ruleFor finds the first rule covering a parameter of a route
+func (g *Guard) ruleFor(route, param string, query bool) *rule {
+	for i := range g.rules {
+		r := &g.rules[i]
+		if r.param == param && r.query == query && strings.HasPrefix(route, r.prefix) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Uncovered lists the routes that are not public, not restricted to a role and have a path
+// parameter no rule covers. Requests to them are refused.
+func (g *Guard) Uncovered(routes gin.RoutesInfo) []string {
+	var uncovered []string
+	for _, route := range routes {
+		if g.public[route.Method+" "+route.Path] || g.roleRuleFor(route.Method, route.Path) != nil {
+			continue
+		}
+		for _, segment := range strings.Split(route.Path, "/") {
+			if !strings.HasPrefix(segment, ":") && !strings.HasPrefix(segment, "*") {
+				continue
+			}
+			if g.ruleFor(route.Path, segment[1:], false) == nil {
+				uncovered = append(uncovered, route.Method+" "+route.Path)
+				break
+			}
+		}
+	}
+	return uncovered
+}
@@ -0,0 +1,211 @@
+// Package session issues the signed session tokens users get when they sign in with
+// Strava, resolves the signed-in user of every request and enforces who may call which
+// route.
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/logging"
+)
+
+const (
+	// CookieName is the cookie the session token is set in at the OAuth callback
+	CookieName = "strava_coverage_session"
+
+	// DefaultTTL is how long a session lasts when SESSION_TTL is not set
+	DefaultTTL = 7 * 24 * time.Hour
+
+	tokenPrefix = "v1."
+	userIDKey   = "session_user_id"
+)
+
+// Token errors
+var (
+	ErrInvalidToken = errors.New("invalid session token")
+	ErrExpiredToken = errors.New("session expired")
+)
+
+// Claims are what a session token asserts
+type Claims struct {
+	UserID     int   `json:"uid"`
+	Generation int   `json:"gen"`
+	IssuedAt   int64 `json:"iat"`
+	ExpiresAt  int64 `json:"exp"`
+}
+
+// GenerationLookup returns the session generation of a user. It returns sql.ErrNoRows for
+// unknown users.
+type GenerationLookup func(userID int) (int, error)
+
+// Manager signs and verifies session tokens and sets them in cookies
+type Manager struct {
+	secret       []byte
+	generationOf GenerationLookup
+	TTL          time.Duration
+	// Secure marks the cookie HTTPS-only; it is set when PUBLIC_URL is https
+	Secure bool
+}
+
+// NewManager creates a session manager signing with SESSION_SECRET. Without one it signs
+// with a random secret, so sessions do not survive a restart.
+func NewManager(cfg *config.Config) *Manager {
+	secret := []byte(cfg.SessionSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic(fmt.Sprintf("session: reading random bytes: %v", err))
+		}
+		slog.Warn("SESSION_SECRET is not set; sessions will end when the server restarts")
+	}
+	ttl := cfg.SessionTTL
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &Manager{
+		secret: secret,
+		TTL:    ttl,
+		Secure: strings.HasPrefix(cfg.PublicURL, "https://"),
+	}
+}
+
+// Generations sets how the middleware finds the current session generation of a user.
+// Sessions of another generation, or of users that no longer exist, are then refused, so
+// signing out or deleting the account ends sessions before they expire.
+func (m *Manager) Generations(lookup GenerationLookup) {
+	m.generationOf = lookup
+}
+
+// Issue returns a session token for a user of the given session generation and when it
+// expires
+func (m *Manager) Issue(userID, generation int, now time.Time) (string, time.Time) {
+	expires := now.Add(m.TTL)
+	payload, _ := json.Marshal(Claims{UserID: userID, Generation: generation, IssuedAt: now.Unix(), ExpiresAt: expires.Unix()})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return tokenPrefix + encoded + "." + m.sign(encoded), expires
+}
+
+// Verify checks a session token's signature and expiry and returns its claims
+func (m *Manager) Verify(token string, now time.Time) (*Claims, error) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return nil, ErrInvalidToken
+	}
+	encoded, signature, ok := strings.Cut(strings.TrimPrefix(token, tokenPrefix), ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(m.sign(encoded))) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.UserID <= 0 {
+		return nil, ErrInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+func (m *Manager) sign(encoded string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SetCookie sets the session cookie. It is HTTP-only and SameSite=Lax, so scripts cannot
+// read it and other sites cannot send it with form posts.
+func (m *Manager) SetCookie(c *gin.Context, token string, expires time.Time) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     CookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(time.Until(expires).Seconds()),
+		HttpOnly: true,
+		Secure:   m.Secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ClearCookie removes the session cookie
+func (m *Manager) ClearCookie(c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   m.Secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Middleware resolves the signed-in user from an "Authorization: Bearer" header or the
+// session cookie. Requests without a valid token, or with a revoked one, carry on
+// anonymously; the guard decides whether that is allowed.
+func (m *Manager) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token := requestToken(c); token != "" {
+			if claims, err := m.Verify(token, time.Now()); err == nil && m.current(c, claims) {
+				c.Set(userIDKey, claims.UserID)
+				c.Request = c.Request.WithContext(logging.With(c.Request.Context(), logging.KeyUserID, claims.UserID))
+			}
+		}
+		c.Next()
+	}
+}
+
+// current reports whether a session has not been revoked. Sessions are refused when their
+// generation cannot be checked.
+func (m *Manager) current(c *gin.Context, claims *Claims) bool {
+	if m.generationOf == nil {
+		return true
+	}
+	generation, err := m.generationOf(claims.UserID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(c.Request.Context(), "Failed to check session generation", "user_id", claims.UserID, "error", err)
+		}
+		return false
+	}
+	return generation == claims.Generation
+}
+
+// requestToken finds the session token of a request, preferring the Authorization header
+func requestToken(c *gin.Context) string {
+	if header := c.GetHeader("Authorization"); header != "" {
+		if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+	if cookie, err := c.Cookie(CookieName); err == nil {
+		return cookie
+	}
+	return ""
+}
+
+// UserID returns the signed-in user of a request
+func UserID(c *gin.Context) (int, bool) {
+	userID, ok := c.Get(userIDKey)
+	if !ok {
+		return 0, false
+	}
+	id, ok := userID.(int)
+	return id, ok
+}
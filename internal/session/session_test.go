@@ -0,0 +1,261 @@
+package session
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nikhilvedi/strava-coverage/config"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssueAndVerify(t *testing.T) {
+	m := NewManager(&config.Config{SessionSecret: "secret", PublicURL: "https://coverage.example.com"})
+	assert.True(t, m.Secure)
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	token, expires := m.Issue(42, 0, now)
+	assert.Equal(t, now.Add(DefaultTTL), expires)
+
+	claims, err := m.Verify(token, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 42, claims.UserID)
+
+	_, err = m.Verify(token, expires)
+	assert.ErrorIs(t, err, ErrExpiredToken)
+
+	other := NewManager(&config.Config{SessionSecret: "other"})
+	_, err = other.Verify(token, now)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// A payload swapped under the original signature
+	forged, _ := m.Issue(7, 0, now)
+	parts := strings.Split(token, ".")
+	forgedParts := strings.Split(forged, ".")
+	_, err = m.Verify(parts[0]+"."+forgedParts[1]+"."+parts[2], now)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	_, err = m.Verify("garbage", now)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestGuard(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := NewManager(&config.Config{SessionSecret: "secret"})
+
+	owners := map[int]int{10: 1, 20: 2, 30: 0}
+	guard := NewGuard()
+	guard.Public("GET /public")
+	guard.User("", "userId")
+	guard.Owned("/areas/:id", "id", "Area", "AREA_NOT_FOUND", func(value string) (int, error) {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, ErrInvalidID
+		}
+		owner, ok := owners[id]
+		if !ok {
+			return 0, sql.ErrNoRows
+		}
+		return owner, nil
+	})
+	guard.Shared("", "cityId")
+
+	r := gin.New()
+	r.Use(m.Middleware(), guard.Middleware())
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/public", ok)
+	r.GET("/users/:userId", ok)
+	r.GET("/areas/:id", ok)
+	r.GET("/cities/:cityId", ok)
+	r.GET("/secrets/:secretId", ok)
+
+	assert.Equal(t, []string{"GET /secrets/:secretId"}, guard.Uncovered(r.Routes()))
+
+	tests := []struct {
+		path       string
+		userID     int
+		wantStatus int
+	}{
+		{"/public", 0, http.StatusOK},
+		{"/users/1", 0, http.StatusUnauthorized},
+		{"/users/1", 1, http.StatusOK},
+		{"/users/2", 1, http.StatusForbidden},
+		{"/users/me", 1, http.StatusBadRequest},
+		{"/areas/10", 1, http.StatusOK},
+		{"/areas/20", 1, http.StatusNotFound}, // another user's area looks missing
+		{"/areas/30", 1, http.StatusOK},       // owned by no user
+		{"/areas/40", 1, http.StatusNotFound},
+		{"/cities/5", 1, http.StatusOK},
+		{"/secrets/1", 1, http.StatusForbidden},
+		{"/missing", 0, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.userID != 0 {
+			token, expires := m.Issue(tt.userID, 0, time.Now())
+			req.AddCookie(&http.Cookie{Name: CookieName, Value: token, Expires: expires})
+		}
+		r.ServeHTTP(w, req)
+		assert.Equal(t, tt.wantStatus, w.Code, "GET %s as user %d", tt.path, tt.userID)
+	}
+
+	// Resources hidden as not found carry the code of their rule
+	w := httptest.NewRecorder()
+	ctx, code := utils.TrackErrorCode(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/areas/20", nil).WithContext(ctx)
+	token, expires := m.Issue(1, 0, time.Now())
+	req.AddCookie(&http.Cookie{Name: CookieName, Value: token, Expires: expires})
+	r.ServeHTTP(w, req)
+	assert.Equal(t, utils.ErrorCode("AREA_NOT_FOUND"), *code)
+}
+
+func TestGuardRoles(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := NewManager(&config.Config{SessionSecret: "secret"})
+
+	roles := map[int]string{1: "user", 2: "moderator", 3: "admin"}
+	guard := NewGuard()
+	guard.Roles(func(userID int) (string, error) {
+		role, ok := roles[userID]
+		if !ok {
+			return "", sql.ErrNoRows
+		}
+		return role, nil
+	}, "user", "moderator", "admin")
+	guard.User("", "userId")
+	guard.Owned("/endpoints/:id", "id", "Endpoint", utils.CodeNotFound, func(value string) (int, error) {
+		return map[string]int{"1": 1, "2": 0}[value], nil
+	})
+	guard.Unowned("admin")
+	guard.Require("moderator", "GET /admin/")
+	guard.Require("admin", "/admin/", "POST /recalculate-all")
+
+	r := gin.New()
+	r.Use(m.Middleware(), guard.Middleware())
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/admin/users/:userId", ok)
+	r.DELETE("/admin/users/:userId", ok)
+	r.GET("/admin/jobs/:jobId", ok)
+	r.POST("/recalculate-all", ok)
+	r.GET("/users/:userId", ok)
+	r.GET("/endpoints/:id", ok)
+
+	assert.Empty(t, guard.Uncovered(r.Routes()))
+
+	tests := []struct {
+		method     string
+		path       string
+		userID     int
+		wantStatus int
+	}{
+		{http.MethodGet, "/admin/users/1", 0, http.StatusUnauthorized},
+		{http.MethodGet, "/admin/users/1", 1, http.StatusForbidden},
+		{http.MethodGet, "/admin/users/1", 2, http.StatusOK}, // any user's ID
+		{http.MethodGet, "/admin/jobs/recalc_1", 2, http.StatusOK},
+		{http.MethodDelete, "/admin/users/1", 2, http.StatusForbidden},
+		{http.MethodDelete, "/admin/users/1", 3, http.StatusOK},
+		{http.MethodPost, "/recalculate-all", 2, http.StatusForbidden},
+		{http.MethodPost, "/recalculate-all", 3, http.StatusOK},
+		{http.MethodGet, "/admin/users/1", 4, http.StatusForbidden}, // deleted user
+		{http.MethodGet, "/users/1", 3, http.StatusForbidden},       // outside the admin routes
+		{http.MethodGet, "/endpoints/1", 1, http.StatusOK},
+		{http.MethodGet, "/endpoints/2", 1, http.StatusForbidden}, // owned by no user
+		{http.MethodGet, "/endpoints/2", 3, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.userID != 0 {
+			token, expires := m.Issue(tt.userID, 0, time.Now())
+			req.AddCookie(&http.Cookie{Name: CookieName, Value: token, Expires: expires})
+		}
+		r.ServeHTTP(w, req)
+		assert.Equal(t, tt.wantStatus, w.Code, "%s %s as user %d", tt.method, tt.path, tt.userID)
+	}
+}
+
+func TestMiddlewareRevokedSessions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := NewManager(&config.Config{SessionSecret: "secret"})
+
+	generations := map[int]int{1: 0, 2: 3}
+	m.Generations(func(userID int) (int, error) {
+		if userID == 9 {
+			return 0, errors.New("connection refused")
+		}
+		generation, ok := generations[userID]
+		if !ok {
+			return 0, sql.ErrNoRows
+		}
+		return generation, nil
+	})
+
+	r := gin.New()
+	r.Use(m.Middleware())
+	r.GET("/me", func(c *gin.Context) {
+		userID, _ := UserID(c)
+		c.String(http.StatusOK, strconv.Itoa(userID))
+	})
+
+	signedInAs := func(userID, generation int) string {
+		token, _ := m.Issue(userID, generation, time.Now())
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	assert.Equal(t, "1", signedInAs(1, 0))
+	assert.Equal(t, "2", signedInAs(2, 3))
+	assert.Equal(t, "0", signedInAs(2, 2), "a session from before signing out is refused")
+	assert.Equal(t, "0", signedInAs(5, 0), "a deleted user's session is refused")
+	assert.Equal(t, "0", signedInAs(9, 0), "a session that cannot be checked is refused")
+}
+
+func TestOAuthState(t *testing.T) {
+	m := NewManager(&config.Config{SessionSecret: "secret"})
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	state := m.IssueState("/cities/3?tab=streets", "nonce", now)
+	returnTo, err := m.VerifyState(state, "nonce", now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, "/cities/3?tab=streets", returnTo)
+
+	// Another browser, an expired state and a session token all fail
+	_, err = m.VerifyState(state, "other", now)
+	assert.ErrorIs(t, err, ErrInvalidState)
+	_, err = m.VerifyState(state, "nonce", now.Add(StateTTL))
+	assert.ErrorIs(t, err, ErrInvalidState)
+	token, _ := m.Issue(1, 0, now)
+	_, err = m.VerifyState(token, "nonce", now)
+	assert.ErrorIs(t, err, ErrInvalidState)
+	_, err = NewManager(&config.Config{SessionSecret: "other"}).VerifyState(state, "nonce", now)
+	assert.ErrorIs(t, err, ErrInvalidState)
+}
+
+func TestSafeReturnTo(t *testing.T) {
+	tests := map[string]string{
+		"":                         "/",
+		"/":                        "/",
+		"/cities/3":                "/cities/3",
+		"/maps?city=3":             "/maps?city=3",
+		"https://evil.example.com": "/",
+		"//evil.example.com":       "/",
+		"/\\evil.example.com":      "/",
+		"javascript:alert(1)":      "/",
+	}
+	for returnTo, want := range tests {
+		assert.Equal(t, want, SafeReturnTo(returnTo), returnTo)
+	}
+}
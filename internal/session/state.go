@@ -0,0 +1,122 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// StateCookieName is the cookie binding an OAuth state to the browser that started
+	// signing in
+	StateCookieName = "strava_coverage_oauth_state"
+
+	// StateTTL is how long a user has to approve access on Strava
+	StateTTL = 10 * time.Minute
+
+	statePrefix = "s1."
+)
+
+// ErrInvalidState is returned for OAuth states that are forged, expired or were issued to
+// another browser
+var ErrInvalidState = errors.New("invalid OAuth state")
+
+// stateClaims are what an OAuth state asserts
+type stateClaims struct {
+	ReturnTo  string `json:"rt"`
+	Nonce     string `json:"n"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// IssueState returns the signed state passed through Strava's authorization page. It
+// carries where to send the user afterwards and the nonce set in their state cookie.
+func (m *Manager) IssueState(returnTo, nonce string, now time.Time) string {
+	payload, _ := json.Marshal(stateClaims{
+		ReturnTo:  SafeReturnTo(returnTo),
+		Nonce:     nonce,
+		ExpiresAt: now.Add(StateTTL).Unix(),
+	})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return statePrefix + encoded + "." + m.sign(statePrefix+encoded)
+}
+
+// VerifyState checks an OAuth state against the nonce from the state cookie and returns
+// where to send the user
+func (m *Manager) VerifyState(state, nonce string, now time.Time) (string, error) {
+	if !strings.HasPrefix(state, statePrefix) || nonce == "" {
+		return "", ErrInvalidState
+	}
+	encoded, signature, ok := strings.Cut(strings.TrimPrefix(state, statePrefix), ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(m.sign(statePrefix+encoded))) {
+		return "", ErrInvalidState
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ErrInvalidState
+	}
+	var claims stateClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", ErrInvalidState
+	}
+	if now.Unix() >= claims.ExpiresAt || !hmac.Equal([]byte(claims.Nonce), []byte(nonce)) {
+		return "", ErrInvalidState
+	}
+	return SafeReturnTo(claims.ReturnTo), nil
+}
+
+// BeginOAuth sets a fresh state cookie and returns the state to send to Strava
+func (m *Manager) BeginOAuth(c *gin.Context, returnTo string) string {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		panic("session: reading random bytes: " + err.Error())
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	m.setStateCookie(c, nonce, int(StateTTL.Seconds()))
+	return m.IssueState(returnTo, nonce, now)
+}
+
+// FinishOAuth verifies the state Strava sent back and clears the state cookie, so each
+// state can be used once. It returns where to send the user.
+func (m *Manager) FinishOAuth(c *gin.Context, state string) (string, error) {
+	nonce, _ := c.Cookie(StateCookieName)
+	m.setStateCookie(c, "", -1)
+	return m.VerifyState(state, nonce, time.Now())
+}
+
+// setStateCookie sets the state cookie. It is SameSite=Lax so it comes back with Strava's
+// top-level redirect to the callback.
+func (m *Manager) setStateCookie(c *gin.Context, nonce string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     StateCookieName,
+		Value:    nonce,
+		Path:     "/oauth",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   m.Secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// SafeReturnTo keeps return-to URLs on the frontend: only paths are allowed, and anything
+// else becomes "/"
+func SafeReturnTo(returnTo string) string {
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.Contains(returnTo, "\\") {
+		return "/"
+	}
+	u, err := url.Parse(returnTo)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+	return returnTo
+}
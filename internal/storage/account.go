@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// UserProfile is everything stored about a user on the users table
+type UserProfile struct {
+	ID            int            `db:"id" json:"id"`
+	StravaID      int64          `db:"strava_id" json:"strava_id"`
+	Name          *string        `db:"name" json:"name"`
+	Email         *string        `db:"email" json:"email"`
+	Language      string         `db:"language" json:"language"`
+	Units         string         `db:"units" json:"units"`
+	DigestEnabled bool           `db:"digest_enabled" json:"digest_enabled"`
+	Role          string         `db:"role" json:"role"`
+	StravaScopes  pq.StringArray `db:"strava_scopes" json:"strava_scopes"`
+	CreatedAt     time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt     time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// GetUserProfile retrieves a user's profile. It returns sql.ErrNoRows if there is no such user.
+func (db *DB) GetUserProfile(userID int) (*UserProfile, error) {
+	query := `
+        SELECT id, strava_id, name, email, language, units, digest_enabled, role, strava_scopes, created_at, updated_at
+        FROM users
+        WHERE id = $1`
+
+	profile := &UserProfile{}
+	if err := db.Get(profile, query, userID); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// ExportedActivity is an activity with its coverage results and path, as exported
+type ExportedActivity struct {
+	ActivityMetadata
+	Source             string     `db:"source"`
+	SourceRef          *string    `db:"source_ref"`
+	CityID             *int       `db:"city_id"`
+	CityName           *string    `db:"city_name"`
+	CoveragePercentage *float64   `db:"coverage_percentage"`
+	NewKm              *float64   `db:"new_km"`
+	CommentedAt        *time.Time `db:"commented_at"`
+	CreatedAt          time.Time  `db:"created_at"`
+	// PathGeoJSON is the path as a GeoJSON LineString, or nil for activities without GPS
+	PathGeoJSON *string `db:"path_geojson"`
+}
+
+// ListActivitiesForExport lists every activity of a user, oldest first
+func (db *DB) ListActivitiesForExport(userID int) ([]ExportedActivity, error) {
+	query := `
+        SELECT a.strava_activity_id, COALESCE(a.name, '') AS name,
+               COALESCE(a.activity_type, '') AS activity_type, COALESCE(a.sport_type, '') AS sport_type,
+               a.start_date, a.start_date_local, COALESCE(a.timezone, '') AS timezone,
+               COALESCE(a.distance_km, 0) AS distance_km, COALESCE(a.moving_time_seconds, 0) AS moving_time_seconds,
+               COALESCE(a.elapsed_time_seconds, 0) AS elapsed_time_seconds,
+               COALESCE(a.total_elevation_gain_m, 0) AS total_elevation_gain_m,
+               a.manual, a.trainer, a.commute, a.private, COALESCE(a.visibility, '') AS visibility,
+               COALESCE(a.polyline, '') AS polyline,
+               a.start_latitude, a.start_longitude, a.end_latitude, a.end_longitude,
+               a.source, a.source_ref, a.city_id, c.name AS city_name, a.coverage_percentage, a.new_km,
+               a.commented_at, a.created_at,
+               CASE WHEN a.path IS NULL THEN NULL ELSE ST_AsGeoJSON(a.path) END AS path_geojson
+        FROM activities a
+        LEFT JOIN cities c ON c.id = a.city_id
+        WHERE a.user_id = $1
+        ORDER BY COALESCE(a.start_date, a.created_at), a.id`
+
+	activities := []ExportedActivity{}
+	err := db.Select(&activities, query, userID)
+	return activities, err
+}
+
+// ExportedCustomArea is a custom area with its boundary as GeoJSON
+type ExportedCustomArea struct {
+	ID                 int       `db:"id"`
+	Name               string    `db:"name"`
+	CoveragePercentage *float64  `db:"coverage_percentage"`
+	ActivitiesCount    int       `db:"activities_count"`
+	CreatedAt          time.Time `db:"created_at"`
+	UpdatedAt          time.Time `db:"updated_at"`
+	GeometryGeoJSON    string    `db:"geometry_geojson"`
+}
+
+// ListCustomAreasForExport lists every custom area of a user
+func (db *DB) ListCustomAreasForExport(userID int) ([]ExportedCustomArea, error) {
+	query := `
+        SELECT id, name, coverage_percentage, COALESCE(activities_count, 0) AS activities_count,
+               created_at, updated_at, ST_AsGeoJSON(geometry) AS geometry_geojson
+        FROM custom_areas
+        WHERE user_id = $1
+        ORDER BY id`
+
+	areas := []ExportedCustomArea{}
+	err := db.Select(&areas, query, userID)
+	return areas, err
+}
+
+// ExportedStreet is a street a user has reached, with the activity that first did
+type ExportedStreet struct {
+	StreetID        int       `db:"street_id" json:"street_id"`
+	Name            string    `db:"name" json:"name"`
+	CityID          int       `db:"city_id" json:"city_id"`
+	FirstActivityID int64     `db:"first_activity_id" json:"first_activity_id"`
+	FirstReachedAt  time.Time `db:"first_reached_at" json:"first_reached_at"`
+}
+
+// ListStreetsReachedForExport lists every street a user has reached, first reached first
+func (db *DB) ListStreetsReachedForExport(userID int) ([]ExportedStreet, error) {
+	query := `
+        SELECT us.street_id, st.name, st.city_id, us.first_activity_id, us.first_reached_at
+        FROM user_streets us
+        JOIN streets st ON st.id = us.street_id
+        WHERE us.user_id = $1
+        ORDER BY us.first_reached_at, us.street_id`
+
+	streets := []ExportedStreet{}
+	err := db.Select(&streets, query, userID)
+	return streets, err
+}
+
+// userDataTables are the tables DeleteUserData clears, children before the rows they
+// reference, with the condition selecting the user's rows. $1 is the user ID, or their
+// Strava athlete ID for tables keyed by athlete.
+var userDataTables = []struct {
+	table     string
+	where     string
+	byAthlete bool
+}{
+	{"activity_streams", "strava_activity_id IN (SELECT strava_activity_id FROM activities WHERE user_id = $1)", false},
+	{"user_tiles", "user_id = $1", false},
+	{"user_streets", "user_id = $1", false},
+	{"announced_milestones", "user_id = $1", false},
+	{"comment_outbox", "user_id = $1", false},
+	{"comment_triggers", "user_id = $1", false},
+	{"comment_settings", "user_id = $1", false},
+	{"webhook_deliveries", "endpoint_id IN (SELECT id FROM webhook_endpoints WHERE user_id = $1)", false},
+	{"webhook_endpoints", "user_id = $1", false},
+	{"webhook_events", "owner_id = $1", true},
+	{"custom_areas", "user_id = $1", false},
+	{"import_status", "user_id = $1", false},
+	{"rate_limit_buckets", "key = 'user:' || $1::text", false},
+	{"user_features", "user_id = $1", false},
+	{"activities", "user_id = $1", false},
+	{"strava_tokens", "user_id = $1", false},
+	{"users", "id = $1", false},
+}
+
+// DeleteUserData deletes every row stored about a user in one transaction and returns how
+// many rows each table lost. It returns sql.ErrNoRows if there is no such user.
+func (db *DB) DeleteUserData(userID int) (map[string]int64, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var stravaID int64
+	if err := tx.Get(&stravaID, `SELECT strava_id FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+		return nil, err
+	}
+
+	removed := make(map[string]int64, len(userDataTables))
+	for _, t := range userDataTables {
+		var id interface{} = userID
+		if t.byAthlete {
+			id = stravaID
+		}
+		result, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", t.table, t.where), id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete from %s: %w", t.table, err)
+		}
+		removed[t.table], _ = result.RowsAffected()
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserDataTablesCoverSchema(t *testing.T) {
+	db := testDB(t)
+
+	// Every table holding rows of a user by user_id must be cleared by DeleteUserData
+	var tables []string
+	require.NoError(t, db.Select(&tables, `
+        SELECT DISTINCT c.conrelid::regclass::text
+        FROM pg_constraint c
+        JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = ANY (c.conkey)
+        WHERE c.contype = 'f' AND c.confrelid = 'users'::regclass AND a.attname = 'user_id'`))
+	require.NotEmpty(t, tables)
+
+	listed := make(map[string]bool, len(userDataTables))
+	for _, table := range userDataTables {
+		listed[table.table] = true
+	}
+	for _, table := range tables {
+		assert.True(t, listed[table], "%s is missing from userDataTables", table)
+	}
+}
@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Activity sources
+const (
+	ActivitySourceStrava    = "strava"
+	ActivitySourceDirectory = "directory"
+)
+
+// ActivityMetadata holds the summary fields Strava returns for an activity
+type ActivityMetadata struct {
+	StravaActivityID    int64      `db:"strava_activity_id"`
+	Name                string     `db:"name"`
+	ActivityType        string     `db:"activity_type"`
+	SportType           string     `db:"sport_type"`
+	StartDate           *time.Time `db:"start_date"`
+	StartDateLocal      *time.Time `db:"start_date_local"`
+	Timezone            string     `db:"timezone"`
+	DistanceKm          float64    `db:"distance_km"`
+	MovingTimeSeconds   int        `db:"moving_time_seconds"`
+	ElapsedTimeSeconds  int        `db:"elapsed_time_seconds"`
+	TotalElevationGainM float64    `db:"total_elevation_gain_m"`
+	Manual              bool       `db:"manual"`
+	Trainer             bool       `db:"trainer"`
+	Commute             bool       `db:"commute"`
+	Private             bool       `db:"private"`
+	Visibility          string     `db:"visibility"`
+	Polyline            string     `db:"polyline"`
+	StartLatitude       *float64   `db:"start_latitude"`
+	StartLongitude      *float64   `db:"start_longitude"`
+	EndLatitude         *float64   `db:"end_latitude"`
+	EndLongitude        *float64   `db:"end_longitude"`
+}
+
+// StravaActivity is an activity as Strava's activity list and detail endpoints return it
+type StravaActivity struct {
+	ID                 int64     `json:"id"`
+	Name               string    `json:"name"`
+	Distance           float64   `json:"distance"`
+	MovingTime         int       `json:"moving_time"`
+	ElapsedTime        int       `json:"elapsed_time"`
+	TotalElevationGain float64   `json:"total_elevation_gain"`
+	Type               string    `json:"type"`
+	SportType          string    `json:"sport_type"`
+	StartDate          string    `json:"start_date"`
+	StartDateLocal     string    `json:"start_date_local"`
+	Timezone           string    `json:"timezone"`
+	Manual             bool      `json:"manual"`
+	Trainer            bool      `json:"trainer"`
+	Commute            bool      `json:"commute"`
+	Private            bool      `json:"private"`
+	Visibility         string    `json:"visibility"`
+	StartLatlng        []float64 `json:"start_latlng"`
+	EndLatlng          []float64 `json:"end_latlng"`
+	Map                struct {
+		ID              string `json:"id"`
+		Polyline        string `json:"polyline"`
+		SummaryPolyline string `json:"summary_polyline"`
+		ResourceState   int    `json:"resource_state"`
+	} `json:"map"`
+}
+
+// Metadata converts the Strava activity into the columns stored for every activity
+func (a StravaActivity) Metadata() *ActivityMetadata {
+	// Detailed responses carry the full polyline, list responses only the summary one
+	polyline := a.Map.Polyline
+	if polyline == "" {
+		polyline = a.Map.SummaryPolyline
+	}
+
+	meta := &ActivityMetadata{
+		StravaActivityID:    a.ID,
+		Name:                a.Name,
+		ActivityType:        a.Type,
+		SportType:           a.SportType,
+		StartDate:           ParseActivityTime(a.StartDate),
+		StartDateLocal:      ParseActivityTime(a.StartDateLocal),
+		Timezone:            a.Timezone,
+		DistanceKm:          a.Distance / 1000.0, // Strava reports metres
+		MovingTimeSeconds:   a.MovingTime,
+		ElapsedTimeSeconds:  a.ElapsedTime,
+		TotalElevationGainM: a.TotalElevationGain,
+		Manual:              a.Manual,
+		Trainer:             a.Trainer,
+		Commute:             a.Commute,
+		Private:             a.Private,
+		Visibility:          a.Visibility,
+		Polyline:            polyline,
+	}
+	if len(a.StartLatlng) == 2 {
+		meta.StartLatitude = &a.StartLatlng[0]
+		meta.StartLongitude = &a.StartLatlng[1]
+	}
+	if len(a.EndLatlng) == 2 {
+		meta.EndLatitude = &a.EndLatlng[0]
+		meta.EndLongitude = &a.EndLatlng[1]
+	}
+	return meta
+}
+
+// ParseActivityTime parses a Strava timestamp such as start_date or start_date_local.
+// It returns nil for empty or malformed values.
+func ParseActivityTime(value string) *time.Time {
+	if value == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// UpsertActivity inserts an activity with its metadata, or refreshes the metadata of an
+// existing one. An empty pathWKT stores no path (indoor activities) and never clears an
+// existing path. It reports whether a new row was created.
+func (db *DB) UpsertActivity(userID int, meta *ActivityMetadata, pathWKT string) (bool, error) {
+	if meta.SportType == "" {
+		meta.SportType = meta.ActivityType
+	}
+
+	query := `
+        INSERT INTO activities (
+            user_id, strava_activity_id, source, source_ref, path,
+            name, activity_type, sport_type, start_date, start_date_local, timezone,
+            distance_km, moving_time_seconds, elapsed_time_seconds, total_elevation_gain_m,
+            manual, trainer, commute, private, visibility, polyline,
+            start_latitude, start_longitude, end_latitude, end_longitude,
+            comment_posted, metadata_synced_at, created_at, updated_at
+        ) VALUES (
+            $1, $2, 'strava', $2::text, ST_GeomFromText(NULLIF($3::text, ''), 4326),
+            $4, $5, $6, $7, $8, $9,
+            $10, $11, $12, $13,
+            $14, $15, $16, $17, NULLIF($18, ''), NULLIF($19, ''),
+            $20, $21, $22, $23,
+            false, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+        )
+        ON CONFLICT (strava_activity_id) DO UPDATE SET
+            path = COALESCE(EXCLUDED.path, activities.path),
+            name = EXCLUDED.name,
+            activity_type = EXCLUDED.activity_type,
+            sport_type = EXCLUDED.sport_type,
+            start_date = COALESCE(EXCLUDED.start_date, activities.start_date),
+            start_date_local = COALESCE(EXCLUDED.start_date_local, activities.start_date_local),
+            timezone = EXCLUDED.timezone,
+            distance_km = EXCLUDED.distance_km,
+            moving_time_seconds = EXCLUDED.moving_time_seconds,
+            elapsed_time_seconds = EXCLUDED.elapsed_time_seconds,
+            total_elevation_gain_m = EXCLUDED.total_elevation_gain_m,
+            manual = EXCLUDED.manual,
+            trainer = EXCLUDED.trainer,
+            commute = EXCLUDED.commute,
+            private = EXCLUDED.private,
+            visibility = EXCLUDED.visibility,
+            polyline = COALESCE(EXCLUDED.polyline, activities.polyline),
+            start_latitude = EXCLUDED.start_latitude,
+            start_longitude = EXCLUDED.start_longitude,
+            end_latitude = EXCLUDED.end_latitude,
+            end_longitude = EXCLUDED.end_longitude,
+            metadata_synced_at = CURRENT_TIMESTAMP,
+            updated_at = CURRENT_TIMESTAMP
+        RETURNING (xmax = 0) AS inserted`
+
+	var inserted bool
+	err := db.QueryRow(query,
+		userID, meta.StravaActivityID, pathWKT,
+		meta.Name, meta.ActivityType, meta.SportType, meta.StartDate, meta.StartDateLocal, meta.Timezone,
+		meta.DistanceKm, meta.MovingTimeSeconds, meta.ElapsedTimeSeconds, meta.TotalElevationGainM,
+		meta.Manual, meta.Trainer, meta.Commute, meta.Private, meta.Visibility, meta.Polyline,
+		meta.StartLatitude, meta.StartLongitude, meta.EndLatitude, meta.EndLongitude,
+	).Scan(&inserted)
+	return inserted, err
+}
+
+// UpdateActivityMetadata refreshes the metadata of an existing activity without touching
+// its path or coverage. It reports whether a matching activity was found.
+func (db *DB) UpdateActivityMetadata(userID int, meta *ActivityMetadata) (bool, error) {
+	if meta.SportType == "" {
+		meta.SportType = meta.ActivityType
+	}
+
+	query := `
+        UPDATE activities SET
+            name = :name,
+            activity_type = :activity_type,
+            sport_type = :sport_type,
+            start_date = :start_date,
+            start_date_local = :start_date_local,
+            timezone = :timezone,
+            distance_km = :distance_km,
+            moving_time_seconds = :moving_time_seconds,
+            elapsed_time_seconds = :elapsed_time_seconds,
+            total_elevation_gain_m = :total_elevation_gain_m,
+            manual = :manual,
+            trainer = :trainer,
+            commute = :commute,
+            private = :private,
+            visibility = NULLIF(:visibility, ''),
+            polyline = COALESCE(NULLIF(:polyline, ''), polyline),
+            start_latitude = :start_latitude,
+            start_longitude = :start_longitude,
+            end_latitude = :end_latitude,
+            end_longitude = :end_longitude,
+            metadata_synced_at = CURRENT_TIMESTAMP,
+            updated_at = CURRENT_TIMESTAMP
+        WHERE strava_activity_id = :strava_activity_id AND user_id = :user_id`
+
+	args := struct {
+		*ActivityMetadata
+		UserID int `db:"user_id"`
+	}{meta, userID}
+
+	result, err := db.NamedExec(query, args)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// CountActivitiesMissingMetadata counts a user's activities that have never had their
+// Strava summary synced
+func (db *DB) CountActivitiesMissingMetadata(userID int) (int, error) {
+	var count int
+	err := db.Get(&count, `SELECT COUNT(*) FROM activities WHERE user_id = $1 AND metadata_synced_at IS NULL`, userID)
+	return count, err
+}
+
+// UsersMissingMetadata lists the users with a Strava token who have Strava activities
+// whose summary was never synced
+func (db *DB) UsersMissingMetadata() ([]int, error) {
+	query := `
+        SELECT DISTINCT a.user_id
+        FROM activities a
+        JOIN strava_tokens t ON t.user_id = a.user_id
+        WHERE a.metadata_synced_at IS NULL AND a.source = 'strava'
+        ORDER BY a.user_id`
+
+	userIDs := []int{}
+	err := db.Select(&userIDs, query)
+	return userIDs, err
+}
+
+// InsertSourcedActivity stores an activity that did not come from Strava. It is given the
+// next negative ID from local_activity_id_seq, which is written to meta.StravaActivityID.
+// It returns false without error if the user already has an activity with this source reference.
+func (db *DB) InsertSourcedActivity(userID int, source, sourceRef string, meta *ActivityMetadata, pathWKT string) (bool, error) {
+	if meta.SportType == "" {
+		meta.SportType = meta.ActivityType
+	}
+
+	query := `
+        INSERT INTO activities (
+            user_id, strava_activity_id, source, source_ref, path,
+            name, activity_type, sport_type, start_date, start_date_local, timezone,
+            distance_km, moving_time_seconds, elapsed_time_seconds, total_elevation_gain_m,
+            manual, trainer, commute, private, visibility, polyline,
+            start_latitude, start_longitude, end_latitude, end_longitude,
+            comment_posted, metadata_synced_at, created_at, updated_at
+        ) VALUES (
+            $1, nextval('local_activity_id_seq'), $2, $3, ST_GeomFromText(NULLIF($4::text, ''), 4326),
+            $5, $6, $7, $8, $9, NULLIF($10, ''),
+            $11, $12, $13, $14,
+            $15, $16, $17, $18, NULLIF($19, ''), NULLIF($20, ''),
+            $21, $22, $23, $24,
+            false, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+        )
+        ON CONFLICT (user_id, source, source_ref) WHERE source_ref IS NOT NULL DO NOTHING
+        RETURNING strava_activity_id`
+
+	err := db.QueryRow(query,
+		userID, source, sourceRef, pathWKT,
+		meta.Name, meta.ActivityType, meta.SportType, meta.StartDate, meta.StartDateLocal, meta.Timezone,
+		meta.DistanceKm, meta.MovingTimeSeconds, meta.ElapsedTimeSeconds, meta.TotalElevationGainM,
+		meta.Manual, meta.Trainer, meta.Commute, meta.Private, meta.Visibility, meta.Polyline,
+		meta.StartLatitude, meta.StartLongitude, meta.EndLatitude, meta.EndLongitude,
+	).Scan(&meta.StravaActivityID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ActivityExistsForSource checks whether a user already has an activity with the given source reference
+func (db *DB) ActivityExistsForSource(userID int, source, sourceRef string) (bool, error) {
+	var exists bool
+	err := db.Get(&exists, `
+        SELECT EXISTS(SELECT 1 FROM activities WHERE user_id = $1 AND source = $2 AND source_ref = $3)`,
+		userID, source, sourceRef)
+	return exists, err
+}
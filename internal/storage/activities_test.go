@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStravaActivityMetadata(t *testing.T) {
+	var activity StravaActivity
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"id": 123, "name": "Morning Run", "distance": 10500, "moving_time": 3000, "elapsed_time": 3200,
+		"total_elevation_gain": 85.5, "type": "Run", "sport_type": "TrailRun",
+		"start_date": "2024-01-15T07:30:00Z", "start_date_local": "2024-01-15T08:30:00Z",
+		"timezone": "(GMT+01:00) Europe/Paris", "commute": true, "visibility": "followers_only",
+		"start_latlng": [48.85, 2.35], "end_latlng": [],
+		"map": {"polyline": "full", "summary_polyline": "summary"}
+	}`), &activity))
+
+	meta := activity.Metadata()
+	assert.Equal(t, int64(123), meta.StravaActivityID)
+	assert.Equal(t, "Run", meta.ActivityType)
+	assert.Equal(t, "TrailRun", meta.SportType)
+	assert.Equal(t, 10.5, meta.DistanceKm)
+	assert.Equal(t, 85.5, meta.TotalElevationGainM)
+	assert.Equal(t, time.Date(2024, 1, 15, 7, 30, 0, 0, time.UTC), *meta.StartDate)
+	assert.True(t, meta.Commute)
+	assert.Equal(t, "full", meta.Polyline, "detailed responses carry the full polyline")
+	require.NotNil(t, meta.StartLatitude)
+	assert.Equal(t, 48.85, *meta.StartLatitude)
+	assert.Nil(t, meta.EndLatitude)
+
+	// List responses only carry the summary polyline
+	activity.Map.Polyline = ""
+	assert.Equal(t, "summary", activity.Metadata().Polyline)
+}
+
+func TestUpsertActivity(t *testing.T) {
+	db := testDB(t)
+	userID := newTestUser(t, db)
+	activityID := time.Now().UnixNano()
+
+	meta := &ActivityMetadata{StravaActivityID: activityID, Name: "Lunch Ride", ActivityType: "Ride", DistanceKm: 20}
+	inserted, err := db.UpsertActivity(userID, meta, "LINESTRING(2.35 48.85, 2.36 48.86)")
+	require.NoError(t, err)
+	assert.True(t, inserted)
+	assert.Equal(t, "Ride", meta.SportType, "the sport type defaults to the activity type")
+
+	// Upserting again refreshes the metadata and keeps the path when none is given
+	meta.Name = "Renamed Ride"
+	inserted, err = db.UpsertActivity(userID, meta, "")
+	require.NoError(t, err)
+	assert.False(t, inserted)
+
+	var stored struct {
+		Name     string `db:"name"`
+		HasPath  bool   `db:"has_path"`
+		Source   string `db:"source"`
+		Ref      string `db:"source_ref"`
+		IsSynced bool   `db:"synced"`
+	}
+	require.NoError(t, db.Get(&stored, `
+        SELECT name, path IS NOT NULL AS has_path, source, source_ref, metadata_synced_at IS NOT NULL AS synced
+        FROM activities WHERE strava_activity_id = $1`, activityID))
+	assert.Equal(t, "Renamed Ride", stored.Name)
+	assert.True(t, stored.HasPath)
+	assert.Equal(t, ActivitySourceStrava, stored.Source)
+	assert.Equal(t, fmt.Sprint(activityID), stored.Ref)
+	assert.True(t, stored.IsSynced)
+
+	exists, err := db.ActivityExistsForSource(userID, ActivitySourceStrava, fmt.Sprint(activityID))
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestUpdateActivityMetadata(t *testing.T) {
+	db := testDB(t)
+	userID := newTestUser(t, db)
+	otherUserID := newTestUser(t, db)
+	activityID := time.Now().UnixNano()
+
+	_, err := db.Exec(`
+        INSERT INTO activities (user_id, strava_activity_id, source, source_ref, name)
+        VALUES ($1, $2, 'strava', $2::text, 'Imported before metadata')`, userID, activityID)
+	require.NoError(t, err)
+
+	missing, err := db.CountActivitiesMissingMetadata(userID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, missing)
+
+	meta := &ActivityMetadata{StravaActivityID: activityID, Name: "Evening Walk", ActivityType: "Walk", Visibility: "everyone"}
+
+	// Another user's activities are never touched
+	found, err := db.UpdateActivityMetadata(otherUserID, meta)
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	found, err = db.UpdateActivityMetadata(userID, meta)
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	missing, err = db.CountActivitiesMissingMetadata(userID)
+	require.NoError(t, err)
+	assert.Zero(t, missing)
+
+	var name, sportType string
+	require.NoError(t, db.QueryRow(`SELECT name, sport_type FROM activities WHERE strava_activity_id = $1`, activityID).Scan(&name, &sportType))
+	assert.Equal(t, "Evening Walk", name)
+	assert.Equal(t, "Walk", sportType)
+}
+
+func TestActivityMetadataMigrationRenamesStartTime(t *testing.T) {
+	db := testDB(t)
+	migration, err := os.ReadFile("migrations/011_activity_metadata.sql")
+	require.NoError(t, err)
+
+	// Run the migration against a table shaped like it was before, in a schema of its own
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	schema := fmt.Sprintf("migration_test_%d", time.Now().UnixNano())
+	_, err = conn.ExecContext(ctx, fmt.Sprintf(`CREATE SCHEMA %s; SET search_path TO %s, public`, schema, schema))
+	require.NoError(t, err)
+	defer func() {
+		_, _ = conn.ExecContext(ctx, fmt.Sprintf(`SET search_path TO DEFAULT; DROP SCHEMA %s CASCADE`, schema))
+	}()
+
+	_, err = conn.ExecContext(ctx, `
+        CREATE TABLE activities (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER,
+            path GEOMETRY(LINESTRING, 4326),
+            activity_type VARCHAR(50),
+            sport_type VARCHAR(50),
+            distance_km DECIMAL(10,2),
+            start_time TIMESTAMP WITH TIME ZONE,
+            comment_posted BOOLEAN DEFAULT FALSE,
+            commented_at TIMESTAMP WITH TIME ZONE,
+            updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX idx_activities_start_time ON activities(start_time);
+        INSERT INTO activities (activity_type, start_time, comment_posted)
+        VALUES ('Run', '2024-01-15T07:30:00Z', TRUE)`)
+	require.NoError(t, err)
+
+	// Applying it twice must be harmless
+	for i := 0; i < 2; i++ {
+		_, err = conn.ExecContext(ctx, string(migration))
+		require.NoError(t, err)
+	}
+
+	var columns []string
+	rows, err := conn.QueryContext(ctx, `
+        SELECT column_name FROM information_schema.columns
+        WHERE table_schema = $1 AND table_name = 'activities' AND column_name IN ('start_time', 'start_date')`, schema)
+	require.NoError(t, err)
+	for rows.Next() {
+		var column string
+		require.NoError(t, rows.Scan(&column))
+		columns = append(columns, column)
+	}
+	require.NoError(t, rows.Close())
+	assert.Equal(t, []string{"start_date"}, columns)
+
+	var startDate time.Time
+	var sportType string
+	var commented bool
+	require.NoError(t, conn.QueryRowContext(ctx, `SELECT start_date, sport_type, commented_at IS NOT NULL FROM activities`).
+		Scan(&startDate, &sportType, &commented))
+	assert.True(t, startDate.Equal(time.Date(2024, 1, 15, 7, 30, 0, 0, time.UTC)), "the rename keeps the data")
+	assert.Equal(t, "Run", sportType)
+	assert.True(t, commented)
+
+	var index string
+	require.NoError(t, conn.QueryRowContext(ctx, `SELECT indexname FROM pg_indexes WHERE schemaname = $1 AND indexdef LIKE '%(start_date)'`, schema).Scan(&index))
+	assert.Equal(t, "idx_activities_start_date", index)
+}
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/nikhilvedi/strava-coverage/internal/pagination"
+)
+
+// AdminUser is a user as listed in the admin API
+type AdminUser struct {
+	ID             int        `db:"id" json:"id"`
+	StravaID       int64      `db:"strava_id" json:"strava_id"`
+	Name           string     `db:"name" json:"name"`
+	Email          *string    `db:"email" json:"email"`
+	Role           string     `db:"role" json:"role"`
+	ActivityCount  int        `db:"activity_count" json:"activity_count"`
+	LastActivityAt *time.Time `db:"last_activity_at" json:"last_activity_at"`
+	CreatedAt      time.Time  `db:"created_at" json:"created_at"`
+}
+
+// UserPages pages through users, newest first by default
+var UserPages = pagination.Options{
+	Sorts: []pagination.Sort{
+		{Name: "created_at", Column: "u.created_at", Type: "timestamptz"},
+		{Name: "name", Column: "COALESCE(u.name, '')", Type: "text"},
+	},
+	Default:      "-created_at",
+	DefaultLimit: 50,
+	MaxLimit:     500,
+}
+
+// ListUsers lists a page of users, optionally those whose name or email contains search or
+// whose Strava athlete ID is search, and those with a role
+func (db *DB) ListUsers(search, role string, params pagination.Params) ([]AdminUser, pagination.Page, error) {
+	where := `($1 = '' OR u.name ILIKE '%' || $1 || '%' OR u.email ILIKE '%' || $1 || '%' OR u.strava_id::text = $1)
+        AND ($2 = '' OR u.role = $2)`
+
+	var page pagination.Page
+	if err := db.Get(&page.Total, `SELECT COUNT(*) FROM users u WHERE `+where, search, role); err != nil {
+		return nil, page, err
+	}
+
+	args := []interface{}{search, role}
+	query := fmt.Sprintf(`
+        SELECT u.id, u.strava_id, COALESCE(u.name, '') AS name, u.email, u.role, u.created_at,
+               COUNT(a.id) AS activity_count, MAX(COALESCE(a.start_date, a.created_at)) AS last_activity_at
+        FROM users u
+        LEFT JOIN activities a ON a.user_id = u.id
+        WHERE %s AND %s
+        GROUP BY u.id
+        ORDER BY %s
+        LIMIT %d`, where, params.Where("u.id", &args), params.OrderBy("u.id"), params.Fetch())
+
+	users := []AdminUser{}
+	if err := db.Select(&users, query, args...); err != nil {
+		return nil, page, err
+	}
+	var keep int
+	keep, page.Next = params.Trim(len(users), func(i int) (string, int64) {
+		if params.Sort.Name == "name" {
+			return users[i].Name, int64(users[i].ID)
+		}
+		return users[i].CreatedAt.UTC().Format(time.RFC3339Nano), int64(users[i].ID)
+	})
+	return users[:keep], page, nil
+}
+
+// GetAdminUser returns a user as listed in the admin API. It returns sql.ErrNoRows if there
+// is no such user.
+func (db *DB) GetAdminUser(userID int) (*AdminUser, error) {
+	query := `
+        SELECT u.id, u.strava_id, COALESCE(u.name, '') AS name, u.email, u.role, u.created_at,
+               COUNT(a.id) AS activity_count, MAX(COALESCE(a.start_date, a.created_at)) AS last_activity_at
+        FROM users u
+        LEFT JOIN activities a ON a.user_id = u.id
+        WHERE u.id = $1
+        GROUP BY u.id`
+
+	user := &AdminUser{}
+	if err := db.Get(user, query, userID); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// queues are the tables background work waits in, each with a status column
+var queues = []string{"comment_outbox", "webhook_deliveries", "webhook_events"}
+
+// QueueCounts counts the rows of every queue by status
+func (db *DB) QueueCounts() (map[string]map[string]int, error) {
+	counts := make(map[string]map[string]int, len(queues))
+	for _, queue := range queues {
+		var rows []struct {
+			Status string `db:"status"`
+			Count  int    `db:"count"`
+		}
+		if err := db.Select(&rows, fmt.Sprintf(`SELECT status, COUNT(*) AS count FROM %s GROUP BY status`, queue)); err != nil {
+			return nil, fmt.Errorf("failed to count %s: %w", queue, err)
+		}
+		counts[queue] = make(map[string]int, len(rows))
+		for _, row := range rows {
+			counts[queue][row.Status] = row.Count
+		}
+	}
+	return counts, nil
+}
+
+// QueueBacklog is the work waiting in one queue, including work being done: how much
+// there is and when the oldest of it was queued
+type QueueBacklog struct {
+	Queue  string     `db:"queue"`
+	Depth  int        `db:"depth"`
+	Oldest *time.Time `db:"oldest"`
+}
+
+// QueueBacklogs reports the backlog of every queue, with initial imports in progress as
+// the "imports" queue
+func (db *DB) QueueBacklogs() ([]QueueBacklog, error) {
+	query := `
+        SELECT 'comment_outbox' AS queue, COUNT(*) AS depth, MIN(created_at) AS oldest
+        FROM comment_outbox WHERE status IN ('pending', 'sending')
+        UNION ALL
+        SELECT 'webhook_deliveries', COUNT(*), MIN(created_at)
+        FROM webhook_deliveries WHERE status IN ('pending', 'sending')
+        UNION ALL
+        SELECT 'webhook_events', COUNT(*), MIN(received_at)
+        FROM webhook_events WHERE status IN ('received', 'processing')
+        UNION ALL
+        SELECT 'imports', COUNT(*), MIN(started_at)
+        FROM import_status WHERE in_progress`
+
+	backlogs := []QueueBacklog{}
+	err := db.Select(&backlogs, query)
+	return backlogs, err
+}
+
+// RunningImport is an initial import marked in progress
+type RunningImport struct {
+	UserID        int        `db:"user_id" json:"user_id"`
+	ImportedCount int        `db:"imported_count" json:"imported_count"`
+	FailedCount   int        `db:"failed_count" json:"failed_count"`
+	CurrentPage   int        `db:"current_page" json:"current_page"`
+	StartedAt     *time.Time `db:"started_at" json:"started_at"`
+	UpdatedAt     *time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// ListRunningImports lists the imports marked in progress, oldest first. One not updated
+// for a while was probably cut off by a restart.
+func (db *DB) ListRunningImports() ([]RunningImport, error) {
+	query := `
+        SELECT user_id, COALESCE(imported_count, 0) AS imported_count, COALESCE(failed_count, 0) AS failed_count,
+               COALESCE(current_page, 1) AS current_page, started_at, updated_at
+        FROM import_status
+        WHERE in_progress
+        ORDER BY started_at`
+
+	imports := []RunningImport{}
+	err := db.Select(&imports, query)
+	return imports, err
+}
+
+// CityUpdate holds the fields of a city to change; nil fields are left as they are
+type CityUpdate struct {
+	Name        *string
+	CountryCode *string
+	// BoundaryGeoJSON is a Polygon or MultiPolygon
+	BoundaryGeoJSON *string
+}
+
+// UpdateCity changes a city. It returns sql.ErrNoRows if there is no such city.
+func (db *DB) UpdateCity(cityID int, update CityUpdate) error {
+	query := `
+        UPDATE cities SET
+            name = COALESCE($2, name),
+            country_code = COALESCE(UPPER($3), country_code),
+            boundary = COALESCE(ST_Multi(ST_SetSRID(ST_GeomFromGeoJSON($4), 4326)), boundary),
+            updated_at = NOW()
+        WHERE id = $1`
+
+	result, err := db.Exec(query, cityID, update.Name, update.CountryCode, update.BoundaryGeoJSON)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// MergeCities folds one city into another: the target's boundary grows to cover both, and
+// the source's activities and streets move to the target before the source is deleted. It
+// returns how many activities moved, or sql.ErrNoRows if either city does not exist.
+// Coverage of the moved activities needs recalculating afterwards.
+func (db *DB) MergeCities(sourceID, targetID int) (int64, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var found int
+	if err := tx.Get(&found, `SELECT COUNT(*) FROM (SELECT id FROM cities WHERE id IN ($1, $2) FOR UPDATE) c`, sourceID, targetID); err != nil {
+		return 0, err
+	}
+	if found != 2 {
+		return 0, sql.ErrNoRows
+	}
+
+	if _, err := tx.Exec(`
+        UPDATE cities t SET boundary = ST_Multi(ST_Union(t.boundary, s.boundary)), updated_at = NOW()
+        FROM cities s
+        WHERE t.id = $2 AND s.id = $1`, sourceID, targetID); err != nil {
+		return 0, fmt.Errorf("failed to merge boundaries: %w", err)
+	}
+
+	moved, err := tx.Exec(`UPDATE activities SET city_id = $2, updated_at = NOW() WHERE city_id = $1`, sourceID, targetID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to move activities: %w", err)
+	}
+
+	// Streets in both cities are kept once, in the target
+	if _, err := tx.Exec(`
+        DELETE FROM streets s
+        WHERE s.city_id = $1 AND s.osm_id IS NOT NULL
+        AND EXISTS (SELECT 1 FROM streets t WHERE t.city_id = $2 AND t.osm_id = s.osm_id)`, sourceID, targetID); err != nil {
+		return 0, fmt.Errorf("failed to drop duplicate streets: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE streets SET city_id = $2 WHERE city_id = $1`, sourceID, targetID); err != nil {
+		return 0, fmt.Errorf("failed to move streets: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM cities WHERE id = $1`, sourceID); err != nil {
+		return 0, fmt.Errorf("failed to delete merged city: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	activities, _ := moved.RowsAffected()
+	return activities, nil
+}
+
+// DeleteCity deletes a city and its streets. Its activities are kept without a city, so
+// city detection can place them again. It returns how many activities lost their city, or
+// sql.ErrNoRows if there is no such city.
+func (db *DB) DeleteCity(cityID int) (int64, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	unassigned, err := tx.Exec(`UPDATE activities SET city_id = NULL, coverage_percentage = NULL, updated_at = NOW() WHERE city_id = $1`, cityID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to unassign activities: %w", err)
+	}
+	result, err := tx.Exec(`DELETE FROM cities WHERE id = $1`, cityID)
+	if err != nil {
+		return 0, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return 0, sql.ErrNoRows
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	activities, _ := unassigned.RowsAffected()
+	return activities, nil
+}
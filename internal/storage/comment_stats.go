@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Thresholds used by GetActivityCommentStats
+const (
+	// StreetMatchDistanceM is how close a GPS track must pass to count as covering a street
+	StreetMatchDistanceM = 15.0
+	// StreetCompleteFraction is the share of a street's length that must be covered to complete it
+	StreetCompleteFraction = 0.9
+	// TileZoom is the zoom level of the map tiles counted as explored
+	TileZoom = 14
+)
+
+// ActivityCommentStats holds everything a coverage comment can mention about an activity.
+// Comparisons only consider the user's activities in the same city that started earlier,
+// so the stats of a past activity are the same as when it was uploaded.
+type ActivityCommentStats struct {
+	ActivityID       int64          `db:"strava_activity_id"`
+	UserID           int            `db:"user_id"`
+	Name             string         `db:"name"`
+	ActivityType     string         `db:"activity_type"`
+	DistanceKm       float64        `db:"distance_km"`
+	StartedAt        time.Time      `db:"started_at"`
+	CityID           *int           `db:"city_id"`
+	CityName         *string        `db:"city_name"`
+	Coverage         *float64       `db:"coverage_percentage"`
+	PreviousCoverage float64        `db:"previous_coverage"`
+	NewKm            float64        `db:"new_km"`
+	CompletedStreets pq.StringArray `db:"completed_streets"` // names of the streets the activity completed
+	CityRank         int            `db:"city_rank"`         // 0 when the activity has no coverage
+	CityAthletes     int            `db:"city_athletes"`     // users with coverage in the city
+	EarlierInCity    int            `db:"earlier_in_city"`
+	LongestInCity    bool           `db:"longest_in_city"`
+	BiggestIncrease  bool           `db:"biggest_increase"`
+	// PreviousBestNewKm is the most new km of any earlier activity in any city, if known
+	PreviousBestNewKm *float64 `db:"previous_best_new_km"`
+	TilesNew          int      `db:"tiles_new"`   // tiles first visited by the activity
+	TilesTotal        int      `db:"tiles_total"` // tiles visited up to and including the activity
+}
+
+// GetActivityCommentStats computes the comment stats of an activity
+func (db *DB) GetActivityCommentStats(stravaActivityID int64) (*ActivityCommentStats, error) {
+	query := `
+        WITH act AS (
+            SELECT a.strava_activity_id, a.user_id, a.city_id, a.path, a.coverage_percentage,
+                   COALESCE(a.name, '') AS name,
+                   COALESCE(a.sport_type, a.activity_type, '') AS activity_type,
+                   COALESCE(a.distance_km, 0) AS distance_km,
+                   COALESCE(a.start_date, a.created_at) AS started_at
+            FROM activities a
+            WHERE a.strava_activity_id = $1
+        ),
+        earlier AS (
+            SELECT e.path, e.coverage_percentage, e.distance_km,
+                   COALESCE(e.start_date, e.created_at) AS started_at
+            FROM activities e, act
+            WHERE e.user_id = act.user_id
+                AND e.city_id = act.city_id
+                AND e.strava_activity_id <> act.strava_activity_id
+                AND COALESCE(e.start_date, e.created_at) < act.started_at
+        ),
+        before_area AS (
+            SELECT ST_Union(ST_Buffer(path::geography, $2::float8)::geometry) AS geom
+            FROM earlier
+            WHERE path IS NOT NULL
+        ),
+        after_area AS (
+            SELECT CASE
+                       WHEN b.geom IS NULL THEN ST_Buffer(act.path::geography, $2::float8)::geometry
+                       ELSE ST_Union(b.geom, ST_Buffer(act.path::geography, $2::float8)::geometry)
+                   END AS geom
+            FROM act, before_area b
+            WHERE act.path IS NOT NULL
+        ),
+        previous AS (
+            SELECT coverage_percentage
+            FROM earlier
+            WHERE coverage_percentage IS NOT NULL
+            ORDER BY started_at DESC
+            LIMIT 1
+        ),
+        increases AS (
+            SELECT COALESCE(h.start_date, h.created_at) AS started_at,
+                   h.coverage_percentage - LAG(h.coverage_percentage, 1, 0)
+                       OVER (ORDER BY COALESCE(h.start_date, h.created_at)) AS increase
+            FROM activities h, act
+            WHERE h.user_id = act.user_id
+                AND h.city_id = act.city_id
+                AND h.coverage_percentage IS NOT NULL
+        ),
+        standings AS (
+            SELECT s.user_id, MAX(s.coverage_percentage) AS coverage
+            FROM activities s, act
+            WHERE s.city_id = act.city_id AND s.coverage_percentage IS NOT NULL
+            GROUP BY s.user_id
+        )
+        SELECT
+            act.strava_activity_id,
+            act.user_id,
+            act.name,
+            act.activity_type,
+            act.distance_km,
+            act.started_at,
+            act.city_id,
+            c.name AS city_name,
+            act.coverage_percentage,
+            COALESCE((SELECT coverage_percentage FROM previous), 0) AS previous_coverage,
+            CASE
+                WHEN act.path IS NULL OR c.id IS NULL THEN 0
+                WHEN b.geom IS NULL THEN ST_Length(ST_Intersection(act.path, c.boundary)::geography) / 1000
+                ELSE ST_Length(ST_Difference(ST_Intersection(act.path, c.boundary), b.geom)::geography) / 1000
+            END AS new_km,
+            COALESCE((
+                SELECT array_agg(st.name ORDER BY st.name)
+                FROM streets st, after_area aa
+                WHERE st.city_id = act.city_id
+                    AND ST_DWithin(st.geom::geography, act.path::geography, $2::float8)
+                    AND ST_Length(ST_Intersection(st.geom, aa.geom)::geography) >= $3::float8 * st.length_m
+                    AND (b.geom IS NULL OR ST_Length(ST_Intersection(st.geom, b.geom)::geography) < $3::float8 * st.length_m)
+            ), '{}') AS completed_streets,
+            CASE
+                WHEN act.coverage_percentage IS NULL THEN 0
+                ELSE 1 + (SELECT COUNT(*) FROM standings WHERE user_id <> act.user_id AND coverage > act.coverage_percentage)
+            END AS city_rank,
+            (SELECT COUNT(*) FROM standings) AS city_athletes,
+            (SELECT COUNT(*) FROM earlier) AS earlier_in_city,
+            EXISTS (SELECT 1 FROM earlier)
+                AND act.distance_km > (SELECT COALESCE(MAX(distance_km), 0) FROM earlier) AS longest_in_city,
+            EXISTS (SELECT 1 FROM previous)
+                AND COALESCE(act.coverage_percentage - (SELECT coverage_percentage FROM previous), 0) > 0
+                AND act.coverage_percentage - (SELECT coverage_percentage FROM previous) >
+                    (SELECT COALESCE(MAX(increase), 0) FROM increases WHERE started_at < act.started_at) AS biggest_increase,
+            (
+                SELECT MAX(p.new_km)
+                FROM activities p
+                WHERE p.user_id = act.user_id
+                    AND p.strava_activity_id <> act.strava_activity_id
+                    AND COALESCE(p.start_date, p.created_at) < act.started_at
+            ) AS previous_best_new_km,
+            (
+                SELECT COUNT(*) FROM user_tiles t
+                WHERE t.user_id = act.user_id AND t.zoom = $4 AND t.first_activity_id = act.strava_activity_id
+            ) AS tiles_new,
+            (
+                SELECT COUNT(*) FROM user_tiles t
+                WHERE t.user_id = act.user_id AND t.zoom = $4 AND t.first_visited_at <= act.started_at
+            ) AS tiles_total
+        FROM act
+        LEFT JOIN cities c ON c.id = act.city_id
+        CROSS JOIN before_area b`
+
+	var stats ActivityCommentStats
+	err := db.Get(&stats, query, stravaActivityID, StreetMatchDistanceM, StreetCompleteFraction, TileZoom)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// GetLatestCoveredActivityID returns the most recent of a user's activities with coverage
+func (db *DB) GetLatestCoveredActivityID(userID int) (int64, error) {
+	query := `
+        SELECT strava_activity_id
+        FROM activities
+        WHERE user_id = $1 AND coverage_percentage IS NOT NULL
+        ORDER BY COALESCE(start_date, created_at) DESC
+        LIMIT 1`
+
+	var activityID int64
+	err := db.Get(&activityID, query, userID)
+	return activityID, err
+}
+
+// SetActivityNewKm stores the km of new ground an activity covered, used to find records
+func (db *DB) SetActivityNewKm(stravaActivityID int64, newKm float64) error {
+	_, err := db.Exec(`UPDATE activities SET new_km = $1 WHERE strava_activity_id = $2`, newKm, stravaActivityID)
+	return err
+}
+
+// RecordActivityTiles adds the map tiles an activity passed through to its user's explored
+// tiles. A tile already explored by a later activity is credited to this one instead, and
+// its first-reached time is cleared until this activity's coverage is calculated.
+func (db *DB) RecordActivityTiles(stravaActivityID int64) error {
+	query := `
+        INSERT INTO user_tiles (user_id, zoom, x, y, first_activity_id, first_visited_at)
+        SELECT a.user_id, $2::int, t.x, t.y, a.strava_activity_id, COALESCE(a.start_date, a.created_at)
+        FROM activities a, activity_tiles(a.path, $2::int) t
+        WHERE a.strava_activity_id = $1 AND a.path IS NOT NULL
+        ON CONFLICT (user_id, zoom, x, y) DO UPDATE SET
+            first_activity_id = EXCLUDED.first_activity_id,
+            first_visited_at = EXCLUDED.first_visited_at,
+            first_reached_at = NULL
+        WHERE EXCLUDED.first_visited_at < user_tiles.first_visited_at`
+
+	_, err := db.Exec(query, stravaActivityID, TileZoom)
+	return err
+}
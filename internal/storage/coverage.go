@@ -95,18 +95,18 @@ func (db *DB) GetUserCityCoverage(userID int, cityID int) (float64, error) {
 	return coverage, err
 }
 
-// MarkActivityCommented marks an activity as having its coverage comment posted
+// MarkActivityCommented records that the notifications of an activity were sent
 func (db *DB) MarkActivityCommented(activityID int64) error {
 	query := `
         UPDATE activities
-        SET comment_posted = true
+        SET comment_posted = true, commented_at = NOW(), updated_at = CURRENT_TIMESTAMP
         WHERE strava_activity_id = $1`
 
 	_, err := db.Exec(query, activityID)
 	return err
 }
 
-// GetUncommentedActivities gets activities that need coverage comments
+// GetUncommentedActivities gets activities with coverage whose notifications were not sent, oldest first
 func (db *DB) GetUncommentedActivities(userID int) ([]*Activity, error) {
 	query := `
         SELECT 
@@ -114,15 +114,63 @@ func (db *DB) GetUncommentedActivities(userID int) ([]*Activity, error) {
             coverage_percentage, comment_posted, created_at, updated_at
         FROM activities
         WHERE user_id = $1 
-        AND comment_posted = false
+        AND commented_at IS NULL
         AND coverage_percentage IS NOT NULL
-        ORDER BY created_at DESC`
+        ORDER BY COALESCE(start_date, created_at) ASC`
 
 	activities := []*Activity{}
 	err := db.Select(&activities, query, userID)
 	return activities, err
 }
 
+// ActivityNotifyState is what the notification pipeline needs to know about an activity
+type ActivityNotifyState struct {
+	UserID       int        `db:"user_id"`
+	Source       string     `db:"source"`
+	ActivityType string     `db:"activity_type"`
+	Coverage     *float64   `db:"coverage_percentage"`
+	CommentedAt  *time.Time `db:"commented_at"`
+}
+
+// GetActivityNotifyState loads the notification state of an activity
+func (db *DB) GetActivityNotifyState(activityID int64) (*ActivityNotifyState, error) {
+	query := `
+        SELECT user_id, source, COALESCE(sport_type, activity_type, '') AS activity_type,
+               coverage_percentage, commented_at
+        FROM activities
+        WHERE strava_activity_id = $1`
+
+	var state ActivityNotifyState
+	if err := db.Get(&state, query, activityID); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// SetDescriptionBlock records whether the Strava description of an activity carries a coverage block
+func (db *DB) SetDescriptionBlock(activityID int64, present bool) error {
+	query := `
+        UPDATE activities
+        SET description_block_at = CASE WHEN $2 THEN NOW() END, updated_at = CURRENT_TIMESTAMP
+        WHERE strava_activity_id = $1`
+
+	_, err := db.Exec(query, activityID, present)
+	return err
+}
+
+// GetDescriptionBlockActivities lists the Strava IDs of a user's activities whose description carries a coverage block
+func (db *DB) GetDescriptionBlockActivities(userID int) ([]int64, error) {
+	query := `
+        SELECT strava_activity_id
+        FROM activities
+        WHERE user_id = $1 AND description_block_at IS NOT NULL
+        ORDER BY description_block_at`
+
+	ids := []int64{}
+	err := db.Select(&ids, query, userID)
+	return ids, err
+}
+
 // GetCity retrieves a city by ID
 func (db *DB) GetCity(cityID int) (*City, error) {
 	query := `
@@ -11,6 +11,9 @@ import (
 // DB wraps sqlx.DB to provide custom functionality
 type DB struct {
 	*sqlx.DB
+
+	// tokenKeys encrypts Strava tokens; without keys they are stored in plaintext
+	tokenKeys *KeyRing
 }
 
 // NewDB creates a new database connection
@@ -29,7 +32,12 @@ func NewDB(dbURL string) (*DB, error) {
 		return nil, fmt.Errorf("failed to enable PostGIS: %v", err)
 	}
 
-	return &DB{db}, nil
+	return &DB{DB: db}, nil
+}
+
+// SetTokenKeys sets the keys Strava tokens are encrypted with
+func (db *DB) SetTokenKeys(keys *KeyRing) {
+	db.tokenKeys = keys
 }
 
 // Close closes the database connection
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testDB connects to the database in DB_URL, which must have every migration applied, or
+// skips the test when DB_URL is not set
+func testDB(t *testing.T) *DB {
+	t.Helper()
+	url := os.Getenv("DB_URL")
+	if url == "" {
+		t.Skip("DB_URL is not set")
+	}
+	db, err := NewDB(url)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// newTestUser creates a user with a Strava ID no other test uses, and deletes it and
+// everything it owns when the test ends
+func newTestUser(t *testing.T, db *DB) int {
+	t.Helper()
+	var userID int
+	require.NoError(t, db.Get(&userID, `INSERT INTO users (strava_id) VALUES ($1) RETURNING id`, time.Now().UnixNano()))
+	t.Cleanup(func() { _, _ = db.Exec(`DELETE FROM users WHERE id = $1`, userID) })
+	return userID
+}
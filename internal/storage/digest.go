@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Street suggestion tuning for the weekly digest
+const (
+	// SuggestionRouteWindow is how far back activities count as the user's usual routes
+	SuggestionRouteWindow = 90 * 24 * time.Hour
+	// SuggestionRadiusM is how close to a usual route a suggested street must be
+	SuggestionRadiusM = 1000.0
+	// SuggestionMaxCoveredFraction is the most of a street's length the user may have covered
+	// for it to count as unexplored
+	SuggestionMaxCoveredFraction = 0.1
+)
+
+// DigestSubscription is a user's weekly digest email settings
+type DigestSubscription struct {
+	UserID           int        `db:"id" json:"user_id"`
+	Name             string     `db:"name" json:"-"`
+	Language         string     `db:"language" json:"-"`
+	Units            string     `db:"units" json:"-"`
+	Email            *string    `db:"email" json:"email"`
+	Enabled          bool       `db:"digest_enabled" json:"enabled"`
+	UnsubscribeToken *string    `db:"digest_unsubscribe_token" json:"-"`
+	LastSentAt       *time.Time `db:"digest_last_sent_at" json:"last_sent_at"`
+}
+
+const digestSubscriptionColumns = `id, COALESCE(name, '') AS name, language, units, email, digest_enabled,
+               digest_unsubscribe_token, digest_last_sent_at`
+
+// GetDigestSubscription retrieves a user's digest settings
+func (db *DB) GetDigestSubscription(userID int) (*DigestSubscription, error) {
+	query := `SELECT ` + digestSubscriptionColumns + ` FROM users WHERE id = $1`
+
+	sub := &DigestSubscription{}
+	if err := db.QueryRowx(query, userID).StructScan(sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// UpdateDigestSubscription saves a user's digest address, opt-in and unsubscribe token. It
+// returns sql.ErrNoRows if the user does not exist.
+func (db *DB) UpdateDigestSubscription(sub *DigestSubscription) error {
+	query := `
+        UPDATE users
+        SET email = $2, digest_enabled = $3, digest_unsubscribe_token = $4, updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1`
+
+	result, err := db.Exec(query, sub.UserID, sub.Email, sub.Enabled, sub.UnsubscribeToken)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// UnsubscribeDigest turns the digest off for the user holding an unsubscribe token and
+// returns their language. It returns sql.ErrNoRows if no user holds the token.
+func (db *DB) UnsubscribeDigest(token string) (string, error) {
+	query := `
+        UPDATE users
+        SET digest_enabled = FALSE, updated_at = CURRENT_TIMESTAMP
+        WHERE digest_unsubscribe_token = $1
+        RETURNING language`
+
+	var language string
+	err := db.QueryRow(query, token).Scan(&language)
+	return language, err
+}
+
+// GetDueDigestSubscriptions lists the opted-in users with an address whose last digest was
+// sent before the cutoff, or who never had one. Users an admin switched digests off for
+// are left out.
+func (db *DB) GetDueDigestSubscriptions(sentBefore time.Time) ([]DigestSubscription, error) {
+	query := `
+        SELECT ` + digestSubscriptionColumns + `
+        FROM users
+        WHERE digest_enabled AND email IS NOT NULL AND email <> ''
+        AND (digest_last_sent_at IS NULL OR digest_last_sent_at < $1)
+        AND NOT ` + featureOff("users.id", FeatureDigest) + `
+        ORDER BY id`
+
+	subs := []DigestSubscription{}
+	err := db.Select(&subs, query, sentBefore)
+	return subs, err
+}
+
+// MarkDigestSent records when a user's digest was sent
+func (db *DB) MarkDigestSent(userID int, sentAt time.Time) error {
+	_, err := db.Exec(`UPDATE users SET digest_last_sent_at = $2 WHERE id = $1`, userID, sentAt)
+	return err
+}
+
+// GetActivityTotals counts a user's activities started in [since, until) and the km of new
+// ground they covered
+func (db *DB) GetActivityTotals(userID int, since, until time.Time) (activities int, newKm float64, err error) {
+	query := `
+        SELECT COUNT(*), COALESCE(SUM(new_km), 0)
+        FROM activities
+        WHERE user_id = $1
+        AND COALESCE(start_date, created_at) >= $2
+        AND COALESCE(start_date, created_at) < $3`
+
+	err = db.QueryRow(query, userID, since, until).Scan(&activities, &newKm)
+	return activities, newKm, err
+}
+
+// CityStreet is a named street in a city
+type CityStreet struct {
+	CityName   string  `db:"city_name" json:"city_name"`
+	StreetName string  `db:"street_name" json:"street_name"`
+	LengthKm   float64 `db:"length_km" json:"length_km"`
+	DistanceKm float64 `db:"distance_km" json:"distance_km,omitempty"` // from the user's routes, for suggestions
+}
+
+// GetStreetsCompletedBetween lists the streets a user completed with activities started in
+// [since, until): covered by everything up to until but not by what came before since
+func (db *DB) GetStreetsCompletedBetween(userID int, since, until time.Time) ([]CityStreet, error) {
+	query := `
+        WITH active_cities AS (
+            SELECT DISTINCT city_id
+            FROM activities
+            WHERE user_id = $1 AND city_id IS NOT NULL AND path IS NOT NULL
+            AND COALESCE(start_date, created_at) >= $2
+            AND COALESCE(start_date, created_at) < $3
+        ),
+        before_area AS (
+            SELECT a.city_id, ST_Union(ST_Buffer(a.path::geography, $4::float8)::geometry) AS geom
+            FROM activities a
+            JOIN active_cities ac ON ac.city_id = a.city_id
+            WHERE a.user_id = $1 AND a.path IS NOT NULL
+            AND COALESCE(a.start_date, a.created_at) < $2
+            GROUP BY a.city_id
+        ),
+        after_area AS (
+            SELECT a.city_id, ST_Union(ST_Buffer(a.path::geography, $4::float8)::geometry) AS geom
+            FROM activities a
+            JOIN active_cities ac ON ac.city_id = a.city_id
+            WHERE a.user_id = $1 AND a.path IS NOT NULL
+            AND COALESCE(a.start_date, a.created_at) < $3
+            GROUP BY a.city_id
+        )
+        SELECT c.name AS city_name, st.name AS street_name, st.length_m / 1000 AS length_km, 0::float8 AS distance_km
+        FROM streets st
+        JOIN after_area aa ON aa.city_id = st.city_id
+        JOIN cities c ON c.id = st.city_id
+        LEFT JOIN before_area b ON b.city_id = st.city_id
+        WHERE ST_Length(ST_Intersection(st.geom, aa.geom)::geography) >= $5::float8 * st.length_m
+        AND (b.geom IS NULL OR ST_Length(ST_Intersection(st.geom, b.geom)::geography) < $5::float8 * st.length_m)
+        ORDER BY c.name, st.name`
+
+	streets := []CityStreet{}
+	err := db.Select(&streets, query, userID, since, until, StreetMatchDistanceM, StreetCompleteFraction)
+	return streets, err
+}
+
+// GetStreetSuggestions lists streets near the user's recent routes that they have barely
+// covered, longest first
+func (db *DB) GetStreetSuggestions(userID int, limit int) ([]CityStreet, error) {
+	query := `
+        WITH recent AS (
+            SELECT city_id, ST_Collect(path) AS geom
+            FROM activities
+            WHERE user_id = $1 AND city_id IS NOT NULL AND path IS NOT NULL
+            AND COALESCE(start_date, created_at) >= NOW() - $2 * INTERVAL '1 second'
+            GROUP BY city_id
+        ),
+        covered AS (
+            SELECT a.city_id, ST_Union(ST_Buffer(a.path::geography, $3::float8)::geometry) AS geom
+            FROM activities a
+            JOIN recent r ON r.city_id = a.city_id
+            WHERE a.user_id = $1 AND a.path IS NOT NULL
+            GROUP BY a.city_id
+        )
+        SELECT c.name AS city_name, st.name AS street_name, st.length_m / 1000 AS length_km,
+               ST_Distance(st.geom::geography, r.geom::geography) / 1000 AS distance_km
+        FROM streets st
+        JOIN recent r ON r.city_id = st.city_id
+        JOIN cities c ON c.id = st.city_id
+        LEFT JOIN covered cv ON cv.city_id = st.city_id
+        WHERE ST_DWithin(st.geom::geography, r.geom::geography, $4::float8)
+        AND (cv.geom IS NULL OR ST_Length(ST_Intersection(st.geom, cv.geom)::geography) < $5::float8 * st.length_m)
+        ORDER BY st.length_m DESC
+        LIMIT $6`
+
+	streets := []CityStreet{}
+	err := db.Select(&streets, query, userID, SuggestionRouteWindow.Seconds(), StreetMatchDistanceM,
+		SuggestionRadiusM, SuggestionMaxCoveredFraction, limit)
+	return streets, err
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"time"
+)
+
+// StreetEntry is where an activity's path first came within the street match distance of a
+// street, as a fraction of the path's length
+type StreetEntry struct {
+	StreetID int     `db:"street_id"`
+	Fraction float64 `db:"fraction"`
+}
+
+// TileEntry is where an activity's path first entered a map tile, as a fraction of the
+// path's length
+type TileEntry struct {
+	X        int     `db:"x"`
+	Y        int     `db:"y"`
+	Fraction float64 `db:"fraction"`
+}
+
+// StreetReached is a street first reached by an activity
+type StreetReached struct {
+	StreetID  int       `db:"street_id" json:"street_id"`
+	Name      string    `db:"name" json:"name"`
+	ReachedAt time.Time `db:"first_reached_at" json:"reached_at"`
+}
+
+// TileReached is a map tile first reached by an activity
+type TileReached struct {
+	Zoom      int       `db:"zoom" json:"zoom"`
+	X         int       `db:"x" json:"x"`
+	Y         int       `db:"y" json:"y"`
+	ReachedAt time.Time `db:"first_reached_at" json:"reached_at"`
+}
+
+// GetStreetEntries locates where an activity first reached each street of a city it passed
+func (db *DB) GetStreetEntries(stravaActivityID int64, cityID int) ([]StreetEntry, error) {
+	query := `
+        SELECT street_id, fraction FROM (
+            SELECT st.id AS street_id,
+                   first_entry_fraction(a.path, ST_Buffer(st.geom::geography, $3::float8)::geometry) AS fraction
+            FROM activities a
+            JOIN streets st ON st.city_id = $2
+            WHERE a.strava_activity_id = $1
+                AND ST_DWithin(st.geom::geography, a.path::geography, $3::float8)
+        ) e
+        WHERE fraction IS NOT NULL`
+
+	entries := []StreetEntry{}
+	err := db.Select(&entries, query, stravaActivityID, cityID, StreetMatchDistanceM)
+	return entries, err
+}
+
+// GetTileEntries locates where an activity first entered each tile credited to it
+func (db *DB) GetTileEntries(stravaActivityID int64) ([]TileEntry, error) {
+	query := `
+        SELECT x, y, fraction FROM (
+            SELECT t.x, t.y, first_entry_fraction(a.path, ST_TileEnvelope(t.zoom, t.x, t.y)) AS fraction
+            FROM user_tiles t
+            JOIN activities a ON a.strava_activity_id = t.first_activity_id
+            WHERE t.first_activity_id = $1 AND t.zoom = $2
+        ) e
+        WHERE fraction IS NOT NULL`
+
+	entries := []TileEntry{}
+	err := db.Select(&entries, query, stravaActivityID, TileZoom)
+	return entries, err
+}
+
+// RecordStreetReached stores when a user first reached a street, keeping an earlier time
+// from another activity
+func (db *DB) RecordStreetReached(userID int, streetID int, stravaActivityID int64, reachedAt time.Time) error {
+	query := `
+        INSERT INTO user_streets (user_id, street_id, first_activity_id, first_reached_at)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (user_id, street_id) DO UPDATE SET
+            first_activity_id = EXCLUDED.first_activity_id,
+            first_reached_at = EXCLUDED.first_reached_at
+        WHERE EXCLUDED.first_reached_at < user_streets.first_reached_at`
+
+	_, err := db.Exec(query, userID, streetID, stravaActivityID, reachedAt)
+	return err
+}
+
+// SetTileReached stores when the activity credited with a tile entered it
+func (db *DB) SetTileReached(stravaActivityID int64, x, y int, reachedAt time.Time) error {
+	query := `
+        UPDATE user_tiles SET first_reached_at = $5
+        WHERE first_activity_id = $1 AND zoom = $2 AND x = $3 AND y = $4`
+
+	_, err := db.Exec(query, stravaActivityID, TileZoom, x, y, reachedAt)
+	return err
+}
+
+// GetStreetsReachedBy lists the streets an activity is the first to have reached
+func (db *DB) GetStreetsReachedBy(stravaActivityID int64) ([]StreetReached, error) {
+	query := `
+        SELECT us.street_id, st.name, us.first_reached_at
+        FROM user_streets us
+        JOIN streets st ON st.id = us.street_id
+        WHERE us.first_activity_id = $1
+        ORDER BY us.first_reached_at, st.name`
+
+	streets := []StreetReached{}
+	err := db.Select(&streets, query, stravaActivityID)
+	return streets, err
+}
+
+// GetTilesReachedBy lists the tiles an activity is the first to have reached, leaving out
+// those without a stored time
+func (db *DB) GetTilesReachedBy(stravaActivityID int64) ([]TileReached, error) {
+	query := `
+        SELECT zoom, x, y, first_reached_at
+        FROM user_tiles
+        WHERE first_activity_id = $1 AND first_reached_at IS NOT NULL
+        ORDER BY first_reached_at, x, y`
+
+	tiles := []TileReached{}
+	err := db.Select(&tiles, query, stravaActivityID)
+	return tiles, err
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirstEntryFraction(t *testing.T) {
+	db := testDB(t)
+
+	// East along 60°N for 1° of longitude, then north for 1° of latitude. The northern leg
+	// is about twice as long in metres, though both span one degree.
+	path := `ST_GeomFromText('LINESTRING(0 60, 1 60, 1 61)', 4326)`
+
+	var corner float64
+	require.NoError(t, db.Get(&corner, `SELECT first_entry_fraction(`+path+`,
+        ST_GeomFromText('POLYGON((0.99 59.9, 1.1 59.9, 1.1 60.1, 0.99 60.1, 0.99 59.9))', 4326))`))
+	assert.InDelta(t, 0.33, corner, 0.01, "the fraction is of the metric length, not 0.5 degrees")
+
+	// The earliest entry wins whichever part of the area comes first in the geometry
+	var entry float64
+	require.NoError(t, db.Get(&entry, `SELECT first_entry_fraction(`+path+`, ST_GeomFromText('MULTIPOLYGON(
+        ((0.9 60.8, 1.1 60.8, 1.1 60.9, 0.9 60.9, 0.9 60.8)),
+        ((0.4 59.9, 0.5 59.9, 0.5 60.1, 0.4 60.1, 0.4 59.9)))', 4326))`))
+	assert.InDelta(t, 0.132, entry, 0.005)
+
+	var missed *float64
+	require.NoError(t, db.Get(&missed, `SELECT first_entry_fraction(`+path+`,
+        ST_GeomFromText('POLYGON((5 5, 6 5, 6 6, 5 6, 5 5))', 4326))`))
+	assert.Nil(t, missed)
+}
+
+func TestRecordStreetReached(t *testing.T) {
+	db := testDB(t)
+	userID := newTestUser(t, db)
+
+	var cityID, streetID int
+	require.NoError(t, db.Get(&cityID, `
+        INSERT INTO cities (name, country_code, boundary)
+        VALUES ('First Reached Test', 'GB', ST_GeomFromText('MULTIPOLYGON(((0 60, 1 60, 1 61, 0 61, 0 60)))', 4326))
+        RETURNING id`))
+	t.Cleanup(func() { _, _ = db.Exec(`DELETE FROM cities WHERE id = $1`, cityID) })
+	require.NoError(t, db.Get(&streetID, `
+        INSERT INTO streets (city_id, name, geom, length_m)
+        VALUES ($1, 'Test Street', ST_GeomFromText('MULTILINESTRING((0.5 60.4, 0.5 60.6))', 4326), 22000)
+        RETURNING id`, cityID))
+
+	later, earlier := time.Now().UnixNano(), time.Now().UnixNano()+1
+	for _, id := range []int64{later, earlier} {
+		_, err := db.UpsertActivity(userID, &ActivityMetadata{StravaActivityID: id, Name: "Walk", ActivityType: "Walk"},
+			"LINESTRING(0.4 60.5, 0.6 60.5)")
+		require.NoError(t, err)
+	}
+
+	entries, err := db.GetStreetEntries(later, cityID)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, streetID, entries[0].StreetID)
+	assert.InDelta(t, 0.5, entries[0].Fraction, 0.01)
+
+	// An earlier time replaces the stored one; a later one does not
+	noon := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, db.RecordStreetReached(userID, streetID, later, noon))
+	require.NoError(t, db.RecordStreetReached(userID, streetID, earlier, noon.Add(-time.Hour)))
+	require.NoError(t, db.RecordStreetReached(userID, streetID, later, noon))
+
+	reached, err := db.GetStreetsReachedBy(earlier)
+	require.NoError(t, err)
+	require.Len(t, reached, 1)
+	assert.Equal(t, "Test Street", reached[0].Name)
+	assert.True(t, reached[0].ReachedAt.Equal(noon.Add(-time.Hour)))
+
+	reached, err = db.GetStreetsReachedBy(later)
+	require.NoError(t, err)
+	assert.Empty(t, reached)
+}
@@ -0,0 +1,30 @@
+-- Persistent log of incoming Strava webhook events
+-- Strava retries deliveries, so (object_id, aspect_type, event_time) is used as an idempotency key
+
+CREATE TABLE IF NOT EXISTS webhook_events (
+    id SERIAL PRIMARY KEY,
+    object_type VARCHAR(20) NOT NULL,
+    object_id BIGINT NOT NULL,
+    aspect_type VARCHAR(20) NOT NULL,
+    owner_id BIGINT NOT NULL,
+    subscription_id BIGINT,
+    event_time BIGINT NOT NULL,
+    updates JSONB,
+    status VARCHAR(20) NOT NULL DEFAULT 'received',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    error_message TEXT,
+    received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    processed_at TIMESTAMP WITH TIME ZONE,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    UNIQUE(object_id, aspect_type, event_time),
+    CHECK (status IN ('received', 'processing', 'processed', 'skipped', 'failed'))
+);
+
+-- Index for the admin failed-event listing
+CREATE INDEX IF NOT EXISTS idx_webhook_events_status ON webhook_events(status, received_at DESC);
+CREATE INDEX IF NOT EXISTS idx_webhook_events_owner ON webhook_events(owner_id);
+
+COMMENT ON TABLE webhook_events IS 'Every webhook event received from Strava, with its processing outcome';
+COMMENT ON COLUMN webhook_events.status IS 'received, processing, processed, skipped (not an event we act on) or failed';
+COMMENT ON COLUMN webhook_events.attempts IS 'Number of times processing has been attempted, including replays';
@@ -0,0 +1,41 @@
+-- Store the full Strava activity summary and settle on one set of column names
+-- The start time column is named after Strava's start_date field, which the comment queries already read
+
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_schema = current_schema() AND table_name = 'activities' AND column_name = 'start_time')
+       AND NOT EXISTS (SELECT 1 FROM information_schema.columns
+                       WHERE table_schema = current_schema() AND table_name = 'activities' AND column_name = 'start_date') THEN
+        ALTER TABLE activities RENAME COLUMN start_time TO start_date;
+    END IF;
+END $$;
+
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS start_date TIMESTAMP WITH TIME ZONE;
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS start_date_local TIMESTAMP;
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS manual BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS trainer BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS commute BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS private BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS visibility VARCHAR(30);
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS metadata_synced_at TIMESTAMP WITH TIME ZONE;
+
+ALTER INDEX IF EXISTS idx_activities_start_time RENAME TO idx_activities_start_date;
+CREATE INDEX IF NOT EXISTS idx_activities_start_date ON activities(start_date);
+CREATE INDEX IF NOT EXISTS idx_activities_user_start_date ON activities(user_id, start_date DESC);
+
+-- Backfill what can be derived locally; the rest is synced from Strava for rows where
+-- metadata_synced_at IS NULL by the server's backfill worker or POST /api/import/backfill-metadata/:userId
+UPDATE activities SET sport_type = activity_type WHERE sport_type IS NULL AND activity_type IS NOT NULL;
+UPDATE activities SET activity_type = sport_type WHERE activity_type IS NULL AND sport_type IS NOT NULL;
+UPDATE activities
+SET distance_km = ROUND((ST_Length(path::geography) / 1000)::numeric, 2)
+WHERE distance_km IS NULL AND path IS NOT NULL;
+
+COMMENT ON COLUMN activities.start_date IS 'Activity start time in UTC (Strava start_date)';
+COMMENT ON COLUMN activities.start_date_local IS 'Activity start wall-clock time in the athlete''s timezone (Strava start_date_local)';
+COMMENT ON COLUMN activities.metadata_synced_at IS 'When the Strava summary fields were last written; NULL rows still need a backfill';
+
+-- comment_posted and commented_at are both written when a comment is posted; reconcile older rows
+UPDATE activities SET commented_at = updated_at WHERE comment_posted = TRUE AND commented_at IS NULL;
+UPDATE activities SET comment_posted = TRUE WHERE commented_at IS NOT NULL AND comment_posted IS DISTINCT FROM TRUE;
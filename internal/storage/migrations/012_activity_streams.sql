@@ -0,0 +1,17 @@
+-- Companion store for the Strava time, altitude and distance streams of each activity
+-- The path column keeps the plain LINESTRING used by the coverage queries; the full
+-- streams are kept here as a gzip-compressed JSON blob keyed by the Strava activity ID
+
+CREATE TABLE IF NOT EXISTS activity_streams (
+    strava_activity_id BIGINT PRIMARY KEY REFERENCES activities(strava_activity_id) ON DELETE CASCADE,
+    point_count INTEGER NOT NULL,
+    has_time BOOLEAN NOT NULL DEFAULT FALSE,
+    has_altitude BOOLEAN NOT NULL DEFAULT FALSE,
+    has_distance BOOLEAN NOT NULL DEFAULT FALSE,
+    data BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+COMMENT ON TABLE activity_streams IS 'Per-point Strava streams (latlng, time, altitude, distance) for each activity';
+COMMENT ON COLUMN activity_streams.data IS 'gzip-compressed JSON object keyed by stream type, e.g. {"time": [0, 1, ...], "altitude": [...]}';
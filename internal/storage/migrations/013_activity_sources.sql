@@ -0,0 +1,21 @@
+-- Activities can come from sources other than Strava, e.g. GPX/FIT files dropped into a watched folder
+-- Non-Strava activities get negative IDs from local_activity_id_seq so the strava_activity_id key
+-- used throughout coverage, streams and maps stays unique and never collides with a Strava ID
+
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS source VARCHAR(20) NOT NULL DEFAULT 'strava';
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS source_ref TEXT;
+
+UPDATE activities SET source_ref = strava_activity_id::text WHERE source = 'strava' AND source_ref IS NULL;
+
+CREATE SEQUENCE IF NOT EXISTS local_activity_id_seq
+    INCREMENT BY -1
+    MINVALUE -9223372036854775807
+    MAXVALUE -1
+    START WITH -1;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_activities_user_source_ref
+    ON activities(user_id, source, source_ref)
+    WHERE source_ref IS NOT NULL;
+
+COMMENT ON COLUMN activities.source IS 'Origin of the activity: strava or directory';
+COMMENT ON COLUMN activities.source_ref IS 'Identifier within the source: the Strava activity ID, or the SHA-256 of an imported file';
@@ -0,0 +1,20 @@
+-- Street network of each tracked city, used to count streets a user has completed
+-- Rows are loaded from OpenStreetMap (e.g. named highways clipped to the city boundary);
+-- cities without streets simply report no completed streets
+
+CREATE TABLE IF NOT EXISTS streets (
+    id SERIAL PRIMARY KEY,
+    city_id INTEGER NOT NULL REFERENCES cities(id) ON DELETE CASCADE,
+    osm_id BIGINT,
+    name VARCHAR(255) NOT NULL,
+    geom GEOMETRY(MULTILINESTRING, 4326) NOT NULL,
+    length_m DOUBLE PRECISION NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_streets_city ON streets(city_id);
+CREATE INDEX IF NOT EXISTS idx_streets_geom ON streets USING GIST(geom);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_streets_city_osm ON streets(city_id, osm_id) WHERE osm_id IS NOT NULL;
+
+COMMENT ON TABLE streets IS 'Named streets within each city, one row per street with all its ways merged';
+COMMENT ON COLUMN streets.length_m IS 'Geodesic length of geom in metres';
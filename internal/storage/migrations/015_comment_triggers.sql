@@ -0,0 +1,63 @@
+-- Trigger rules deciding when an activity gets a coverage comment, and the record of
+-- milestones already announced so recalculations never announce them twice
+
+CREATE TABLE IF NOT EXISTS comment_triggers (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    trigger_type VARCHAR(30) NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    threshold INTEGER,
+    message TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, trigger_type)
+);
+
+COMMENT ON COLUMN comment_triggers.trigger_type IS 'every_activity, coverage_milestone, first_city, new_km_record, street_completed or explored_tiles';
+COMMENT ON COLUMN comment_triggers.threshold IS 'Tile interval for explored_tiles; unused by other triggers';
+COMMENT ON COLUMN comment_triggers.message IS 'Comment template; empty uses the default message of the trigger';
+
+CREATE TABLE IF NOT EXISTS announced_milestones (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    trigger_type VARCHAR(30) NOT NULL,
+    milestone_key TEXT NOT NULL,
+    strava_activity_id BIGINT,
+    announced_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, milestone_key)
+);
+
+COMMENT ON COLUMN announced_milestones.milestone_key IS 'Identifies the milestone, e.g. coverage_milestone:city:4:25 or explored_tiles:500';
+
+-- Km of new ground covered by each activity, used to detect personal records
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS new_km DECIMAL(10,2);
+
+-- Explored map tiles (slippy map tiles at a fixed zoom) with the activity that first visited each
+CREATE TABLE IF NOT EXISTS user_tiles (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    zoom SMALLINT NOT NULL,
+    x INTEGER NOT NULL,
+    y INTEGER NOT NULL,
+    first_activity_id BIGINT NOT NULL REFERENCES activities(strava_activity_id) ON DELETE CASCADE,
+    first_visited_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (user_id, zoom, x, y)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_tiles_first_activity ON user_tiles(first_activity_id);
+
+-- Tiles a path passes through; the path is densified to 100m so no tile is skipped
+CREATE OR REPLACE FUNCTION activity_tiles(path GEOMETRY, zoom INTEGER)
+RETURNS TABLE (x INTEGER, y INTEGER) AS $$
+    SELECT DISTINCT
+        floor((ST_X(pt.geom) + 180) / 360 * (1 << zoom))::INTEGER,
+        floor((1 - ln(tan(radians(ST_Y(pt.geom))) + 1 / cos(radians(ST_Y(pt.geom)))) / pi()) / 2 * (1 << zoom))::INTEGER
+    FROM ST_DumpPoints(ST_Segmentize(path::geography, 100)::geometry) AS pt
+$$ LANGUAGE SQL IMMUTABLE;
+
+-- Backfill explored tiles from existing activities, crediting each tile to its earliest visit
+INSERT INTO user_tiles (user_id, zoom, x, y, first_activity_id, first_visited_at)
+SELECT DISTINCT ON (a.user_id, t.x, t.y)
+    a.user_id, 14, t.x, t.y, a.strava_activity_id, COALESCE(a.start_date, a.created_at)
+FROM activities a, activity_tiles(a.path, 14) t
+WHERE a.path IS NOT NULL
+ORDER BY a.user_id, t.x, t.y, COALESCE(a.start_date, a.created_at)
+ON CONFLICT (user_id, zoom, x, y) DO NOTHING;
@@ -0,0 +1,13 @@
+-- Let users choose between a comment and a block in the activity description
+
+ALTER TABLE comment_settings ADD COLUMN IF NOT EXISTS output_mode VARCHAR(20) NOT NULL DEFAULT 'comment';
+
+ALTER TABLE comment_settings DROP CONSTRAINT IF EXISTS comment_settings_output_mode_check;
+ALTER TABLE comment_settings ADD CONSTRAINT comment_settings_output_mode_check
+    CHECK (output_mode IN ('comment', 'description'));
+
+-- Activities whose Strava description currently carries a coverage block, so the
+-- blocks can be removed again when the user switches back to comments
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS description_block_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_activities_description_block ON activities(user_id) WHERE description_block_at IS NOT NULL;
@@ -0,0 +1,35 @@
+-- Every notification the pipeline intends to deliver, recorded before it is sent.
+-- Transient failures (rate limits, Strava errors) stay pending and are retried with backoff.
+
+CREATE TABLE IF NOT EXISTS comment_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    activity_id BIGINT NOT NULL,
+    channel VARCHAR(50) NOT NULL,
+    text TEXT NOT NULL,
+    triggers TEXT[] NOT NULL DEFAULT '{}',
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    response TEXT,
+    external_id VARCHAR(100),
+    next_attempt_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMP WITH TIME ZONE,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CHECK (status IN ('pending', 'sending', 'sent', 'failed', 'dry_run'))
+);
+
+-- Index for the retry worker
+CREATE INDEX IF NOT EXISTS idx_comment_outbox_due ON comment_outbox(next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_comment_outbox_user ON comment_outbox(user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_comment_outbox_activity ON comment_outbox(activity_id);
+
+-- Per-user dry run: render and record notifications without delivering them
+ALTER TABLE comment_settings ADD COLUMN IF NOT EXISTS dry_run BOOLEAN NOT NULL DEFAULT FALSE;
+
+COMMENT ON TABLE comment_outbox IS 'Audit trail of every notification, with its delivery attempts and outcome';
+COMMENT ON COLUMN comment_outbox.status IS 'pending (waiting for an attempt), sending, sent, failed (gave up) or dry_run (never sent)';
+COMMENT ON COLUMN comment_outbox.response IS 'Body of the last response from the channel, e.g. the Strava API';
+COMMENT ON COLUMN comment_outbox.external_id IS 'ID of what was created remotely, e.g. the Strava comment ID';
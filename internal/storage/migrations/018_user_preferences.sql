@@ -0,0 +1,7 @@
+-- Language and distance units of the text posted to Strava for a user
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS language VARCHAR(10) NOT NULL DEFAULT 'en';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS units VARCHAR(10) NOT NULL DEFAULT 'km';
+
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_units_check;
+ALTER TABLE users ADD CONSTRAINT users_units_check CHECK (units IN ('km', 'miles'));
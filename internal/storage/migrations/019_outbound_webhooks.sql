@@ -0,0 +1,46 @@
+-- Endpoints registered to receive signed coverage events, and every delivery made to them
+
+CREATE TABLE IF NOT EXISTS webhook_endpoints (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    events TEXT[] NOT NULL DEFAULT '{}',
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    secret TEXT NOT NULL,
+    previous_secret TEXT,
+    previous_secret_expires_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_endpoints_user ON webhook_endpoints(user_id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    endpoint_id INTEGER NOT NULL REFERENCES webhook_endpoints(id) ON DELETE CASCADE,
+    event_id VARCHAR(50) NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    response_status INTEGER,
+    response_body TEXT,
+    last_error TEXT,
+    duration_ms INTEGER,
+    next_attempt_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    delivered_at TIMESTAMP WITH TIME ZONE,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CHECK (status IN ('pending', 'sending', 'delivered', 'failed'))
+);
+
+-- Index for the retry worker
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_endpoint ON webhook_deliveries(endpoint_id, created_at DESC);
+
+COMMENT ON COLUMN webhook_endpoints.user_id IS 'Owner of the endpoint; NULL for admin endpoints, which receive every user''s events';
+COMMENT ON COLUMN webhook_endpoints.events IS 'Event types delivered to the endpoint; empty for all';
+COMMENT ON COLUMN webhook_endpoints.previous_secret IS 'Secret replaced by the last rotation, still signing deliveries until previous_secret_expires_at';
+COMMENT ON COLUMN webhook_deliveries.status IS 'pending (waiting for an attempt), sending, delivered or failed (gave up)';
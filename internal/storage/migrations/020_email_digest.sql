@@ -0,0 +1,11 @@
+-- Opt-in weekly digest email
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email VARCHAR(255);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS digest_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS digest_unsubscribe_token VARCHAR(64);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS digest_last_sent_at TIMESTAMP WITH TIME ZONE;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_digest_unsubscribe_token ON users(digest_unsubscribe_token);
+
+COMMENT ON COLUMN users.email IS 'Address the weekly digest is sent to';
+COMMENT ON COLUMN users.digest_unsubscribe_token IS 'Secret in the one-click unsubscribe link of every digest';
@@ -0,0 +1,11 @@
+-- Strava OAuth scopes each user granted
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS strava_scopes TEXT[];
+
+-- Users who signed in before scopes were recorded were asked for read access only
+UPDATE users SET strava_scopes = ARRAY['read', 'activity:read', 'activity:read_all'] WHERE strava_scopes IS NULL;
+
+ALTER TABLE users ALTER COLUMN strava_scopes SET DEFAULT '{}';
+ALTER TABLE users ALTER COLUMN strava_scopes SET NOT NULL;
+
+COMMENT ON COLUMN users.strava_scopes IS 'Scopes granted at the last Strava authorization; features needing a missing scope are disabled';
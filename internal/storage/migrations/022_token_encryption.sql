@@ -0,0 +1,22 @@
+-- Encryption at rest for Strava tokens
+--
+-- Tokens are sealed with envelope encryption: a random data key per row encrypts
+-- access_token and refresh_token with AES-256-GCM, and data_key holds that data key
+-- encrypted with the key-encryption key numbered key_version from TOKEN_ENCRYPTION_KEYS.
+-- Rows written before this migration keep key_version NULL and stay readable as plaintext;
+-- the server encrypts them at startup once keys are configured, and
+-- `go run ./cmd/rotate_tokens` does the same on demand.
+
+ALTER TABLE strava_tokens ADD COLUMN IF NOT EXISTS key_version INTEGER;
+ALTER TABLE strava_tokens ADD COLUMN IF NOT EXISTS data_key TEXT;
+
+ALTER TABLE strava_tokens DROP CONSTRAINT IF EXISTS strava_tokens_key_check;
+ALTER TABLE strava_tokens ADD CONSTRAINT strava_tokens_key_check
+    CHECK ((key_version IS NULL) = (data_key IS NULL));
+
+CREATE INDEX IF NOT EXISTS idx_strava_tokens_key_version ON strava_tokens(key_version);
+
+COMMENT ON COLUMN strava_tokens.access_token IS 'Base64 AES-GCM nonce and ciphertext under data_key, or plaintext when key_version is NULL';
+COMMENT ON COLUMN strava_tokens.refresh_token IS 'Base64 AES-GCM nonce and ciphertext under data_key, or plaintext when key_version is NULL';
+COMMENT ON COLUMN strava_tokens.key_version IS 'Version of the TOKEN_ENCRYPTION_KEYS key that encrypted data_key; NULL for plaintext rows';
+COMMENT ON COLUMN strava_tokens.data_key IS 'Per-row data key, encrypted with key key_version';
@@ -0,0 +1,15 @@
+-- Token buckets for API rate limiting, shared by every server instance when
+-- RATE_LIMIT_STORE=postgres. A bucket holds `tokens` as of `updated_at` and refills from
+-- there; rows for buckets that have refilled are pruned.
+
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+    key VARCHAR(255) PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limit_buckets_updated_at ON rate_limit_buckets(updated_at);
+
+COMMENT ON TABLE rate_limit_buckets IS 'API rate limit token buckets, keyed by user or client IP';
+COMMENT ON COLUMN rate_limit_buckets.key IS 'user:<id> for signed-in users, ip:<address> otherwise';
+COMMENT ON COLUMN rate_limit_buckets.tokens IS 'Tokens left in the bucket at updated_at';
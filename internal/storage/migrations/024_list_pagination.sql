@@ -0,0 +1,9 @@
+-- Indexes for paging through lists by keyset. Activity lists sort on the start date,
+-- falling back to the import time, with the ID breaking ties.
+
+CREATE INDEX IF NOT EXISTS idx_activities_user_start_id
+    ON activities(user_id, (COALESCE(start_date, created_at)) DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_activities_user_distance_id
+    ON activities(user_id, (COALESCE(distance_km, 0)) DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_custom_areas_user_created_id ON custom_areas(user_id, created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_webhook_events_received_id ON webhook_events(received_at DESC, id DESC);
@@ -0,0 +1,23 @@
+-- Roles for the admin API and features admins can switch off for a user
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'user';
+
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_check;
+ALTER TABLE users ADD CONSTRAINT users_role_check CHECK (role IN ('user', 'moderator', 'admin'));
+
+CREATE INDEX IF NOT EXISTS idx_users_role ON users(role) WHERE role <> 'user';
+
+COMMENT ON COLUMN users.role IS 'user, moderator (reads the admin API and edits cities) or admin (everything)';
+
+-- Features are on unless a row switches them off
+CREATE TABLE IF NOT EXISTS user_features (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    feature VARCHAR(50) NOT NULL,
+    enabled BOOLEAN NOT NULL,
+    updated_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, feature)
+);
+
+COMMENT ON TABLE user_features IS 'Per-user overrides of features: comments, digest, webhooks and auto_import';
+COMMENT ON COLUMN user_features.updated_by IS 'The admin who last set the override';
@@ -0,0 +1,27 @@
+-- When each user first reached each street and map tile, stored when coverage is calculated
+
+ALTER TABLE user_tiles ADD COLUMN IF NOT EXISTS first_reached_at TIMESTAMP WITH TIME ZONE;
+
+COMMENT ON COLUMN user_tiles.first_reached_at IS 'Time the first activity entered the tile; NULL when the activity has no time stream';
+
+CREATE TABLE IF NOT EXISTS user_streets (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    street_id INTEGER NOT NULL REFERENCES streets(id) ON DELETE CASCADE,
+    first_activity_id BIGINT NOT NULL REFERENCES activities(strava_activity_id) ON DELETE CASCADE,
+    first_reached_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (user_id, street_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_streets_first_activity ON user_streets(first_activity_id);
+
+COMMENT ON TABLE user_streets IS 'Streets each user has passed within the street match distance of, with the first time they did';
+
+-- Fraction of a path's length at which it first enters an area, or NULL when it never does.
+-- Every part of the intersection is considered, not just the first. Both are projected to
+-- EPSG:3857 so the fraction is of a metric length, matching the distance stream.
+CREATE OR REPLACE FUNCTION first_entry_fraction(path GEOMETRY, area GEOMETRY)
+RETURNS DOUBLE PRECISION AS $$
+    SELECT MIN(ST_LineLocatePoint(l.line, pt.geom))
+    FROM (SELECT ST_Transform(path, 3857) AS line) l,
+         ST_DumpPoints(ST_Intersection(l.line, ST_Transform(area, 3857))) AS pt
+$$ LANGUAGE SQL IMMUTABLE;
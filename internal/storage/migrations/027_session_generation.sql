@@ -0,0 +1,5 @@
+-- Sessions carry the generation of their user when issued; bumping it signs every session out
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS session_generation INTEGER NOT NULL DEFAULT 0;
+
+COMMENT ON COLUMN users.session_generation IS 'Sessions issued with a lower generation are no longer accepted; raised on sign out';
@@ -1,32 +1,29 @@
 package storage
 
 import (
+	"database/sql"
 	"fmt"
+	"strconv"
 	"time"
 )
 
-// GetTokenByUserID fetches the token for a user (by string userID)
+// GetTokenByUserID fetches the token for a user (by string Strava athlete ID)
 func GetTokenByUserID(db *DB, token *StravaToken, userID string) error {
-	// Convert string userID to int64 for database lookup
-	var stravaID int64
-	if _, err := fmt.Sscanf(userID, "%d", &stravaID); err != nil {
+	stravaID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
 		return fmt.Errorf("invalid strava_id format: %s", userID)
 	}
 
-	fmt.Printf("Looking up user with Strava ID: %d\n", stravaID)
-	var id int
-	if err := db.Get(&id, "SELECT id FROM users WHERE strava_id = $1", stravaID); err != nil {
-		fmt.Printf("Error finding user: %v\n", err)
+	id, err := db.GetUserIDByStravaID(stravaID)
+	if err != nil {
 		return fmt.Errorf("failed to find user with strava_id %d: %v", stravaID, err)
 	}
-	fmt.Printf("Found user with internal ID: %d\n", id)
 
-	err := db.Get(token, "SELECT * FROM strava_tokens WHERE user_id = $1", id)
+	stored, err := db.GetStravaToken(id)
 	if err != nil {
-		fmt.Printf("Error finding token: %v\n", err)
 		return fmt.Errorf("failed to find token for user_id %d: %v", id, err)
 	}
-	fmt.Printf("Successfully found token for user_id %d\n", id)
+	*token = *stored
 	return nil
 }
 
@@ -80,6 +77,27 @@ func (db *DB) GetUserByStravaID(stravaID int64) (*User, error) {
 	return user, nil
 }
 
+// UserExists reports whether a user with the given ID exists
+func (db *DB) UserExists(userID int) (bool, error) {
+	var exists bool
+	err := db.Get(&exists, `SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, userID)
+	return exists, err
+}
+
+// GetSessionGeneration returns the generation a user's sessions must carry to be accepted.
+// It returns sql.ErrNoRows if there is no such user.
+func (db *DB) GetSessionGeneration(userID int) (int, error) {
+	var generation int
+	err := db.Get(&generation, `SELECT session_generation FROM users WHERE id = $1`, userID)
+	return generation, err
+}
+
+// RevokeSessions ends every session of a user by raising their session generation
+func (db *DB) RevokeSessions(userID int) error {
+	_, err := db.Exec(`UPDATE users SET session_generation = session_generation + 1 WHERE id = $1`, userID)
+	return err
+}
+
 // UpdateUserName updates a user's name
 func (db *DB) UpdateUserName(userID int, name string) error {
 	query := `
@@ -91,35 +109,76 @@ func (db *DB) UpdateUserName(userID int, name string) error {
 	return err
 }
 
-// UpsertStravaToken creates or updates Strava tokens for a user
+// UserPreferences are a user's language and distance units
+type UserPreferences struct {
+	UserID   int    `db:"id" json:"user_id"`
+	Language string `db:"language" json:"language"`
+	Units    string `db:"units" json:"units"`
+}
+
+// GetUserPreferences retrieves a user's language and units
+func (db *DB) GetUserPreferences(userID int) (*UserPreferences, error) {
+	prefs := &UserPreferences{}
+	err := db.QueryRowx(`SELECT id, language, units FROM users WHERE id = $1`, userID).StructScan(prefs)
+	if err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+// UpdateUserPreferences saves a user's language and units. It returns sql.ErrNoRows if the user does not exist.
+func (db *DB) UpdateUserPreferences(prefs *UserPreferences) error {
+	query := `
+        UPDATE users
+        SET language = $2, units = $3, updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1`
+
+	result, err := db.Exec(query, prefs.UserID, prefs.Language, prefs.Units)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// UpsertStravaToken creates or updates Strava tokens for a user. The tokens are encrypted
+// when token keys are set.
 func (db *DB) UpsertStravaToken(userID int, token *StravaToken) error {
+	sealed, err := db.sealTokens(userID, token.AccessToken, token.RefreshToken)
+	if err != nil {
+		return err
+	}
+
 	query := `
-        INSERT INTO strava_tokens (user_id, access_token, refresh_token, expires_at)
-        VALUES ($1, $2, $3, $4)
+        INSERT INTO strava_tokens (user_id, access_token, refresh_token, expires_at, key_version, data_key)
+        VALUES ($1, $2, $3, $4, NULLIF($5, 0), NULLIF($6, ''))
         ON CONFLICT (user_id)
         DO UPDATE SET
             access_token = EXCLUDED.access_token,
             refresh_token = EXCLUDED.refresh_token,
             expires_at = EXCLUDED.expires_at,
+            key_version = EXCLUDED.key_version,
+            data_key = EXCLUDED.data_key,
             updated_at = CURRENT_TIMESTAMP`
 
-	_, err := db.Exec(query, userID, token.AccessToken, token.RefreshToken, token.ExpiresAt)
+	_, err = db.Exec(query, userID, sealed.AccessToken, sealed.RefreshToken, token.ExpiresAt, sealed.KeyVersion, sealed.DataKey)
 	return err
 }
 
-// GetStravaToken retrieves Strava tokens for a user
+// GetStravaToken retrieves and decrypts Strava tokens for a user
 func (db *DB) GetStravaToken(userID int) (*StravaToken, error) {
 	query := `
-        SELECT id, user_id, access_token, refresh_token, expires_at, created_at, updated_at
+        SELECT id, user_id, access_token, refresh_token, expires_at, created_at, updated_at, key_version, data_key
         FROM strava_tokens
         WHERE user_id = $1`
 
-	token := &StravaToken{}
-	err := db.QueryRowx(query, userID).StructScan(token)
-	if err != nil {
+	row := &storedToken{}
+	if err := db.QueryRowx(query, userID).StructScan(row); err != nil {
 		return nil, err
 	}
-	return token, nil
+	return db.openToken(row)
 }
 
 // CustomArea represents a user-drawn custom area
@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevokeSessions(t *testing.T) {
+	db := testDB(t)
+	userID := newTestUser(t, db)
+
+	generation, err := db.GetSessionGeneration(userID)
+	require.NoError(t, err)
+	assert.Zero(t, generation)
+
+	require.NoError(t, db.RevokeSessions(userID))
+	generation, err = db.GetSessionGeneration(userID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, generation)
+
+	_, err = db.GetSessionGeneration(-1)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nikhilvedi/strava-coverage/internal/pagination"
+)
+
+// Comment outbox states
+const (
+	OutboxStatusPending = "pending"
+	OutboxStatusSending = "sending"
+	OutboxStatusSent    = "sent"
+	OutboxStatusFailed  = "failed"
+	OutboxStatusDryRun  = "dry_run"
+)
+
+// OutboxEntry is a notification recorded for delivery to one channel
+type OutboxEntry struct {
+	ID            int64          `db:"id" json:"id"`
+	UserID        int            `db:"user_id" json:"user_id"`
+	ActivityID    int64          `db:"activity_id" json:"activity_id"`
+	Channel       string         `db:"channel" json:"channel"`
+	Text          string         `db:"text" json:"text"`
+	Triggers      pq.StringArray `db:"triggers" json:"triggers"`
+	Status        string         `db:"status" json:"status"`
+	Attempts      int            `db:"attempts" json:"attempts"`
+	LastError     *string        `db:"last_error" json:"last_error,omitempty"`
+	Response      *string        `db:"response" json:"response,omitempty"`
+	ExternalID    *string        `db:"external_id" json:"external_id,omitempty"`
+	NextAttemptAt *time.Time     `db:"next_attempt_at" json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time      `db:"created_at" json:"created_at"`
+	SentAt        *time.Time     `db:"sent_at" json:"sent_at,omitempty"`
+	UpdatedAt     time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+const outboxColumns = `id, user_id, activity_id, channel, text, triggers, status, attempts, last_error,
+               response, external_id, next_attempt_at, created_at, sent_at, updated_at`
+
+// CreateOutboxEntry records a notification before any delivery is attempted
+func (db *DB) CreateOutboxEntry(entry *OutboxEntry) error {
+	query := `
+        INSERT INTO comment_outbox (user_id, activity_id, channel, text, triggers, status, next_attempt_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING id, created_at, updated_at`
+
+	if entry.Triggers == nil {
+		entry.Triggers = pq.StringArray{}
+	}
+	return db.QueryRow(query,
+		entry.UserID, entry.ActivityID, entry.Channel, entry.Text, entry.Triggers, entry.Status, entry.NextAttemptAt,
+	).Scan(&entry.ID, &entry.CreatedAt, &entry.UpdatedAt)
+}
+
+// ClaimOutboxEntry moves a pending entry to sending and counts the attempt. It returns
+// false if the entry is no longer pending, e.g. another worker claimed it.
+func (db *DB) ClaimOutboxEntry(id int64) (bool, error) {
+	query := `
+        UPDATE comment_outbox
+        SET status = 'sending', attempts = attempts + 1, updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1 AND status = 'pending'`
+
+	result, err := db.Exec(query, id)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// FinishOutboxEntry records the outcome of a delivery attempt. A pending status needs
+// nextAttempt, the time of the retry. The last error is kept after a later success.
+func (db *DB) FinishOutboxEntry(id int64, status string, response, externalID, lastError *string, nextAttempt *time.Time) error {
+	query := `
+        UPDATE comment_outbox
+        SET status = $2, response = $3, external_id = $4, last_error = COALESCE($5, last_error), next_attempt_at = $6,
+            sent_at = CASE WHEN $2 = 'sent' THEN NOW() END, updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1`
+
+	_, err := db.Exec(query, id, status, response, externalID, lastError, nextAttempt)
+	return err
+}
+
+// GetDueOutboxEntries lists pending entries whose next attempt is due, oldest first
+func (db *DB) GetDueOutboxEntries(limit int) ([]OutboxEntry, error) {
+	query := `
+        SELECT ` + outboxColumns + `
+        FROM comment_outbox
+        WHERE status = 'pending' AND next_attempt_at <= NOW()
+        ORDER BY next_attempt_at
+        LIMIT $1`
+
+	entries := []OutboxEntry{}
+	err := db.Select(&entries, query, limit)
+	return entries, err
+}
+
+// ListOutboxEntries lists a user's outbox entries, newest first, optionally filtered by status
+func (db *DB) ListOutboxEntries(userID int, status string, limit int) ([]OutboxEntry, error) {
+	query := `
+        SELECT ` + outboxColumns + `
+        FROM comment_outbox
+        WHERE user_id = $1 AND ($2 = '' OR status = $2)
+        ORDER BY created_at DESC, id DESC
+        LIMIT $3`
+
+	entries := []OutboxEntry{}
+	err := db.Select(&entries, query, userID, status, limit)
+	return entries, err
+}
+
+// OutboxPages pages through a user's outbox, newest first by default
+var OutboxPages = pagination.Options{
+	Sorts:        []pagination.Sort{{Name: "created_at", Column: "created_at", Type: "timestamptz"}},
+	Default:      "-created_at",
+	DefaultLimit: 50,
+	MaxLimit:     500,
+}
+
+// PageOutboxEntries lists a page of a user's outbox entries, optionally filtered by status
+func (db *DB) PageOutboxEntries(userID int, status string, params pagination.Params) ([]OutboxEntry, pagination.Page, error) {
+	var page pagination.Page
+	countQuery := `SELECT COUNT(*) FROM comment_outbox WHERE user_id = $1 AND ($2 = '' OR status = $2)`
+	if err := db.Get(&page.Total, countQuery, userID, status); err != nil {
+		return nil, page, err
+	}
+
+	args := []interface{}{userID, status}
+	query := fmt.Sprintf(`
+        SELECT `+outboxColumns+`
+        FROM comment_outbox
+        WHERE user_id = $1 AND ($2 = '' OR status = $2) AND %s
+        ORDER BY %s
+        LIMIT %d`, params.Where("id", &args), params.OrderBy("id"), params.Fetch())
+
+	entries := []OutboxEntry{}
+	if err := db.Select(&entries, query, args...); err != nil {
+		return nil, page, err
+	}
+	var keep int
+	keep, page.Next = params.Trim(len(entries), func(i int) (string, int64) {
+		return entries[i].CreatedAt.UTC().Format(time.RFC3339Nano), entries[i].ID
+	})
+	return entries[:keep], page, nil
+}
+
+// ReleaseStaleOutboxEntries puts entries stuck in sending for longer than olderThan, e.g.
+// because the server stopped mid-delivery, back to pending so they are retried
+func (db *DB) ReleaseStaleOutboxEntries(olderThan time.Duration) error {
+	query := `
+        UPDATE comment_outbox
+        SET status = 'pending', next_attempt_at = NOW(), updated_at = CURRENT_TIMESTAMP
+        WHERE status = 'sending' AND updated_at < NOW() - $1 * INTERVAL '1 second'`
+
+	_, err := db.Exec(query, olderThan.Seconds())
+	return err
+}
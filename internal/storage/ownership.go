@@ -0,0 +1,47 @@
+package storage
+
+// GetActivityOwner returns the user an activity belongs to, by its Strava activity ID. It
+// returns sql.ErrNoRows if there is no such activity.
+func (db *DB) GetActivityOwner(stravaActivityID int64) (int, error) {
+	var userID int
+	err := db.Get(&userID, `SELECT user_id FROM activities WHERE strava_activity_id = $1`, stravaActivityID)
+	return userID, err
+}
+
+// GetCustomAreaOwner returns the user a custom area belongs to. It returns sql.ErrNoRows if
+// there is no such area.
+func (db *DB) GetCustomAreaOwner(areaID int) (int, error) {
+	var userID int
+	err := db.Get(&userID, `SELECT user_id FROM custom_areas WHERE id = $1`, areaID)
+	return userID, err
+}
+
+// GetWebhookEndpointOwner returns the user a webhook endpoint belongs to, or 0 for admin
+// endpoints. It returns sql.ErrNoRows if there is no such endpoint.
+func (db *DB) GetWebhookEndpointOwner(endpointID int) (int, error) {
+	var userID int
+	err := db.Get(&userID, `SELECT COALESCE(user_id, 0) FROM webhook_endpoints WHERE id = $1`, endpointID)
+	return userID, err
+}
+
+// GetWebhookDeliveryOwner returns the user owning the endpoint a delivery was made to, or 0
+// for admin endpoints. It returns sql.ErrNoRows if there is no such delivery.
+func (db *DB) GetWebhookDeliveryOwner(deliveryID int64) (int, error) {
+	query := `
+        SELECT COALESCE(e.user_id, 0)
+        FROM webhook_deliveries d
+        JOIN webhook_endpoints e ON e.id = d.endpoint_id
+        WHERE d.id = $1`
+
+	var userID int
+	err := db.Get(&userID, query, deliveryID)
+	return userID, err
+}
+
+// GetUserIDByStravaID returns the internal ID of the user with a Strava athlete ID. It
+// returns sql.ErrNoRows if there is no such user.
+func (db *DB) GetUserIDByStravaID(stravaID int64) (int, error) {
+	var userID int
+	err := db.Get(&userID, `SELECT id FROM users WHERE strava_id = $1`, stravaID)
+	return userID, err
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"math"
+	"time"
+)
+
+// TakeRateLimitTokens refills the token bucket named key at refillPerSecond up to capacity,
+// then takes cost from it if it holds enough. It returns the tokens left and, when the
+// bucket held too few, how long until it will hold cost. The bucket row is locked for the
+// update, so instances sharing the database draw from the same bucket.
+func (db *DB) TakeRateLimitTokens(key string, capacity, refillPerSecond, cost float64) (float64, time.Duration, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+        INSERT INTO rate_limit_buckets (key, tokens, updated_at)
+        VALUES ($1, $2, NOW())
+        ON CONFLICT (key) DO NOTHING`, key, capacity); err != nil {
+		return 0, 0, err
+	}
+
+	var tokens float64
+	if err := tx.Get(&tokens, `
+        SELECT LEAST($2::double precision,
+                     tokens + GREATEST(EXTRACT(EPOCH FROM NOW() - updated_at), 0) * $3::double precision)
+        FROM rate_limit_buckets
+        WHERE key = $1
+        FOR UPDATE`, key, capacity, refillPerSecond); err != nil {
+		return 0, 0, err
+	}
+
+	var wait time.Duration
+	if tokens < cost {
+		wait = time.Hour
+		if refillPerSecond > 0 {
+			wait = time.Duration((cost - tokens) / refillPerSecond * float64(time.Second))
+		}
+	} else {
+		tokens = math.Max(tokens-cost, 0)
+	}
+
+	if _, err := tx.Exec(`UPDATE rate_limit_buckets SET tokens = $2, updated_at = NOW() WHERE key = $1`, key, tokens); err != nil {
+		return 0, 0, err
+	}
+	return tokens, wait, tx.Commit()
+}
+
+// PruneRateLimitBuckets deletes buckets untouched since before, which have long refilled
+func (db *DB) PruneRateLimitBuckets(before time.Time) (int64, error) {
+	result, err := db.Exec(`DELETE FROM rate_limit_buckets WHERE updated_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Roles, lowest first. Moderators can read the admin API and edit cities; admins can do
+// everything.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Roles lists the roles, lowest first
+var Roles = []string{RoleUser, RoleModerator, RoleAdmin}
+
+// ValidRole reports whether role is one of Roles
+func ValidRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// GetUserRole returns a user's role. It returns sql.ErrNoRows if there is no such user.
+func (db *DB) GetUserRole(userID int) (string, error) {
+	var role string
+	err := db.Get(&role, `SELECT role FROM users WHERE id = $1`, userID)
+	return role, err
+}
+
+// SetUserRole changes a user's role. It returns sql.ErrNoRows if there is no such user.
+func (db *DB) SetUserRole(userID int, role string) error {
+	result, err := db.Exec(`UPDATE users SET role = $2, updated_at = NOW() WHERE id = $1`, userID, role)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Features admins can switch off for a user. Every feature is on unless switched off.
+const (
+	// FeatureComments posts coverage comments and descriptions to Strava
+	FeatureComments = "comments"
+	// FeatureDigest sends digest emails
+	FeatureDigest = "digest"
+	// FeatureWebhooks delivers events to the user's webhook endpoints
+	FeatureWebhooks = "webhooks"
+	// FeatureAutoImport imports activities when Strava pushes them
+	FeatureAutoImport = "auto_import"
+)
+
+// UserFeatures lists the features that can be switched per user
+var UserFeatures = []string{FeatureComments, FeatureDigest, FeatureWebhooks, FeatureAutoImport}
+
+// ValidUserFeature reports whether feature is one of UserFeatures
+func ValidUserFeature(feature string) bool {
+	for _, f := range UserFeatures {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// featureOff is the SQL condition that a feature is switched off for the user in
+// userColumn
+func featureOff(userColumn, feature string) string {
+	return fmt.Sprintf(`EXISTS (SELECT 1 FROM user_features f WHERE f.user_id = %s AND f.feature = '%s' AND NOT f.enabled)`, userColumn, feature)
+}
+
+// GetUserFeatures returns whether each of UserFeatures is on for a user
+func (db *DB) GetUserFeatures(userID int) (map[string]bool, error) {
+	var overrides []struct {
+		Feature string `db:"feature"`
+		Enabled bool   `db:"enabled"`
+	}
+	if err := db.Select(&overrides, `SELECT feature, enabled FROM user_features WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+
+	features := make(map[string]bool, len(UserFeatures))
+	for _, feature := range UserFeatures {
+		features[feature] = true
+	}
+	for _, o := range overrides {
+		if ValidUserFeature(o.Feature) {
+			features[o.Feature] = o.Enabled
+		}
+	}
+	return features, nil
+}
+
+// UserFeatureEnabled reports whether a feature is on for a user
+func (db *DB) UserFeatureEnabled(userID int, feature string) (bool, error) {
+	var off bool
+	err := db.Get(&off, `SELECT `+featureOff("$1", feature), userID)
+	return !off, err
+}
+
+// SetUserFeatures switches features on or off for a user, recording the admin who did
+func (db *DB) SetUserFeatures(userID int, features map[string]bool, updatedBy int) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+        INSERT INTO user_features (user_id, feature, enabled, updated_by)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (user_id, feature) DO UPDATE SET
+            enabled = EXCLUDED.enabled,
+            updated_by = EXCLUDED.updated_by,
+            updated_at = NOW()`
+	for feature, enabled := range features {
+		if _, err := tx.Exec(query, userID, feature, enabled, updatedBy); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
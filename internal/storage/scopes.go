@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Strava OAuth scopes
+const (
+	ScopeRead            = "read"
+	ScopeActivityRead    = "activity:read"
+	ScopeActivityReadAll = "activity:read_all"
+	ScopeActivityWrite   = "activity:write"
+)
+
+// Scopes are the Strava scopes a user granted
+type Scopes []string
+
+// ParseScopes splits the comma-separated scope list Strava passes to the OAuth callback
+func ParseScopes(granted string) Scopes {
+	scopes := Scopes{}
+	for _, scope := range strings.Split(granted, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// Has reports whether a scope was granted. activity:read_all includes activity:read.
+func (s Scopes) Has(scope string) bool {
+	for _, granted := range s {
+		if granted == scope || (scope == ScopeActivityRead && granted == ScopeActivityReadAll) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsActivity reports whether an activity may be imported: private activities need
+// activity:read_all
+func (s Scopes) AllowsActivity(private bool) bool {
+	return !private || s.Has(ScopeActivityReadAll)
+}
+
+// GetUserScopes retrieves the Strava scopes a user granted
+func (db *DB) GetUserScopes(userID int) (Scopes, error) {
+	var scopes []string
+	err := db.QueryRow(`SELECT strava_scopes FROM users WHERE id = $1`, userID).Scan(pq.Array(&scopes))
+	return Scopes(scopes), err
+}
+
+// UpdateUserScopes records the Strava scopes a user granted. It returns sql.ErrNoRows if the
+// user does not exist.
+func (db *DB) UpdateUserScopes(userID int, scopes Scopes) error {
+	result, err := db.Exec(`UPDATE users SET strava_scopes = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $1`,
+		userID, pq.Array([]string(scopes)))
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"time"
+)
+
+// ActivityStreamsRecord holds the compressed per-point streams stored for an activity
+type ActivityStreamsRecord struct {
+	StravaActivityID int64     `db:"strava_activity_id"`
+	PointCount       int       `db:"point_count"`
+	HasTime          bool      `db:"has_time"`
+	HasAltitude      bool      `db:"has_altitude"`
+	HasDistance      bool      `db:"has_distance"`
+	Data             []byte    `db:"data"` // gzip-compressed JSON
+	CreatedAt        time.Time `db:"created_at"`
+	UpdatedAt        time.Time `db:"updated_at"`
+}
+
+// SaveActivityStreams stores or replaces the streams of an activity
+func (db *DB) SaveActivityStreams(record *ActivityStreamsRecord) error {
+	query := `
+        INSERT INTO activity_streams (strava_activity_id, point_count, has_time, has_altitude, has_distance, data)
+        VALUES (:strava_activity_id, :point_count, :has_time, :has_altitude, :has_distance, :data)
+        ON CONFLICT (strava_activity_id) DO UPDATE SET
+            point_count = EXCLUDED.point_count,
+            has_time = EXCLUDED.has_time,
+            has_altitude = EXCLUDED.has_altitude,
+            has_distance = EXCLUDED.has_distance,
+            data = EXCLUDED.data,
+            updated_at = CURRENT_TIMESTAMP`
+
+	_, err := db.NamedExec(query, record)
+	return err
+}
+
+// GetActivityStreams retrieves the stored streams of an activity
+func (db *DB) GetActivityStreams(stravaActivityID int64) (*ActivityStreamsRecord, error) {
+	query := `
+        SELECT strava_activity_id, point_count, has_time, has_altitude, has_distance, data, created_at, updated_at
+        FROM activity_streams
+        WHERE strava_activity_id = $1`
+
+	record := &ActivityStreamsRecord{}
+	if err := db.Get(record, query, stravaActivityID); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
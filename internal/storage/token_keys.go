@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrNoTokenKeys is returned when reading an encrypted token without encryption keys configured
+var ErrNoTokenKeys = errors.New("strava token is encrypted but no TOKEN_ENCRYPTION_KEYS are configured")
+
+// KeyRing holds the versioned keys Strava tokens are encrypted with. Tokens are sealed with
+// envelope encryption: each row gets a random data key that encrypts its tokens with
+// AES-256-GCM, and the data key itself is encrypted with the newest key. Older keys are
+// kept only to read rows not yet re-encrypted.
+type KeyRing struct {
+	keys    map[int]cipher.AEAD
+	current int
+}
+
+// LoadKeyRing builds the key ring from TOKEN_ENCRYPTION_KEYS and the file named by
+// TOKEN_ENCRYPTION_KEY_FILE. Both list keys as "version:base64-key" entries separated by
+// commas or newlines; keys are 32 random bytes, e.g. from `openssl rand -base64 32`. It
+// returns nil if neither holds any key.
+func LoadKeyRing(keys, keyFile string) (*KeyRing, error) {
+	spec := keys
+	if keyFile != "" {
+		contents, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token key file: %w", err)
+		}
+		spec += "\n" + string(contents)
+	}
+	return ParseKeyRing(spec)
+}
+
+// ParseKeyRing parses "version:base64-key" entries separated by commas or newlines. Lines
+// starting with # are ignored. It returns nil if there are no entries.
+func ParseKeyRing(spec string) (*KeyRing, error) {
+	ring := &KeyRing{keys: make(map[int]cipher.AEAD)}
+	entries := strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' })
+	for i, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		versionText, encoded, ok := strings.Cut(entry, ":")
+		version, err := strconv.Atoi(strings.TrimSpace(versionText))
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("token key entry %d is not in the form version:base64-key", i+1)
+		}
+		if _, exists := ring.keys[version]; exists {
+			return nil, fmt.Errorf("token key version %d is listed twice", version)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("token key version %d must be 32 bytes, base64 encoded", version)
+		}
+
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		ring.keys[version] = aead
+		if version > ring.current {
+			ring.current = version
+		}
+	}
+
+	if len(ring.keys) == 0 {
+		return nil, nil
+	}
+	return ring, nil
+}
+
+// Current returns the version new tokens are encrypted with
+func (k *KeyRing) Current() int {
+	return k.current
+}
+
+// sealedTokens are a token pair as stored: the tokens encrypted with a data key, and the
+// data key encrypted with a key of the ring
+type sealedTokens struct {
+	KeyVersion   int
+	DataKey      string
+	AccessToken  string
+	RefreshToken string
+}
+
+// seal encrypts a user's tokens with a fresh data key wrapped by the current key. The user
+// ID is bound into every ciphertext, so values copied to another row fail to decrypt.
+func (k *KeyRing) seal(userID int, accessToken, refreshToken string) (*sealedTokens, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	data, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sealedTokens{
+		KeyVersion:   k.current,
+		DataKey:      sealValue(k.keys[k.current], dataKey, dataKeyAAD(userID, k.current)),
+		AccessToken:  sealValue(data, []byte(accessToken), tokenAAD(userID, "access_token")),
+		RefreshToken: sealValue(data, []byte(refreshToken), tokenAAD(userID, "refresh_token")),
+	}, nil
+}
+
+// open decrypts a user's sealed tokens
+func (k *KeyRing) open(userID int, sealed *sealedTokens) (string, string, error) {
+	key, ok := k.keys[sealed.KeyVersion]
+	if !ok {
+		return "", "", fmt.Errorf("strava token is encrypted with unknown key version %d", sealed.KeyVersion)
+	}
+	dataKey, err := openValue(key, sealed.DataKey, dataKeyAAD(userID, sealed.KeyVersion))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	data, err := newGCM(dataKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	accessToken, err := openValue(data, sealed.AccessToken, tokenAAD(userID, "access_token"))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to decrypt access token: %w", err)
+	}
+	refreshToken, err := openValue(data, sealed.RefreshToken, tokenAAD(userID, "refresh_token"))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to decrypt refresh token: %w", err)
+	}
+	return string(accessToken), string(refreshToken), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealValue encrypts a value, returning the base64 nonce and ciphertext
+func sealValue(aead cipher.AEAD, plaintext, aad []byte) string {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Sprintf("storage: reading random bytes: %v", err))
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, aad))
+}
+
+// openValue decrypts a value sealed by sealValue
+func openValue(aead cipher.AEAD, sealed string, aad []byte) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(raw) < aead.NonceSize() {
+		return nil, errors.New("malformed ciphertext")
+	}
+	return aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], aad)
+}
+
+func dataKeyAAD(userID, version int) []byte {
+	return []byte(fmt.Sprintf("strava_tokens.data_key:%d:%d", userID, version))
+}
+
+func tokenAAD(userID int, column string) []byte {
+	return []byte(fmt.Sprintf("strava_tokens.%s:%d", column, userID))
+}
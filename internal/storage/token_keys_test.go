@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune(b)), 32)))
+}
+
+func TestParseKeyRing(t *testing.T) {
+	ring, err := ParseKeyRing("")
+	require.NoError(t, err)
+	assert.Nil(t, ring)
+
+	ring, err = ParseKeyRing("1:" + testKey('a') + "\n# retired soon\n3:" + testKey('c') + ", 2:" + testKey('b'))
+	require.NoError(t, err)
+	assert.Equal(t, 3, ring.Current())
+
+	for _, spec := range []string{"a-key", "1:" + testKey('a') + ",1:" + testKey('b'), "1:c2hvcnQ=", "0:" + testKey('a')} {
+		_, err := ParseKeyRing(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestSealAndOpenTokens(t *testing.T) {
+	old, err := ParseKeyRing("1:" + testKey('a'))
+	require.NoError(t, err)
+
+	sealed, err := old.seal(7, "access", "refresh")
+	require.NoError(t, err)
+	assert.Equal(t, 1, sealed.KeyVersion)
+	assert.NotContains(t, sealed.AccessToken, "access")
+
+	access, refresh, err := old.open(7, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "access", access)
+	assert.Equal(t, "refresh", refresh)
+
+	// Rotated rings still read rows under older keys and seal with the newest
+	rotated, err := ParseKeyRing("2:" + testKey('b') + ",1:" + testKey('a'))
+	require.NoError(t, err)
+	access, _, err = rotated.open(7, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "access", access)
+	resealed, err := rotated.seal(7, access, refresh)
+	require.NoError(t, err)
+	assert.Equal(t, 2, resealed.KeyVersion)
+
+	// Rows copied to another user, swapped columns and unknown keys fail
+	_, _, err = old.open(8, sealed)
+	assert.Error(t, err)
+	swapped := *sealed
+	swapped.AccessToken, swapped.RefreshToken = sealed.RefreshToken, sealed.AccessToken
+	_, _, err = old.open(7, &swapped)
+	assert.Error(t, err)
+	_, _, err = old.open(7, resealed)
+	assert.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// storedToken is a strava_tokens row as stored, before decryption
+type storedToken struct {
+	StravaToken
+	KeyVersion sql.NullInt64  `db:"key_version"`
+	DataKey    sql.NullString `db:"data_key"`
+}
+
+// sealTokens encrypts a user's tokens with the current key, or leaves them in plaintext
+// with a key version of 0 when no keys are set
+func (db *DB) sealTokens(userID int, accessToken, refreshToken string) (*sealedTokens, error) {
+	if db.tokenKeys == nil {
+		return &sealedTokens{AccessToken: accessToken, RefreshToken: refreshToken}, nil
+	}
+	return db.tokenKeys.seal(userID, accessToken, refreshToken)
+}
+
+// openToken decrypts a stored token row. Rows without a key version are plaintext.
+func (db *DB) openToken(row *storedToken) (*StravaToken, error) {
+	token := row.StravaToken
+	if !row.KeyVersion.Valid {
+		return &token, nil
+	}
+	if db.tokenKeys == nil {
+		return nil, ErrNoTokenKeys
+	}
+
+	var err error
+	token.AccessToken, token.RefreshToken, err = db.tokenKeys.open(row.UserID, &sealedTokens{
+		KeyVersion:   int(row.KeyVersion.Int64),
+		DataKey:      row.DataKey.String,
+		AccessToken:  row.AccessToken,
+		RefreshToken: row.RefreshToken,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt Strava token of user %d: %w", row.UserID, err)
+	}
+	return &token, nil
+}
+
+// CountTokensByKeyVersion counts the stored token pairs per key version. Plaintext tokens
+// are counted under version 0.
+func (db *DB) CountTokensByKeyVersion() (map[int]int, error) {
+	var rows []struct {
+		KeyVersion int `db:"key_version"`
+		Count      int `db:"count"`
+	}
+	query := `
+        SELECT COALESCE(key_version, 0) AS key_version, COUNT(*) AS count
+        FROM strava_tokens
+        GROUP BY COALESCE(key_version, 0)`
+	if err := db.Select(&rows, query); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[int]int, len(rows))
+	for _, row := range rows {
+		counts[row.KeyVersion] = row.Count
+	}
+	return counts, nil
+}
+
+// ReencryptTokens rewrites every token pair not encrypted with the current key, including
+// plaintext ones, so old keys can be retired. Each row is locked while it is rewritten, so
+// it is safe while the server runs. It returns how many rows were rewritten.
+func (db *DB) ReencryptTokens() (int, error) {
+	if db.tokenKeys == nil {
+		return 0, errors.New("no token encryption keys are configured")
+	}
+
+	var userIDs []int
+	query := `SELECT user_id FROM strava_tokens WHERE key_version IS DISTINCT FROM $1 ORDER BY user_id`
+	if err := db.Select(&userIDs, query, db.tokenKeys.Current()); err != nil {
+		return 0, fmt.Errorf("failed to list tokens to re-encrypt: %w", err)
+	}
+
+	rewritten := 0
+	var errs []error
+	for _, userID := range userIDs {
+		done, err := db.reencryptToken(userID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("user %d: %w", userID, err))
+			continue
+		}
+		if done {
+			rewritten++
+		}
+	}
+	return rewritten, errors.Join(errs...)
+}
+
+// reencryptToken re-encrypts one user's tokens with the current key. It reports false if
+// the row was already current or has gone.
+func (db *DB) reencryptToken(userID int) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := `
+        SELECT id, user_id, access_token, refresh_token, expires_at, created_at, updated_at, key_version, data_key
+        FROM strava_tokens
+        WHERE user_id = $1
+        FOR UPDATE`
+	row := &storedToken{}
+	if err := tx.QueryRowx(query, userID).StructScan(row); errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if row.KeyVersion.Valid && int(row.KeyVersion.Int64) == db.tokenKeys.Current() {
+		return false, nil
+	}
+
+	token, err := db.openToken(row)
+	if err != nil {
+		return false, err
+	}
+	sealed, err := db.tokenKeys.seal(userID, token.AccessToken, token.RefreshToken)
+	if err != nil {
+		return false, err
+	}
+
+	update := `
+        UPDATE strava_tokens
+        SET access_token = $2, refresh_token = $3, key_version = $4, data_key = $5
+        WHERE user_id = $1`
+	if _, err := tx.Exec(update, userID, sealed.AccessToken, sealed.RefreshToken, sealed.KeyVersion, sealed.DataKey); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,293 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
+	"github.com/nikhilvedi/strava-coverage/internal/pagination"
+)
+
+// Outbound webhook delivery states
+const (
+	DeliveryStatusPending   = "pending"
+	DeliveryStatusSending   = "sending"
+	DeliveryStatusDelivered = "delivered"
+	DeliveryStatusFailed    = "failed"
+)
+
+// WebhookEndpoint is a URL registered to receive coverage events. Endpoints without a
+// user are admin endpoints and receive the events of every user.
+type WebhookEndpoint struct {
+	ID                      int            `db:"id" json:"id"`
+	UserID                  *int           `db:"user_id" json:"user_id"`
+	URL                     string         `db:"url" json:"url"`
+	Description             string         `db:"description" json:"description"`
+	Events                  pq.StringArray `db:"events" json:"events"`
+	Enabled                 bool           `db:"enabled" json:"enabled"`
+	Secret                  string         `db:"secret" json:"-"`
+	PreviousSecret          *string        `db:"previous_secret" json:"-"`
+	PreviousSecretExpiresAt *time.Time     `db:"previous_secret_expires_at" json:"previous_secret_expires_at,omitempty"`
+	CreatedAt               time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt               time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// SigningSecrets returns the secrets deliveries are signed with: the current one and, during
+// the grace period after a rotation, the previous one
+func (e *WebhookEndpoint) SigningSecrets(now time.Time) []string {
+	secrets := []string{e.Secret}
+	if e.PreviousSecret != nil && e.PreviousSecretExpiresAt != nil && now.Before(*e.PreviousSecretExpiresAt) {
+		secrets = append(secrets, *e.PreviousSecret)
+	}
+	return secrets
+}
+
+// WebhookDelivery is one event sent, or to be sent, to one endpoint
+type WebhookDelivery struct {
+	ID             int64          `db:"id" json:"id"`
+	EndpointID     int            `db:"endpoint_id" json:"endpoint_id"`
+	EventID        string         `db:"event_id" json:"event_id"`
+	EventType      string         `db:"event_type" json:"event_type"`
+	Payload        types.JSONText `db:"payload" json:"payload"`
+	Status         string         `db:"status" json:"status"`
+	Attempts       int            `db:"attempts" json:"attempts"`
+	ResponseStatus *int           `db:"response_status" json:"response_status,omitempty"`
+	ResponseBody   *string        `db:"response_body" json:"response_body,omitempty"`
+	LastError      *string        `db:"last_error" json:"last_error,omitempty"`
+	DurationMs     *int           `db:"duration_ms" json:"duration_ms,omitempty"`
+	NextAttemptAt  *time.Time     `db:"next_attempt_at" json:"next_attempt_at,omitempty"`
+	CreatedAt      time.Time      `db:"created_at" json:"created_at"`
+	DeliveredAt    *time.Time     `db:"delivered_at" json:"delivered_at,omitempty"`
+	UpdatedAt      time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+const webhookEndpointColumns = `id, user_id, url, description, events, enabled, secret, previous_secret,
+               previous_secret_expires_at, created_at, updated_at`
+
+const webhookDeliveryColumns = `id, endpoint_id, event_id, event_type, payload, status, attempts, response_status,
+               response_body, last_error, duration_ms, next_attempt_at, created_at, delivered_at, updated_at`
+
+// CreateWebhookEndpoint registers an endpoint
+func (db *DB) CreateWebhookEndpoint(endpoint *WebhookEndpoint) error {
+	query := `
+        INSERT INTO webhook_endpoints (user_id, url, description, events, enabled, secret)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id, created_at, updated_at`
+
+	if endpoint.Events == nil {
+		endpoint.Events = pq.StringArray{}
+	}
+	return db.QueryRow(query,
+		endpoint.UserID, endpoint.URL, endpoint.Description, endpoint.Events, endpoint.Enabled, endpoint.Secret,
+	).Scan(&endpoint.ID, &endpoint.CreatedAt, &endpoint.UpdatedAt)
+}
+
+// GetWebhookEndpoint retrieves an endpoint by ID
+func (db *DB) GetWebhookEndpoint(id int) (*WebhookEndpoint, error) {
+	query := `SELECT ` + webhookEndpointColumns + ` FROM webhook_endpoints WHERE id = $1`
+
+	endpoint := &WebhookEndpoint{}
+	if err := db.QueryRowx(query, id).StructScan(endpoint); err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+// ListWebhookEndpoints lists a user's endpoints, or the admin endpoints when userID is nil
+func (db *DB) ListWebhookEndpoints(userID *int) ([]WebhookEndpoint, error) {
+	query := `
+        SELECT ` + webhookEndpointColumns + `
+        FROM webhook_endpoints
+        WHERE user_id IS NOT DISTINCT FROM $1
+        ORDER BY id`
+
+	endpoints := []WebhookEndpoint{}
+	err := db.Select(&endpoints, query, userID)
+	return endpoints, err
+}
+
+// UpdateWebhookEndpoint saves an endpoint's URL, description, events and enabled switch
+func (db *DB) UpdateWebhookEndpoint(endpoint *WebhookEndpoint) error {
+	query := `
+        UPDATE webhook_endpoints
+        SET url = $2, description = $3, events = $4, enabled = $5, updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1
+        RETURNING updated_at`
+
+	return db.QueryRow(query,
+		endpoint.ID, endpoint.URL, endpoint.Description, endpoint.Events, endpoint.Enabled,
+	).Scan(&endpoint.UpdatedAt)
+}
+
+// DeleteWebhookEndpoint removes an endpoint and its delivery log
+func (db *DB) DeleteWebhookEndpoint(id int) error {
+	_, err := db.Exec(`DELETE FROM webhook_endpoints WHERE id = $1`, id)
+	return err
+}
+
+// RotateWebhookSecret replaces an endpoint's secret. The old secret keeps signing
+// deliveries, next to the new one, until previousExpiresAt.
+func (db *DB) RotateWebhookSecret(id int, secret string, previousExpiresAt time.Time) error {
+	query := `
+        UPDATE webhook_endpoints
+        SET previous_secret = secret, previous_secret_expires_at = $3, secret = $2, updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1`
+
+	_, err := db.Exec(query, id, secret, previousExpiresAt)
+	return err
+}
+
+// CreateWebhookDeliveries records an event for every enabled endpoint subscribed to it: the
+// user's own endpoints, unless an admin switched webhooks off for them, and the admin
+// endpoints. A userID of 0 reaches admin endpoints only.
+func (db *DB) CreateWebhookDeliveries(userID int, eventID, eventType string, payload []byte) ([]int64, error) {
+	query := `
+        INSERT INTO webhook_deliveries (endpoint_id, event_id, event_type, payload, status, next_attempt_at)
+        SELECT id, $2, $3, $4, 'pending', NOW()
+        FROM webhook_endpoints
+        WHERE enabled
+        AND (user_id IS NULL OR (user_id = $1 AND NOT ` + featureOff("$1", FeatureWebhooks) + `))
+        AND (cardinality(events) = 0 OR $3 = ANY(events))
+        RETURNING id`
+
+	ids := []int64{}
+	err := db.Select(&ids, query, userID, eventID, eventType, types.JSONText(payload))
+	return ids, err
+}
+
+// CreateWebhookDelivery records an event for a single endpoint, e.g. a test ping
+func (db *DB) CreateWebhookDelivery(endpointID int, eventID, eventType string, payload []byte) (int64, error) {
+	query := `
+        INSERT INTO webhook_deliveries (endpoint_id, event_id, event_type, payload, status, next_attempt_at)
+        VALUES ($1, $2, $3, $4, 'pending', NOW())
+        RETURNING id`
+
+	var id int64
+	err := db.QueryRow(query, endpointID, eventID, eventType, types.JSONText(payload)).Scan(&id)
+	return id, err
+}
+
+// ClaimWebhookDelivery moves a pending delivery to sending and counts the attempt. It
+// returns nil without error if the delivery is no longer pending.
+func (db *DB) ClaimWebhookDelivery(id int64) (*WebhookDelivery, error) {
+	query := `
+        UPDATE webhook_deliveries
+        SET status = 'sending', attempts = attempts + 1, updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1 AND status = 'pending'
+        RETURNING ` + webhookDeliveryColumns
+
+	delivery := &WebhookDelivery{}
+	err := db.QueryRowx(query, id).StructScan(delivery)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// FinishWebhookDelivery records the outcome of a delivery attempt. A pending status needs
+// nextAttempt, the time of the retry.
+func (db *DB) FinishWebhookDelivery(delivery *WebhookDelivery) error {
+	query := `
+        UPDATE webhook_deliveries
+        SET status = $2, response_status = $3, response_body = $4, last_error = $5, duration_ms = $6,
+            next_attempt_at = $7, delivered_at = CASE WHEN $2 = 'delivered' THEN NOW() END,
+            updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1`
+
+	_, err := db.Exec(query, delivery.ID, delivery.Status, delivery.ResponseStatus, delivery.ResponseBody,
+		delivery.LastError, delivery.DurationMs, delivery.NextAttemptAt)
+	return err
+}
+
+// GetDueWebhookDeliveries lists the IDs of pending deliveries whose attempt is due, oldest first
+func (db *DB) GetDueWebhookDeliveries(limit int) ([]int64, error) {
+	query := `
+        SELECT id
+        FROM webhook_deliveries
+        WHERE status = 'pending' AND next_attempt_at <= NOW()
+        ORDER BY next_attempt_at
+        LIMIT $1`
+
+	ids := []int64{}
+	err := db.Select(&ids, query, limit)
+	return ids, err
+}
+
+// ReleaseStaleWebhookDeliveries puts deliveries stuck in sending for longer than olderThan
+// back to pending so they are retried
+func (db *DB) ReleaseStaleWebhookDeliveries(olderThan time.Duration) error {
+	query := `
+        UPDATE webhook_deliveries
+        SET status = 'pending', next_attempt_at = NOW(), updated_at = CURRENT_TIMESTAMP
+        WHERE status = 'sending' AND updated_at < NOW() - $1 * INTERVAL '1 second'`
+
+	_, err := db.Exec(query, olderThan.Seconds())
+	return err
+}
+
+// WebhookDeliveryPages pages through an endpoint's deliveries, newest first by default
+var WebhookDeliveryPages = pagination.Options{
+	Sorts:        []pagination.Sort{{Name: "created_at", Column: "created_at", Type: "timestamptz"}},
+	Default:      "-created_at",
+	DefaultLimit: 50,
+	MaxLimit:     500,
+}
+
+// ListWebhookDeliveries lists a page of an endpoint's deliveries, optionally filtered by status
+func (db *DB) ListWebhookDeliveries(endpointID int, status string, params pagination.Params) ([]WebhookDelivery, pagination.Page, error) {
+	var page pagination.Page
+	countQuery := `SELECT COUNT(*) FROM webhook_deliveries WHERE endpoint_id = $1 AND ($2 = '' OR status = $2)`
+	if err := db.Get(&page.Total, countQuery, endpointID, status); err != nil {
+		return nil, page, err
+	}
+
+	args := []interface{}{endpointID, status}
+	query := fmt.Sprintf(`
+        SELECT `+webhookDeliveryColumns+`
+        FROM webhook_deliveries
+        WHERE endpoint_id = $1 AND ($2 = '' OR status = $2) AND %s
+        ORDER BY %s
+        LIMIT %d`, params.Where("id", &args), params.OrderBy("id"), params.Fetch())
+
+	deliveries := []WebhookDelivery{}
+	if err := db.Select(&deliveries, query, args...); err != nil {
+		return nil, page, err
+	}
+	var keep int
+	keep, page.Next = params.Trim(len(deliveries), func(i int) (string, int64) {
+		return deliveries[i].CreatedAt.UTC().Format(time.RFC3339Nano), deliveries[i].ID
+	})
+	return deliveries[:keep], page, nil
+}
+
+// GetWebhookDelivery retrieves a delivery by ID
+func (db *DB) GetWebhookDelivery(id int64) (*WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE id = $1`
+
+	delivery := &WebhookDelivery{}
+	if err := db.QueryRowx(query, id).StructScan(delivery); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// RequeueWebhookDelivery makes a delivered or failed delivery pending again, with a fresh
+// set of attempts. It returns false if the delivery is pending or being sent.
+func (db *DB) RequeueWebhookDelivery(id int64) (bool, error) {
+	query := `
+        UPDATE webhook_deliveries
+        SET status = 'pending', attempts = 0, next_attempt_at = NOW(), updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1 AND status IN ('delivered', 'failed')`
+
+	result, err := db.Exec(query, id)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/nikhilvedi/strava-coverage/internal/pagination"
+)
+
+// Webhook event processing states
+const (
+	WebhookStatusReceived   = "received"
+	WebhookStatusProcessing = "processing"
+	WebhookStatusProcessed  = "processed"
+	WebhookStatusSkipped    = "skipped"
+	WebhookStatusFailed     = "failed"
+)
+
+// WebhookEvent represents a webhook event received from Strava
+type WebhookEvent struct {
+	ID             int            `db:"id" json:"id"`
+	ObjectType     string         `db:"object_type" json:"object_type"`
+	ObjectID       int64          `db:"object_id" json:"object_id"`
+	AspectType     string         `db:"aspect_type" json:"aspect_type"`
+	OwnerID        int64          `db:"owner_id" json:"owner_id"`
+	SubscriptionID int64          `db:"subscription_id" json:"subscription_id"`
+	EventTime      int64          `db:"event_time" json:"event_time"`
+	Updates        types.JSONText `db:"updates" json:"updates"`
+	Status         string         `db:"status" json:"status"`
+	Attempts       int            `db:"attempts" json:"attempts"`
+	ErrorMessage   *string        `db:"error_message" json:"error_message,omitempty"`
+	ReceivedAt     time.Time      `db:"received_at" json:"received_at"`
+	ProcessedAt    *time.Time     `db:"processed_at" json:"processed_at,omitempty"`
+	UpdatedAt      time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// RecordWebhookEvent stores an incoming event. It returns false without error if
+// the same event (object, aspect and event time) was already recorded.
+func (db *DB) RecordWebhookEvent(event *WebhookEvent) (bool, error) {
+	query := `
+        INSERT INTO webhook_events (
+            object_type, object_id, aspect_type, owner_id, subscription_id, event_time, updates, status
+        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        ON CONFLICT (object_id, aspect_type, event_time) DO NOTHING
+        RETURNING id, received_at, updated_at`
+
+	if len(event.Updates) == 0 {
+		event.Updates = types.JSONText("{}")
+	}
+	if event.Status == "" {
+		event.Status = WebhookStatusReceived
+	}
+
+	err := db.QueryRow(query,
+		event.ObjectType, event.ObjectID, event.AspectType, event.OwnerID,
+		event.SubscriptionID, event.EventTime, event.Updates, event.Status,
+	).Scan(&event.ID, &event.ReceivedAt, &event.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetWebhookEvent retrieves a webhook event by ID
+func (db *DB) GetWebhookEvent(id int) (*WebhookEvent, error) {
+	query := `
+        SELECT id, object_type, object_id, aspect_type, owner_id, COALESCE(subscription_id, 0) AS subscription_id,
+               event_time, updates, status, attempts, error_message, received_at, processed_at, updated_at
+        FROM webhook_events
+        WHERE id = $1`
+
+	event := &WebhookEvent{}
+	if err := db.QueryRowx(query, id).StructScan(event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// WebhookEventPages pages through webhook events, newest first by default
+var WebhookEventPages = pagination.Options{
+	Sorts:        []pagination.Sort{{Name: "received_at", Column: "received_at", Type: "timestamptz"}},
+	Default:      "-received_at",
+	DefaultLimit: 50,
+	MaxLimit:     500,
+}
+
+// ListWebhookEvents lists a page of webhook events, optionally filtered by status
+func (db *DB) ListWebhookEvents(status string, params pagination.Params) ([]WebhookEvent, pagination.Page, error) {
+	var page pagination.Page
+	if err := db.Get(&page.Total, `SELECT COUNT(*) FROM webhook_events WHERE ($1 = '' OR status = $1)`, status); err != nil {
+		return nil, page, err
+	}
+
+	args := []interface{}{status}
+	query := fmt.Sprintf(`
+        SELECT id, object_type, object_id, aspect_type, owner_id, COALESCE(subscription_id, 0) AS subscription_id,
+               event_time, updates, status, attempts, error_message, received_at, processed_at, updated_at
+        FROM webhook_events
+        WHERE ($1 = '' OR status = $1) AND %s
+        ORDER BY %s
+        LIMIT %d`, params.Where("id", &args), params.OrderBy("id"), params.Fetch())
+
+	events := []WebhookEvent{}
+	if err := db.Select(&events, query, args...); err != nil {
+		return nil, page, err
+	}
+	var keep int
+	keep, page.Next = params.Trim(len(events), func(i int) (string, int64) {
+		return events[i].ReceivedAt.UTC().Format(time.RFC3339Nano), int64(events[i].ID)
+	})
+	return events[:keep], page, nil
+}
+
+// ClaimWebhookEvent moves an event from the given status to processing and counts the attempt.
+// It returns false if the event is no longer in that status, e.g. a concurrent replay claimed it.
+func (db *DB) ClaimWebhookEvent(id int, fromStatus string) (bool, error) {
+	query := `
+        UPDATE webhook_events
+        SET status = 'processing', attempts = attempts + 1, error_message = NULL, updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1 AND status = $2`
+
+	result, err := db.Exec(query, id, fromStatus)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// FinishWebhookEvent records the outcome of a processing attempt.
+// A nil procErr marks the event with the given status, otherwise it is marked failed.
+func (db *DB) FinishWebhookEvent(id int, status string, procErr error) error {
+	var errMsg *string
+	if procErr != nil {
+		status = WebhookStatusFailed
+		msg := procErr.Error()
+		errMsg = &msg
+	}
+
+	query := `
+        UPDATE webhook_events
+        SET status = $2, error_message = $3, processed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1`
+
+	_, err := db.Exec(query, id, status, errMsg)
+	return err
+}
+
+// ReleaseStaleWebhookEvents puts events stuck in processing for longer than olderThan, e.g.
+// because the server stopped mid-processing, back to received so they are processed again
+func (db *DB) ReleaseStaleWebhookEvents(olderThan time.Duration) error {
+	query := `
+        UPDATE webhook_events
+        SET status = 'received', updated_at = CURRENT_TIMESTAMP
+        WHERE status = 'processing' AND updated_at < NOW() - $1 * INTERVAL '1 second'`
+
+	_, err := db.Exec(query, olderThan.Seconds())
+	return err
+}
+
+// GetStaleWebhookEvents lists events left in received for longer than olderThan, oldest first.
+// Events are processed as soon as they are recorded, so these were lost by a restart.
+func (db *DB) GetStaleWebhookEvents(olderThan time.Duration, limit int) ([]WebhookEvent, error) {
+	query := `
+        SELECT id, object_type, object_id, aspect_type, owner_id, COALESCE(subscription_id, 0) AS subscription_id,
+               event_time, updates, status, attempts, error_message, received_at, processed_at, updated_at
+        FROM webhook_events
+        WHERE status = 'received' AND updated_at < NOW() - $1 * INTERVAL '1 second'
+        ORDER BY received_at
+        LIMIT $2`
+
+	events := []WebhookEvent{}
+	err := db.Select(&events, query, olderThan.Seconds(), limit)
+	return events, err
+}
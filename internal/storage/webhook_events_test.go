@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestWebhookEvent returns an activity event with an object ID no other test uses, and
+// deletes its rows when the test ends
+func newTestWebhookEvent(t *testing.T, db *DB) *WebhookEvent {
+	objectID := time.Now().UnixNano()
+	t.Cleanup(func() { _, _ = db.Exec(`DELETE FROM webhook_events WHERE object_id = $1`, objectID) })
+	return &WebhookEvent{
+		ObjectType:     "activity",
+		ObjectID:       objectID,
+		AspectType:     "create",
+		OwnerID:        1001,
+		SubscriptionID: 7,
+		EventTime:      time.Now().Unix(),
+	}
+}
+
+func TestRecordWebhookEventDeduplicates(t *testing.T) {
+	db := testDB(t)
+	event := newTestWebhookEvent(t, db)
+
+	inserted, err := db.RecordWebhookEvent(event)
+	require.NoError(t, err)
+	assert.True(t, inserted)
+	assert.NotZero(t, event.ID)
+
+	// Strava retries deliveries with the same object, aspect and event time
+	retry := *event
+	retry.ID = 0
+	inserted, err = db.RecordWebhookEvent(&retry)
+	require.NoError(t, err)
+	assert.False(t, inserted)
+	assert.Zero(t, retry.ID)
+
+	// A later event about the same object is a new event
+	update := *event
+	update.ID, update.AspectType = 0, "update"
+	inserted, err = db.RecordWebhookEvent(&update)
+	require.NoError(t, err)
+	assert.True(t, inserted)
+
+	var count int
+	require.NoError(t, db.Get(&count, `SELECT COUNT(*) FROM webhook_events WHERE object_id = $1`, event.ObjectID))
+	assert.Equal(t, 2, count)
+}
+
+func TestClaimAndFinishWebhookEvent(t *testing.T) {
+	db := testDB(t)
+	event := newTestWebhookEvent(t, db)
+	_, err := db.RecordWebhookEvent(event)
+	require.NoError(t, err)
+
+	claimed, err := db.ClaimWebhookEvent(event.ID, WebhookStatusReceived)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	// A second claim, e.g. a concurrent replay, loses
+	claimed, err = db.ClaimWebhookEvent(event.ID, WebhookStatusReceived)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+
+	require.NoError(t, db.FinishWebhookEvent(event.ID, WebhookStatusProcessed, errors.New("strava API error: 429")))
+	stored, err := db.GetWebhookEvent(event.ID)
+	require.NoError(t, err)
+	assert.Equal(t, WebhookStatusFailed, stored.Status)
+	assert.Equal(t, 1, stored.Attempts)
+	require.NotNil(t, stored.ErrorMessage)
+	assert.Equal(t, "strava API error: 429", *stored.ErrorMessage)
+	assert.NotNil(t, stored.ProcessedAt)
+
+	// A replay claims the failed event again, counting the attempt and clearing the error
+	claimed, err = db.ClaimWebhookEvent(event.ID, WebhookStatusFailed)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	require.NoError(t, db.FinishWebhookEvent(event.ID, WebhookStatusProcessed, nil))
+
+	stored, err = db.GetWebhookEvent(event.ID)
+	require.NoError(t, err)
+	assert.Equal(t, WebhookStatusProcessed, stored.Status)
+	assert.Equal(t, 2, stored.Attempts)
+	assert.Nil(t, stored.ErrorMessage)
+}
+
+func TestReleaseStaleWebhookEvents(t *testing.T) {
+	db := testDB(t)
+	event := newTestWebhookEvent(t, db)
+	_, err := db.RecordWebhookEvent(event)
+	require.NoError(t, err)
+	_, err = db.ClaimWebhookEvent(event.ID, WebhookStatusReceived)
+	require.NoError(t, err)
+
+	// Events still being processed are left alone
+	require.NoError(t, db.ReleaseStaleWebhookEvents(time.Hour))
+	stored, err := db.GetWebhookEvent(event.ID)
+	require.NoError(t, err)
+	assert.Equal(t, WebhookStatusProcessing, stored.Status)
+
+	// Once stuck for longer, the event goes back to received and is listed as lost
+	_, err = db.Exec(`UPDATE webhook_events SET updated_at = NOW() - INTERVAL '2 hours' WHERE id = $1`, event.ID)
+	require.NoError(t, err)
+	require.NoError(t, db.ReleaseStaleWebhookEvents(time.Hour))
+	stored, err = db.GetWebhookEvent(event.ID)
+	require.NoError(t, err)
+	assert.Equal(t, WebhookStatusReceived, stored.Status)
+
+	lost, err := db.GetStaleWebhookEvents(0, 1000)
+	require.NoError(t, err)
+	assert.Contains(t, webhookEventIDs(lost), event.ID)
+
+	lost, err = db.GetStaleWebhookEvents(time.Hour, 1000)
+	require.NoError(t, err)
+	assert.NotContains(t, webhookEventIDs(lost), event.ID, "releasing the event restarts its clock")
+}
+
+func webhookEventIDs(events []WebhookEvent) []int {
+	ids := make([]int, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	return ids
+}
@@ -1,45 +1,15 @@
 package utils
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-// Logger provides structured logging functionality
-type Logger struct {
-	prefix string
-}
-
-// NewLogger creates a new logger with a prefix
-func NewLogger(prefix string) *Logger {
-	return &Logger{prefix: prefix}
-}
-
-// Info logs an info message
-func (l *Logger) Info(message string, args ...interface{}) {
-	log.Printf("[INFO] [%s] %s", l.prefix, fmt.Sprintf(message, args...))
-}
-
-// Error logs an error message
-func (l *Logger) Error(message string, args ...interface{}) {
-	log.Printf("[ERROR] [%s] %s", l.prefix, fmt.Sprintf(message, args...))
-}
-
-// Debug logs a debug message
-func (l *Logger) Debug(message string, args ...interface{}) {
-	log.Printf("[DEBUG] [%s] %s", l.prefix, fmt.Sprintf(message, args...))
-}
-
-// Warn logs a warning message
-func (l *Logger) Warn(message string, args ...interface{}) {
-	log.Printf("[WARN] [%s] %s", l.prefix, fmt.Sprintf(message, args...))
-}
-
 // APIError represents a structured API error
 type APIError struct {
 	Code      int    `json:"code"`
@@ -100,6 +70,111 @@ func SuccessResponse(c *gin.Context, data interface{}) {
 	c.JSON(http.StatusOK, response)
 }
 
+// Envelope wraps every response of the v2 API. Paginated lists also describe their page.
+type Envelope struct {
+	Success    bool                `json:"success"`
+	Data       interface{}         `json:"data,omitempty"`
+	Error      *EnvelopeError      `json:"error,omitempty"`
+	Pagination *EnvelopePagination `json:"pagination,omitempty"`
+	Timestamp  string              `json:"timestamp"`
+	RequestID  string              `json:"request_id,omitempty"`
+}
+
+// EnvelopePagination describes the page of a v2 list
+type EnvelopePagination struct {
+	Total      int    `json:"total"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// EnvelopeError describes a failed v2 request
+type EnvelopeError struct {
+	Code             ErrorCode         `json:"code"`
+	Status           int               `json:"status"`
+	Message          string            `json:"message"`
+	Details          string            `json:"details,omitempty"`
+	ValidationErrors []ValidationError `json:"validation_errors,omitempty"`
+}
+
+// ErrorCode says what went wrong in a form clients can switch on. Handlers give a failure
+// its code with SetErrorCode; failures without one get the code of their status.
+type ErrorCode string
+
+// Error codes
+const (
+	CodeBadRequest       ErrorCode = "BAD_REQUEST"
+	CodeValidationFailed ErrorCode = "VALIDATION_FAILED"
+	CodeUnauthorized     ErrorCode = "UNAUTHORIZED"
+	CodeForbidden        ErrorCode = "FORBIDDEN"
+	CodeNotFound         ErrorCode = "NOT_FOUND"
+	CodeConflict         ErrorCode = "CONFLICT"
+	CodeRateLimited      ErrorCode = "RATE_LIMITED"
+	CodeInternal         ErrorCode = "INTERNAL_ERROR"
+	CodeUpstream         ErrorCode = "UPSTREAM_ERROR"
+	CodeUnavailable      ErrorCode = "SERVICE_UNAVAILABLE"
+)
+
+// Codes of missing resources
+const (
+	CodeUserNotFound            ErrorCode = "USER_NOT_FOUND"
+	CodeCityNotFound            ErrorCode = "CITY_NOT_FOUND"
+	CodeActivityNotFound        ErrorCode = "ACTIVITY_NOT_FOUND"
+	CodeCustomAreaNotFound      ErrorCode = "CUSTOM_AREA_NOT_FOUND"
+	CodeJobNotFound             ErrorCode = "JOB_NOT_FOUND"
+	CodeWebhookEventNotFound    ErrorCode = "WEBHOOK_EVENT_NOT_FOUND"
+	CodeWebhookEndpointNotFound ErrorCode = "WEBHOOK_ENDPOINT_NOT_FOUND"
+	CodeWebhookDeliveryNotFound ErrorCode = "WEBHOOK_DELIVERY_NOT_FOUND"
+)
+
+// errorCodeKey is the request context key under which SetErrorCode records a code
+type errorCodeKey struct{}
+
+// TrackErrorCode returns a copy of ctx in which SetErrorCode records the code of a failed
+// request, and where the code will be once the request is served
+func TrackErrorCode(ctx context.Context) (context.Context, *ErrorCode) {
+	code := new(ErrorCode)
+	return context.WithValue(ctx, errorCodeKey{}, code), code
+}
+
+// SetErrorCode gives a failed request its error code. It does nothing for requests whose
+// context is not tracked, such as those of the v1 API, which has no codes.
+func SetErrorCode(c *gin.Context, code ErrorCode) {
+	if tracked, ok := c.Request.Context().Value(errorCodeKey{}).(*ErrorCode); ok {
+		*tracked = code
+	}
+}
+
+// NotFound reports a missing resource with its error code
+func NotFound(c *gin.Context, code ErrorCode, message string) {
+	SetErrorCode(c, code)
+	c.JSON(http.StatusNotFound, gin.H{"error": message})
+}
+
+// CodeForStatus returns the error code of an HTTP status
+func CodeForStatus(status int) ErrorCode {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return CodeUpstream
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
+
 // ValidationError represents a field validation error
 type ValidationError struct {
 	Field   string `json:"field"`
@@ -179,6 +254,8 @@ func isValidID(id string) bool {
 }
 
 // PaginationParams represents pagination parameters
+//
+// Deprecated: lists page by cursor with the pagination package.
 type PaginationParams struct {
 	Limit  int `form:"limit" json:"limit"`
 	Offset int `form:"offset" json:"offset"`
@@ -186,6 +263,8 @@ type PaginationParams struct {
 }
 
 // GetPaginationParams extracts and validates pagination parameters
+//
+// Deprecated: use pagination.Parse.
 func GetPaginationParams(c *gin.Context) PaginationParams {
 	var params PaginationParams
 
@@ -212,6 +291,8 @@ func GetPaginationParams(c *gin.Context) PaginationParams {
 }
 
 // PaginatedResponse represents a paginated response
+//
+// Deprecated: lists page by cursor with the pagination package.
 type PaginatedResponse struct {
 	Data       interface{} `json:"data"`
 	Total      int         `json:"total"`
@@ -224,6 +305,8 @@ type PaginatedResponse struct {
 }
 
 // NewPaginatedResponse creates a paginated response
+//
+// Deprecated: use pagination.SetHeaders.
 func NewPaginatedResponse(data interface{}, total int, params PaginationParams) PaginatedResponse {
 	totalPages := (total + params.Limit - 1) / params.Limit
 	currentPage := (params.Offset / params.Limit) + 1
@@ -306,3 +306,17 @@ func TestPaginatedResponse(t *testing.T) {
 	assert.Equal(t, true, responseBody["data"].(map[string]interface{})["HasNext"])
 	assert.Equal(t, true, responseBody["data"].(map[string]interface{})["HasPrev"])
 }
+
+func TestSuccessResponseKeepsNilData(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	SuccessResponse(c, nil)
+
+	var responseBody map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &responseBody))
+	assert.Contains(t, responseBody, "data")
+	assert.NotContains(t, responseBody, "request_id")
+}
@@ -0,0 +1,83 @@
+package webhooks
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// ValidateURL checks an endpoint URL: HTTPS to a host that is not a blocked IP, or plain
+// HTTP to localhost when local endpoints are allowed. Host names are checked again against
+// the addresses they resolve to when a delivery connects.
+func (d *Dispatcher) ValidateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("url must be an absolute URL")
+	}
+
+	host := u.Hostname()
+	ip := net.ParseIP(host)
+	local := host == "localhost" || (ip != nil && ip.IsLoopback())
+	switch {
+	case u.Scheme != "https" && u.Scheme != "http":
+		return fmt.Errorf("url must use https")
+	case local && d.allowLocal:
+		return nil
+	case u.Scheme == "http":
+		return fmt.Errorf("url must use https")
+	case local || (ip != nil && blockedIP(ip)):
+		return fmt.Errorf("url must not point to a local or private address")
+	}
+	return nil
+}
+
+// blockedIP reports whether deliveries must not connect to ip: loopback, private,
+// link-local (including cloud metadata services) and unspecified addresses
+func blockedIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// dialControl refuses connections to blocked addresses. It runs on the resolved address
+// of every connection, so a host name that resolves, or later re-resolves, to a private
+// address is refused too.
+func dialControl(allowLocal bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return fmt.Errorf("webhook delivery to %s refused: not an IP address", address)
+		}
+		if allowLocal && ip.IsLoopback() {
+			return nil
+		}
+		if blockedIP(ip) {
+			return fmt.Errorf("webhook delivery to %s refused: local or private address", address)
+		}
+		return nil
+	}
+}
+
+// newDeliveryTransport creates the transport deliveries are made through. It uses no
+// proxy, since a proxy would make the connection in its place and bypass dialControl.
+func newDeliveryTransport(allowLocal bool) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   deliveryTimeout,
+		KeepAlive: 30 * time.Second,
+		Control:   dialControl(allowLocal),
+	}
+	return &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   deliveryTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
@@ -0,0 +1,303 @@
+// Package webhooks delivers coverage events to HTTPS endpoints registered by users and
+// admins. Every delivery is signed with the endpoint's secret, recorded in a delivery log
+// and retried with backoff until the endpoint accepts it.
+package webhooks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+)
+
+// Event types endpoints can subscribe to
+const (
+	EventActivityProcessed = "activity.processed"
+	EventCoverageIncreased = "coverage.increased"
+	EventMilestoneReached  = "milestone.reached"
+	EventImportCompleted   = "import.completed"
+	EventCityCreated       = "city.created"
+
+	// EventPing is sent by the ping endpoint only; it cannot be subscribed to
+	EventPing = "ping"
+)
+
+// EventTypes lists the event types endpoints can subscribe to
+var EventTypes = []string{
+	EventActivityProcessed,
+	EventCoverageIncreased,
+	EventMilestoneReached,
+	EventImportCompleted,
+	EventCityCreated,
+}
+
+// ValidEventType reports whether endpoints can subscribe to an event type
+func ValidEventType(eventType string) bool {
+	for _, t := range EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery tuning
+const (
+	// MaxDeliveryAttempts is how many times a delivery is attempted before it fails for good
+	MaxDeliveryAttempts = 6
+
+	deliveryTimeout   = 10 * time.Second
+	retryBaseDelay    = time.Minute
+	retryMaxDelay     = 6 * time.Hour
+	retryBatchSize    = 50
+	maxStoredResponse = 2000
+	staleSendingAfter = 10 * time.Minute
+	userAgent         = "strava-coverage-webhooks/1.0"
+)
+
+// Event is the JSON body posted to endpoints
+type Event struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	UserID    *int        `json:"user_id,omitempty"`
+	Data      interface{} `json:"data"`
+}
+
+// Dispatcher records events for the endpoints subscribed to them and delivers them
+type Dispatcher struct {
+	DB         *storage.DB
+	client     *resty.Client
+	allowLocal bool
+}
+
+// NewDispatcher creates a dispatcher posting to endpoints with a 10 second timeout. It
+// refuses to connect to loopback, private, link-local and unspecified addresses, except
+// loopback when allowLocal is set for development.
+func NewDispatcher(db *storage.DB, allowLocal bool) *Dispatcher {
+	return &Dispatcher{
+		DB: db,
+		client: resty.New().
+			SetTransport(newDeliveryTransport(allowLocal)).
+			SetTimeout(deliveryTimeout).
+			SetRedirectPolicy(resty.NoRedirectPolicy()).
+			SetHeader("User-Agent", userAgent),
+		allowLocal: allowLocal,
+	}
+}
+
+// Emit records an event for every enabled endpoint subscribed to it and delivers it in the
+// background. userID is the user the event is about, or 0 for events that belong to no
+// user, which only reach admin endpoints. A nil dispatcher emits nothing, so services can
+// run without webhooks.
+func (d *Dispatcher) Emit(userID int, eventType string, data interface{}) {
+	if d == nil {
+		return
+	}
+
+	event := &Event{
+		ID:        newEventID(),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}
+	if userID != 0 {
+		event.UserID = &userID
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Failed to encode webhook event", "event_type", eventType, "error", err)
+		return
+	}
+
+	ids, err := d.DB.CreateWebhookDeliveries(userID, event.ID, eventType, payload)
+	if err != nil {
+		slog.Error("Failed to record webhook deliveries", "event_type", eventType, "user_id", userID, "error", err)
+		return
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	go func() {
+		for _, id := range ids {
+			d.Deliver(id)
+		}
+	}()
+}
+
+// Deliver makes the next attempt of a pending delivery and records the outcome. It
+// returns the delivery as recorded, or nil if it was not pending.
+func (d *Dispatcher) Deliver(id int64) *storage.WebhookDelivery {
+	delivery, err := d.DB.ClaimWebhookDelivery(id)
+	if err != nil {
+		slog.Error("Failed to claim webhook delivery", "delivery_id", id, "error", err)
+		return nil
+	}
+	if delivery == nil {
+		return nil
+	}
+
+	endpoint, err := d.DB.GetWebhookEndpoint(delivery.EndpointID)
+	if err != nil {
+		slog.Error("Failed to load webhook endpoint", "delivery_id", id, "endpoint_id", delivery.EndpointID, "error", err)
+		d.finish(delivery, 0, "", fmt.Errorf("endpoint not found"), 0)
+		return delivery
+	}
+	if !endpoint.Enabled && delivery.EventType != EventPing {
+		d.finish(delivery, 0, "", fmt.Errorf("endpoint disabled"), 0)
+		return delivery
+	}
+
+	now := time.Now()
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	resp, err := d.client.R().
+		SetHeader("Content-Type", "application/json").
+		SetHeader("X-Webhook-Id", delivery.EventID).
+		SetHeader("X-Webhook-Event", delivery.EventType).
+		SetHeader("X-Webhook-Delivery", strconv.FormatInt(delivery.ID, 10)).
+		SetHeader("X-Webhook-Timestamp", timestamp).
+		SetHeader("X-Webhook-Signature", SignatureHeader(endpoint.SigningSecrets(now), timestamp, []byte(delivery.Payload))).
+		SetBody([]byte(delivery.Payload)).
+		Post(endpoint.URL)
+	duration := time.Since(now)
+
+	if err != nil {
+		d.finish(delivery, 0, "", err, duration)
+		return delivery
+	}
+	if !resp.IsSuccess() {
+		d.finish(delivery, resp.StatusCode(), string(resp.Body()), fmt.Errorf("endpoint responded %s", resp.Status()), duration)
+		return delivery
+	}
+	d.finish(delivery, resp.StatusCode(), string(resp.Body()), nil, duration)
+	return delivery
+}
+
+// finish records an attempt's outcome on delivery and in the delivery log
+func (d *Dispatcher) finish(delivery *storage.WebhookDelivery, statusCode int, body string, err error, duration time.Duration) {
+	delivery.Status, delivery.NextAttemptAt = deliveryOutcome(err, delivery.Attempts, time.Now())
+	if delivery.EventType == EventPing && delivery.Status == storage.DeliveryStatusPending {
+		// A ping reports on the endpoint as it is now; retrying it later tells nobody anything
+		delivery.Status, delivery.NextAttemptAt = storage.DeliveryStatusFailed, nil
+	}
+	delivery.ResponseStatus = nil
+	if statusCode != 0 {
+		delivery.ResponseStatus = &statusCode
+	}
+	delivery.ResponseBody = truncated(body)
+	delivery.LastError = nil
+	if err != nil {
+		msg := err.Error()
+		delivery.LastError = &msg
+	}
+	ms := int(duration / time.Millisecond)
+	delivery.DurationMs = &ms
+
+	if err := d.DB.FinishWebhookDelivery(delivery); err != nil {
+		slog.Error("Failed to record webhook delivery", "delivery_id", delivery.ID, "error", err)
+	}
+	if delivery.Status == storage.DeliveryStatusFailed {
+		slog.Warn("Webhook delivery failed", "delivery_id", delivery.ID, "event_type", delivery.EventType,
+			"endpoint_id", delivery.EndpointID, "attempts", delivery.Attempts, "error", err)
+	}
+}
+
+// deliveryOutcome decides a delivery's status after an attempt: delivered, pending with the
+// time of the next attempt, or failed once the attempts are used up. Endpoints that do not
+// answer with a 2xx are retried whatever the status, since they may be mid-deploy.
+func deliveryOutcome(err error, attempts int, now time.Time) (string, *time.Time) {
+	if err == nil {
+		return storage.DeliveryStatusDelivered, nil
+	}
+	if attempts >= MaxDeliveryAttempts {
+		return storage.DeliveryStatusFailed, nil
+	}
+
+	delay := retryBaseDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 4
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	next := now.Add(delay)
+	return storage.DeliveryStatusPending, &next
+}
+
+// truncated caps a stored response body
+func truncated(s string) *string {
+	if s == "" {
+		return nil
+	}
+	if len(s) > maxStoredResponse {
+		s = s[:maxStoredResponse]
+	}
+	return &s
+}
+
+// RetryDue makes the next attempt for every delivery whose retry is due. It returns how
+// many were delivered.
+func (d *Dispatcher) RetryDue() (int, error) {
+	ids, err := d.DB.GetDueWebhookDeliveries(retryBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list due webhook deliveries: %w", err)
+	}
+
+	delivered := 0
+	for _, id := range ids {
+		if delivery := d.Deliver(id); delivery != nil && delivery.Status == storage.DeliveryStatusDelivered {
+			delivered++
+		}
+	}
+	return delivered, nil
+}
+
+// RunRetryWorker retries due deliveries every interval until ctx is cancelled
+func (d *Dispatcher) RunRetryWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.DB.ReleaseStaleWebhookDeliveries(staleSendingAfter); err != nil {
+			slog.ErrorContext(ctx, "Failed to release stale webhook deliveries", "error", err)
+		}
+		delivered, err := d.RetryDue()
+		if err != nil {
+			slog.ErrorContext(ctx, "Webhook retry failed", "error", err)
+		} else if delivered > 0 {
+			slog.InfoContext(ctx, "Delivered queued webhooks", "delivered", delivered)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// newEventID returns a random event ID
+func newEventID() string {
+	return "evt_" + randomHex(12)
+}
+
+// NewSecret returns a random endpoint signing secret
+func NewSecret() string {
+	return "whsec_" + randomHex(24)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("webhooks: reading random bytes: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
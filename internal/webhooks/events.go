@@ -0,0 +1,146 @@
+package webhooks
+
+import (
+	"log/slog"
+	"time"
+)
+
+// milestones are the city coverage percentages announced by milestone.reached
+var milestones = []float64{1, 5, 10, 25, 50, 75, 90, 100}
+
+// ActivityData is the data of activity.processed
+type ActivityData struct {
+	ActivityID              int64     `json:"activity_id"`
+	Name                    string    `json:"name"`
+	ActivityType            string    `json:"activity_type"`
+	DistanceKm              float64   `json:"distance_km"`
+	StartedAt               time.Time `json:"started_at"`
+	CityID                  *int      `json:"city_id"`
+	CityName                *string   `json:"city_name"`
+	CoveragePercent         *float64  `json:"coverage_percent"`
+	PreviousCoveragePercent float64   `json:"previous_coverage_percent"`
+	NewKm                   float64   `json:"new_km"`
+}
+
+// CoverageIncreasedData is the data of coverage.increased
+type CoverageIncreasedData struct {
+	ActivityID              int64   `json:"activity_id"`
+	CityID                  int     `json:"city_id"`
+	CityName                string  `json:"city_name"`
+	CoveragePercent         float64 `json:"coverage_percent"`
+	PreviousCoveragePercent float64 `json:"previous_coverage_percent"`
+	Increase                float64 `json:"increase"`
+	NewKm                   float64 `json:"new_km"`
+}
+
+// MilestoneData is the data of milestone.reached
+type MilestoneData struct {
+	ActivityID      int64   `json:"activity_id"`
+	CityID          int     `json:"city_id"`
+	CityName        string  `json:"city_name"`
+	Milestone       float64 `json:"milestone"`
+	CoveragePercent float64 `json:"coverage_percent"`
+}
+
+// ImportData is the data of import.completed
+type ImportData struct {
+	Source   string `json:"source"`
+	Imported int    `json:"imported"`
+	Skipped  int    `json:"skipped"`
+	Failed   int    `json:"failed"`
+}
+
+// CityData is the data of city.created
+type CityData struct {
+	CityID      int    `json:"city_id"`
+	Name        string `json:"name"`
+	CountryCode string `json:"country_code"`
+	Source      string `json:"source"` // manual, geocoded or detected
+}
+
+// ActivityProcessed emits activity.processed once an activity's coverage is calculated,
+// followed by coverage.increased and milestone.reached when the activity earned them
+func (d *Dispatcher) ActivityProcessed(activityID int64) {
+	if d == nil {
+		return
+	}
+
+	stats, err := d.DB.GetActivityCommentStats(activityID)
+	if err != nil {
+		slog.Error("Failed to load activity stats for webhooks", "activity_id", activityID, "error", err)
+		return
+	}
+
+	d.Emit(stats.UserID, EventActivityProcessed, ActivityData{
+		ActivityID:              stats.ActivityID,
+		Name:                    stats.Name,
+		ActivityType:            stats.ActivityType,
+		DistanceKm:              stats.DistanceKm,
+		StartedAt:               stats.StartedAt,
+		CityID:                  stats.CityID,
+		CityName:                stats.CityName,
+		CoveragePercent:         stats.Coverage,
+		PreviousCoveragePercent: stats.PreviousCoverage,
+		NewKm:                   stats.NewKm,
+	})
+
+	if stats.CityID == nil || stats.Coverage == nil || *stats.Coverage <= stats.PreviousCoverage {
+		return
+	}
+	cityName := ""
+	if stats.CityName != nil {
+		cityName = *stats.CityName
+	}
+
+	d.Emit(stats.UserID, EventCoverageIncreased, CoverageIncreasedData{
+		ActivityID:              stats.ActivityID,
+		CityID:                  *stats.CityID,
+		CityName:                cityName,
+		CoveragePercent:         *stats.Coverage,
+		PreviousCoveragePercent: stats.PreviousCoverage,
+		Increase:                *stats.Coverage - stats.PreviousCoverage,
+		NewKm:                   stats.NewKm,
+	})
+
+	for _, m := range crossedMilestones(stats.PreviousCoverage, *stats.Coverage) {
+		d.Emit(stats.UserID, EventMilestoneReached, MilestoneData{
+			ActivityID:      stats.ActivityID,
+			CityID:          *stats.CityID,
+			CityName:        cityName,
+			Milestone:       m,
+			CoveragePercent: *stats.Coverage,
+		})
+	}
+}
+
+// crossedMilestones returns the milestones passed going from previous to current coverage
+func crossedMilestones(previous, current float64) []float64 {
+	var crossed []float64
+	for _, m := range milestones {
+		if previous < m && current >= m {
+			crossed = append(crossed, m)
+		}
+	}
+	return crossed
+}
+
+// ImportCompleted emits import.completed at the end of an import run
+func (d *Dispatcher) ImportCompleted(userID int, source string, imported, skipped, failed int) {
+	d.Emit(userID, EventImportCompleted, ImportData{
+		Source:   source,
+		Imported: imported,
+		Skipped:  skipped,
+		Failed:   failed,
+	})
+}
+
+// CityCreated emits city.created. Cities are shared by every user, so the event only
+// reaches admin endpoints.
+func (d *Dispatcher) CityCreated(cityID int, name, countryCode, source string) {
+	d.Emit(0, EventCityCreated, CityData{
+		CityID:      cityID,
+		Name:        name,
+		CountryCode: countryCode,
+		Source:      source,
+	})
+}
@@ -0,0 +1,415 @@
+package webhooks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/nikhilvedi/strava-coverage/internal/pagination"
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/nikhilvedi/strava-coverage/internal/utils"
+)
+
+// Secret rotation grace period bounds
+const (
+	defaultGracePeriod = 24 * time.Hour
+	maxGracePeriod     = 7 * 24 * time.Hour
+)
+
+// Handler serves the endpoint management, delivery log and secret rotation API
+type Handler struct {
+	DB         *storage.DB
+	Dispatcher *Dispatcher
+}
+
+// NewHandler creates a new webhook handler
+func NewHandler(db *storage.DB, dispatcher *Dispatcher) *Handler {
+	return &Handler{
+		DB:         db,
+		Dispatcher: dispatcher,
+	}
+}
+
+// RegisterRoutes adds webhook endpoint routes
+func (h *Handler) RegisterRoutes(r *gin.Engine) {
+	endpoints := r.Group("/api/webhooks/endpoints")
+	{
+		endpoints.GET("/user/:userId", h.ListUserEndpointsHandler)
+		endpoints.POST("/user/:userId", h.CreateUserEndpointHandler)
+		endpoints.GET("/:id", h.GetEndpointHandler)
+		endpoints.PUT("/:id", h.UpdateEndpointHandler)
+		endpoints.DELETE("/:id", h.DeleteEndpointHandler)
+		endpoints.POST("/:id/rotate-secret", h.RotateSecretHandler)
+		endpoints.GET("/:id/deliveries", h.ListDeliveriesHandler)
+		endpoints.POST("/:id/ping", h.PingHandler)
+	}
+
+	r.POST("/api/webhooks/deliveries/:deliveryId/redeliver", h.RedeliverHandler)
+
+	admin := r.Group("/api/admin/webhooks/endpoints")
+	{
+		admin.GET("", h.ListAdminEndpointsHandler)
+		admin.POST("", h.CreateAdminEndpointHandler)
+	}
+}
+
+// CreateEndpointRequest registers an endpoint. No events means every event.
+type CreateEndpointRequest struct {
+	URL         string   `json:"url" binding:"required"`
+	Description string   `json:"description"`
+	Events      []string `json:"events"`
+	Enabled     *bool    `json:"enabled"`
+}
+
+// UpdateEndpointRequest changes the fields that are set
+type UpdateEndpointRequest struct {
+	URL         *string   `json:"url"`
+	Description *string   `json:"description"`
+	Events      *[]string `json:"events"`
+	Enabled     *bool     `json:"enabled"`
+}
+
+// ListUserEndpointsHandler lists a user's endpoints
+func (h *Handler) ListUserEndpointsHandler(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	h.listEndpoints(c, &userID)
+}
+
+// ListAdminEndpointsHandler lists the admin endpoints, which receive every user's events
+func (h *Handler) ListAdminEndpointsHandler(c *gin.Context) {
+	h.listEndpoints(c, nil)
+}
+
+func (h *Handler) listEndpoints(c *gin.Context, userID *int) {
+	endpoints, err := h.DB.ListWebhookEndpoints(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get webhook endpoints"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"endpoints": endpoints,
+		"count":     len(endpoints),
+	})
+}
+
+// CreateUserEndpointHandler registers an endpoint for a user's events
+func (h *Handler) CreateUserEndpointHandler(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	h.createEndpoint(c, &userID)
+}
+
+// CreateAdminEndpointHandler registers an admin endpoint
+func (h *Handler) CreateAdminEndpointHandler(c *gin.Context) {
+	h.createEndpoint(c, nil)
+}
+
+// createEndpoint registers an endpoint and returns its secret. The secret is only ever
+// shown here and on rotation.
+func (h *Handler) createEndpoint(c *gin.Context, userID *int) {
+	var req CreateEndpointRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := h.Dispatcher.ValidateURL(req.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateEvents(req.Events); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	endpoint := &storage.WebhookEndpoint{
+		UserID:      userID,
+		URL:         req.URL,
+		Description: req.Description,
+		Events:      pq.StringArray(req.Events),
+		Enabled:     req.Enabled == nil || *req.Enabled,
+		Secret:      NewSecret(),
+	}
+	if err := h.DB.CreateWebhookEndpoint(endpoint); err != nil {
+		if isForeignKeyViolation(err) {
+			utils.NotFound(c, utils.CodeUserNotFound, "User not found")
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook endpoint"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"endpoint": endpoint,
+		"secret":   endpoint.Secret,
+	})
+}
+
+// GetEndpointHandler returns an endpoint
+func (h *Handler) GetEndpointHandler(c *gin.Context) {
+	endpoint, ok := h.loadEndpoint(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"endpoint": endpoint})
+}
+
+// UpdateEndpointHandler changes an endpoint's URL, description, events or enabled switch
+func (h *Handler) UpdateEndpointHandler(c *gin.Context) {
+	endpoint, ok := h.loadEndpoint(c)
+	if !ok {
+		return
+	}
+
+	var req UpdateEndpointRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.URL != nil {
+		if err := h.Dispatcher.ValidateURL(*req.URL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		endpoint.URL = *req.URL
+	}
+	if req.Events != nil {
+		if err := validateEvents(*req.Events); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		endpoint.Events = pq.StringArray(*req.Events)
+		if endpoint.Events == nil {
+			endpoint.Events = pq.StringArray{}
+		}
+	}
+	if req.Description != nil {
+		endpoint.Description = *req.Description
+	}
+	if req.Enabled != nil {
+		endpoint.Enabled = *req.Enabled
+	}
+
+	if err := h.DB.UpdateWebhookEndpoint(endpoint); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update webhook endpoint"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"endpoint": endpoint})
+}
+
+// DeleteEndpointHandler removes an endpoint and its delivery log
+func (h *Handler) DeleteEndpointHandler(c *gin.Context) {
+	endpoint, ok := h.loadEndpoint(c)
+	if !ok {
+		return
+	}
+
+	if err := h.DB.DeleteWebhookEndpoint(endpoint.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook endpoint"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook endpoint deleted"})
+}
+
+// RotateSecretRequest sets how long the old secret stays valid; the body is optional
+type RotateSecretRequest struct {
+	GracePeriodHours *float64 `json:"grace_period_hours"`
+}
+
+// RotateSecretHandler replaces an endpoint's secret. Deliveries are signed with both the
+// new and the old secret for the grace period (grace_period_hours, default 24, 0 to drop
+// the old secret at once) so receivers can switch without missing events.
+func (h *Handler) RotateSecretHandler(c *gin.Context) {
+	endpoint, ok := h.loadEndpoint(c)
+	if !ok {
+		return
+	}
+
+	var req RotateSecretRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+	grace := defaultGracePeriod
+	if req.GracePeriodHours != nil {
+		grace = time.Duration(*req.GracePeriodHours * float64(time.Hour))
+		if grace < 0 || grace > maxGracePeriod {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "grace_period_hours must be between 0 and 168"})
+			return
+		}
+	}
+
+	secret := NewSecret()
+	expiresAt := time.Now().Add(grace)
+	if err := h.DB.RotateWebhookSecret(endpoint.ID, secret, expiresAt); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate webhook secret"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":                     secret,
+		"previous_secret_expires_at": expiresAt.UTC(),
+	})
+}
+
+// ListDeliveriesHandler lists an endpoint's delivery log, newest first
+func (h *Handler) ListDeliveriesHandler(c *gin.Context) {
+	endpoint, ok := h.loadEndpoint(c)
+	if !ok {
+		return
+	}
+
+	status := c.Query("status")
+	switch status {
+	case "", storage.DeliveryStatusPending, storage.DeliveryStatusSending, storage.DeliveryStatusDelivered,
+		storage.DeliveryStatusFailed:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status filter"})
+		return
+	}
+
+	params, err := pagination.Parse(c, storage.WebhookDeliveryPages)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deliveries, page, err := h.DB.ListWebhookDeliveries(endpoint.ID, status, params)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get webhook deliveries"})
+		return
+	}
+
+	pagination.SetHeaders(c, page)
+	c.JSON(http.StatusOK, gin.H{
+		"deliveries":  deliveries,
+		"count":       len(deliveries),
+		"total":       page.Total,
+		"next_cursor": page.Next,
+	})
+}
+
+// PingHandler sends a ping event to an endpoint straight away and returns the outcome, to
+// check the URL and the receiver's signature verification
+func (h *Handler) PingHandler(c *gin.Context) {
+	endpoint, ok := h.loadEndpoint(c)
+	if !ok {
+		return
+	}
+
+	event := &Event{
+		ID:        newEventID(),
+		Type:      EventPing,
+		CreatedAt: time.Now().UTC(),
+		UserID:    endpoint.UserID,
+		Data:      gin.H{"endpoint_id": endpoint.ID},
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode ping"})
+		return
+	}
+	id, err := h.DB.CreateWebhookDelivery(endpoint.ID, event.ID, EventPing, payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record ping"})
+		return
+	}
+
+	delivery := h.Dispatcher.Deliver(id)
+	if delivery == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send ping"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"delivered": delivery.Status == storage.DeliveryStatusDelivered,
+		"delivery":  delivery,
+	})
+}
+
+// RedeliverHandler queues a delivered or failed delivery to be sent again, with a fresh
+// set of attempts
+func (h *Handler) RedeliverHandler(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("deliveryId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery ID"})
+		return
+	}
+
+	if _, err := h.DB.GetWebhookDelivery(id); errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeWebhookDeliveryNotFound, "Delivery not found")
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get delivery"})
+		return
+	}
+
+	requeued, err := h.DB.RequeueWebhookDelivery(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to requeue delivery"})
+		return
+	}
+	if !requeued {
+		c.JSON(http.StatusConflict, gin.H{"error": "Delivery is still pending"})
+		return
+	}
+
+	go h.Dispatcher.Deliver(id)
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Delivery queued"})
+}
+
+// loadEndpoint loads the endpoint named by the :id parameter, writing the error response
+// if there is none
+func (h *Handler) loadEndpoint(c *gin.Context) (*storage.WebhookEndpoint, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid endpoint ID"})
+		return nil, false
+	}
+
+	endpoint, err := h.DB.GetWebhookEndpoint(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.NotFound(c, utils.CodeWebhookEndpointNotFound, "Webhook endpoint not found")
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get webhook endpoint"})
+		return nil, false
+	}
+	return endpoint, true
+}
+
+// validateEvents checks that every event type can be subscribed to
+func validateEvents(events []string) error {
+	for _, e := range events {
+		if !ValidEventType(e) {
+			return fmt.Errorf("unknown event %q; events are %s", e, strings.Join(EventTypes, ", "))
+		}
+	}
+	return nil
+}
+
+// isForeignKeyViolation reports whether err is a Postgres foreign key violation
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
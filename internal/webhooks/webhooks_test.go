@@ -0,0 +1,128 @@
+package webhooks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nikhilvedi/strava-coverage/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	body := []byte(`{"id":"evt_1","type":"ping"}`)
+
+	header := SignatureHeader([]string{"whsec_new", "whsec_old"}, timestamp, body)
+	assert.Len(t, strings.Fields(header), 2)
+	assert.True(t, strings.HasPrefix(header, "v1="+Sign("whsec_new", timestamp, body)))
+
+	// Either secret verifies during the rotation grace period
+	assert.NoError(t, Verify("whsec_new", header, timestamp, body, 5*time.Minute, now))
+	assert.NoError(t, Verify("whsec_old", header, timestamp, body, 5*time.Minute, now))
+
+	assert.ErrorIs(t, Verify("whsec_other", header, timestamp, body, 5*time.Minute, now), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("whsec_new", header, timestamp, []byte(`{"id":"evt_2"}`), 5*time.Minute, now), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("whsec_new", header, timestamp, body, 5*time.Minute, now.Add(10*time.Minute)), ErrTimestampExpired)
+	assert.ErrorIs(t, Verify("whsec_new", header, "yesterday", body, 5*time.Minute, now), ErrInvalidTimestamp)
+}
+
+func TestSigningSecrets(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	previous := "whsec_old"
+	expires := now.Add(time.Hour)
+	endpoint := &storage.WebhookEndpoint{Secret: "whsec_new", PreviousSecret: &previous, PreviousSecretExpiresAt: &expires}
+
+	assert.Equal(t, []string{"whsec_new", "whsec_old"}, endpoint.SigningSecrets(now))
+	assert.Equal(t, []string{"whsec_new"}, endpoint.SigningSecrets(now.Add(2*time.Hour)))
+}
+
+func TestDeliveryOutcome(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	status, next := deliveryOutcome(nil, 1, now)
+	assert.Equal(t, storage.DeliveryStatusDelivered, status)
+	assert.Nil(t, next)
+
+	for attempts, delay := range map[int]time.Duration{1: time.Minute, 2: 4 * time.Minute, 3: 16 * time.Minute, 5: 256 * time.Minute} {
+		status, next := deliveryOutcome(assert.AnError, attempts, now)
+		assert.Equal(t, storage.DeliveryStatusPending, status)
+		if assert.NotNil(t, next) {
+			assert.Equal(t, delay, next.Sub(now), "attempt %d", attempts)
+		}
+	}
+
+	status, next = deliveryOutcome(assert.AnError, MaxDeliveryAttempts, now)
+	assert.Equal(t, storage.DeliveryStatusFailed, status)
+	assert.Nil(t, next)
+}
+
+func TestCrossedMilestones(t *testing.T) {
+	assert.Equal(t, []float64{5, 10}, crossedMilestones(4.2, 12))
+	assert.Equal(t, []float64{100}, crossedMilestones(99.5, 100))
+	assert.Empty(t, crossedMilestones(10, 11))
+}
+
+func TestValidateURL(t *testing.T) {
+	d := NewDispatcher(nil, false)
+	assert.NoError(t, d.ValidateURL("https://example.com/hooks"))
+	assert.NoError(t, d.ValidateURL("https://93.184.216.34/hooks"))
+	assert.Error(t, d.ValidateURL("http://example.com/hooks"))
+	assert.Error(t, d.ValidateURL("ftp://example.com"))
+	assert.Error(t, d.ValidateURL("/hooks"))
+
+	// Local and private addresses are refused unless local endpoints are allowed
+	for _, raw := range []string{
+		"http://localhost:9000/hooks",
+		"https://localhost/hooks",
+		"https://127.0.0.1/hooks",
+		"https://[::1]/hooks",
+		"https://10.0.0.5/hooks",
+		"https://192.168.1.1/hooks",
+		"https://169.254.169.254/latest/meta-data",
+		"https://0.0.0.0/hooks",
+	} {
+		assert.Error(t, d.ValidateURL(raw), raw)
+	}
+
+	dev := NewDispatcher(nil, true)
+	assert.NoError(t, dev.ValidateURL("http://localhost:9000/hooks"))
+	assert.NoError(t, dev.ValidateURL("http://127.0.0.1/hooks"))
+	assert.Error(t, dev.ValidateURL("https://169.254.169.254/latest/meta-data"))
+	assert.Error(t, dev.ValidateURL("http://example.com/hooks"))
+}
+
+func TestDialControl(t *testing.T) {
+	control := dialControl(false)
+	for _, address := range []string{"127.0.0.1:443", "[::1]:443", "10.1.2.3:443", "172.16.0.1:443",
+		"192.168.0.10:80", "169.254.169.254:80", "[fe80::1]:443", "0.0.0.0:443", "[::ffff:127.0.0.1]:443"} {
+		assert.Error(t, control("tcp", address, nil), address)
+	}
+	assert.NoError(t, control("tcp", "93.184.216.34:443", nil))
+	assert.NoError(t, control("tcp", "[2606:2800:220:1:248:1893:25c8:1946]:443", nil))
+
+	dev := dialControl(true)
+	assert.NoError(t, dev("tcp", "127.0.0.1:9000", nil))
+	assert.Error(t, dev("tcp", "169.254.169.254:80", nil))
+}
+
+func TestDeliveryRefusesLocalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("internal secret"))
+	}))
+	defer server.Close()
+
+	// A host name resolving to loopback is refused when connecting, whatever validation saw
+	url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	_, err := NewDispatcher(nil, false).client.R().Post(url)
+	assert.ErrorContains(t, err, "refused")
+
+	resp, err := NewDispatcher(nil, true).client.R().Post(url)
+	require.NoError(t, err)
+	assert.Equal(t, "internal secret", resp.String())
+}